@@ -10,6 +10,7 @@ import (
 	"mlock/lambdas/shared/dynamo/climatecontrol"
 	"mlock/lambdas/shared/dynamo/device"
 	"mlock/lambdas/shared/dynamo/miscellaneous"
+	"mlock/lambdas/shared/dynamo/property"
 	"mlock/lambdas/shared/dynamo/unit"
 	"mlock/lambdas/shared/sqs"
 	mshared "mlock/shared"
@@ -157,6 +158,14 @@ func detail(ctx context.Context, req events.APIGatewayProxyRequest, entity share
 	}
 	unit := units[entity.GetFriendlyNamePrefix()]
 
+	var p *shared.Property
+	if prop, ok, err := property.NewRepository().Get(ctx, unit.PropertyID); err != nil {
+		return nil, fmt.Errorf("error getting property: %s", err.Error())
+	} else if ok {
+		p = &prop
+	}
+	buffers := unit.GetReservationBuffers(p)
+
 	devices, err := device.NewRepository().List(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("error getting devices: %s", err.Error())
@@ -178,7 +187,7 @@ func detail(ctx context.Context, req events.APIGatewayProxyRequest, entity share
 		year, month, day := now.Date()
 		date := time.Date(year, month, day, 0, 0, 0, 0, tz)
 
-		occupiedStatusForDay := unit.OccupancyStatusForDay(devices, date)
+		occupiedStatusForDay := unit.OccupancyStatusForDay(devices, date, buffers)
 		unitOccupancyStatuses = append(unitOccupancyStatuses, occupiedStatusForDay)
 	}
 
@@ -288,7 +297,7 @@ func updateSettings(ctx context.Context, req events.APIGatewayProxyRequest) (*sh
 		return nil, fmt.Errorf("error putting miscellaneous: %s", err.Error())
 	}
 
-	if err := queue.SendBlankMessageToManageClimateControlsQueue(ctx); err != nil {
+	if err := queue.SendJob(ctx, sqs.NewManageClimateControlsJob("climate control settings changed")); err != nil {
 		return nil, fmt.Errorf("error sending message to manage climate controls queue: %s", err.Error())
 	}
 
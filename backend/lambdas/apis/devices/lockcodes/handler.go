@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"log"
 	"mlock/lambdas/shared"
 	"mlock/lambdas/shared/dynamo/device"
 	"mlock/lambdas/shared/sqs"
@@ -25,6 +26,10 @@ type CreateResponse struct {
 	Entity shared.Device `json:"entity"`
 }
 
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
 type UpdateBody struct {
 	Reservation UpdateBodyReservation `json:"reservation"`
 	EndAt       time.Time             `json:"endAt"`
@@ -122,21 +127,34 @@ func create(
 		return nil, fmt.Errorf("can't start after it ends")
 	}
 
+	if conflicts := d.FindLockCodeConflicts(mlc); len(conflicts) > 0 {
+		return shared.NewAPIResponse(http.StatusConflict, ErrorResponse{Error: conflictMessage(conflicts)})
+	}
+
 	d.ManagedLockCodes = append(d.ManagedLockCodes, mlc)
 
 	if err := device.NewRepository().AppendToAuditLog(ctx, d, []*shared.DeviceManagedLockCode{mlc}); err != nil {
 		return nil, fmt.Errorf("error appending to audit log: %s", err.Error())
 	}
 
-	d, err = device.NewRepository().Put(ctx, d)
+	// The poll may save the device while we do, the code is added to its version.
+	d, err = shared.SaveDevice(ctx, device.NewRepository(), d, func(fresh *shared.Device) (bool, error) {
+		if conflicts := fresh.FindLockCodeConflicts(mlc); len(conflicts) > 0 {
+			return false, fmt.Errorf("%s", conflictMessage(conflicts))
+		}
+		fresh.ManagedLockCodes = append(fresh.ManagedLockCodes, mlc)
+		return true, nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("error updating device: %s", err.Error())
 	}
 
-	if err := q.SendBlankMessageToPollSchedulesQueue(ctx); err != nil {
+	if err := q.SendJob(ctx, sqs.NewDeviceJob(d.ID, "lock code created")); err != nil {
 		return nil, fmt.Errorf("error sending message to queue: %s", err.Error())
 	}
 
+	emitScheduled(ctx, d, mlc)
+
 	return shared.NewAPIResponse(http.StatusOK, CreateResponse{Entity: d})
 }
 
@@ -157,6 +175,13 @@ func update(
 		return nil, fmt.Errorf("unable to find managed lock code")
 	}
 
+	if mlc.RecurringLockCodeID != nil {
+		return shared.NewAPIResponse(http.StatusBadRequest, ErrorResponse{Error: "this code is an occurrence of a recurring code, edit the recurring code instead"})
+	}
+	if mlc.UnitLockCodeID != nil {
+		return shared.NewAPIResponse(http.StatusBadRequest, ErrorResponse{Error: "this code belongs to the unit, edit it on the unit instead"})
+	}
+
 	mlc.Reservation.Sync = body.Reservation.Sync
 	if !mlc.Reservation.Sync {
 		if !body.StartAt.IsZero() {
@@ -169,6 +194,10 @@ func update(
 		}
 	}
 
+	if conflicts := d.FindLockCodeConflicts(mlc); len(conflicts) > 0 {
+		return shared.NewAPIResponse(http.StatusConflict, ErrorResponse{Error: conflictMessage(conflicts)})
+	}
+
 	cd, err := shared.GetContextData(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("can't get context data: %s", err.Error())
@@ -181,18 +210,71 @@ func update(
 
 	mlc.Note = fmt.Sprintf("Edited by %s.", currentUser.Email)
 
-	if device.NewRepository().AppendToAuditLog(ctx, d, []*shared.DeviceManagedLockCode{mlc}); err != nil {
+	// Editing a failed code gives it another go.
+	if mlc.Status == shared.DeviceManagedLockCodeStatus6Failed {
+		if err := mlc.SetStatus(shared.DeviceManagedLockCodeStatus1Scheduled); err != nil {
+			return nil, fmt.Errorf("error rescheduling managed lock code: %s", err.Error())
+		}
+	}
+
+	if err := device.NewRepository().AppendToAuditLog(ctx, d, []*shared.DeviceManagedLockCode{mlc}); err != nil {
 		return nil, fmt.Errorf("error appending to audit log: %s", err.Error())
 	}
 
-	d, err = device.NewRepository().Put(ctx, d)
+	// The poll may save the device while we do, the edit is applied to its version of the code.
+	d, err = shared.SaveDevice(ctx, device.NewRepository(), d, func(fresh *shared.Device) (bool, error) {
+		theirs := fresh.GetManagedLockCode(mlcID)
+		if theirs == nil {
+			return false, fmt.Errorf("unable to find managed lock code")
+		}
+		theirs.Reservation.Sync = mlc.Reservation.Sync
+		theirs.StartAt = mlc.StartAt
+		theirs.EndAt = mlc.EndAt
+		theirs.Note = mlc.Note
+		if theirs.Status == shared.DeviceManagedLockCodeStatus6Failed {
+			if err := theirs.SetStatus(shared.DeviceManagedLockCodeStatus1Scheduled); err != nil {
+				return false, fmt.Errorf("error rescheduling managed lock code: %s", err.Error())
+			}
+		}
+		return true, nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("error updating device: %s", err.Error())
 	}
 
-	if err := q.SendBlankMessageToPollSchedulesQueue(ctx); err != nil {
+	if err := q.SendJob(ctx, sqs.NewDeviceJob(d.ID, "lock code updated")); err != nil {
 		return nil, fmt.Errorf("error sending message to queue: %s", err.Error())
 	}
 
+	if mlc.Status == shared.DeviceManagedLockCodeStatus1Scheduled {
+		emitScheduled(ctx, d, mlc)
+	}
+
 	return shared.NewAPIResponse(http.StatusOK, UpdateResponse{Entity: d})
 }
+
+// emitScheduled is the scheduler's CodeScheduled event for codes added by hand. The code is already saved, so a failure is only logged.
+func emitScheduled(ctx context.Context, d shared.Device, mlc *shared.DeviceManagedLockCode) {
+	if err := (shared.LogEventSink{}).Emit(ctx, shared.NewCodeEvent(shared.EventTypeCodeScheduled, time.Now(), d, mlc)); err != nil {
+		log.Printf("error emitting event for %s: %s\n", d.RawDevice.Name, err.Error())
+	}
+}
+
+func conflictMessage(conflicts []*shared.DeviceManagedLockCode) string {
+	c := conflicts[0]
+	owner := "another code added by hand"
+	if c.RecurringLockCodeID != nil {
+		owner = "a recurring code"
+	} else if c.UnitLockCodeID != nil {
+		owner = "a code for the whole unit"
+	} else if c.Reservation.ID != "" {
+		owner = fmt.Sprintf("reservation %s", c.Reservation.ID)
+	}
+	return fmt.Sprintf(
+		"code %s is already in use by %s from %s to %s",
+		c.Code,
+		owner,
+		c.StartAt.Format(time.RFC3339),
+		c.EndAt.Format(time.RFC3339),
+	)
+}
@@ -5,12 +5,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"mlock/lambdas/apis/devices/lockcodes"
+	"mlock/lambdas/apis/devices/recurringlockcodes"
 	"mlock/lambdas/helpers"
 	"mlock/lambdas/shared"
 	"mlock/lambdas/shared/dynamo/auditlog"
 	"mlock/lambdas/shared/dynamo/device"
+	"mlock/lambdas/shared/dynamo/property"
 	"mlock/lambdas/shared/dynamo/unit"
 	"mlock/lambdas/shared/ezlo"
+	"mlock/lambdas/shared/lockengine"
+	mshared "mlock/shared"
 	"net/http"
 	"regexp"
 	"strings"
@@ -38,8 +42,13 @@ type ListResponse struct {
 	Extra    ExtraEntities   `json:"extra"`
 }
 
+type PlanResponse struct {
+	Entity lockengine.Plan `json:"entity"`
+}
+
 type UpdateBody struct {
-	UnitID *uuid.UUID `json:"unitId"`
+	UnitID                  *uuid.UUID                      `json:"unitId"`
+	UnmanagedLockCodePolicy *shared.UnmanagedLockCodePolicy `json:"unmanagedLockCodePolicy"` // Left alone if not provided.
 }
 
 type UpdateResponse struct {
@@ -49,6 +58,7 @@ type UpdateResponse struct {
 
 type ExtraEntities struct {
 	AuditLog           shared.AuditLog            `json:"auditLog"`
+	SlotUsage          *shared.DeviceSlotUsage    `json:"slotUsage,omitempty"`
 	Units              []shared.Unit              `json:"units"`
 	UnmanagedLockCodes []shared.RawDeviceLockCode `json:"unmanagedLockCodes"`
 }
@@ -68,6 +78,14 @@ func HandleRequest(ctx context.Context, req events.APIGatewayProxyRequest) (*sha
 		return lockcodes.HandleRequest(ctx, req)
 	}
 
+	match, err = regexp.MatchString(`^/devices/[0-9a-fA-F]{8}\b-[0-9a-fA-F]{4}\b-[0-9a-fA-F]{4}\b-[0-9a-fA-F]{4}\b-[0-9a-fA-F]{12}/recurring-lock-codes/`, req.Path)
+	if err != nil {
+		return shared.NewAPIResponse(http.StatusBadRequest, ErrorResponse{Error: "unable to parse request"})
+	}
+	if match {
+		return recurringlockcodes.HandleRequest(ctx, req)
+	}
+
 	match, err = regexp.MatchString(`^/devices/[0-9a-fA-F]{8}\b-[0-9a-fA-F]{4}\b-[0-9a-fA-F]{4}\b-[0-9a-fA-F]{4}\b-[0-9a-fA-F]{12}/reboot-controller/`, req.Path)
 	if err != nil {
 		return shared.NewAPIResponse(http.StatusBadRequest, ErrorResponse{Error: "unable to parse request"})
@@ -76,6 +94,14 @@ func HandleRequest(ctx context.Context, req events.APIGatewayProxyRequest) (*sha
 		return rebootController(ctx, req)
 	}
 
+	match, err = regexp.MatchString(`^/devices/[0-9a-fA-F]{8}\b-[0-9a-fA-F]{4}\b-[0-9a-fA-F]{4}\b-[0-9a-fA-F]{4}\b-[0-9a-fA-F]{12}/plan/?$`, req.Path)
+	if err != nil {
+		return shared.NewAPIResponse(http.StatusBadRequest, ErrorResponse{Error: "unable to parse request"})
+	}
+	if match && req.HTTPMethod == "GET" {
+		return plan(ctx, req)
+	}
+
 	switch req.HTTPMethod {
 	case "DELETE":
 		return delete(ctx, req)
@@ -199,10 +225,13 @@ func detail(ctx context.Context, req events.APIGatewayProxyRequest, id string) (
 		return nil, fmt.Errorf("error getting units: %s", err.Error())
 	}
 
+	slotUsage := entity.SlotUsage()
+
 	return shared.NewAPIResponse(http.StatusOK, DetailResponse{
 		Entity: entity,
 		Extra: ExtraEntities{
 			AuditLog:           auditLog,
+			SlotUsage:          &slotUsage,
 			Units:              units,
 			UnmanagedLockCodes: entity.GenerateUnmanagedLockCodes(),
 		},
@@ -221,7 +250,8 @@ func update(ctx context.Context, req events.APIGatewayProxyRequest) (*shared.API
 		return nil, fmt.Errorf("error unmarshalling body: %s", err.Error())
 	}
 
-	entity, ok, err := device.NewRepository().Get(ctx, parsedID)
+	dr := device.NewRepository()
+	entity, ok, err := dr.Get(ctx, parsedID)
 	if err != nil {
 		return nil, fmt.Errorf("error getting entity: %s", err.Error())
 	}
@@ -229,9 +259,17 @@ func update(ctx context.Context, req events.APIGatewayProxyRequest) (*shared.API
 		return nil, fmt.Errorf("entity not found: %s", parsedID)
 	}
 
-	entity.UnitID = body.UnitID
+	// The poll may save the device while we do, the edit is applied to its version.
+	edit := func(d *shared.Device) (bool, error) {
+		d.UnitID = body.UnitID
+		if body.UnmanagedLockCodePolicy != nil {
+			d.UnmanagedLockCodePolicy = body.UnmanagedLockCodePolicy
+		}
+		return true, nil
+	}
+	edit(&entity)
 
-	entity, err = device.NewRepository().Put(ctx, entity)
+	entity, err = shared.SaveDevice(ctx, dr, entity, edit)
 	if err != nil {
 		return nil, fmt.Errorf("error updating entity: %s", err.Error())
 	}
@@ -239,6 +277,52 @@ func update(ctx context.Context, req events.APIGatewayProxyRequest) (*shared.API
 	return shared.NewAPIResponse(http.StatusOK, UpdateResponse{Entity: entity})
 }
 
+func plan(ctx context.Context, req events.APIGatewayProxyRequest) (*shared.APIResponse, error) {
+	id := entityRegex.ReplaceAllString(req.Path, "")
+	id = strings.TrimSuffix(strings.Replace(id, "/plan", "", 1), "/")
+	parsedID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing id: %s", err.Error())
+	}
+
+	entity, ok, err := device.NewRepository().Get(ctx, parsedID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting entity: %s", err.Error())
+	}
+	if !ok {
+		return nil, fmt.Errorf("entity not found: %s", parsedID)
+	}
+
+	tzName, err := mshared.GetConfig("TIME_ZONE")
+	if err != nil {
+		return nil, fmt.Errorf("error getting time zone name: %s", err.Error())
+	}
+
+	tz, err := time.LoadLocation(tzName)
+	if err != nil {
+		return nil, fmt.Errorf("error getting time zone %s", err.Error())
+	}
+
+	// Planning only reads the device's unit and property. It never talks to the controller, saves or sends email, so it doesn't get any of those.
+	le := lockengine.NewLockEngine(
+		nil,
+		nil,
+		nil,
+		shared.LogEventSink{},
+		"",
+		property.NewRepository(),
+		tz,
+		unit.NewRepository(),
+	)
+
+	policy, err := le.UnmanagedLockCodePolicy(ctx, entity)
+	if err != nil {
+		return nil, fmt.Errorf("error getting unmanaged lock code policy: %s", err.Error())
+	}
+
+	return shared.NewAPIResponse(http.StatusOK, PlanResponse{Entity: le.Plan(time.Now(), entity, policy)})
+}
+
 func rebootController(ctx context.Context, req events.APIGatewayProxyRequest) (*shared.APIResponse, error) {
 	id := entityRegex.ReplaceAllString(req.Path, "")
 	id = strings.Replace(id, "/reboot-controller/", "", 1)
@@ -255,7 +339,12 @@ func rebootController(ctx context.Context, req events.APIGatewayProxyRequest) (*
 		return nil, fmt.Errorf("entity not found: %s", parsedID)
 	}
 
-	connectionPool := ezlo.NewConnectionPool()
+	localHubs, err := ezlo.GetLocalHubs()
+	if err != nil {
+		return nil, fmt.Errorf("error getting local hubs: %s", err.Error())
+	}
+
+	connectionPool := ezlo.NewConnectionPool().WithLocalHubs(localHubs)
 	defer connectionPool.Close()
 
 	deviceController := ezlo.NewDeviceController(connectionPool)
@@ -265,7 +354,10 @@ func rebootController(ctx context.Context, req events.APIGatewayProxyRequest) (*
 
 	now := time.Now()
 	entity.LastRebootedControllerAt = &now
-	if _, err := device.NewRepository().Put(ctx, entity); err != nil {
+	if _, err := shared.SaveDevice(ctx, device.NewRepository(), entity, func(d *shared.Device) (bool, error) {
+		d.LastRebootedControllerAt = &now
+		return true, nil
+	}); err != nil {
 		return nil, fmt.Errorf("error updating entity: %s", err.Error())
 	}
 
@@ -0,0 +1,266 @@
+package recurringlockcodes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mlock/lambdas/shared"
+	"mlock/lambdas/shared/dynamo/device"
+	"mlock/lambdas/shared/sqs"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/uuid"
+)
+
+type CreateRequest struct {
+	Code     string    `json:"code"`
+	EndAt    time.Time `json:"endAt"`
+	Note     string    `json:"note"`
+	RRule    string    `json:"rrule"`
+	StartAt  time.Time `json:"startAt"`
+	TimeZone string    `json:"timeZone"`
+}
+
+type CreateResponse struct {
+	Entity shared.Device `json:"entity"`
+}
+
+type DeleteResponse struct {
+	Entity shared.Device `json:"entity"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+type UpdateBody struct {
+	Code     string    `json:"code"`
+	EndAt    time.Time `json:"endAt"`
+	Note     string    `json:"note"`
+	RRule    string    `json:"rrule"`
+	StartAt  time.Time `json:"startAt"`
+	TimeZone string    `json:"timeZone"`
+}
+
+type UpdateResponse struct {
+	Entity shared.Device `json:"entity"`
+}
+
+func HandleRequest(ctx context.Context, req events.APIGatewayProxyRequest) (*shared.APIResponse, error) {
+	r, err := regexp.Compile(`^/devices/([0-9a-fA-F]{8}\b-[0-9a-fA-F]{4}\b-[0-9a-fA-F]{4}\b-[0-9a-fA-F]{4}\b-[0-9a-fA-F]{12})/recurring-lock-codes/([0-9a-fA-F]{8}\b-[0-9a-fA-F]{4}\b-[0-9a-fA-F]{4}\b-[0-9a-fA-F]{4}\b-[0-9a-fA-F]{12})?`)
+	if err != nil {
+		return nil, fmt.Errorf("error generating regex: %s", err.Error())
+	}
+
+	match := r.FindStringSubmatch(req.Path)
+
+	if len(match) < 2 {
+		return nil, fmt.Errorf("regex didn't match path")
+	}
+
+	deviceID, err := uuid.Parse(match[1])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing device id: %s", err.Error())
+	}
+
+	d, ok, err := device.NewRepository().Get(ctx, deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting entity: %s", err.Error())
+	}
+	if !ok {
+		return nil, fmt.Errorf("unable to find entity: %s", deviceID)
+	}
+
+	queue, err := sqs.NewSQSService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error creating sqs service: %s", err.Error())
+	}
+
+	switch req.HTTPMethod {
+	case "POST":
+		return create(ctx, req, d, queue)
+	case "PUT", "DELETE":
+		if len(match) != 3 || match[2] == "" {
+			return nil, fmt.Errorf("regex didn't match path for %s", req.HTTPMethod)
+		}
+
+		rlcID, err := uuid.Parse(match[2])
+		if err != nil {
+			return nil, fmt.Errorf("error parsing recurring lock code id: %s", err.Error())
+		}
+
+		if req.HTTPMethod == "DELETE" {
+			return delete(ctx, d, rlcID, queue)
+		}
+		return update(ctx, req, d, rlcID, queue)
+	default:
+		return shared.NewAPIResponse(http.StatusNotImplemented, "not implemented")
+	}
+}
+
+func create(
+	ctx context.Context,
+	req events.APIGatewayProxyRequest,
+	d shared.Device,
+	q *sqs.SQSService,
+) (*shared.APIResponse, error) {
+	var body CreateRequest
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		return nil, fmt.Errorf("error unmarshalling body: %s", err.Error())
+	}
+
+	currentUser, err := getCurrentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rlc := &shared.DeviceRecurringLockCode{
+		Code:     body.Code,
+		EndAt:    body.EndAt,
+		ID:       uuid.New(),
+		Note:     body.Note,
+		RRule:    body.RRule,
+		StartAt:  body.StartAt,
+		TimeZone: body.TimeZone,
+	}
+	if rlc.Note == "" {
+		rlc.Note = fmt.Sprintf("Added by %s.", currentUser.Email)
+	}
+
+	if err := rlc.Validate(); err != nil {
+		return shared.NewAPIResponse(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
+
+	d.RecurringLockCodes = append(d.RecurringLockCodes, rlc)
+
+	d, err = save(ctx, d, q, fmt.Sprintf("Recurring code created. %s", describe(rlc)))
+	if err != nil {
+		return nil, err
+	}
+
+	return shared.NewAPIResponse(http.StatusOK, CreateResponse{Entity: d})
+}
+
+func update(
+	ctx context.Context,
+	req events.APIGatewayProxyRequest,
+	d shared.Device,
+	rlcID uuid.UUID,
+	q *sqs.SQSService,
+) (*shared.APIResponse, error) {
+	var body UpdateBody
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		return nil, fmt.Errorf("error unmarshalling body: %s", err.Error())
+	}
+
+	rlc := d.GetRecurringLockCode(rlcID)
+	if rlc == nil {
+		return nil, fmt.Errorf("unable to find recurring lock code")
+	}
+
+	currentUser, err := getCurrentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	updated := *rlc
+	updated.Code = body.Code
+	updated.EndAt = body.EndAt
+	updated.RRule = body.RRule
+	updated.StartAt = body.StartAt
+	updated.TimeZone = body.TimeZone
+	if body.Note != "" {
+		updated.Note = body.Note
+	} else {
+		updated.Note = fmt.Sprintf("Edited by %s.", currentUser.Email)
+	}
+
+	if err := updated.Validate(); err != nil {
+		return shared.NewAPIResponse(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	}
+
+	*rlc = updated
+
+	// The scheduler brings the managed lock codes in line with the new schedule.
+	d, err = save(ctx, d, q, fmt.Sprintf("Recurring code edited. %s", describe(rlc)))
+	if err != nil {
+		return nil, err
+	}
+
+	return shared.NewAPIResponse(http.StatusOK, UpdateResponse{Entity: d})
+}
+
+func delete(
+	ctx context.Context,
+	d shared.Device,
+	rlcID uuid.UUID,
+	q *sqs.SQSService,
+) (*shared.APIResponse, error) {
+	deleted := d.GetRecurringLockCode(rlcID)
+	if deleted == nil {
+		return nil, fmt.Errorf("unable to find recurring lock code")
+	}
+
+	currentUser, err := getCurrentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rlcs := []*shared.DeviceRecurringLockCode{}
+	for _, rlc := range d.RecurringLockCodes {
+		if rlc.ID != rlcID {
+			rlcs = append(rlcs, rlc)
+		}
+	}
+	d.RecurringLockCodes = rlcs
+
+	// The scheduler ends any of its managed lock codes that are still around.
+	d, err = save(ctx, d, q, fmt.Sprintf("Recurring code deleted by %s. %s", currentUser.Email, describe(deleted)))
+	if err != nil {
+		return nil, err
+	}
+
+	return shared.NewAPIResponse(http.StatusOK, DeleteResponse{Entity: d})
+}
+
+func getCurrentUser(ctx context.Context) (*shared.User, error) {
+	cd, err := shared.GetContextData(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can't get context data: %s", err.Error())
+	}
+
+	if cd.User == nil {
+		return nil, fmt.Errorf("no current user")
+	}
+
+	return cd.User, nil
+}
+
+// describe is how a recurring code is written in the audit log.
+func describe(rlc *shared.DeviceRecurringLockCode) string {
+	return fmt.Sprintf("Code: %s; Rule: %s; Start: %s; End: %s; Time Zone: %s; Note: %s", rlc.Code, rlc.RRule, rlc.StartAt.Format(time.RFC3339), rlc.EndAt.Format(time.RFC3339), rlc.TimeZone, rlc.Note)
+}
+
+func save(ctx context.Context, d shared.Device, q *sqs.SQSService, auditLogNote string) (shared.Device, error) {
+	if err := device.NewRepository().AppendNoteToAuditLog(ctx, d, auditLogNote); err != nil {
+		return shared.Device{}, fmt.Errorf("error appending to audit log: %s", err.Error())
+	}
+
+	// Only the API changes the recurring codes, so ours win if the poll saved the device meanwhile.
+	d, err := shared.SaveDevice(ctx, device.NewRepository(), d, func(fresh *shared.Device) (bool, error) {
+		fresh.RecurringLockCodes = d.RecurringLockCodes
+		return true, nil
+	})
+	if err != nil {
+		return shared.Device{}, fmt.Errorf("error updating device: %s", err.Error())
+	}
+
+	if err := q.SendJob(ctx, sqs.NewDeviceJob(d.ID, "recurring lock codes changed")); err != nil {
+		return shared.Device{}, fmt.Errorf("error sending message to queue: %s", err.Error())
+	}
+
+	return d, nil
+}
@@ -9,6 +9,7 @@ import (
 	"mlock/lambdas/shared/dynamo/property"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/google/uuid"
@@ -30,6 +31,18 @@ type CreateResponse struct {
 	Entity shared.Property `json:"entity"`
 }
 
+type UpdateBody struct {
+	GuestMessageTemplate    string                          `json:"guestMessageTemplate"`
+	Name                    string                          `json:"name"`
+	ReservationBuffers      *shared.ReservationBuffers      `json:"reservationBuffers"`
+	UnmanagedLockCodePolicy *shared.UnmanagedLockCodePolicy `json:"unmanagedLockCodePolicy"`
+}
+
+type UpdateResponse struct {
+	Entity shared.Property `json:"entity"`
+	Error  string          `json:"error"`
+}
+
 func main() {
 	helpers.StartAPILambda(HandleRequest, []string{helpers.MiddlewareAuth})
 }
@@ -42,6 +55,8 @@ func HandleRequest(ctx context.Context, req events.APIGatewayProxyRequest) (*sha
 		return list(ctx, req)
 	case "POST":
 		return create(ctx, req)
+	case "PUT":
+		return update(ctx, req)
 	default:
 		return shared.NewAPIResponse(http.StatusNotImplemented, "not implemented")
 	}
@@ -96,3 +111,53 @@ func create(ctx context.Context, req events.APIGatewayProxyRequest) (*shared.API
 
 	return shared.NewAPIResponse(http.StatusOK, CreateResponse{Entity: entity})
 }
+
+func update(ctx context.Context, req events.APIGatewayProxyRequest) (*shared.APIResponse, error) {
+	id := strings.Replace(req.Path, "/properties/", "", 1)
+	parsedID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing id: %s", err.Error())
+	}
+
+	var body UpdateBody
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		return nil, fmt.Errorf("error unmarshalling body: %s", err.Error())
+	}
+
+	entity, ok, err := property.NewRepository().Get(ctx, parsedID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting entity: %s", err.Error())
+	}
+	if !ok {
+		return nil, fmt.Errorf("unable to find entity: %s", parsedID)
+	}
+
+	if err := shared.ValidateGuestMessageTemplate(body.GuestMessageTemplate); err != nil {
+		return shared.NewAPIResponse(http.StatusBadRequest, UpdateResponse{Error: fmt.Sprintf("invalid guest message template: %s", err.Error())})
+	}
+	if body.ReservationBuffers != nil {
+		if err := body.ReservationBuffers.Validate(); err != nil {
+			return shared.NewAPIResponse(http.StatusBadRequest, UpdateResponse{Error: fmt.Sprintf("invalid reservation buffers: %s", err.Error())})
+		}
+	}
+
+	if body.Name != "" {
+		entity.Name = body.Name
+	}
+	if body.GuestMessageTemplate == "" {
+		entity.GuestMessageTemplateSetAt = nil
+	} else if entity.GuestMessageTemplate == "" || entity.GuestMessageTemplateSetAt == nil {
+		now := time.Now()
+		entity.GuestMessageTemplateSetAt = &now
+	}
+	entity.GuestMessageTemplate = body.GuestMessageTemplate
+	entity.ReservationBuffers = body.ReservationBuffers
+	entity.UnmanagedLockCodePolicy = body.UnmanagedLockCodePolicy
+
+	entity, err = property.NewRepository().Put(ctx, entity)
+	if err != nil {
+		return nil, fmt.Errorf("error updating entity: %s", err.Error())
+	}
+
+	return shared.NewAPIResponse(http.StatusOK, UpdateResponse{Entity: entity})
+}
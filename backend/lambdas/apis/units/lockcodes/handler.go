@@ -0,0 +1,286 @@
+package lockcodes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mlock/lambdas/shared"
+	"mlock/lambdas/shared/dynamo/device"
+	"mlock/lambdas/shared/dynamo/unit"
+	"mlock/lambdas/shared/sqs"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/uuid"
+)
+
+type CreateRequest struct {
+	Code    string    `json:"code"`
+	EndAt   time.Time `json:"endAt"`
+	StartAt time.Time `json:"startAt"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+type ListResponse struct {
+	Entities []shared.UnitLockCodeStatus `json:"entities"`
+}
+
+type Response struct {
+	Entity shared.UnitLockCodeStatus `json:"entity"`
+}
+
+type UpdateBody struct {
+	Code    string    `json:"code"`
+	EndAt   time.Time `json:"endAt"`
+	StartAt time.Time `json:"startAt"`
+}
+
+func HandleRequest(ctx context.Context, req events.APIGatewayProxyRequest) (*shared.APIResponse, error) {
+	r, err := regexp.Compile(`^/units/([0-9a-fA-F]{8}\b-[0-9a-fA-F]{4}\b-[0-9a-fA-F]{4}\b-[0-9a-fA-F]{4}\b-[0-9a-fA-F]{12})/lock-codes/?([0-9a-fA-F]{8}\b-[0-9a-fA-F]{4}\b-[0-9a-fA-F]{4}\b-[0-9a-fA-F]{4}\b-[0-9a-fA-F]{12})?`)
+	if err != nil {
+		return nil, fmt.Errorf("error generating regex: %s", err.Error())
+	}
+
+	match := r.FindStringSubmatch(req.Path)
+
+	if len(match) < 2 {
+		return nil, fmt.Errorf("regex didn't match path")
+	}
+
+	unitID, err := uuid.Parse(match[1])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing unit id: %s", err.Error())
+	}
+
+	u, ok, err := unit.NewRepository().Get(ctx, unitID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting entity: %s", err.Error())
+	}
+	if !ok {
+		return nil, fmt.Errorf("unable to find entity: %s", unitID)
+	}
+
+	devices, err := device.NewRepository().ListForUnit(ctx, u)
+	if err != nil {
+		return nil, fmt.Errorf("error getting devices: %s", err.Error())
+	}
+
+	if req.HTTPMethod == "GET" {
+		return list(u, devices)
+	}
+
+	queue, err := sqs.NewSQSService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error creating sqs service: %s", err.Error())
+	}
+
+	switch req.HTTPMethod {
+	case "POST":
+		return create(ctx, req, u, devices, queue)
+	case "PUT", "DELETE":
+		if len(match) != 3 || match[2] == "" {
+			return nil, fmt.Errorf("regex didn't match path for %s", req.HTTPMethod)
+		}
+
+		ulcID, err := uuid.Parse(match[2])
+		if err != nil {
+			return nil, fmt.Errorf("error parsing lock code id: %s", err.Error())
+		}
+
+		ulc := u.GetLockCode(ulcID)
+		if ulc == nil {
+			return nil, fmt.Errorf("unable to find unit lock code")
+		}
+
+		if req.HTTPMethod == "DELETE" {
+			return end(ctx, u, ulc, devices, queue)
+		}
+		return update(ctx, req, u, ulc, devices, queue)
+	default:
+		return shared.NewAPIResponse(http.StatusNotImplemented, "not implemented")
+	}
+}
+
+func list(u shared.Unit, devices []shared.Device) (*shared.APIResponse, error) {
+	statuses := []shared.UnitLockCodeStatus{}
+	for _, ulc := range u.LockCodes {
+		statuses = append(statuses, ulc.Status(devices))
+	}
+
+	return shared.NewAPIResponse(http.StatusOK, ListResponse{Entities: statuses})
+}
+
+func create(
+	ctx context.Context,
+	req events.APIGatewayProxyRequest,
+	u shared.Unit,
+	devices []shared.Device,
+	q *sqs.SQSService,
+) (*shared.APIResponse, error) {
+	var body CreateRequest
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		return nil, fmt.Errorf("error unmarshalling body: %s", err.Error())
+	}
+
+	currentUser, err := getCurrentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(devices) == 0 {
+		return shared.NewAPIResponse(http.StatusBadRequest, ErrorResponse{Error: "the unit doesn't have any devices"})
+	}
+
+	ulc := &shared.UnitLockCode{
+		Code:    body.Code,
+		EndAt:   body.EndAt,
+		ID:      uuid.New(),
+		Note:    fmt.Sprintf("Added by %s.", currentUser.Email),
+		StartAt: body.StartAt,
+	}
+
+	if ulc.StartAt.After(ulc.EndAt) {
+		return nil, fmt.Errorf("can't start after it ends")
+	}
+
+	u.LockCodes = append(u.LockCodes, ulc)
+
+	return apply(ctx, u, ulc, devices, q, fmt.Sprintf("Added to the unit by %s.", currentUser.Email))
+}
+
+func update(
+	ctx context.Context,
+	req events.APIGatewayProxyRequest,
+	u shared.Unit,
+	ulc *shared.UnitLockCode,
+	devices []shared.Device,
+	q *sqs.SQSService,
+) (*shared.APIResponse, error) {
+	var body UpdateBody
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		return nil, fmt.Errorf("error unmarshalling body: %s", err.Error())
+	}
+
+	currentUser, err := getCurrentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if body.Code != "" {
+		ulc.Code = body.Code
+	}
+	if !body.StartAt.IsZero() {
+		ulc.StartAt = body.StartAt
+	}
+	ulc.EndAt = body.EndAt
+	if ulc.StartAt.After(ulc.EndAt) {
+		return nil, fmt.Errorf("can't start after it ends")
+	}
+	ulc.Note = fmt.Sprintf("Edited by %s.", currentUser.Email)
+
+	return apply(ctx, u, ulc, devices, q, fmt.Sprintf("Edited on the unit by %s.", currentUser.Email))
+}
+
+func end(
+	ctx context.Context,
+	u shared.Unit,
+	ulc *shared.UnitLockCode,
+	devices []shared.Device,
+	q *sqs.SQSService,
+) (*shared.APIResponse, error) {
+	currentUser, err := getCurrentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ulc.End(time.Now())
+	ulc.Note = fmt.Sprintf("Ended by %s.", currentUser.Email)
+
+	return apply(ctx, u, ulc, devices, q, fmt.Sprintf("Ended on the unit by %s.", currentUser.Email))
+}
+
+// apply saves the unit and brings every device in the unit in line with the code. Devices that joined the unit since the code was created pick it up here too.
+func apply(
+	ctx context.Context,
+	u shared.Unit,
+	ulc *shared.UnitLockCode,
+	devices []shared.Device,
+	q *sqs.SQSService,
+	note string,
+) (*shared.APIResponse, error) {
+	now := time.Now()
+	changes := map[uuid.UUID][]*shared.DeviceManagedLockCode{}
+	for i := range devices {
+		mlcs, err := ulc.ApplyToDevice(&devices[i], note, now)
+		if err != nil {
+			return nil, fmt.Errorf("error applying to device %s: %s", devices[i].ID, err.Error())
+		}
+		if len(mlcs) == 0 {
+			continue
+		}
+		changes[devices[i].ID] = mlcs
+
+		for _, mlc := range mlcs {
+			if conflicts := devices[i].FindLockCodeConflicts(mlc); len(conflicts) > 0 {
+				return shared.NewAPIResponse(http.StatusConflict, ErrorResponse{Error: fmt.Sprintf(
+					"code %s is already in use on %s from %s to %s",
+					conflicts[0].Code,
+					devices[i].RawDevice.Name,
+					conflicts[0].StartAt.Format(time.RFC3339),
+					conflicts[0].EndAt.Format(time.RFC3339),
+				)})
+			}
+		}
+	}
+
+	if _, err := unit.NewRepository().Put(ctx, u); err != nil {
+		return nil, fmt.Errorf("error updating unit: %s", err.Error())
+	}
+
+	for i, d := range devices {
+		mlcs, ok := changes[d.ID]
+		if !ok {
+			continue
+		}
+
+		if err := device.NewRepository().AppendToAuditLog(ctx, d, mlcs); err != nil {
+			return nil, fmt.Errorf("error appending to audit log: %s", err.Error())
+		}
+
+		// The poll may save the device while we do, the code is applied to its version.
+		saved, err := shared.SaveDevice(ctx, device.NewRepository(), d, func(fresh *shared.Device) (bool, error) {
+			mlcs, err := ulc.ApplyToDevice(fresh, note, now)
+			return len(mlcs) > 0, err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error updating device %s: %s", d.ID, err.Error())
+		}
+		devices[i] = saved
+	}
+
+	if len(changes) > 0 {
+		if err := q.SendJob(ctx, sqs.NewUnitJob(u.ID, note)); err != nil {
+			return nil, fmt.Errorf("error sending message to queue: %s", err.Error())
+		}
+	}
+
+	return shared.NewAPIResponse(http.StatusOK, Response{Entity: ulc.Status(devices)})
+}
+
+func getCurrentUser(ctx context.Context) (*shared.User, error) {
+	cd, err := shared.GetContextData(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can't get context data: %s", err.Error())
+	}
+
+	if cd.User == nil {
+		return nil, fmt.Errorf("no current user")
+	}
+
+	return cd.User, nil
+}
@@ -4,12 +4,16 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"mlock/lambdas/apis/units/lockcodes"
 	"mlock/lambdas/helpers"
 	"mlock/lambdas/shared"
+	"mlock/lambdas/shared/codegenerator"
 	"mlock/lambdas/shared/dynamo/device"
 	"mlock/lambdas/shared/dynamo/property"
 	"mlock/lambdas/shared/dynamo/unit"
 	"mlock/lambdas/shared/hostaway"
+	"mlock/lambdas/shared/ical"
+	"mlock/lambdas/shared/reservationprovider"
 	mshared "mlock/shared"
 	"net/http"
 	"regexp"
@@ -56,9 +60,12 @@ type CreateResponse struct {
 }
 
 type UpdateBody struct {
-	Name              string    `json:"name"`
-	PropertyID        uuid.UUID `json:"propertyId"`
-	RemotePropertyURL string    `json:"remotePropertyUrl"`
+	ICalFeed            *shared.UnitICalFeed       `json:"iCalFeed"`
+	Name                string                     `json:"name"`
+	PropertyID          uuid.UUID                  `json:"propertyId"`
+	RemotePropertyURL   string                     `json:"remotePropertyUrl"`
+	ReservationBuffers  *shared.ReservationBuffers `json:"reservationBuffers"` // Nil uses the property's buffers.
+	ReservationProvider string                     `json:"reservationProvider"`
 }
 
 type UpdateResponse struct {
@@ -67,9 +74,10 @@ type UpdateResponse struct {
 }
 
 type ExtraEntities struct {
-	Devices      []shared.Device      `json:"devices"`
-	Properties   []shared.Property    `json:"properties"`
-	Reservations []shared.Reservation `json:"reservations"`
+	Devices      []shared.Device             `json:"devices"`
+	LockCodes    []shared.UnitLockCodeStatus `json:"lockCodes"`
+	Properties   []shared.Property           `json:"properties"`
+	Reservations []shared.Reservation        `json:"reservations"`
 }
 
 var unitsRegex = regexp.MustCompile(`/units/?`)
@@ -79,6 +87,14 @@ func main() {
 }
 
 func HandleRequest(ctx context.Context, req events.APIGatewayProxyRequest) (*shared.APIResponse, error) {
+	match, err := regexp.MatchString(`^/units/[0-9a-fA-F]{8}\b-[0-9a-fA-F]{4}\b-[0-9a-fA-F]{4}\b-[0-9a-fA-F]{4}\b-[0-9a-fA-F]{12}/lock-codes/?`, req.Path)
+	if err != nil {
+		return shared.NewAPIResponse(http.StatusBadRequest, DeleteResponse{Error: "unable to parse request"})
+	}
+	if match {
+		return lockcodes.HandleRequest(ctx, req)
+	}
+
 	switch req.HTTPMethod {
 	case "DELETE":
 		return delete(ctx, req)
@@ -205,13 +221,13 @@ func detail(ctx context.Context, req events.APIGatewayProxyRequest, id string) (
 		return nil, fmt.Errorf("error getting time zone %s", err.Error())
 	}
 
-	reservations := []shared.Reservation{}
-	if entity.RemotePropertyURL != "" {
-		hostawayReservations, err := hostaway.NewRepository(tz, "").Get(ctx, entity)
-		if err != nil {
-			return nil, fmt.Errorf("error getting reservation items: %s", err.Error())
-		}
-		reservations = append(reservations, hostawayReservations...)
+	codeGenerator := codegenerator.NewCodeGenerator(device.NewRepository(), codegenerator.DefaultConfig)
+	reservations, err := reservationprovider.NewRepository(
+		hostaway.NewRepository(tz, "").WithCodeGenerator(codeGenerator),
+		ical.NewRepository(tz, codeGenerator),
+	).Get(ctx, entity)
+	if err != nil {
+		return nil, fmt.Errorf("error getting reservation items: %s", err.Error())
 	}
 
 	properties, err := property.NewRepository().List(ctx)
@@ -224,10 +240,16 @@ func detail(ctx context.Context, req events.APIGatewayProxyRequest, id string) (
 		return nil, fmt.Errorf("error getting devices: %s", err.Error())
 	}
 
+	lockCodes := []shared.UnitLockCodeStatus{}
+	for _, ulc := range entity.LockCodes {
+		lockCodes = append(lockCodes, ulc.Status(devices))
+	}
+
 	return shared.NewAPIResponse(http.StatusOK, DetailResponse{
 		Entity: entity,
 		Extra: ExtraEntities{
 			Devices:      devices,
+			LockCodes:    lockCodes,
 			Properties:   properties,
 			Reservations: reservations,
 		},
@@ -254,9 +276,36 @@ func update(ctx context.Context, req events.APIGatewayProxyRequest) (*shared.API
 		return nil, fmt.Errorf("entity not found: %s", parsedID)
 	}
 
+	if body.ReservationBuffers != nil {
+		if err := body.ReservationBuffers.Validate(); err != nil {
+			return shared.NewAPIResponse(http.StatusBadRequest, UpdateResponse{Error: fmt.Sprintf("invalid reservation buffers: %s", err.Error())})
+		}
+	}
+
 	entity.Name = body.Name
 	entity.PropertyID = body.PropertyID
 	entity.RemotePropertyURL = body.RemotePropertyURL
+	entity.ReservationBuffers = body.ReservationBuffers
+
+	// Older clients don't know about the providers, so leave it alone if it isn't set.
+	switch body.ReservationProvider {
+	case "":
+		body.ReservationProvider = entity.ReservationProvider
+		body.ICalFeed = entity.ICalFeed
+	case shared.UnitReservationProviderHostaway:
+		body.ICalFeed = nil
+	case shared.UnitReservationProviderICal:
+		if body.ICalFeed == nil {
+			return shared.NewAPIResponse(http.StatusBadRequest, UpdateResponse{Error: "an iCal feed is required"})
+		}
+		if err := body.ICalFeed.Validate(); err != nil {
+			return shared.NewAPIResponse(http.StatusBadRequest, UpdateResponse{Error: fmt.Sprintf("invalid iCal feed: %s", err.Error())})
+		}
+	default:
+		return shared.NewAPIResponse(http.StatusBadRequest, UpdateResponse{Error: fmt.Sprintf("unknown reservation provider: %s", body.ReservationProvider)})
+	}
+	entity.ReservationProvider = body.ReservationProvider
+	entity.ICalFeed = body.ICalFeed
 
 	entity, err = unit.NewRepository().Put(ctx, entity)
 	if err != nil {
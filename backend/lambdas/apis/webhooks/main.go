@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"mlock/lambdas/helpers"
 	"mlock/lambdas/shared"
+	"mlock/lambdas/shared/dynamo/unit"
 	"mlock/lambdas/shared/sqs"
 
 	"net/http"
@@ -14,12 +15,23 @@ import (
 )
 
 type hostawayRequest struct {
-	Object *string `json:"object"`
-	Event  *string `json:"event"`
+	Data   *hostawayReservation `json:"data"`
+	Event  *string              `json:"event"`
+	Object *string              `json:"object"`
+}
+
+// hostawayReservation is the part of the reservation we need to find its unit, the scheduler gets the rest from the API.
+type hostawayReservation struct {
+	HostawayReservationID string `json:"hostawayReservationId"`
+	ListingMapID          int    `json:"listingMapId"`
+	UpdatedOn             string `json:"updatedOn"`
 }
 
 type emptyResponse struct{}
 
+// The webhook's auth is shared by all of Hostaway, so there's no user to put on the job.
+const webhookActor = "Hostaway webhook"
+
 func main() {
 	helpers.StartAPILambda(HandleRequest, []string{helpers.MiddlewareAuth})
 }
@@ -58,9 +70,38 @@ func post(ctx context.Context, req events.APIGatewayProxyRequest) (*shared.APIRe
 		return nil, fmt.Errorf("error getting sqs service: %s", err.Error())
 	}
 
-	if err := sqsService.SendBlankMessageToPollSchedulesQueue(ctx); err != nil {
-		return nil, fmt.Errorf("error sending blank message to poll schedules queue: %s", err.Error())
+	// If we can't tell which listing it's for, fall back to polling everything.
+	if body.Data == nil || body.Data.ListingMapID == 0 {
+		job := sqs.NewPollSchedulesJob("reservation webhook without a listing")
+		job.Actor = webhookActor
+		if err := sqsService.SendJob(ctx, job); err != nil {
+			return nil, fmt.Errorf("error sending job to poll schedules queue: %s", err.Error())
+		}
+		return shared.NewAPIResponse(http.StatusOK, emptyResponse{})
+	}
+
+	units, err := unit.NewRepository().List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting units: %s", err.Error())
+	}
+
+	for _, u := range units {
+		if u.GetReservationProvider() != shared.UnitReservationProviderHostaway || u.GetRemotePropertyID() != body.Data.ListingMapID {
+			continue
+		}
+
+		fmt.Printf("reconciling unit %s for reservation %s\n", u.Name, body.Data.HostawayReservationID)
+		job := sqs.NewUnitJob(u.ID, fmt.Sprintf("reservation %s changed", body.Data.HostawayReservationID))
+		job.Actor = webhookActor
+		if body.Data.UpdatedOn != "" {
+			// Hostaway retries webhooks, but each change to the reservation needs its own run.
+			job.Source = fmt.Sprintf("Hostaway reservation %s updated %s", body.Data.HostawayReservationID, body.Data.UpdatedOn)
+		}
+		if err := sqsService.SendJob(ctx, job); err != nil {
+			return nil, fmt.Errorf("error sending job to poll schedules queue: %s", err.Error())
+		}
 	}
 
+	// Listings that aren't connected to a unit don't have any locks for us to update.
 	return shared.NewAPIResponse(http.StatusOK, emptyResponse{})
 }
@@ -6,6 +6,7 @@ import (
 	"log"
 	"mlock/lambdas/shared"
 	"mlock/lambdas/shared/dynamo/miscellaneous"
+	"mlock/lambdas/shared/dynamo/synccursor"
 	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
@@ -39,6 +40,12 @@ func HandleRequest(ctx context.Context, event MyEvent) (Response, error) {
 	}
 	log.Printf("migrated miscellaneous\n")
 
+	log.Printf("migrating sync cursors...\n")
+	if err := synccursor.Migrate(ctx); err != nil {
+		return Response{}, fmt.Errorf("error migrating sync cursors: %s", err.Error())
+	}
+	log.Printf("migrated sync cursors\n")
+
 	return Response{Messages: []string{"success!"}}, nil
 
 	// Old code as a reference to what we once did:
@@ -84,6 +84,9 @@ func handleRequest(
 
 	// Must be done after `LoadConfig`.
 	ctx = shared.CreateContextData(ctx)
+	if cd, err := shared.GetContextData(ctx); err == nil {
+		cd.RequestID = req.RequestContext.RequestID
+	}
 
 	// Super lame middleware, maybe we'll need something better one day.
 	if err := handleMiddlewares(ctx, req, middlewares); err != nil {
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"mlock/lambdas/shared"
+	"mlock/lambdas/shared/devicelistener"
+	"mlock/lambdas/shared/dynamo/device"
+	"mlock/lambdas/shared/dynamo/property"
+	"mlock/lambdas/shared/dynamo/unit"
+	"mlock/lambdas/shared/ezlo"
+	"mlock/lambdas/shared/lockengine"
+	"mlock/lambdas/shared/ses"
+	mshared "mlock/shared"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// How often we look for controllers that were added or removed since we started listening.
+const refreshControllersInterval = 5 * time.Minute
+
+// Unlike the other jobs this isn't a lambda, it keeps a websocket open to every controller for as long as it runs. The poll job still does everything, this just gets there sooner.
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx); err != nil {
+		log.Fatalf("error listening: %s\n", err.Error())
+	}
+}
+
+func run(ctx context.Context) error {
+	ctx = shared.CreateContextData(ctx)
+
+	if err := mshared.LoadConfig(); err != nil {
+		return fmt.Errorf("error loading config: %s", err.Error())
+	}
+
+	emailService, err := ses.NewEmailService(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting email service: %s", err.Error())
+	}
+
+	tzName, err := mshared.GetConfig("TIME_ZONE")
+	if err != nil {
+		return fmt.Errorf("error getting time zone name: %s", err.Error())
+	}
+
+	tz, err := time.LoadLocation(tzName)
+	if err != nil {
+		return fmt.Errorf("error getting time zone %s", err.Error())
+	}
+
+	fed, err := mshared.GetConfig("FRONTEND_DOMAIN")
+	if err != nil {
+		return fmt.Errorf("error getting front end domain: %s", err.Error())
+	}
+
+	localHubs, err := ezlo.GetLocalHubs()
+	if err != nil {
+		return fmt.Errorf("error getting local hubs: %s", err.Error())
+	}
+
+	connectionPool := ezlo.NewConnectionPool().WithLocalHubs(localHubs)
+	defer connectionPool.Close()
+
+	deviceController := ezlo.NewDeviceController(connectionPool)
+	deviceRepository := device.NewRepository()
+	lockEngine := lockengine.NewLockEngine(
+		deviceController,
+		deviceRepository,
+		emailService,
+		shared.LogEventSink{},
+		fed,
+		property.NewRepository(),
+		tz,
+		unit.NewRepository(),
+	)
+	listener := devicelistener.NewListener(deviceController, deviceRepository, emailService, lockEngine)
+
+	controllerIDs, err := listControllerIDs(ctx, deviceRepository)
+	if err != nil {
+		return err
+	}
+
+	// When the controllers change we stop listening and start again with the new ones.
+	for ctx.Err() == nil {
+		listenCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func(controllerIDs []string) {
+			defer close(done)
+			log.Printf("listening to %d controllers\n", len(controllerIDs))
+			listener.Listen(listenCtx, controllerIDs)
+		}(controllerIDs)
+
+		controllerIDs = waitForControllersToChange(listenCtx, deviceRepository, controllerIDs)
+		cancel()
+		<-done
+	}
+	log.Printf("stopped listening\n")
+
+	return nil
+}
+
+// waitForControllersToChange returns the new controllers once they're different, or the old ones when the context is done.
+func waitForControllersToChange(ctx context.Context, deviceRepository *device.Repository, controllerIDs []string) []string {
+	ticker := time.NewTicker(refreshControllersInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return controllerIDs
+		case <-ticker.C:
+			latest, err := listControllerIDs(ctx, deviceRepository)
+			if err != nil {
+				log.Printf("error refreshing controllers, still listening to the ones we have: %s\n", err.Error())
+				continue
+			}
+			if !slices.Equal(latest, controllerIDs) {
+				return latest
+			}
+		}
+	}
+}
+
+// listControllerIDs is sorted so that it can be compared with the last time.
+func listControllerIDs(ctx context.Context, deviceRepository *device.Repository) ([]string, error) {
+	devices, err := deviceRepository.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting devices: %s", err.Error())
+	}
+	grouped, _ := shared.GroupDevicesByController(devices)
+	controllerIDs := []string{}
+	for _, controllerID := range grouped {
+		if controllerID != "" {
+			controllerIDs = append(controllerIDs, controllerID)
+		}
+	}
+	slices.Sort(controllerIDs)
+	return controllerIDs, nil
+}
@@ -7,69 +7,71 @@ import (
 	"mlock/lambdas/shared/dynamo/climatecontrol"
 	"mlock/lambdas/shared/dynamo/device"
 	"mlock/lambdas/shared/dynamo/miscellaneous"
+	"mlock/lambdas/shared/dynamo/property"
 	"mlock/lambdas/shared/dynamo/unit"
 	"mlock/lambdas/shared/homeassistant"
+	"mlock/lambdas/shared/sqs"
 	mshared "mlock/shared"
 	"time"
 
+	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/google/uuid"
 )
 
-type MyEvent struct {
-}
-
-type Response struct {
-	Message string `json:"message"`
-}
-
 func main() {
 	lambda.Start(HandleRequest)
 }
 
-func HandleRequest(ctx context.Context, event MyEvent) (Response, error) {
+// HandleRequest runs each job in the batch on its own, only the ones that fail are retried.
+func HandleRequest(ctx context.Context, event events.SQSEvent) (sqs.BatchResponse, error) {
 	ctx = shared.CreateContextData(ctx)
 
 	if err := mshared.LoadConfig(); err != nil {
-		return Response{}, fmt.Errorf("error loading config: %s", err.Error())
+		return sqs.BatchResponse{}, fmt.Errorf("error loading config: %s", err.Error())
 	}
 
+	return sqs.ProcessJobs(ctx, event, sqs.JobKindManageClimateControls, manage)
+}
+
+// manage always looks at every climate control, the job only says why we're running.
+func manage(ctx context.Context, job sqs.Job) error {
 	tzName, err := mshared.GetConfig("TIME_ZONE")
 	if err != nil {
-		return Response{}, fmt.Errorf("error getting time zone name: %s", err.Error())
+		return fmt.Errorf("error getting time zone name: %s", err.Error())
 	}
 
 	tz, err := time.LoadLocation(tzName)
 	if err != nil {
-		return Response{}, fmt.Errorf("error getting time zone %s", err.Error())
+		return fmt.Errorf("error getting time zone %s", err.Error())
 	}
 
 	climateControlRepository := climatecontrol.NewRepository()
 	haRepository, err := homeassistant.NewRepository()
 	if err != nil {
-		return Response{}, fmt.Errorf("error creating climate control repository: %s", err.Error())
+		return fmt.Errorf("error creating climate control repository: %s", err.Error())
 	}
 
 	devices, err := device.NewRepository().List(ctx)
 	if err != nil {
-		return Response{}, fmt.Errorf("error getting devices: %s", err.Error())
+		return fmt.Errorf("error getting devices: %s", err.Error())
 	}
 
 	miscellaneous, ok, err := miscellaneous.NewRepository().Get(ctx)
 	if err != nil {
-		return Response{}, fmt.Errorf("error getting miscellaneous: %s", err.Error())
+		return fmt.Errorf("error getting miscellaneous: %s", err.Error())
 	}
 	if !ok {
-		return Response{}, fmt.Errorf("miscellaneous not found")
+		return fmt.Errorf("miscellaneous not found")
 	}
 
 	units, err := unit.NewRepository().ListByName(ctx)
 	if err != nil {
-		return Response{}, fmt.Errorf("error getting units: %s", err.Error())
+		return fmt.Errorf("error getting units: %s", err.Error())
 	}
 
 	if err := refreshClimateControls(ctx, climateControlRepository, haRepository); err != nil {
-		return Response{}, fmt.Errorf("error refreshing climate controls: %s", err.Error())
+		return fmt.Errorf("error refreshing climate controls: %s", err.Error())
 	}
 
 	now := time.Now().In(tz)
@@ -89,11 +91,20 @@ func HandleRequest(ctx context.Context, event MyEvent) (Response, error) {
 
 		existingClimateControls, err := climateControlRepository.List(ctx)
 		if err != nil {
-			return Response{}, fmt.Errorf("error getting existing climate controls: %s", err.Error())
+			return fmt.Errorf("error getting existing climate controls: %s", err.Error())
 		}
+		propertyRepository := property.NewRepository()
 		for _, ecc := range existingClimateControls {
 			u := units[ecc.GetFriendlyNamePrefix()]
-			os := u.OccupancyStatusForDay(devices, now)
+
+			var p *shared.Property
+			if prop, ok, err := propertyRepository.GetCached(ctx, u.PropertyID); err != nil {
+				return fmt.Errorf("error getting property: %s", err.Error())
+			} else if ok {
+				p = &prop
+			}
+
+			os := u.OccupancyStatusForDay(devices, now, u.GetReservationBuffers(p))
 
 			if ecc.DesiredState.WasSuccessfulAt == nil && now.Before(ecc.DesiredState.AbandonAfter) && !ecc.DesiredState.SyncWithSettings {
 				// There's a non-syncing setting in place, don't make a change.
@@ -168,7 +179,7 @@ func HandleRequest(ctx context.Context, event MyEvent) (Response, error) {
 		// Pull in the new controls since we just added/updated them.
 		existingClimateControls, err = climateControlRepository.List(ctx)
 		if err != nil {
-			return Response{}, fmt.Errorf("error getting existing climate controls: %s", err.Error())
+			return fmt.Errorf("error getting existing climate controls: %s", err.Error())
 		}
 		attemptedToUpdateAClimateControl := false
 		for _, ecc := range existingClimateControls {
@@ -192,7 +203,7 @@ func HandleRequest(ctx context.Context, event MyEvent) (Response, error) {
 					ecc.DesiredState.Temperature,
 				),
 			); err != nil {
-				return Response{}, fmt.Errorf("error appending to audit log: %s", err.Error())
+				return fmt.Errorf("error appending to audit log: %s", err.Error())
 			}
 
 			setDesiredStateCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
@@ -206,7 +217,7 @@ func HandleRequest(ctx context.Context, event MyEvent) (Response, error) {
 						err.Error(),
 					),
 				); err != nil {
-					return Response{}, fmt.Errorf("error appending to audit log: %s", err.Error())
+					return fmt.Errorf("error appending to audit log: %s", err.Error())
 				}
 			}
 			attemptedToUpdateAClimateControl = true
@@ -214,14 +225,12 @@ func HandleRequest(ctx context.Context, event MyEvent) (Response, error) {
 
 		if attemptedToUpdateAClimateControl {
 			if err := refreshClimateControls(ctx, climateControlRepository, haRepository); err != nil {
-				return Response{}, fmt.Errorf("error refreshing climate controls: %s", err.Error())
+				return fmt.Errorf("error refreshing climate controls: %s", err.Error())
 			}
 		}
 	}
 
-	return Response{
-		Message: "ok",
-	}, nil
+	return nil
 }
 
 func refreshClimateControls(
@@ -2,123 +2,291 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"mlock/lambdas/shared"
+	"mlock/lambdas/shared/codegenerator"
 	"mlock/lambdas/shared/dynamo/device"
+	"mlock/lambdas/shared/dynamo/property"
+	"mlock/lambdas/shared/dynamo/synccursor"
 	"mlock/lambdas/shared/dynamo/unit"
 	"mlock/lambdas/shared/ezlo"
+	"mlock/lambdas/shared/guestmessenger"
 	"mlock/lambdas/shared/hostaway"
+	"mlock/lambdas/shared/ical"
 	"mlock/lambdas/shared/lockengine"
+	"mlock/lambdas/shared/reservationprovider"
 	"mlock/lambdas/shared/scheduler"
 	"mlock/lambdas/shared/ses"
+	"mlock/lambdas/shared/sqs"
 	mshared "mlock/shared"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/google/uuid"
 )
 
-type MyEvent struct {
+// DeviceRepository is what keeping the devices up to date needs from the repository.
+type DeviceRepository interface {
+	AppendToAuditLog(ctx context.Context, device shared.Device, managedLockCodes []*shared.DeviceManagedLockCode) error
+	Get(ctx context.Context, id uuid.UUID) (shared.Device, bool, error)
+	List(ctx context.Context) ([]shared.Device, error)
+	PutIfUnchanged(ctx context.Context, item shared.Device) (shared.Device, error)
 }
 
-type Response struct {
-	Message string `json:"message"`
+type EmailService interface {
+	SendEmailToAdmins(ctx context.Context, subject string, body string) error
+	SendEmailToDevelopers(ctx context.Context, subject string, body string) error
+}
+
+// poller is everything a run needs, set up once for all of the batch's jobs.
+type poller struct {
+	deviceController      *ezlo.DeviceController
+	deviceRepository      *device.Repository
+	emailService          *ses.EmailService
+	eventSink             shared.LogEventSink
+	fed                   string
+	hostawayRepository    *hostaway.Repository
+	propertyRepository    *property.Repository
+	reservationRepository *reservationprovider.Repository
+	syncCursorRepository  *synccursor.Repository
+	tz                    *time.Location
+	unitRepository        *unit.Repository
 }
 
 func main() {
 	lambda.Start(HandleRequest)
 }
 
-func HandleRequest(ctx context.Context, event MyEvent) (Response, error) {
+// HandleRequest runs each job in the batch on its own, only the ones that fail are retried.
+func HandleRequest(ctx context.Context, event events.SQSEvent) (sqs.BatchResponse, error) {
 	ctx = shared.CreateContextData(ctx)
 
-	log.Printf("starting poll\n")
-
 	if err := mshared.LoadConfig(); err != nil {
-		return Response{}, fmt.Errorf("error loading config: %s", err.Error())
+		return sqs.BatchResponse{}, fmt.Errorf("error loading config: %s", err.Error())
 	}
 
 	emailService, err := ses.NewEmailService(ctx)
 	if err != nil {
-		return Response{}, fmt.Errorf("error getting email service: %s", err.Error())
+		return sqs.BatchResponse{}, fmt.Errorf("error getting email service: %s", err.Error())
 	}
 
 	tzName, err := mshared.GetConfig("TIME_ZONE")
 	if err != nil {
-		return Response{}, fmt.Errorf("error getting time zone name: %s", err.Error())
+		return sqs.BatchResponse{}, fmt.Errorf("error getting time zone name: %s", err.Error())
 	}
 
 	tz, err := time.LoadLocation(tzName)
 	if err != nil {
-		return Response{}, fmt.Errorf("error getting time zone %s", err.Error())
+		return sqs.BatchResponse{}, fmt.Errorf("error getting time zone %s", err.Error())
+	}
+
+	fed, err := mshared.GetConfig("FRONTEND_DOMAIN")
+	if err != nil {
+		return sqs.BatchResponse{}, fmt.Errorf("error getting front end domain: %s", err.Error())
 	}
 
-	connectionPool := ezlo.NewConnectionPool()
+	localHubs, err := ezlo.GetLocalHubs()
+	if err != nil {
+		return sqs.BatchResponse{}, fmt.Errorf("error getting local hubs: %s", err.Error())
+	}
+
+	connectionPool := ezlo.NewConnectionPool().WithLocalHubs(localHubs)
 	defer connectionPool.Close()
 
-	deviceController := ezlo.NewDeviceController(connectionPool)
 	deviceRepository := device.NewRepository()
-	hostawayReservationRepository := hostaway.NewRepository(tz, "")
-	unitRepository := unit.NewRepository()
+	codeGenerator := codegenerator.NewCodeGenerator(deviceRepository, codegenerator.DefaultConfig)
+	hostawayRepository := hostaway.NewRepository(tz, "").WithCodeGenerator(codeGenerator)
+	p := &poller{
+		deviceController:   ezlo.NewDeviceController(connectionPool),
+		deviceRepository:   deviceRepository,
+		emailService:       emailService,
+		eventSink:          shared.LogEventSink{},
+		fed:                fed,
+		hostawayRepository: hostawayRepository,
+		propertyRepository: property.NewRepository(),
+		reservationRepository: reservationprovider.NewRepository(
+			hostawayRepository,
+			ical.NewRepository(tz, codeGenerator),
+		),
+		syncCursorRepository: synccursor.NewRepository(),
+		tz:                   tz,
+		unitRepository:       unit.NewRepository(),
+	}
+
+	return sqs.ProcessJobs(ctx, event, sqs.JobKindPollSchedules, p.poll)
+}
 
-	if err := updateDevicesFromController(
-		ctx,
-		emailService,
-		deviceController,
-		deviceRepository,
-	); err != nil {
-		return Response{}, fmt.Errorf("error updating devices from controller: %s", err.Error())
+// poll is a full run unless the job is for a unit or device (e.g. a webhook or someone editing a lock code), then it only reconciles those.
+func (p *poller) poll(ctx context.Context, job sqs.Job) error {
+	targeted := job.UnitID != nil || job.DeviceID != nil
+
+	// The periodic full poll keeps the devices' status up to date, a targeted run only talks to the controllers when it changes a code.
+	if !targeted {
+		if err := updateDevicesFromController(
+			ctx,
+			p.emailService,
+			p.deviceController,
+			p.deviceRepository,
+		); err != nil {
+			return fmt.Errorf("error updating devices from controller: %s", err.Error())
+		}
 	}
 
-	// Get the latest data from the reservations and save it to the devices.
-	if err := scheduler.NewScheduler(
-		deviceRepository,
+	// Problems with individual devices are collected here so that they don't stop the rest of the devices from being processed.
+	report := shared.NewRunReport(time.Now())
+
+	// Get the latest data from the reservations and save it to the devices. Most runs only fetch the units whose reservations changed.
+	s := scheduler.NewScheduler(
+		p.deviceRepository,
+		p.eventSink,
 		time.Now(),
-		hostawayReservationRepository,
-		unitRepository,
-	).ReconcileReservationsAndLockCodes(ctx); err != nil {
-		return Response{}, fmt.Errorf("error scheduling: %s", err.Error())
+		p.propertyRepository,
+		p.reservationRepository,
+		p.unitRepository,
+	).WithIncrementalSync(p.syncCursorRepository)
+	// Process and save any device changes to the controller.
+	le := lockengine.NewLockEngine(
+		p.deviceController,
+		p.deviceRepository,
+		p.emailService,
+		p.eventSink,
+		p.fed,
+		p.propertyRepository,
+		p.tz,
+		p.unitRepository,
+	)
+	if job.UnitID != nil {
+		s = s.WithUnits([]uuid.UUID{*job.UnitID})
+		le = le.WithUnits([]uuid.UUID{*job.UnitID})
+	}
+	if job.DeviceID != nil {
+		s = s.WithDevices([]uuid.UUID{*job.DeviceID})
+		le = le.WithDevices([]uuid.UUID{*job.DeviceID})
 	}
 
-	fed, err := mshared.GetConfig("FRONTEND_DOMAIN")
-	if err != nil {
-		return Response{}, fmt.Errorf("error getting front end domain: %s", err.Error())
+	if err := s.ReconcileReservationsAndLockCodes(ctx, report); err != nil {
+		return fmt.Errorf("error scheduling: %s", err.Error())
+	}
+	if err := le.UpdateLocks(ctx, report); err != nil {
+		return fmt.Errorf("error updating lock codes: %s", err.Error())
 	}
 
-	// Process and save any device changes to the controller.
-	if err := lockengine.NewLockEngine(
-		deviceController,
-		deviceRepository,
-		emailService,
-		fed,
-		tz,
-	).UpdateLocks(ctx); err != nil {
-		return Response{}, fmt.Errorf("error updating lock codes: %s", err.Error())
+	if targeted {
+		return p.finishRun(ctx, job, report)
+	}
+
+	// Let the guests know their codes once they're on the locks.
+	if err := guestmessenger.NewGuestMessenger(
+		p.deviceRepository,
+		p.hostawayRepository,
+		p.propertyRepository,
+		p.tz,
+		p.unitRepository,
+	).SendMessages(ctx, report); err != nil {
+		return fmt.Errorf("error sending guest messages: %s", err.Error())
+	}
+
+	// Let us know about devices that are about to run out of slots for lock codes.
+	if err := forecastCapacity(
+		ctx,
+		p.deviceRepository,
+		p.emailService,
+		p.fed,
+	); err != nil {
+		return fmt.Errorf("error forecasting capacity: %s", err.Error())
 	}
 
 	// Reboot any controllers for devices that might benefit from doing so.
 	if err := rebootUnresponsiveDevices(
 		ctx,
-		deviceController,
-		deviceRepository,
-		emailService,
+		p.deviceController,
+		p.deviceRepository,
+		p.emailService,
+		p.eventSink,
 	); err != nil {
-		return Response{}, fmt.Errorf("error rediscovering unresponsive devices: %s", err.Error())
+		return fmt.Errorf("error rediscovering unresponsive devices: %s", err.Error())
+	}
+
+	return p.finishRun(ctx, job, report)
+}
+
+func (p *poller) finishRun(ctx context.Context, job sqs.Job, report *shared.RunReport) error {
+	if report.HasErrors() || report.HasWarnings() {
+		subject := fmt.Sprintf("zcclock - Poll Schedules Run Report (%s)", job.Key())
+		if err := p.emailService.SendEmailToDevelopers(ctx, subject, report.HTML(p.fed)); err != nil {
+			log.Printf("error sending run report: %s\n", err.Error())
+		}
+	}
+	if err := report.Err(); err != nil {
+		return fmt.Errorf("error processing devices: %s", err.Error())
 	}
 
-	return Response{
-		Message: "ok",
-	}, nil
+	return nil
+}
+
+func forecastCapacity(
+	ctx context.Context,
+	deviceRepository DeviceRepository,
+	emailService EmailService,
+	fed string,
+) error {
+	devices, err := deviceRepository.List(ctx)
+	if err != nil {
+		return fmt.Errorf("error listing devices: %s", err.Error())
+	}
+
+	now := time.Now()
+	warnBefore := now.Add(shared.DeviceCapacityWarningWindow)
+
+	runningOutDevices := []shared.Device{}
+	for _, d := range devices {
+		forecast := d.ForecastCapacity(now)
+
+		wasWarned := d.CapacityExhaustedAt != nil && d.CapacityExhaustedAt.Before(warnBefore)
+		shouldWarn := forecast != nil && forecast.Before(warnBefore)
+
+		// When the device is already full the forecast is "now", which would otherwise change every time we run.
+		changed := (forecast == nil) != (d.CapacityExhaustedAt == nil)
+		if forecast != nil && d.CapacityExhaustedAt != nil {
+			alreadyFull := !forecast.After(now) && !d.CapacityExhaustedAt.After(now)
+			changed = !alreadyFull && !forecast.Equal(*d.CapacityExhaustedAt)
+		}
+		if !changed {
+			continue
+		}
+
+		d.CapacityExhaustedAt = forecast
+		if shouldWarn && !wasWarned {
+			runningOutDevices = append(runningOutDevices, d)
+		}
+
+		if _, err := shared.SaveDevice(ctx, deviceRepository, d, func(fresh *shared.Device) (bool, error) {
+			fresh.CapacityExhaustedAt = fresh.ForecastCapacity(now)
+			return true, nil
+		}); err != nil && !errors.Is(err, shared.ErrDeviceDeleted) {
+			return fmt.Errorf("error saving device %s: %s", d.RawDevice.Name, err.Error())
+		}
+	}
+
+	if err := sendCapacityEmail(ctx, emailService, fed, runningOutDevices); err != nil {
+		return fmt.Errorf("error sending capacity email: %s", err.Error())
+	}
+
+	return nil
 }
 
 func rebootUnresponsiveDevices(
 	ctx context.Context,
 	deviceController *ezlo.DeviceController,
-	deviceRepository *device.Repository,
-	emailService *ses.EmailService,
+	deviceRepository DeviceRepository,
+	emailService EmailService,
+	eventSink shared.LogEventSink,
 ) error {
 	devices, err := deviceRepository.List(ctx)
 	if err != nil {
@@ -159,7 +327,13 @@ func rebootUnresponsiveDevices(
 
 		now := time.Now()
 		d.LastRebootedControllerAt = &now
-		d, err := deviceRepository.Put(ctx, d)
+		d, err := shared.SaveDevice(ctx, deviceRepository, d, func(fresh *shared.Device) (bool, error) {
+			fresh.LastRebootedControllerAt = &now
+			return true, nil
+		})
+		if errors.Is(err, shared.ErrDeviceDeleted) {
+			continue
+		}
 		if err != nil {
 			return fmt.Errorf("error saving device %s: %s", d.RawDevice.Name, err.Error())
 		}
@@ -169,6 +343,13 @@ func rebootUnresponsiveDevices(
 			return fmt.Errorf("error appending to audit log: %s", err.Error())
 		}
 
+		event := shared.NewDeviceEvent(shared.EventTypeControllerRebooted, now, d)
+		event.Code = shouldRebootFor.Code
+		event.Note = shouldRebootFor.Note
+		if err := eventSink.Emit(ctx, event); err != nil {
+			log.Printf("error emitting event for %s: %s\n", d.RawDevice.Name, err.Error())
+		}
+
 		emailService.SendEmailToDevelopers(
 			ctx,
 			"Rebooting Controller",
@@ -181,9 +362,9 @@ func rebootUnresponsiveDevices(
 
 func updateDevicesFromController(
 	ctx context.Context,
-	emailService *ses.EmailService,
+	emailService EmailService,
 	deviceController *ezlo.DeviceController,
-	deviceRepository *device.Repository,
+	deviceRepository DeviceRepository,
 ) error {
 	devices, err := deviceRepository.List(ctx)
 	if err != nil {
@@ -195,19 +376,26 @@ func updateDevicesFromController(
 	transitioningToLowBatteryDevices := []shared.Device{}
 	lowBatteryDevices := []shared.Device{}
 
-	online, offline, err := ezlo.GetControllers(ctx)
+	online, offline, err := deviceController.GetControllers(ctx)
 	if err != nil {
 		return fmt.Errorf("error getting controllers: %s", err.Error())
 	}
 
+	// Each controller gets its own worker, the work for a single controller stays on that worker since it shares a websocket.
+	var mu sync.Mutex
+
+	onlineIDs := []string{}
 	for _, c := range online {
+		onlineIDs = append(onlineIDs, c.PKDevice)
+	}
+	shared.RunPerKey(onlineIDs, shared.DefaultMaxControllerWorkers, func(controllerID string) {
 		ctxUpdateDevices, cancel := context.WithTimeout(ctx, 40*time.Second)
 		defer cancel()
 
 		tTODevices, oDevices, tTLDevices, lDevices, err := updateOnlineDevicesFromController(
 			ctxUpdateDevices,
 			emailService,
-			c.PKDevice,
+			controllerID,
 			deviceController,
 			deviceRepository,
 			devices,
@@ -215,33 +403,40 @@ func updateDevicesFromController(
 		if err != nil {
 			if strings.Contains(err.Error(), "cloud.error.controller_not_connected") {
 				// We get a ton of these when we're swapping out controllers. This should be temporary (but we know how that goes)...
-				continue
+				return
 			}
 			fmt.Printf("error updating devices from controller: %s\n", err.Error())
 			/*
 				if err2 := emailService.SendEmailToDevelopers(
 					ctx,
 					"zcclock - Error updating devices from controller.",
-					fmt.Sprintf("Controller ID: %s; error: %s", c.PKDevice, err.Error()),
+					fmt.Sprintf("Controller ID: %s; error: %s", controllerID, err.Error()),
 				); err2 != nil {
-					return fmt.Errorf("error sending error email for updating devices for controller: %s, error: %s", c.PKDevice, err.Error())
+					return fmt.Errorf("error sending error email for updating devices for controller: %s, error: %s", controllerID, err.Error())
 				}
 			*/
 		}
+
+		mu.Lock()
+		defer mu.Unlock()
 		transitioningToOfflineDevices = append(transitioningToOfflineDevices, tTODevices...)
 		offlineDevices = append(offlineDevices, oDevices...)
 		transitioningToLowBatteryDevices = append(transitioningToLowBatteryDevices, tTLDevices...)
 		lowBatteryDevices = append(lowBatteryDevices, lDevices...)
-	}
+	})
 
+	offlineIDs := []string{}
 	for _, c := range offline {
+		offlineIDs = append(offlineIDs, c.PKDevice)
+	}
+	shared.RunPerKey(offlineIDs, shared.DefaultMaxControllerWorkers, func(controllerID string) {
 		ctxUpdateDevices, cancel := context.WithTimeout(ctx, 40*time.Second)
 		defer cancel()
 
 		tTODevices, oDevices, err := updateOfflineDevicesFromController(
 			ctxUpdateDevices,
 			emailService,
-			c.PKDevice,
+			controllerID,
 			deviceRepository,
 			devices,
 		)
@@ -251,15 +446,18 @@ func updateDevicesFromController(
 				if err2 := emailService.SendEmailToDevelopers(
 					ctx,
 					"zcclock - Error updating devices from controller.",
-					fmt.Sprintf("Controller ID: %s; error: %s", c.PKDevice, err.Error()),
+					fmt.Sprintf("Controller ID: %s; error: %s", controllerID, err.Error()),
 				); err2 != nil {
-					return fmt.Errorf("error sending error email for updating devices for controller: %s, error: %s", c.PKDevice, err.Error())
+					return fmt.Errorf("error sending error email for updating devices for controller: %s, error: %s", controllerID, err.Error())
 				}
 			*/
 		}
+
+		mu.Lock()
+		defer mu.Unlock()
 		transitioningToOfflineDevices = append(transitioningToOfflineDevices, tTODevices...)
 		offlineDevices = append(offlineDevices, oDevices...)
-	}
+	})
 
 	if err := sendOfflineDeviceEmail(ctx, emailService, transitioningToOfflineDevices, offlineDevices); err != nil {
 		return fmt.Errorf("error sending offline device email: %s", err.Error())
@@ -273,9 +471,9 @@ func updateDevicesFromController(
 
 func updateOfflineDevicesFromController(
 	ctx context.Context,
-	emailService *ses.EmailService,
+	emailService EmailService,
 	controllerID string,
-	deviceRepository *device.Repository,
+	deviceRepository DeviceRepository,
 	devices []shared.Device,
 ) (
 	[]shared.Device,
@@ -292,29 +490,29 @@ func updateOfflineDevicesFromController(
 
 		wasOffline := ed.RawDevice.Status == shared.DeviceStatusOffline
 
-		offlineDevices = append(offlineDevices, ed)
-		if !wasOffline {
-			now := time.Now()
-			ed.LastWentOfflineAt = &now
-			transitioningToOfflineDevices = append(transitioningToOfflineDevices, ed)
-		}
+		now := time.Now()
+		markOffline := func(d *shared.Device) (bool, error) {
+			if d.RawDevice.Status != shared.DeviceStatusOffline {
+				d.LastWentOfflineAt = &now
+			}
 
-		ed.RawDevice.Status = shared.DeviceStatusOffline
+			d.RawDevice.Status = shared.DeviceStatusOffline
 
-		maxHistoryCount := 1
-		historyStartIndex := len(ed.History) - maxHistoryCount
-		if historyStartIndex > 0 {
-			ed.History = ed.History[historyStartIndex:]
+			maxHistoryCount := 1
+			historyStartIndex := len(d.History) - maxHistoryCount
+			if historyStartIndex > 0 {
+				d.History = d.History[historyStartIndex:]
+			}
+			return true, nil
 		}
-		if ed.RawDevice.Status != shared.DeviceStatusOffline {
-			ed.History = append(ed.History, shared.DeviceHistory{
-				Description: "Status Changed",
-				RawDevice:   ed.RawDevice,
-				RecordedAt:  time.Now(),
-			})
+
+		offlineDevices = append(offlineDevices, ed)
+		markOffline(&ed)
+		if !wasOffline {
+			transitioningToOfflineDevices = append(transitioningToOfflineDevices, ed)
 		}
 
-		if _, err := deviceRepository.Put(ctx, ed); err != nil {
+		if _, err := shared.SaveDevice(ctx, deviceRepository, ed, markOffline); err != nil && !errors.Is(err, shared.ErrDeviceDeleted) {
 			return transitioningToOfflineDevices, offlineDevices, fmt.Errorf("error putting device: %s", err.Error())
 		}
 	}
@@ -324,10 +522,10 @@ func updateOfflineDevicesFromController(
 
 func updateOnlineDevicesFromController(
 	ctx context.Context,
-	emailService *ses.EmailService,
+	emailService EmailService,
 	controllerID string,
 	deviceController *ezlo.DeviceController,
-	deviceRepository *device.Repository,
+	deviceRepository DeviceRepository,
 	eds []shared.Device,
 ) (
 	[]shared.Device,
@@ -373,9 +571,8 @@ func updateOnlineDevicesFromController(
 			}
 		}
 
-		d.ControllerID = controllerID
 		eULCs := d.GenerateUnmanagedLockCodes()
-		d.RawDevice = rd
+		refreshFromController(&d, controllerID, rd)
 		uLCs := d.GenerateUnmanagedLockCodes()
 		if len(eULCs) < len(uLCs) {
 			emailService.SendEmailToDevelopers(
@@ -384,9 +581,13 @@ func updateOnlineDevicesFromController(
 				fmt.Sprintf("Device: %s", d.RawDevice.Name),
 			)
 		}
-		d.LastRefreshedAt = time.Now()
 
-		if _, err := deviceRepository.Put(ctx, d); err != nil {
+		// The listener may have saved the device while we were talking to the controller, what we found is applied to its version.
+		if _, err := shared.SaveDevice(ctx, deviceRepository, d, func(fresh *shared.Device) (bool, error) {
+			*fresh, _, _, _, _ = updateDeviceWithRawData(*fresh, rd)
+			refreshFromController(fresh, controllerID, rd)
+			return true, nil
+		}); err != nil && !errors.Is(err, shared.ErrDeviceDeleted) {
 			return transitioningToOfflineDevices, offlineDevices, transitioningToLowBatteryDevices, lowBatteryDevices, fmt.Errorf("error putting device: %s", err.Error())
 		}
 	}
@@ -410,11 +611,11 @@ func updateOnlineDevicesFromController(
 		if ed.RawDevice.Status == shared.DeviceStatusOffline {
 			offlineDevices = append(offlineDevices, ed)
 		} else {
-			rd := ed.RawDevice
-			rd.Status = shared.DeviceStatusOffline // Fake an offline status.
-			d, tTOD, oDs, tTLDevices, lDevices := updateDeviceWithRawData(ed, rd)
-			d.RawDevice = rd
-			if _, err := deviceRepository.Put(ctx, d); err != nil {
+			d, tTOD, oDs, tTLDevices, lDevices := fakeOffline(ed)
+			if _, err := shared.SaveDevice(ctx, deviceRepository, d, func(fresh *shared.Device) (bool, error) {
+				*fresh, _, _, _, _ = fakeOffline(*fresh)
+				return true, nil
+			}); err != nil && !errors.Is(err, shared.ErrDeviceDeleted) {
 				return transitioningToOfflineDevices, offlineDevices, transitioningToLowBatteryDevices, lowBatteryDevices, fmt.Errorf("error putting device: %s", err.Error())
 			}
 			transitioningToOfflineDevices = append(transitioningToOfflineDevices, tTOD...)
@@ -427,6 +628,29 @@ func updateOnlineDevicesFromController(
 	return transitioningToOfflineDevices, offlineDevices, transitioningToLowBatteryDevices, lowBatteryDevices, nil
 }
 
+// refreshFromController records what the controller told us about the device.
+func refreshFromController(d *shared.Device, controllerID string, rd shared.RawDevice) {
+	d.ControllerID = controllerID
+	d.RawDevice = rd
+	d.TrackUnmanagedLockCodes(time.Now())
+	d.LastRefreshedAt = time.Now()
+}
+
+// fakeOffline is for devices that are no longer on their controller, we treat them as offline.
+func fakeOffline(d shared.Device) (
+	shared.Device,
+	[]shared.Device,
+	[]shared.Device,
+	[]shared.Device,
+	[]shared.Device,
+) {
+	rd := d.RawDevice
+	rd.Status = shared.DeviceStatusOffline
+	d, tTOD, oDs, tTLDevices, lDevices := updateDeviceWithRawData(d, rd)
+	d.RawDevice = rd
+	return d, tTOD, oDs, tTLDevices, lDevices
+}
+
 func updateDeviceWithRawData(d shared.Device, rd shared.RawDevice) (
 	shared.Device,
 	[]shared.Device,
@@ -445,9 +669,8 @@ func updateDeviceWithRawData(d shared.Device, rd shared.RawDevice) (
 	wasLowBattery := false
 	isLowBattery := false
 	if d.RawDevice.Battery.BatteryPowered {
-		lowBatteryLevel := 89
-		wasLowBattery = d.RawDevice.Battery.Level <= lowBatteryLevel
-		isLowBattery = rd.Battery.Level <= lowBatteryLevel
+		wasLowBattery = d.RawDevice.Battery.Level <= shared.DeviceLowBatteryLevel
+		isLowBattery = rd.Battery.Level <= shared.DeviceLowBatteryLevel
 	}
 
 	if wasOffline && !isOffline {
@@ -489,7 +712,7 @@ func updateDeviceWithRawData(d shared.Device, rd shared.RawDevice) (
 	return d, transitioningToOfflineDevices, offlineDevices, transitioningToLowBatteryDevices, lowBatteryDevices
 }
 
-func sendOfflineDeviceEmail(ctx context.Context, emailService *ses.EmailService, transitioningToOfflineDevices []shared.Device, offlineDevices []shared.Device) error {
+func sendOfflineDeviceEmail(ctx context.Context, emailService EmailService, transitioningToOfflineDevices []shared.Device, offlineDevices []shared.Device) error {
 	if len(transitioningToOfflineDevices) == 0 {
 		return nil
 	}
@@ -517,9 +740,44 @@ func sendOfflineDeviceEmail(ctx context.Context, emailService *ses.EmailService,
 	return nil
 }
 
+func sendCapacityEmail(ctx context.Context, emailService EmailService, fed string, runningOutDevices []shared.Device) error {
+	if len(runningOutDevices) == 0 {
+		return nil
+	}
+
+	sort.Slice(runningOutDevices, func(i, j int) bool {
+		return runningOutDevices[i].CapacityExhaustedAt.Before(*runningOutDevices[j].CapacityExhaustedAt)
+	})
+
+	var sb strings.Builder
+
+	sb.WriteString("<h1>Devices That Will Run Out of Lock Code Slots</h1>")
+	sb.WriteString("<ul>")
+	for _, d := range runningOutDevices {
+		usage := d.SlotUsage()
+		sb.WriteString(fmt.Sprintf(
+			"<li>Device: <a href=\"%s/devices/%s\">%s</a>, Runs Out At: %s, Slots: %d managed, %d unmanaged, %d free</li>",
+			fed,
+			d.ID,
+			d.RawDevice.Name,
+			d.CapacityExhaustedAt.Format(time.RFC1123),
+			usage.Managed,
+			usage.Unmanaged,
+			usage.Free,
+		))
+	}
+	sb.WriteString("</ul>")
+
+	if err := emailService.SendEmailToAdmins(ctx, "zcclock - Devices Running Out of Lock Code Slots", sb.String()); err != nil {
+		return fmt.Errorf("error sending email: %s", err.Error())
+	}
+
+	return nil
+}
+
 func sendLowBatteryDeviceEmail(
 	ctx context.Context,
-	emailService *ses.EmailService,
+	emailService EmailService,
 	transitioningToLowBatteryDevices []shared.Device,
 	lowBatteryDevices []shared.Device,
 ) error {
@@ -0,0 +1,172 @@
+package main
+
+//go:generate mockgen -source=main.go -destination mocks/mock_main/main.go
+
+import (
+	"context"
+	"mlock/lambdas/jobs/pollschedules/mocks/mock_main"
+	"mlock/lambdas/shared"
+	"mlock/lambdas/shared/ezlo"
+	"mlock/lambdas/shared/ezlo/ezlotest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+func Test_updateDevicesFromController(t *testing.T) {
+	s := ezlotest.NewServer(t)
+	s.AddController("online").AddLock("lock", "Front Door", 80, "1111")
+	s.AddController("offline").SetOnline(false)
+
+	ctrl := gomock.NewController(t)
+	dr := mock_main.NewMockDeviceRepository(ctrl)
+	es := mock_main.NewMockEmailService(ctrl)
+
+	lock := newDevice("online", "lock", "Front Door")
+	lock.RawDevice.LockCodes = []shared.RawDeviceLockCode{{Code: "1111", Mode: "enabled", Name: "1111", Slot: 1}}
+	gone := newDevice("online", "gone", "Garage")
+	unreachable := newDevice("offline", "other", "Back Door")
+	dr.EXPECT().List(gomock.Any()).Return([]shared.Device{lock, gone, unreachable}, nil)
+
+	// The controllers are worked on at the same time.
+	var mu sync.Mutex
+	put := map[string]shared.Device{}
+	dr.EXPECT().PutIfUnchanged(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, d shared.Device) (shared.Device, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		put[d.RawDevice.ID] = d
+		return d, nil
+	}).Times(3)
+
+	es.EXPECT().SendEmailToAdmins(gomock.Any(), "zcclock - Devices That Recently Went Offline", gomock.Any()).DoAndReturn(func(ctx context.Context, subject string, body string) error {
+		assert.Contains(t, body, "Garage")
+		assert.Contains(t, body, "Back Door")
+		assert.NotContains(t, body, "Front Door")
+		return nil
+	})
+	es.EXPECT().SendEmailToAdmins(gomock.Any(), "zcclock - Devices That Recently Changed to Low Battery Levels", gomock.Any()).DoAndReturn(func(ctx context.Context, subject string, body string) error {
+		assert.Contains(t, body, "Front Door")
+		return nil
+	})
+
+	err := updateDevicesFromController(context.Background(), es, newDeviceController(t, s), dr)
+	assert.Nil(t, err)
+
+	assert.Equal(t, lock.ID, put["lock"].ID)
+	assert.Equal(t, shared.DeviceStatusOnline, put["lock"].RawDevice.Status)
+	assert.Equal(t, 80, put["lock"].RawDevice.Battery.Level)
+	assert.Equal(t, lock.RawDevice.LockCodes, put["lock"].RawDevice.LockCodes)
+	assert.Equal(t, shared.DeviceStatusOffline, put["gone"].RawDevice.Status)
+	assert.Equal(t, shared.DeviceStatusOffline, put["other"].RawDevice.Status)
+}
+
+func Test_updateDevicesFromControllerKeepsGoingWhenAControllerFails(t *testing.T) {
+	s := ezlotest.NewServer(t)
+	s.AddController("online").AddLock("lock", "Front Door", 100)
+
+	ctrl := gomock.NewController(t)
+	dr := mock_main.NewMockDeviceRepository(ctrl)
+	es := mock_main.NewMockEmailService(ctrl)
+
+	dr.EXPECT().List(gomock.Any()).Return([]shared.Device{newDevice("online", "lock", "Front Door")}, nil)
+
+	// The hub says no, so the devices are left as they were and nobody is emailed.
+	s.FailNext("hub.devices.list", ezlotest.Failure{Error: "busy"})
+
+	err := updateDevicesFromController(context.Background(), es, newDeviceController(t, s), dr)
+	assert.Nil(t, err)
+}
+
+func Test_updateDevicesFromControllerKeepsChangesMadeMeanwhile(t *testing.T) {
+	s := ezlotest.NewServer(t)
+	s.AddController("online").AddLock("lock", "Front Door", 80)
+
+	ctrl := gomock.NewController(t)
+	dr := mock_main.NewMockDeviceRepository(ctrl)
+	es := mock_main.NewMockEmailService(ctrl)
+
+	lock := newDevice("online", "lock", "Front Door")
+	dr.EXPECT().List(gomock.Any()).Return([]shared.Device{lock}, nil)
+
+	// The lock engine started adding a code while we were talking to the controller.
+	theirs := lock
+	theirs.ManagedLockCodes = []*shared.DeviceManagedLockCode{{Code: "1234", ID: uuid.New(), Status: shared.DeviceManagedLockCodeStatus2Adding}}
+	theirs.Version = 1
+
+	gomock.InOrder(
+		dr.EXPECT().PutIfUnchanged(gomock.Any(), gomock.Any()).Return(shared.Device{}, shared.ErrDeviceChanged),
+		dr.EXPECT().Get(gomock.Any(), lock.ID).Return(theirs, true, nil),
+		dr.EXPECT().PutIfUnchanged(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, d shared.Device) (shared.Device, error) {
+			assert.Equal(t, 1, d.Version)
+			assert.Equal(t, 1, len(d.ManagedLockCodes))
+			assert.Equal(t, 80, d.RawDevice.Battery.Level)
+			return d, nil
+		}),
+	)
+	es.EXPECT().SendEmailToAdmins(gomock.Any(), "zcclock - Devices That Recently Changed to Low Battery Levels", gomock.Any()).Return(nil)
+
+	err := updateDevicesFromController(context.Background(), es, newDeviceController(t, s), dr)
+	assert.Nil(t, err)
+}
+
+func Test_rebootUnresponsiveDevices(t *testing.T) {
+	s := ezlotest.NewServer(t)
+	c := s.AddController("online")
+	c.AddLock("lock", "Front Door", 100)
+
+	ctrl := gomock.NewController(t)
+	dr := mock_main.NewMockDeviceRepository(ctrl)
+	es := mock_main.NewMockEmailService(ctrl)
+
+	startedAddingAt := time.Now().Add(-1 * time.Hour)
+	stuck := newDevice("online", "lock", "Front Door")
+	stuck.ManagedLockCodes = []*shared.DeviceManagedLockCode{{
+		Code:            "1234",
+		ID:              uuid.New(),
+		StartedAddingAt: &startedAddingAt,
+		Status:          shared.DeviceManagedLockCodeStatus2Adding,
+	}}
+	justStarted := newDevice("online", "other", "Back Door")
+	justStarted.ManagedLockCodes = []*shared.DeviceManagedLockCode{{
+		Code:            "5678",
+		ID:              uuid.New(),
+		StartedAddingAt: &startedAddingAt,
+		Status:          shared.DeviceManagedLockCodeStatus2Adding,
+	}}
+	rebootedAt := time.Now().Add(-10 * time.Minute)
+	justStarted.LastRebootedControllerAt = &rebootedAt
+
+	dr.EXPECT().List(gomock.Any()).Return([]shared.Device{stuck, justStarted}, nil)
+	dr.EXPECT().PutIfUnchanged(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, d shared.Device) (shared.Device, error) {
+		assert.Equal(t, stuck.ID, d.ID)
+		assert.NotNil(t, d.LastRebootedControllerAt)
+		return d, nil
+	})
+	dr.EXPECT().AppendToAuditLog(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
+	es.EXPECT().SendEmailToDevelopers(gomock.Any(), "Rebooting Controller", "Rebooting controller for device Front Door").Return(nil)
+
+	err := rebootUnresponsiveDevices(context.Background(), newDeviceController(t, s), dr, es, shared.LogEventSink{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, c.RebootCount())
+}
+
+func newDevice(controllerID string, rawDeviceID string, name string) shared.Device {
+	return shared.Device{
+		ControllerID: controllerID,
+		ID:           uuid.New(),
+		RawDevice: shared.RawDevice{
+			Battery: shared.RawDeviceBattery{BatteryPowered: true, Level: 100},
+			ID:      rawDeviceID,
+			Name:    name,
+			Status:  shared.DeviceStatusOnline,
+		},
+	}
+}
+
+func newDeviceController(t *testing.T, s *ezlotest.Server) *ezlo.DeviceController {
+	return ezlo.NewDeviceController(s.NewConnectionPool(t))
+}
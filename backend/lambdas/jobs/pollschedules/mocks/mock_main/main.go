@@ -0,0 +1,155 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: main.go
+//
+// Generated by this command:
+//
+//	mockgen -source=main.go -destination mocks/mock_main/main.go
+//
+
+// Package mock_main is a generated GoMock package.
+package mock_main
+
+import (
+	context "context"
+	shared "mlock/lambdas/shared"
+	reflect "reflect"
+
+	uuid "github.com/google/uuid"
+	gomock "go.uber.org/mock/gomock"
+)
+
+// MockDeviceRepository is a mock of DeviceRepository interface.
+type MockDeviceRepository struct {
+	ctrl     *gomock.Controller
+	recorder *MockDeviceRepositoryMockRecorder
+	isgomock struct{}
+}
+
+// MockDeviceRepositoryMockRecorder is the mock recorder for MockDeviceRepository.
+type MockDeviceRepositoryMockRecorder struct {
+	mock *MockDeviceRepository
+}
+
+// NewMockDeviceRepository creates a new mock instance.
+func NewMockDeviceRepository(ctrl *gomock.Controller) *MockDeviceRepository {
+	mock := &MockDeviceRepository{ctrl: ctrl}
+	mock.recorder = &MockDeviceRepositoryMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockDeviceRepository) EXPECT() *MockDeviceRepositoryMockRecorder {
+	return m.recorder
+}
+
+// AppendToAuditLog mocks base method.
+func (m *MockDeviceRepository) AppendToAuditLog(ctx context.Context, device shared.Device, managedLockCodes []*shared.DeviceManagedLockCode) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AppendToAuditLog", ctx, device, managedLockCodes)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AppendToAuditLog indicates an expected call of AppendToAuditLog.
+func (mr *MockDeviceRepositoryMockRecorder) AppendToAuditLog(ctx, device, managedLockCodes any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AppendToAuditLog", reflect.TypeOf((*MockDeviceRepository)(nil).AppendToAuditLog), ctx, device, managedLockCodes)
+}
+
+// Get mocks base method.
+func (m *MockDeviceRepository) Get(ctx context.Context, id uuid.UUID) (shared.Device, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Get", ctx, id)
+	ret0, _ := ret[0].(shared.Device)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// Get indicates an expected call of Get.
+func (mr *MockDeviceRepositoryMockRecorder) Get(ctx, id any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockDeviceRepository)(nil).Get), ctx, id)
+}
+
+// List mocks base method.
+func (m *MockDeviceRepository) List(ctx context.Context) ([]shared.Device, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "List", ctx)
+	ret0, _ := ret[0].([]shared.Device)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// List indicates an expected call of List.
+func (mr *MockDeviceRepositoryMockRecorder) List(ctx any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockDeviceRepository)(nil).List), ctx)
+}
+
+// PutIfUnchanged mocks base method.
+func (m *MockDeviceRepository) PutIfUnchanged(ctx context.Context, item shared.Device) (shared.Device, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PutIfUnchanged", ctx, item)
+	ret0, _ := ret[0].(shared.Device)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PutIfUnchanged indicates an expected call of PutIfUnchanged.
+func (mr *MockDeviceRepositoryMockRecorder) PutIfUnchanged(ctx, item any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PutIfUnchanged", reflect.TypeOf((*MockDeviceRepository)(nil).PutIfUnchanged), ctx, item)
+}
+
+// MockEmailService is a mock of EmailService interface.
+type MockEmailService struct {
+	ctrl     *gomock.Controller
+	recorder *MockEmailServiceMockRecorder
+	isgomock struct{}
+}
+
+// MockEmailServiceMockRecorder is the mock recorder for MockEmailService.
+type MockEmailServiceMockRecorder struct {
+	mock *MockEmailService
+}
+
+// NewMockEmailService creates a new mock instance.
+func NewMockEmailService(ctrl *gomock.Controller) *MockEmailService {
+	mock := &MockEmailService{ctrl: ctrl}
+	mock.recorder = &MockEmailServiceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockEmailService) EXPECT() *MockEmailServiceMockRecorder {
+	return m.recorder
+}
+
+// SendEmailToAdmins mocks base method.
+func (m *MockEmailService) SendEmailToAdmins(ctx context.Context, subject, body string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SendEmailToAdmins", ctx, subject, body)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SendEmailToAdmins indicates an expected call of SendEmailToAdmins.
+func (mr *MockEmailServiceMockRecorder) SendEmailToAdmins(ctx, subject, body any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SendEmailToAdmins", reflect.TypeOf((*MockEmailService)(nil).SendEmailToAdmins), ctx, subject, body)
+}
+
+// SendEmailToDevelopers mocks base method.
+func (m *MockEmailService) SendEmailToDevelopers(ctx context.Context, subject, body string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SendEmailToDevelopers", ctx, subject, body)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SendEmailToDevelopers indicates an expected call of SendEmailToDevelopers.
+func (mr *MockEmailServiceMockRecorder) SendEmailToDevelopers(ctx, subject, body any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SendEmailToDevelopers", reflect.TypeOf((*MockEmailService)(nil).SendEmailToDevelopers), ctx, subject, body)
+}
@@ -0,0 +1,14 @@
+package shared
+
+import "time"
+
+// Clock lets things that care about the current time be driven by something other than the wall clock (e.g. a simulation).
+type Clock interface {
+	Now() time.Time
+}
+
+type RealClock struct{}
+
+func (c RealClock) Now() time.Time {
+	return time.Now()
+}
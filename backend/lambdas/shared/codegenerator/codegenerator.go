@@ -0,0 +1,205 @@
+package codegenerator
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"mlock/lambdas/shared"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type DeviceRepository interface {
+	ListForUnit(ctx context.Context, unit shared.Unit) ([]shared.Device, error)
+}
+
+// Config controls what a generated code looks like and what it has to avoid.
+type Config struct {
+	Blocklist          []string       // Codes that are too easy to guess, on top of repeated digits and straight runs.
+	DefaultLength      int            // For lock models that aren't in `LengthByDeviceType`.
+	LengthByDeviceType map[string]int // Keyed by `RawDevice.DeviceTypeID`, some locks only take longer codes.
+	ReuseWindow        time.Duration  // Don't hand out a code that was on the same device this recently. Anything past `shared.ManagedLockCodeRetention` has no effect, the codes are gone by then.
+}
+
+var DefaultConfig = Config{
+	Blocklist: []string{
+		"1004", "1122", "1212", "1313", "2000", "2001", "2020", "2580", "4321", "6969", "7777",
+		"112233", "121212", "123123", "123321", "654321", "696969",
+	},
+	DefaultLength:      4,
+	LengthByDeviceType: map[string]int{},
+	ReuseWindow:        shared.ManagedLockCodeRetention,
+}
+
+// How many random codes we'll try before giving up, a unit would need thousands of codes in play to hit this.
+const maxAttempts = 1000
+
+type CodeGenerator struct {
+	clock               shared.Clock
+	config              Config
+	deviceRepository    DeviceRepository
+	mu                  sync.Mutex
+	issued              map[uuid.UUID][]string // Codes we've handed out that aren't on the devices yet (e.g. two new reservations in the same run).
+	issuedByReservation map[string]string      // So a reservation that comes up twice in a run gets the same code.
+}
+
+func NewCodeGenerator(dr DeviceRepository, config Config) *CodeGenerator {
+	return &CodeGenerator{
+		clock:               shared.RealClock{},
+		config:              config,
+		deviceRepository:    dr,
+		issued:              map[uuid.UUID][]string{},
+		issuedByReservation: map[string]string{},
+	}
+}
+
+func (g *CodeGenerator) WithClock(c shared.Clock) *CodeGenerator {
+	g.clock = c
+	return g
+}
+
+// Generate returns a random code for a reservation in the unit that works on all of its locks.
+func (g *CodeGenerator) Generate(ctx context.Context, unit shared.Unit) (string, error) {
+	devices, err := g.deviceRepository.ListForUnit(ctx, unit)
+	if err != nil {
+		return "", fmt.Errorf("error getting devices: %s", err.Error())
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.generate(unit, devices)
+}
+
+// GenerateForReservation is Generate for providers that can't save the code on the reservation (e.g. iCal feeds). The reservation keeps the code it already has on the unit's devices, so it doesn't change from run to run.
+func (g *CodeGenerator) GenerateForReservation(ctx context.Context, unit shared.Unit, reservationID string) (string, error) {
+	devices, err := g.deviceRepository.ListForUnit(ctx, unit)
+	if err != nil {
+		return "", fmt.Errorf("error getting devices: %s", err.Error())
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if code, ok := g.issuedByReservation[reservationID]; ok {
+		return code, nil
+	}
+	for _, d := range devices {
+		for _, mlc := range d.ManagedLockCodes {
+			if mlc.Reservation.ID == reservationID {
+				return mlc.Code, nil
+			}
+		}
+	}
+
+	code, err := g.generate(unit, devices)
+	if err != nil {
+		return "", err
+	}
+	g.issuedByReservation[reservationID] = code
+	return code, nil
+}
+
+func (g *CodeGenerator) generate(unit shared.Unit, devices []shared.Device) (string, error) {
+	now := g.clock.Now()
+	length := g.length(devices)
+	inUse, recentlyUsed := g.codesToAvoid(unit, devices, now)
+
+	for i := 0; i < maxAttempts; i++ {
+		code, err := randomCode(length)
+		if err != nil {
+			return "", fmt.Errorf("error generating code: %s", err.Error())
+		}
+
+		if g.IsWeak(code) || recentlyUsed[code] || clashes(code, inUse) {
+			continue
+		}
+
+		g.issued[unit.ID] = append(g.issued[unit.ID], code)
+		return code, nil
+	}
+
+	return "", fmt.Errorf("unable to generate a %d digit code for %s after %d attempts", length, unit.Name, maxAttempts)
+}
+
+// IsWeak is true for codes in the blocklist, a single repeated digit (e.g. 0000) or a straight run (e.g. 1234 or 9876).
+func (g *CodeGenerator) IsWeak(code string) bool {
+	for _, c := range g.config.Blocklist {
+		if c == code {
+			return true
+		}
+	}
+
+	repeated, ascending, descending := true, true, true
+	for i := 1; i < len(code); i++ {
+		diff := int(code[i]) - int(code[i-1])
+		repeated = repeated && diff == 0
+		ascending = ascending && (diff == 1 || diff == -9)
+		descending = descending && (diff == -1 || diff == 9)
+	}
+	return repeated || ascending || descending
+}
+
+// length is the longest length any of the unit's locks needs, since the code has to work on all of them.
+func (g *CodeGenerator) length(devices []shared.Device) int {
+	length := 0
+	for _, d := range devices {
+		if l, ok := g.config.LengthByDeviceType[d.RawDevice.DeviceTypeID]; ok && l > length {
+			length = l
+		}
+	}
+	if length == 0 {
+		length = g.config.DefaultLength
+	}
+	return length
+}
+
+// codesToAvoid returns the codes that are (or will be) on the locks, and the ones that were on them within the reuse window.
+func (g *CodeGenerator) codesToAvoid(unit shared.Unit, devices []shared.Device, now time.Time) ([]string, map[string]bool) {
+	inUse := append([]string{}, g.issued[unit.ID]...)
+	recentlyUsed := map[string]bool{}
+
+	for _, d := range devices {
+		for _, c := range d.RawDevice.LockCodes {
+			inUse = append(inUse, c.Code)
+		}
+		for _, rlc := range d.RecurringLockCodes {
+			inUse = append(inUse, rlc.Code)
+		}
+		for _, mlc := range d.ManagedLockCodes {
+			if !mlc.HasEnded(now) {
+				inUse = append(inUse, mlc.Code)
+			} else if mlc.EndAt.After(now.Add(-1 * g.config.ReuseWindow)) {
+				recentlyUsed[mlc.Code] = true
+			}
+		}
+	}
+
+	return inUse, recentlyUsed
+}
+
+// clashes is true if either code is a prefix of the other, some locks open as soon as they see a code they know.
+func clashes(code string, inUse []string) bool {
+	for _, c := range inUse {
+		if c != "" && (strings.HasPrefix(code, c) || strings.HasPrefix(c, code)) {
+			return true
+		}
+	}
+	return false
+}
+
+func randomCode(length int) (string, error) {
+	var b strings.Builder
+	for i := 0; i < length; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(n.String())
+	}
+	return b.String(), nil
+}
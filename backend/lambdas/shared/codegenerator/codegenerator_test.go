@@ -0,0 +1,162 @@
+package codegenerator_test
+
+//go:generate mockgen -source=codegenerator.go -destination mocks/mock_codegenerator/codegenerator.go
+
+import (
+	"context"
+	"fmt"
+	"mlock/lambdas/shared"
+	"mlock/lambdas/shared/codegenerator"
+	"mlock/lambdas/shared/codegenerator/mocks/mock_codegenerator"
+	"mlock/lambdas/shared/simulation"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+func Test_IsWeak(t *testing.T) {
+	g := codegenerator.NewCodeGenerator(nil, codegenerator.DefaultConfig)
+
+	for _, code := range []string{"0000", "1234", "4321", "8901", "2580", "666666", "567890"} {
+		assert.True(t, g.IsWeak(code), code)
+	}
+	for _, code := range []string{"3841", "1235", "902713"} {
+		assert.False(t, g.IsWeak(code), code)
+	}
+}
+
+func Test_LengthByDeviceType(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	dr := mock_codegenerator.NewMockDeviceRepository(ctrl)
+
+	config := codegenerator.DefaultConfig
+	config.LengthByDeviceType = map[string]int{"sixDigits": 6}
+	g := codegenerator.NewCodeGenerator(dr, config)
+
+	unit := shared.Unit{ID: uuid.New()}
+	frontDoor := shared.Device{ID: uuid.New()}
+	garage := shared.Device{ID: uuid.New()}
+	garage.RawDevice.DeviceTypeID = "sixDigits"
+
+	dr.EXPECT().ListForUnit(gomock.Any(), unit).Return([]shared.Device{frontDoor}, nil)
+	code, err := g.Generate(context.Background(), unit)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(code))
+
+	// Both locks have to accept it.
+	dr.EXPECT().ListForUnit(gomock.Any(), unit).Return([]shared.Device{frontDoor, garage}, nil)
+	code, err = g.Generate(context.Background(), unit)
+	assert.Nil(t, err)
+	assert.Equal(t, 6, len(code))
+}
+
+func Test_AvoidsCodesOnTheLock(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	dr := mock_codegenerator.NewMockDeviceRepository(ctrl)
+
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	config := codegenerator.DefaultConfig
+	config.DefaultLength = 2 // Small enough that most codes are taken.
+	g := codegenerator.NewCodeGenerator(dr, config).WithClock(simulation.NewClock(now))
+
+	// Take every 2 digit code except for 38, 56 and 59 using a mix of scheduled codes and codes that ended recently. The single digit code on the lock blocks everything that starts with a 1.
+	d := shared.Device{ID: uuid.New()}
+	d.RawDevice.LockCodes = []shared.RawDeviceLockCode{{Code: "1"}}
+	for i := 0; i < 100; i++ {
+		code := fmt.Sprintf("%02d", i)
+		if code == "38" || code == "56" || code == "59" || strings.HasPrefix(code, "1") {
+			continue
+		}
+		endAt := now.Add(24 * time.Hour)
+		if i%2 == 0 {
+			endAt = now.Add(-24 * time.Hour)
+		}
+		d.ManagedLockCodes = append(d.ManagedLockCodes, &shared.DeviceManagedLockCode{Code: code, EndAt: endAt})
+	}
+
+	unit := shared.Unit{ID: uuid.New()}
+	dr.EXPECT().ListForUnit(gomock.Any(), unit).Return([]shared.Device{d}, nil).AnyTimes()
+
+	// 56 is a straight run, so we should only ever get 38 or 59, and not the same one twice.
+	first, err := g.Generate(context.Background(), unit)
+	assert.Nil(t, err)
+	second, err := g.Generate(context.Background(), unit)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"38", "59"}, []string{first, second})
+
+	_, err = g.Generate(context.Background(), unit)
+	assert.NotNil(t, err)
+}
+
+func Test_ReuseWindowCoversCodesUntilTheyreDeleted(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	dr := mock_codegenerator.NewMockDeviceRepository(ctrl)
+
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	config := codegenerator.DefaultConfig
+	config.DefaultLength = 2
+	g := codegenerator.NewCodeGenerator(dr, config).WithClock(simulation.NewClock(now))
+
+	// Everything but 38 and 59 is scheduled. 38 ended just before the lock engine would delete it.
+	d := shared.Device{ID: uuid.New()}
+	for i := 0; i < 100; i++ {
+		code := fmt.Sprintf("%02d", i)
+		if code == "59" {
+			continue
+		}
+		endAt := now.Add(24 * time.Hour)
+		if code == "38" {
+			endAt = now.Add(-1*shared.ManagedLockCodeRetention + time.Hour)
+		}
+		d.ManagedLockCodes = append(d.ManagedLockCodes, &shared.DeviceManagedLockCode{Code: code, EndAt: endAt})
+	}
+
+	unit := shared.Unit{ID: uuid.New()}
+	dr.EXPECT().ListForUnit(gomock.Any(), unit).DoAndReturn(func(ctx context.Context, unit shared.Unit) ([]shared.Device, error) {
+		return []shared.Device{d}, nil
+	}).Times(2)
+
+	code, err := g.Generate(context.Background(), unit)
+	assert.Nil(t, err)
+	assert.Equal(t, "59", code)
+
+	// Once the lock engine deletes it there's nothing left to avoid (59 was just handed out).
+	remaining := []*shared.DeviceManagedLockCode{}
+	for _, mlc := range d.ManagedLockCodes {
+		if mlc.Code != "38" {
+			remaining = append(remaining, mlc)
+		}
+	}
+	d.ManagedLockCodes = remaining
+	code, err = g.Generate(context.Background(), unit)
+	assert.Nil(t, err)
+	assert.Equal(t, "38", code)
+}
+
+func Test_GenerateForReservationKeepsTheCode(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	dr := mock_codegenerator.NewMockDeviceRepository(ctrl)
+	g := codegenerator.NewCodeGenerator(dr, codegenerator.DefaultConfig)
+
+	unit := shared.Unit{ID: uuid.New()}
+	d := shared.Device{ID: uuid.New()}
+	dr.EXPECT().ListForUnit(gomock.Any(), unit).Return([]shared.Device{d}, nil).Times(2)
+
+	// Nothing's been scheduled yet, the same code comes back if we're asked again.
+	code, err := g.GenerateForReservation(context.Background(), unit, "reservation")
+	assert.Nil(t, err)
+	again, err := g.GenerateForReservation(context.Background(), unit, "reservation")
+	assert.Nil(t, err)
+	assert.Equal(t, code, again)
+
+	// A later run uses the code that's on the device.
+	d.ManagedLockCodes = []*shared.DeviceManagedLockCode{{Code: "3841", Reservation: shared.DeviceManagedLockCodeReservation{ID: "reservation"}}}
+	dr.EXPECT().ListForUnit(gomock.Any(), unit).Return([]shared.Device{d}, nil)
+	code, err = codegenerator.NewCodeGenerator(dr, codegenerator.DefaultConfig).GenerateForReservation(context.Background(), unit, "reservation")
+	assert.Nil(t, err)
+	assert.Equal(t, "3841", code)
+}
@@ -0,0 +1,57 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: codegenerator.go
+//
+// Generated by this command:
+//
+//	mockgen -source=codegenerator.go -destination mocks/mock_codegenerator/codegenerator.go
+//
+
+// Package mock_codegenerator is a generated GoMock package.
+package mock_codegenerator
+
+import (
+	context "context"
+	shared "mlock/lambdas/shared"
+	reflect "reflect"
+
+	gomock "go.uber.org/mock/gomock"
+)
+
+// MockDeviceRepository is a mock of DeviceRepository interface.
+type MockDeviceRepository struct {
+	ctrl     *gomock.Controller
+	recorder *MockDeviceRepositoryMockRecorder
+	isgomock struct{}
+}
+
+// MockDeviceRepositoryMockRecorder is the mock recorder for MockDeviceRepository.
+type MockDeviceRepositoryMockRecorder struct {
+	mock *MockDeviceRepository
+}
+
+// NewMockDeviceRepository creates a new mock instance.
+func NewMockDeviceRepository(ctrl *gomock.Controller) *MockDeviceRepository {
+	mock := &MockDeviceRepository{ctrl: ctrl}
+	mock.recorder = &MockDeviceRepositoryMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockDeviceRepository) EXPECT() *MockDeviceRepositoryMockRecorder {
+	return m.recorder
+}
+
+// ListForUnit mocks base method.
+func (m *MockDeviceRepository) ListForUnit(ctx context.Context, unit shared.Unit) ([]shared.Device, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListForUnit", ctx, unit)
+	ret0, _ := ret[0].([]shared.Device)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListForUnit indicates an expected call of ListForUnit.
+func (mr *MockDeviceRepositoryMockRecorder) ListForUnit(ctx, unit any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListForUnit", reflect.TypeOf((*MockDeviceRepository)(nil).ListForUnit), ctx, unit)
+}
@@ -11,11 +11,12 @@ import (
 )
 
 type ContextData struct {
-	DB   *sql.DB
-	DY   *dynamodb.Client
-	SES  *ses.Client
-	SQS  *sqs.Client
-	User *User
+	DB        *sql.DB
+	DY        *dynamodb.Client
+	RequestID string // The API Gateway request ID, empty outside of the APIs.
+	SES       *ses.Client
+	SQS       *sqs.Client
+	User      *User
 }
 
 type contextKey int
@@ -12,16 +12,21 @@ type Device struct {
 		LastUpdatedAt *time.Time `json:"lastUpdatedAt"`
 		Level         string     `json:"level"` // Could probably do a numeric type, but this simplifies some things (e.g. "NAN").
 	} `json:"battery"`
-	ControllerID             string                   `json:"controllerId"`
-	History                  []DeviceHistory          `json:"history"`
-	ID                       uuid.UUID                `json:"id"`
-	LastRebootedControllerAt *time.Time               `json:"lastRebootedControllerAt"`
-	LastRefreshedAt          time.Time                `json:"lastRefreshedAt"`
-	LastWentOfflineAt        *time.Time               `json:"lastWentOfflineAt"`
-	LastWentOnlineAt         *time.Time               `json:"lastWentOnlineAt"`
-	ManagedLockCodes         []*DeviceManagedLockCode `json:"managedLockCodes"`
-	RawDevice                RawDevice                `json:"rawDevice"`
-	UnitID                   *uuid.UUID               `json:"unitId"`
+	CapacityExhaustedAt      *time.Time                 `json:"capacityExhaustedAt"` // When we forecast the device will run out of slots, nil if it won't.
+	ControllerID             string                     `json:"controllerId"`
+	History                  []DeviceHistory            `json:"history"`
+	ID                       uuid.UUID                  `json:"id"`
+	LastRebootedControllerAt *time.Time                 `json:"lastRebootedControllerAt"`
+	LastRefreshedAt          time.Time                  `json:"lastRefreshedAt"`
+	LastWentOfflineAt        *time.Time                 `json:"lastWentOfflineAt"`
+	LastWentOnlineAt         *time.Time                 `json:"lastWentOnlineAt"`
+	ManagedLockCodes         []*DeviceManagedLockCode   `json:"managedLockCodes"`
+	RawDevice                RawDevice                  `json:"rawDevice"`
+	RecurringLockCodes       []*DeviceRecurringLockCode `json:"recurringLockCodes"`
+	UnitID                   *uuid.UUID                 `json:"unitId"`
+	UnmanagedLockCodePolicy  *UnmanagedLockCodePolicy   `json:"unmanagedLockCodePolicy"`
+	UnmanagedLockCodesSeenAt map[string]time.Time       `json:"unmanagedLockCodesSeenAt"` // When we first saw each unmanaged code.
+	Version                  int                        `json:"version"`                  // Goes up every time the device is saved, see `PutIfUnchanged`.
 }
 
 type DeviceHistory struct {
@@ -36,6 +41,7 @@ type RawDevice struct {
 	DeviceTypeID string              `json:"deviceTypeId"`
 	ID           string              `json:"id"`
 	LockCodes    []RawDeviceLockCode `json:"lockCodes"`
+	MaxLockCodes int                 `json:"maxLockCodes"` // Zero if the device didn't tell us.
 	Name         string              `json:"name"`
 	Status       string              `json:"status"`
 }
@@ -57,6 +63,16 @@ const (
 	DeviceStatusOnline    = "ONLINE"
 )
 
+// A battery powered device at or below this level should have its batteries changed soon.
+const DeviceLowBatteryLevel = 89
+
+// RawDeviceUpdate is a change the controller told us about as it happened. Fields that didn't change are nil, an empty `LockCodes` means the lock has no codes.
+type RawDeviceUpdate struct {
+	BatteryLevel *int
+	ID           string // The `RawDevice.ID`, it's only unique within a controller.
+	LockCodes    []RawDeviceLockCode
+}
+
 func (d *Device) GenerateUnmanagedLockCodes() []RawDeviceLockCode {
 	umlcs := []RawDeviceLockCode{}
 
@@ -83,6 +99,23 @@ func (d *Device) GenerateUnmanagedLockCodes() []RawDeviceLockCode {
 	return umlcs
 }
 
+// FindLockCodeConflicts returns the other managed lock codes that use the same code at the same time for a different owner, see `owner`.
+func (d *Device) FindLockCodeConflicts(mlc *DeviceManagedLockCode) []*DeviceManagedLockCode {
+	conflicts := []*DeviceManagedLockCode{}
+	for _, o := range d.ManagedLockCodes {
+		if o == mlc || o.ID == mlc.ID || o.Code != mlc.Code || o.IsDone() {
+			continue
+		}
+		if o.owner() == mlc.owner() {
+			continue
+		}
+		if o.Overlaps(mlc) {
+			conflicts = append(conflicts, o)
+		}
+	}
+	return conflicts
+}
+
 func (d *Device) GetManagedLockCode(id uuid.UUID) *DeviceManagedLockCode {
 	for _, mlc := range d.ManagedLockCodes {
 		if mlc.ID == id {
@@ -91,3 +124,25 @@ func (d *Device) GetManagedLockCode(id uuid.UUID) *DeviceManagedLockCode {
 	}
 	return nil
 }
+
+func (d *Device) GetRecurringLockCode(id uuid.UUID) *DeviceRecurringLockCode {
+	for _, rlc := range d.RecurringLockCodes {
+		if rlc.ID == id {
+			return rlc
+		}
+	}
+	return nil
+}
+
+// TrackUnmanagedLockCodes records when we first saw each unmanaged code, and forgets the ones that are gone.
+func (d *Device) TrackUnmanagedLockCodes(now time.Time) {
+	seenAt := map[string]time.Time{}
+	for _, lc := range d.GenerateUnmanagedLockCodes() {
+		if t, ok := d.UnmanagedLockCodesSeenAt[lc.Code]; ok {
+			seenAt[lc.Code] = t
+		} else {
+			seenAt[lc.Code] = now
+		}
+	}
+	d.UnmanagedLockCodesSeenAt = seenAt
+}
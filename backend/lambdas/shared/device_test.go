@@ -0,0 +1,67 @@
+package shared
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestDevice_FindLockCodeConflicts(t *testing.T) {
+	now := time.Now()
+	mlc := &DeviceManagedLockCode{
+		Code:        "1234",
+		EndAt:       now.Add(3 * time.Hour),
+		ID:          uuid.New(),
+		Reservation: DeviceManagedLockCodeReservation{ID: "a"},
+		StartAt:     now.Add(1 * time.Hour),
+	}
+	overlapping := &DeviceManagedLockCode{
+		Code:        "1234",
+		EndAt:       now.Add(2 * time.Hour),
+		ID:          uuid.New(),
+		Reservation: DeviceManagedLockCodeReservation{ID: "b"},
+		StartAt:     now,
+	}
+	d := Device{
+		ManagedLockCodes: []*DeviceManagedLockCode{
+			mlc,
+			overlapping,
+			// Same reservation.
+			{Code: "1234", EndAt: now.Add(2 * time.Hour), ID: uuid.New(), Reservation: DeviceManagedLockCodeReservation{ID: "a"}, StartAt: now},
+			// Different code.
+			{Code: "5678", EndAt: now.Add(2 * time.Hour), ID: uuid.New(), StartAt: now},
+			// Ends right as the other starts.
+			{Code: "1234", EndAt: now.Add(1 * time.Hour), ID: uuid.New(), StartAt: now},
+			// Already done.
+			{Code: "1234", EndAt: now.Add(2 * time.Hour), ID: uuid.New(), StartAt: now, Status: DeviceManagedLockCodeStatus5Complete},
+		},
+	}
+
+	conflicts := d.FindLockCodeConflicts(mlc)
+	if len(conflicts) != 1 || conflicts[0] != overlapping {
+		t.Fatalf("unexpected: %+v", conflicts)
+	}
+}
+
+func TestDevice_FindLockCodeConflictsWithoutReservations(t *testing.T) {
+	now := time.Now()
+	recurringLockCodeID := uuid.New()
+	manual := &DeviceManagedLockCode{Code: "1234", EndAt: now.Add(2 * time.Hour), ID: uuid.New(), StartAt: now}
+	otherManual := &DeviceManagedLockCode{Code: "1234", EndAt: now.Add(2 * time.Hour), ID: uuid.New(), StartAt: now}
+	occurrence := &DeviceManagedLockCode{Code: "1234", EndAt: now.Add(2 * time.Hour), ID: uuid.New(), RecurringLockCodeID: &recurringLockCodeID, StartAt: now}
+	nextOccurrence := &DeviceManagedLockCode{Code: "1234", EndAt: now.Add(2 * time.Hour), ID: uuid.New(), RecurringLockCodeID: &recurringLockCodeID, StartAt: now}
+	d := Device{ManagedLockCodes: []*DeviceManagedLockCode{manual, otherManual, occurrence, nextOccurrence}}
+
+	// Two codes added by hand don't share an owner just because neither has a reservation.
+	conflicts := d.FindLockCodeConflicts(manual)
+	if len(conflicts) != 3 || conflicts[0] != otherManual || conflicts[1] != occurrence || conflicts[2] != nextOccurrence {
+		t.Fatalf("unexpected: %+v", conflicts)
+	}
+
+	// Occurrences of the same recurring code do.
+	conflicts = d.FindLockCodeConflicts(occurrence)
+	if len(conflicts) != 2 || conflicts[0] != manual || conflicts[1] != otherManual {
+		t.Fatalf("unexpected: %+v", conflicts)
+	}
+}
@@ -0,0 +1,117 @@
+package shared
+
+import (
+	"sort"
+	"time"
+)
+
+// Some locks report how many codes they can hold, when they don't we'll assume this many.
+const DefaultMaxLockCodes = 30
+
+// How far ahead we'll warn about a device running out of slots.
+const DeviceCapacityWarningWindow = 14 * 24 * time.Hour
+
+type DeviceSlot struct {
+	Code    string `json:"code"`
+	Managed bool   `json:"managed"`
+	Slot    int    `json:"slot"`
+}
+
+type DeviceSlotUsage struct {
+	Free      int          `json:"free"`
+	Managed   int          `json:"managed"`
+	Max       int          `json:"max"`
+	Slots     []DeviceSlot `json:"slots"`
+	Unmanaged int          `json:"unmanaged"`
+}
+
+func (d *Device) MaxLockCodes() int {
+	if d.RawDevice.MaxLockCodes > 0 {
+		return d.RawDevice.MaxLockCodes
+	}
+	return DefaultMaxLockCodes
+}
+
+// SlotUsage is based on the codes we last read from the device.
+func (d *Device) SlotUsage() DeviceSlotUsage {
+	usage := DeviceSlotUsage{
+		Max:   d.MaxLockCodes(),
+		Slots: []DeviceSlot{},
+	}
+
+	for _, lc := range d.RawDevice.LockCodes {
+		managed := false
+		for _, mlc := range d.ManagedLockCodes {
+			if mlc.Code == lc.Code {
+				managed = true
+				break
+			}
+		}
+
+		if managed {
+			usage.Managed++
+		} else {
+			usage.Unmanaged++
+		}
+		usage.Slots = append(usage.Slots, DeviceSlot{
+			Code:    lc.Code,
+			Managed: managed,
+			Slot:    lc.Slot,
+		})
+	}
+
+	sort.Slice(usage.Slots, func(a, b int) bool {
+		return usage.Slots[a].Slot < usage.Slots[b].Slot
+	})
+
+	usage.Free = usage.Max - usage.Managed - usage.Unmanaged
+	if usage.Free < 0 {
+		usage.Free = 0
+	}
+
+	return usage
+}
+
+// ForecastCapacity returns the first time the scheduled codes (plus the unmanaged codes, which we assume stick around) won't fit on the device, or nil if they all fit.
+func (d *Device) ForecastCapacity(now time.Time) *time.Time {
+	available := d.MaxLockCodes() - d.SlotUsage().Unmanaged
+
+	upcoming := []*DeviceManagedLockCode{}
+	for _, mlc := range d.ManagedLockCodes {
+		if mlc.Status == DeviceManagedLockCodeStatus5Complete || mlc.Status == DeviceManagedLockCodeStatus6Failed {
+			continue
+		}
+		if !mlc.EndAt.After(now) || !mlc.EndAt.After(mlc.StartAt) {
+			continue
+		}
+		upcoming = append(upcoming, mlc)
+	}
+
+	// The number of codes only goes up when something starts, so those are the only times we need to check.
+	checkAt := []time.Time{}
+	for _, mlc := range upcoming {
+		if mlc.StartAt.After(now) {
+			checkAt = append(checkAt, mlc.StartAt)
+		} else {
+			checkAt = append(checkAt, now)
+		}
+	}
+	sort.Slice(checkAt, func(a, b int) bool {
+		return checkAt[a].Before(checkAt[b])
+	})
+
+	for _, t := range checkAt {
+		// Managed lock codes that share a code share a slot.
+		codes := map[string]bool{}
+		for _, mlc := range upcoming {
+			if !mlc.StartAt.After(t) && mlc.EndAt.After(t) {
+				codes[mlc.Code] = true
+			}
+		}
+		if len(codes) > available {
+			return &t
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package shared
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDevice_SlotUsage(t *testing.T) {
+	d := Device{
+		ManagedLockCodes: []*DeviceManagedLockCode{
+			{Code: "1111"},
+		},
+		RawDevice: RawDevice{
+			LockCodes: []RawDeviceLockCode{
+				{Code: "2222", Slot: 2},
+				{Code: "1111", Slot: 1},
+			},
+			MaxLockCodes: 6,
+		},
+	}
+
+	usage := d.SlotUsage()
+	if usage.Max != 6 || usage.Managed != 1 || usage.Unmanaged != 1 || usage.Free != 4 {
+		t.Fatalf("unexpected: %+v", usage)
+	}
+	if len(usage.Slots) != 2 || usage.Slots[0].Slot != 1 || !usage.Slots[0].Managed || usage.Slots[1].Managed {
+		t.Fatalf("unexpected slots: %+v", usage.Slots)
+	}
+}
+
+func TestDevice_SlotUsage_DefaultMax(t *testing.T) {
+	d := Device{}
+
+	usage := d.SlotUsage()
+	if usage.Max != DefaultMaxLockCodes || usage.Free != DefaultMaxLockCodes {
+		t.Fatalf("unexpected: %+v", usage)
+	}
+}
+
+func TestDevice_ForecastCapacity_Fits(t *testing.T) {
+	now := time.Now()
+	d := Device{
+		ManagedLockCodes: []*DeviceManagedLockCode{
+			{Code: "1111", StartAt: now.Add(1 * time.Hour), EndAt: now.Add(2 * time.Hour)},
+			{Code: "2222", StartAt: now.Add(3 * time.Hour), EndAt: now.Add(4 * time.Hour)},
+		},
+		RawDevice: RawDevice{
+			LockCodes: []RawDeviceLockCode{
+				{Code: "9999"},
+			},
+			MaxLockCodes: 2,
+		},
+	}
+
+	if forecast := d.ForecastCapacity(now); forecast != nil {
+		t.Fatalf("expected nil but was %s", forecast)
+	}
+}
+
+func TestDevice_ForecastCapacity_RunsOut(t *testing.T) {
+	now := time.Now()
+	d := Device{
+		ManagedLockCodes: []*DeviceManagedLockCode{
+			{Code: "1111", StartAt: now.Add(1 * time.Hour), EndAt: now.Add(5 * time.Hour)},
+			// Same code, same slot.
+			{Code: "1111", StartAt: now.Add(2 * time.Hour), EndAt: now.Add(5 * time.Hour)},
+			{Code: "2222", StartAt: now.Add(3 * time.Hour), EndAt: now.Add(5 * time.Hour)},
+			// Already done, so it shouldn't count.
+			{Code: "3333", StartAt: now.Add(-1 * time.Hour), EndAt: now.Add(5 * time.Hour), Status: DeviceManagedLockCodeStatus6Failed},
+		},
+		RawDevice: RawDevice{
+			LockCodes: []RawDeviceLockCode{
+				{Code: "9999"},
+			},
+			MaxLockCodes: 2,
+		},
+	}
+
+	forecast := d.ForecastCapacity(now)
+	if forecast == nil {
+		t.Fatal("expected a forecast but was nil")
+	}
+	if !forecast.Equal(now.Add(3 * time.Hour)) {
+		t.Fatalf("unexpected forecast: %s", forecast)
+	}
+}
+
+func TestDevice_ForecastCapacity_AlreadyFull(t *testing.T) {
+	now := time.Now()
+	d := Device{
+		ManagedLockCodes: []*DeviceManagedLockCode{
+			{Code: "1111", StartAt: now.Add(-1 * time.Hour), EndAt: now.Add(1 * time.Hour)},
+			{Code: "2222", StartAt: now.Add(-1 * time.Hour), EndAt: now.Add(1 * time.Hour)},
+		},
+		RawDevice: RawDevice{
+			MaxLockCodes: 1,
+		},
+	}
+
+	forecast := d.ForecastCapacity(now)
+	if forecast == nil || !forecast.Equal(now) {
+		t.Fatalf("unexpected forecast: %v", forecast)
+	}
+}
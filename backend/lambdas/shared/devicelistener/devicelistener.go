@@ -0,0 +1,217 @@
+package devicelistener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mlock/lambdas/shared"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type DeviceController interface {
+	Listen(ctx context.Context, controllerID string, onUpdate func(shared.RawDeviceUpdate)) error
+}
+
+type DeviceRepository interface {
+	Get(ctx context.Context, id uuid.UUID) (shared.Device, bool, error)
+	List(ctx context.Context) ([]shared.Device, error)
+	PutIfUnchanged(ctx context.Context, item shared.Device) (shared.Device, error)
+}
+
+type EmailService interface {
+	SendEmailToAdmins(ctx context.Context, subject string, body string) error
+}
+
+type LockEngine interface {
+	UpdateLock(ctx context.Context, d shared.Device) error
+}
+
+// How often we'll list the devices again to look for one we don't know about.
+const refreshDeviceIDsInterval = 5 * time.Minute
+
+// Listener saves changes to the devices as their controllers report them, rather than waiting for the next poll. When the codes on a lock change the lock engine runs for it straight away.
+type Listener struct {
+	clock                shared.Clock
+	deviceController     DeviceController
+	deviceIDs            map[rawDeviceKey]uuid.UUID
+	deviceIDsRefreshedAt time.Time
+	deviceRepository     DeviceRepository
+	emailService         EmailService
+	lockEngine           LockEngine
+	mu                   sync.Mutex // Guards `deviceIDs`, each controller has its own goroutine.
+}
+
+// rawDeviceKey is how the controller refers to the device, raw device IDs are only unique within a controller.
+type rawDeviceKey struct {
+	controllerID string
+	rawDeviceID  string
+}
+
+func NewListener(dc DeviceController, dr DeviceRepository, es EmailService, le LockEngine) *Listener {
+	return &Listener{
+		clock:            shared.RealClock{},
+		deviceController: dc,
+		deviceIDs:        map[rawDeviceKey]uuid.UUID{},
+		deviceRepository: dr,
+		emailService:     es,
+		lockEngine:       le,
+	}
+}
+
+func (l *Listener) WithClock(c shared.Clock) *Listener {
+	l.clock = c
+	return l
+}
+
+// Listen blocks until the context is done, each controller gets its own goroutine.
+func (l *Listener) Listen(ctx context.Context, controllerIDs []string) {
+	var wg sync.WaitGroup
+	for _, controllerID := range controllerIDs {
+		wg.Add(1)
+		go func(controllerID string) {
+			defer wg.Done()
+
+			err := l.deviceController.Listen(ctx, controllerID, func(update shared.RawDeviceUpdate) {
+				if err := l.HandleUpdate(ctx, controllerID, update); err != nil {
+					log.Printf("error handling update for device %s on controller %s: %s\n", update.ID, controllerID, err.Error())
+				}
+			})
+			if err != nil {
+				log.Printf("error listening to controller %s: %s\n", controllerID, err.Error())
+			}
+		}(controllerID)
+	}
+	wg.Wait()
+}
+
+// HandleUpdate ignores devices we don't have yet, the next poll will add them. The device is saved only if nobody else saved it in the meantime, otherwise the update is applied to their version.
+func (l *Listener) HandleUpdate(ctx context.Context, controllerID string, update shared.RawDeviceUpdate) error {
+	id, ok, err := l.deviceID(ctx, controllerID, update.ID)
+	if err != nil {
+		return fmt.Errorf("error finding device: %s", err.Error())
+	}
+	if !ok {
+		return nil
+	}
+
+	d, ok, err := l.deviceRepository.Get(ctx, id)
+	if err != nil {
+		return fmt.Errorf("error getting device: %s", err.Error())
+	}
+	if !ok {
+		return nil // Deleted since we looked it up.
+	}
+
+	wasLowBattery := isLowBattery(d.RawDevice)
+	codesChanged := update.LockCodes != nil && !sameLockCodes(d.RawDevice.LockCodes, update.LockCodes)
+	if !l.apply(&d, update) {
+		return nil
+	}
+
+	saved, err := shared.SaveDevice(ctx, l.deviceRepository, d, func(fresh *shared.Device) (bool, error) {
+		wasLowBattery = isLowBattery(fresh.RawDevice)
+		codesChanged = update.LockCodes != nil && !sameLockCodes(fresh.RawDevice.LockCodes, update.LockCodes)
+		return l.apply(fresh, update), nil
+	})
+	if errors.Is(err, shared.ErrDeviceDeleted) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error putting device: %s", err.Error())
+	}
+
+	if !wasLowBattery && isLowBattery(saved.RawDevice) {
+		if err := l.emailService.SendEmailToAdmins(
+			ctx,
+			"zcclock - Device Changed to a Low Battery Level",
+			fmt.Sprintf("Device: %s, Battery Level: %d", saved.RawDevice.Name, saved.RawDevice.Battery.Level),
+		); err != nil {
+			log.Printf("error sending low battery email for %s: %s\n", saved.RawDevice.Name, err.Error())
+		}
+	}
+
+	// The lock engine saves the device itself, starting from the version we just saved.
+	if codesChanged {
+		if err := l.lockEngine.UpdateLock(ctx, saved); err != nil {
+			return fmt.Errorf("error updating lock: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// apply returns false if the update doesn't change anything.
+func (l *Listener) apply(d *shared.Device, update shared.RawDeviceUpdate) bool {
+	codesChanged := update.LockCodes != nil && !sameLockCodes(d.RawDevice.LockCodes, update.LockCodes)
+	batteryChanged := update.BatteryLevel != nil && *update.BatteryLevel != d.RawDevice.Battery.Level
+	if !codesChanged && !batteryChanged {
+		return false
+	}
+
+	now := l.clock.Now()
+	if codesChanged {
+		d.RawDevice.LockCodes = update.LockCodes
+		d.TrackUnmanagedLockCodes(now)
+	}
+	if batteryChanged {
+		d.RawDevice.Battery.Level = *update.BatteryLevel
+	}
+	d.LastRefreshedAt = now
+	return true
+}
+
+// deviceID looks the device up by how the controller refers to it. The devices are listed again when there's one we don't know, but not more often than `refreshDeviceIDsInterval`.
+func (l *Listener) deviceID(ctx context.Context, controllerID string, rawDeviceID string) (uuid.UUID, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := rawDeviceKey{controllerID: controllerID, rawDeviceID: rawDeviceID}
+	if id, ok := l.deviceIDs[key]; ok {
+		return id, true, nil
+	}
+
+	now := l.clock.Now()
+	if !l.deviceIDsRefreshedAt.IsZero() && now.Sub(l.deviceIDsRefreshedAt) < refreshDeviceIDsInterval {
+		return uuid.Nil, false, nil
+	}
+
+	devices, err := l.deviceRepository.List(ctx)
+	if err != nil {
+		return uuid.Nil, false, fmt.Errorf("error getting devices: %s", err.Error())
+	}
+	l.deviceIDs = map[rawDeviceKey]uuid.UUID{}
+	for _, d := range devices {
+		l.deviceIDs[rawDeviceKey{controllerID: d.ControllerID, rawDeviceID: d.RawDevice.ID}] = d.ID
+	}
+	l.deviceIDsRefreshedAt = now
+
+	id, ok := l.deviceIDs[key]
+	return id, ok, nil
+}
+
+func isLowBattery(rd shared.RawDevice) bool {
+	return rd.Battery.BatteryPowered && rd.Battery.Level <= shared.DeviceLowBatteryLevel
+}
+
+// sameLockCodes ignores the order, the controller doesn't always send them sorted by slot.
+func sameLockCodes(a []shared.RawDeviceLockCode, b []shared.RawDeviceLockCode) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	counts := map[shared.RawDeviceLockCode]int{}
+	for _, lc := range a {
+		counts[lc]++
+	}
+	for _, lc := range b {
+		if counts[lc] == 0 {
+			return false
+		}
+		counts[lc]--
+	}
+	return true
+}
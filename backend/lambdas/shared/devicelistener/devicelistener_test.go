@@ -0,0 +1,206 @@
+package devicelistener_test
+
+//go:generate mockgen -source=devicelistener.go -destination mocks/mock_devicelistener/devicelistener.go
+
+import (
+	"context"
+	"mlock/lambdas/shared"
+	"mlock/lambdas/shared/devicelistener"
+	"mlock/lambdas/shared/devicelistener/mocks/mock_devicelistener"
+	"mlock/lambdas/shared/simulation"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+func Test_HandleUpdateLockCodes(t *testing.T) {
+	l, _, dr, _, le, now := newListener(t)
+
+	ctx := context.Background()
+	lock := newDevice("controller", "lock")
+	lock.RawDevice.LockCodes = []shared.RawDeviceLockCode{{Code: "1111", Slot: 1}}
+	sameIDOtherController := newDevice("otherController", "lock")
+
+	dr.EXPECT().List(ctx).Return([]shared.Device{sameIDOtherController, lock}, nil)
+	dr.EXPECT().Get(ctx, lock.ID).Return(lock, true, nil)
+
+	updated := lock
+	updated.LastRefreshedAt = now
+	updated.RawDevice.LockCodes = []shared.RawDeviceLockCode{{Code: "1111", Slot: 1}, {Code: "2222", Slot: 2}}
+	updated.UnmanagedLockCodesSeenAt = map[string]time.Time{"1111": now, "2222": now}
+	dr.EXPECT().PutIfUnchanged(ctx, updated).Return(updated, nil)
+
+	// The lock engine runs on what was saved, so that it sees the new codes.
+	le.EXPECT().UpdateLock(ctx, updated).Return(nil)
+
+	err := l.HandleUpdate(ctx, "controller", shared.RawDeviceUpdate{
+		ID:        "lock",
+		LockCodes: []shared.RawDeviceLockCode{{Code: "1111", Slot: 1}, {Code: "2222", Slot: 2}},
+	})
+	assert.Nil(t, err)
+}
+
+func Test_HandleUpdateRetriesWhenTheDeviceChanged(t *testing.T) {
+	l, _, dr, _, le, now := newListener(t)
+
+	ctx := context.Background()
+	lock := newDevice("controller", "lock")
+	update := shared.RawDeviceUpdate{ID: "lock", LockCodes: []shared.RawDeviceLockCode{{Code: "1111", Slot: 1}}}
+
+	// The lock engine saved a new managed code in between, so it's read again and kept.
+	changed := lock
+	changed.ManagedLockCodes = []*shared.DeviceManagedLockCode{{Code: "1111", ID: uuid.New(), Status: shared.DeviceManagedLockCodeStatus2Adding}}
+	changed.Version = 1
+
+	dr.EXPECT().List(ctx).Return([]shared.Device{lock}, nil)
+	gomock.InOrder(
+		dr.EXPECT().Get(ctx, lock.ID).Return(lock, true, nil),
+		dr.EXPECT().PutIfUnchanged(ctx, gomock.Any()).Return(shared.Device{}, shared.ErrDeviceChanged),
+		dr.EXPECT().Get(ctx, lock.ID).Return(changed, true, nil),
+		dr.EXPECT().PutIfUnchanged(ctx, gomock.Any()).DoAndReturn(func(ctx context.Context, d shared.Device) (shared.Device, error) {
+			assert.Equal(t, changed.ManagedLockCodes, d.ManagedLockCodes)
+			assert.Equal(t, update.LockCodes, d.RawDevice.LockCodes)
+			assert.Equal(t, now, d.LastRefreshedAt)
+			assert.Equal(t, 1, d.Version)
+			return d, nil
+		}),
+		le.EXPECT().UpdateLock(ctx, gomock.Any()).DoAndReturn(func(ctx context.Context, d shared.Device) error {
+			assert.Equal(t, changed.ManagedLockCodes, d.ManagedLockCodes)
+			return nil
+		}),
+	)
+
+	assert.Nil(t, l.HandleUpdate(ctx, "controller", update))
+
+	// It gives up eventually.
+	dr.EXPECT().Get(ctx, lock.ID).Return(lock, true, nil).Times(3)
+	dr.EXPECT().PutIfUnchanged(ctx, gomock.Any()).Return(shared.Device{}, shared.ErrDeviceChanged).Times(3)
+
+	assert.NotNil(t, l.HandleUpdate(ctx, "controller", update))
+}
+
+func Test_HandleUpdateNothingChanged(t *testing.T) {
+	l, _, dr, _, _, now := newListener(t)
+
+	ctx := context.Background()
+	lock := newDevice("controller", "lock")
+	lock.RawDevice.LockCodes = []shared.RawDeviceLockCode{{Code: "1111", Slot: 1}, {Code: "2222", Slot: 2}}
+
+	// The devices are only listed when there's one we don't know, and not too often.
+	dr.EXPECT().List(ctx).Return([]shared.Device{lock}, nil)
+	dr.EXPECT().Get(ctx, lock.ID).Return(lock, true, nil).Times(2)
+
+	// Same codes in a different order.
+	level := lock.RawDevice.Battery.Level
+	err := l.HandleUpdate(ctx, "controller", shared.RawDeviceUpdate{
+		BatteryLevel: &level,
+		ID:           "lock",
+		LockCodes:    []shared.RawDeviceLockCode{{Code: "2222", Slot: 2}, {Code: "1111", Slot: 1}},
+	})
+	assert.Nil(t, err)
+
+	// Nil codes means they didn't change, rather than that there aren't any.
+	err = l.HandleUpdate(ctx, "controller", shared.RawDeviceUpdate{ID: "lock"})
+	assert.Nil(t, err)
+
+	// Not one of ours yet.
+	err = l.HandleUpdate(ctx, "controller", shared.RawDeviceUpdate{ID: "new", LockCodes: []shared.RawDeviceLockCode{}})
+	assert.Nil(t, err)
+
+	// The poll added it since.
+	newLock := newDevice("controller", "new")
+	l.WithClock(simulation.NewClock(now.Add(10 * time.Minute)))
+	dr.EXPECT().List(ctx).Return([]shared.Device{lock, newLock}, nil)
+	dr.EXPECT().Get(ctx, newLock.ID).Return(newLock, true, nil)
+
+	err = l.HandleUpdate(ctx, "controller", shared.RawDeviceUpdate{ID: "new"})
+	assert.Nil(t, err)
+}
+
+func Test_HandleUpdateBattery(t *testing.T) {
+	l, _, dr, es, _, now := newListener(t)
+
+	ctx := context.Background()
+	lock := newDevice("controller", "lock")
+	lock.RawDevice.Name = "Front Door"
+
+	dr.EXPECT().List(ctx).Return([]shared.Device{lock}, nil)
+	dr.EXPECT().Get(ctx, lock.ID).Return(lock, true, nil)
+
+	updated := lock
+	updated.LastRefreshedAt = now
+	updated.RawDevice.Battery.Level = shared.DeviceLowBatteryLevel
+	dr.EXPECT().PutIfUnchanged(ctx, updated).Return(updated, nil)
+	es.EXPECT().SendEmailToAdmins(ctx, "zcclock - Device Changed to a Low Battery Level", "Device: Front Door, Battery Level: 89").Return(nil)
+
+	level := shared.DeviceLowBatteryLevel
+	err := l.HandleUpdate(ctx, "controller", shared.RawDeviceUpdate{BatteryLevel: &level, ID: "lock"})
+	assert.Nil(t, err)
+
+	// We only email when it changes to low.
+	dr.EXPECT().Get(ctx, lock.ID).Return(updated, true, nil)
+	lower := updated
+	lower.RawDevice.Battery.Level = 80
+	dr.EXPECT().PutIfUnchanged(ctx, lower).Return(lower, nil)
+
+	level = 80
+	err = l.HandleUpdate(ctx, "controller", shared.RawDeviceUpdate{BatteryLevel: &level, ID: "lock"})
+	assert.Nil(t, err)
+}
+
+func Test_Listen(t *testing.T) {
+	l, dc, dr, _, _, _ := newListener(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	dr.EXPECT().List(ctx).Return([]shared.Device{}, nil)
+
+	for _, controllerID := range []string{"first", "second"} {
+		dc.EXPECT().Listen(ctx, controllerID, gomock.Any()).DoAndReturn(func(ctx context.Context, controllerID string, onUpdate func(shared.RawDeviceUpdate)) error {
+			onUpdate(shared.RawDeviceUpdate{ID: "lock"})
+			<-ctx.Done()
+			return nil
+		})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		l.Listen(ctx, []string{"first", "second"})
+		close(done)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "didn't stop listening")
+	}
+}
+
+func newDevice(controllerID string, rawDeviceID string) shared.Device {
+	return shared.Device{
+		ControllerID: controllerID,
+		ID:           uuid.New(),
+		RawDevice: shared.RawDevice{
+			Battery: shared.RawDeviceBattery{BatteryPowered: true, Level: 100},
+			ID:      rawDeviceID,
+			Status:  shared.DeviceStatusOnline,
+		},
+	}
+}
+
+func newListener(t *testing.T) (*devicelistener.Listener, *mock_devicelistener.MockDeviceController, *mock_devicelistener.MockDeviceRepository, *mock_devicelistener.MockEmailService, *mock_devicelistener.MockLockEngine, time.Time) {
+	ctrl := gomock.NewController(t)
+
+	dc := mock_devicelistener.NewMockDeviceController(ctrl)
+	dr := mock_devicelistener.NewMockDeviceRepository(ctrl)
+	es := mock_devicelistener.NewMockEmailService(ctrl)
+	le := mock_devicelistener.NewMockLockEngine(ctrl)
+
+	now := time.Date(2026, 10, 18, 12, 5, 0, 0, time.UTC)
+	l := devicelistener.NewListener(dc, dr, es, le).WithClock(simulation.NewClock(now))
+
+	return l, dc, dr, es, le, now
+}
@@ -0,0 +1,203 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: devicelistener.go
+//
+// Generated by this command:
+//
+//	mockgen -source=devicelistener.go -destination mocks/mock_devicelistener/devicelistener.go
+//
+
+// Package mock_devicelistener is a generated GoMock package.
+package mock_devicelistener
+
+import (
+	context "context"
+	shared "mlock/lambdas/shared"
+	reflect "reflect"
+
+	uuid "github.com/google/uuid"
+	gomock "go.uber.org/mock/gomock"
+)
+
+// MockDeviceController is a mock of DeviceController interface.
+type MockDeviceController struct {
+	ctrl     *gomock.Controller
+	recorder *MockDeviceControllerMockRecorder
+	isgomock struct{}
+}
+
+// MockDeviceControllerMockRecorder is the mock recorder for MockDeviceController.
+type MockDeviceControllerMockRecorder struct {
+	mock *MockDeviceController
+}
+
+// NewMockDeviceController creates a new mock instance.
+func NewMockDeviceController(ctrl *gomock.Controller) *MockDeviceController {
+	mock := &MockDeviceController{ctrl: ctrl}
+	mock.recorder = &MockDeviceControllerMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockDeviceController) EXPECT() *MockDeviceControllerMockRecorder {
+	return m.recorder
+}
+
+// Listen mocks base method.
+func (m *MockDeviceController) Listen(ctx context.Context, controllerID string, onUpdate func(shared.RawDeviceUpdate)) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Listen", ctx, controllerID, onUpdate)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Listen indicates an expected call of Listen.
+func (mr *MockDeviceControllerMockRecorder) Listen(ctx, controllerID, onUpdate any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Listen", reflect.TypeOf((*MockDeviceController)(nil).Listen), ctx, controllerID, onUpdate)
+}
+
+// MockDeviceRepository is a mock of DeviceRepository interface.
+type MockDeviceRepository struct {
+	ctrl     *gomock.Controller
+	recorder *MockDeviceRepositoryMockRecorder
+	isgomock struct{}
+}
+
+// MockDeviceRepositoryMockRecorder is the mock recorder for MockDeviceRepository.
+type MockDeviceRepositoryMockRecorder struct {
+	mock *MockDeviceRepository
+}
+
+// NewMockDeviceRepository creates a new mock instance.
+func NewMockDeviceRepository(ctrl *gomock.Controller) *MockDeviceRepository {
+	mock := &MockDeviceRepository{ctrl: ctrl}
+	mock.recorder = &MockDeviceRepositoryMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockDeviceRepository) EXPECT() *MockDeviceRepositoryMockRecorder {
+	return m.recorder
+}
+
+// Get mocks base method.
+func (m *MockDeviceRepository) Get(ctx context.Context, id uuid.UUID) (shared.Device, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Get", ctx, id)
+	ret0, _ := ret[0].(shared.Device)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// Get indicates an expected call of Get.
+func (mr *MockDeviceRepositoryMockRecorder) Get(ctx, id any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockDeviceRepository)(nil).Get), ctx, id)
+}
+
+// List mocks base method.
+func (m *MockDeviceRepository) List(ctx context.Context) ([]shared.Device, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "List", ctx)
+	ret0, _ := ret[0].([]shared.Device)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// List indicates an expected call of List.
+func (mr *MockDeviceRepositoryMockRecorder) List(ctx any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockDeviceRepository)(nil).List), ctx)
+}
+
+// PutIfUnchanged mocks base method.
+func (m *MockDeviceRepository) PutIfUnchanged(ctx context.Context, item shared.Device) (shared.Device, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PutIfUnchanged", ctx, item)
+	ret0, _ := ret[0].(shared.Device)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PutIfUnchanged indicates an expected call of PutIfUnchanged.
+func (mr *MockDeviceRepositoryMockRecorder) PutIfUnchanged(ctx, item any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PutIfUnchanged", reflect.TypeOf((*MockDeviceRepository)(nil).PutIfUnchanged), ctx, item)
+}
+
+// MockEmailService is a mock of EmailService interface.
+type MockEmailService struct {
+	ctrl     *gomock.Controller
+	recorder *MockEmailServiceMockRecorder
+	isgomock struct{}
+}
+
+// MockEmailServiceMockRecorder is the mock recorder for MockEmailService.
+type MockEmailServiceMockRecorder struct {
+	mock *MockEmailService
+}
+
+// NewMockEmailService creates a new mock instance.
+func NewMockEmailService(ctrl *gomock.Controller) *MockEmailService {
+	mock := &MockEmailService{ctrl: ctrl}
+	mock.recorder = &MockEmailServiceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockEmailService) EXPECT() *MockEmailServiceMockRecorder {
+	return m.recorder
+}
+
+// SendEmailToAdmins mocks base method.
+func (m *MockEmailService) SendEmailToAdmins(ctx context.Context, subject, body string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SendEmailToAdmins", ctx, subject, body)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SendEmailToAdmins indicates an expected call of SendEmailToAdmins.
+func (mr *MockEmailServiceMockRecorder) SendEmailToAdmins(ctx, subject, body any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SendEmailToAdmins", reflect.TypeOf((*MockEmailService)(nil).SendEmailToAdmins), ctx, subject, body)
+}
+
+// MockLockEngine is a mock of LockEngine interface.
+type MockLockEngine struct {
+	ctrl     *gomock.Controller
+	recorder *MockLockEngineMockRecorder
+	isgomock struct{}
+}
+
+// MockLockEngineMockRecorder is the mock recorder for MockLockEngine.
+type MockLockEngineMockRecorder struct {
+	mock *MockLockEngine
+}
+
+// NewMockLockEngine creates a new mock instance.
+func NewMockLockEngine(ctrl *gomock.Controller) *MockLockEngine {
+	mock := &MockLockEngine{ctrl: ctrl}
+	mock.recorder = &MockLockEngineMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockLockEngine) EXPECT() *MockLockEngineMockRecorder {
+	return m.recorder
+}
+
+// UpdateLock mocks base method.
+func (m *MockLockEngine) UpdateLock(ctx context.Context, d shared.Device) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateLock", ctx, d)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateLock indicates an expected call of UpdateLock.
+func (mr *MockLockEngineMockRecorder) UpdateLock(ctx, d any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateLock", reflect.TypeOf((*MockLockEngine)(nil).UpdateLock), ctx, d)
+}
@@ -8,22 +8,29 @@ import (
 )
 
 type DeviceManagedLockCode struct {
-	Code              string                           `json:"code"`
-	EndAt             time.Time                        `json:"endAt"`
-	ID                uuid.UUID                        `json:"id"`
-	Note              string                           `json:"note"`
-	Reservation       DeviceManagedLockCodeReservation `json:"reservation"`
-	Status            DeviceManagedLockCodeStatus      `json:"status"`
-	StartAt           time.Time                        `json:"startAt"`
-	StartedAddingAt   *time.Time                       `json:"startedAddingAt"`
-	WasEnabledAt      *time.Time                       `json:"wasEnabledAt"`
-	StartedRemovingAt *time.Time                       `json:"startedRemovingAt"`
-	WasCompletedAt    *time.Time                       `json:"wasCompletedAt"`
+	Attempts            int                              `json:"attempts"` // Attempts to add or remove the code, reset when we start adding or removing.
+	Code                string                           `json:"code"`
+	EndAt               time.Time                        `json:"endAt"`
+	ID                  uuid.UUID                        `json:"id"`
+	LastAttemptAt       *time.Time                       `json:"lastAttemptAt"`
+	LastError           string                           `json:"lastError"`
+	Note                string                           `json:"note"`
+	RecurringLockCodeID *uuid.UUID                       `json:"recurringLockCodeId"` // Set if this is an occurrence of a recurring code.
+	Reservation         DeviceManagedLockCodeReservation `json:"reservation"`
+	Status              DeviceManagedLockCodeStatus      `json:"status"`
+	StartAt             time.Time                        `json:"startAt"`
+	UnitLockCodeID      *uuid.UUID                       `json:"unitLockCodeId"` // Set if this is the device's copy of a unit-level code.
+	StartedAddingAt     *time.Time                       `json:"startedAddingAt"`
+	WasEnabledAt        *time.Time                       `json:"wasEnabledAt"`
+	StartedRemovingAt   *time.Time                       `json:"startedRemovingAt"`
+	WasCompletedAt      *time.Time                       `json:"wasCompletedAt"`
+	WasFailedAt         *time.Time                       `json:"wasFailedAt"`
 }
 
 type DeviceManagedLockCodeReservation struct {
-	ID   string `json:"id"`
-	Sync bool   `json:"sync"`
+	GuestMessagedAt *time.Time `json:"guestMessagedAt"` // When we sent the guest their code, so that we only do it once.
+	ID              string     `json:"id"`
+	Sync            bool       `json:"sync"`
 }
 
 type DeviceManagedLockCodeStatus string
@@ -35,11 +42,16 @@ const (
 	DeviceManagedLockCodeStatus3Enabled   DeviceManagedLockCodeStatus = "Enabled"
 	DeviceManagedLockCodeStatus4Removing  DeviceManagedLockCodeStatus = "Removing"
 	DeviceManagedLockCodeStatus5Complete  DeviceManagedLockCodeStatus = "Complete"
+	DeviceManagedLockCodeStatus6Failed    DeviceManagedLockCodeStatus = "Failed" // Terminal, we gave up on adding the code. Removals are retried until they work.
 )
 
+// The defaults for properties and units that don't have their own `ReservationBuffers`.
 const ReservationEndBufferInMinutes = 30
 const ReservationStartBufferInMinutes = -240
 
+// The lock engine deletes managed lock codes this long after they end (once they're complete or failed), after that we've no record of them.
+const ManagedLockCodeRetention = 7 * 24 * time.Hour
+
 func (m *DeviceManagedLockCode) HasEnded(now time.Time) bool {
 	return now.After(m.EndAt)
 }
@@ -56,34 +68,99 @@ func (m *DeviceManagedLockCode) CodeShouldBePresent(now time.Time) bool {
 	return !m.HasEnded(now)
 }
 
+func (m *DeviceManagedLockCode) IsDone() bool {
+	return m.Status == DeviceManagedLockCodeStatus5Complete || m.Status == DeviceManagedLockCodeStatus6Failed
+}
+
+// owner is what the code was added for: the recurring code, unit code or reservation it came from. Codes added by hand each have their own owner.
+func (m *DeviceManagedLockCode) owner() string {
+	switch {
+	case m.RecurringLockCodeID != nil:
+		return "recurring:" + m.RecurringLockCodeID.String()
+	case m.UnitLockCodeID != nil:
+		return "unit:" + m.UnitLockCodeID.String()
+	case m.Reservation.ID != "":
+		return "reservation:" + m.Reservation.ID
+	}
+	return "managed:" + m.ID.String()
+}
+
+func (m *DeviceManagedLockCode) Overlaps(o *DeviceManagedLockCode) bool {
+	return m.StartAt.Before(o.EndAt) && o.StartAt.Before(m.EndAt)
+}
+
+// CopyStatusFrom copies what the lock engine keeps track of (the status, when it changed, and the attempts) from another copy of the same code.
+func (m *DeviceManagedLockCode) CopyStatusFrom(o *DeviceManagedLockCode) {
+	m.Attempts = o.Attempts
+	m.LastAttemptAt = o.LastAttemptAt
+	m.LastError = o.LastError
+	m.Note = o.Note
+	m.Status = o.Status
+	m.StartedAddingAt = o.StartedAddingAt
+	m.WasEnabledAt = o.WasEnabledAt
+	m.StartedRemovingAt = o.StartedRemovingAt
+	m.WasCompletedAt = o.WasCompletedAt
+	m.WasFailedAt = o.WasFailedAt
+}
+
+// RecordAttempt counts an attempt at sending the code's command. LastError is only kept while the latest attempt failed.
+func (m *DeviceManagedLockCode) RecordAttempt(now time.Time, err error) {
+	m.Attempts++
+	m.LastAttemptAt = &now
+	m.LastError = ""
+	if err != nil {
+		m.LastError = err.Error()
+	}
+}
+
 func (m *DeviceManagedLockCode) SetStatus(status DeviceManagedLockCodeStatus) error {
+	return m.SetStatusAt(status, time.Now())
+}
+
+// SetStatusAt is SetStatus for when the current time comes from somewhere other than the wall clock.
+func (m *DeviceManagedLockCode) SetStatusAt(status DeviceManagedLockCodeStatus, now time.Time) error {
 	if m.Status == status {
 		return nil
 	}
 	m.Status = status
 
-	now := time.Now()
 	if status == DeviceManagedLockCodeStatus1Scheduled {
 		m.StartedAddingAt = nil
 		m.WasEnabledAt = nil
 		m.StartedRemovingAt = nil
 		m.WasCompletedAt = nil
+		m.WasFailedAt = nil
+		m.resetAttempts()
 	} else if status == DeviceManagedLockCodeStatus2Adding {
 		m.StartedAddingAt = &now
 		m.WasEnabledAt = nil
 		m.StartedRemovingAt = nil
 		m.WasCompletedAt = nil
+		m.WasFailedAt = nil
+		m.resetAttempts()
 	} else if status == DeviceManagedLockCodeStatus3Enabled {
 		m.WasEnabledAt = &now
 		m.StartedRemovingAt = nil
 		m.WasCompletedAt = nil
+		m.WasFailedAt = nil
 	} else if status == DeviceManagedLockCodeStatus4Removing {
 		m.StartedRemovingAt = &now
 		m.WasCompletedAt = nil
+		m.WasFailedAt = nil
+		m.resetAttempts()
 	} else if status == DeviceManagedLockCodeStatus5Complete {
 		m.WasCompletedAt = &now
+		m.WasFailedAt = nil
+	} else if status == DeviceManagedLockCodeStatus6Failed {
+		m.WasFailedAt = &now
 	} else {
 		return fmt.Errorf("unhandled status %s", status)
 	}
 	return nil
 }
+
+func (m *DeviceManagedLockCode) resetAttempts() {
+	m.Attempts = 0
+	m.LastAttemptAt = nil
+	m.LastError = ""
+}
@@ -0,0 +1,75 @@
+package shared
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DeviceRecurringLockCode is a code that comes back on a schedule (e.g. cleaners every Tuesday and Friday from 10:00 to 15:00). The scheduler expands it into managed lock codes a little ahead of time.
+type DeviceRecurringLockCode struct {
+	Code     string    `json:"code"`
+	EndAt    time.Time `json:"endAt"` // End of the first occurrence.
+	ID       uuid.UUID `json:"id"`
+	Note     string    `json:"note"`
+	RRule    string    `json:"rrule"`   // E.g. "FREQ=WEEKLY;BYDAY=TU,FR".
+	StartAt  time.Time `json:"startAt"` // Start of the first occurrence, the time of day is taken from this in `TimeZone`.
+	TimeZone string    `json:"timeZone"`
+}
+
+type LockCodeWindow struct {
+	EndAt   time.Time `json:"endAt"`
+	StartAt time.Time `json:"startAt"`
+}
+
+// How far ahead we create managed lock codes for recurring codes.
+const RecurringLockCodeLookAhead = 48 * time.Hour
+
+func (r *DeviceRecurringLockCode) Validate() error {
+	if r.Code == "" {
+		return fmt.Errorf("code is required")
+	}
+	if !r.StartAt.Before(r.EndAt) {
+		return fmt.Errorf("can't start after it ends")
+	}
+	if r.EndAt.Sub(r.StartAt) > 24*time.Hour {
+		return fmt.Errorf("an occurrence can't be longer than a day")
+	}
+	if r.TimeZone == "" {
+		return fmt.Errorf("time zone is required")
+	}
+	if _, err := time.LoadLocation(r.TimeZone); err != nil {
+		return fmt.Errorf("invalid time zone: %s", err.Error())
+	}
+	if _, err := ParseRRule(r.RRule); err != nil {
+		return fmt.Errorf("invalid rrule: %s", err.Error())
+	}
+	return nil
+}
+
+// Windows returns the occurrences that haven't ended by `from` and start before `to`.
+func (r *DeviceRecurringLockCode) Windows(from time.Time, to time.Time) ([]LockCodeWindow, error) {
+	rule, err := ParseRRule(r.RRule)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing rrule: %s", err.Error())
+	}
+
+	loc, err := time.LoadLocation(r.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("error loading time zone: %s", err.Error())
+	}
+
+	duration := r.EndAt.Sub(r.StartAt)
+
+	windows := []LockCodeWindow{}
+	for _, start := range rule.Occurrences(r.StartAt.In(loc), from.Add(-1*duration), to) {
+		end := start.Add(duration)
+		if !end.After(from) {
+			continue
+		}
+		windows = append(windows, LockCodeWindow{EndAt: end, StartAt: start})
+	}
+
+	return windows, nil
+}
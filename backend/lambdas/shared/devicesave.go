@@ -0,0 +1,51 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// DeviceSaver is the part of a device repository that `SaveDevice` needs.
+type DeviceSaver interface {
+	Get(ctx context.Context, id uuid.UUID) (Device, bool, error)
+	PutIfUnchanged(ctx context.Context, item Device) (Device, error)
+}
+
+// How many times `SaveDevice` will try saving a device that keeps changing underneath it.
+const MaxDeviceSaveAttempts = 3
+
+// SaveDevice saves the device as long as nobody else has since it was read. If they have it's read again and `reapply` makes the same change to their version, so `reapply` shouldn't do anything other than change the device. It returns false when the change is no longer needed, and their version is returned without saving it.
+func SaveDevice(ctx context.Context, dr DeviceSaver, d Device, reapply func(d *Device) (bool, error)) (Device, error) {
+	for attempt := 1; ; attempt++ {
+		saved, err := dr.PutIfUnchanged(ctx, d)
+		if err == nil {
+			return saved, nil
+		}
+		if !errors.Is(err, ErrDeviceChanged) {
+			return Device{}, err
+		}
+		if attempt >= MaxDeviceSaveAttempts {
+			return Device{}, fmt.Errorf("device %s kept changing, gave up after %d attempts", d.ID, attempt)
+		}
+
+		fresh, ok, err := dr.Get(ctx, d.ID)
+		if err != nil {
+			return Device{}, fmt.Errorf("error getting device: %s", err.Error())
+		}
+		if !ok {
+			return Device{}, ErrDeviceDeleted
+		}
+
+		changed, err := reapply(&fresh)
+		if err != nil {
+			return Device{}, fmt.Errorf("error reapplying changes: %s", err.Error())
+		}
+		if !changed {
+			return fresh, nil
+		}
+		d = fresh
+	}
+}
@@ -0,0 +1,83 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// versionedDevices saves devices the way the real repository does, only if their version hasn't moved on.
+type versionedDevices struct {
+	devices map[uuid.UUID]Device
+	puts    int
+}
+
+func (r *versionedDevices) Get(ctx context.Context, id uuid.UUID) (Device, bool, error) {
+	d, ok := r.devices[id]
+	return d, ok, nil
+}
+
+func (r *versionedDevices) PutIfUnchanged(ctx context.Context, item Device) (Device, error) {
+	r.puts++
+	if r.devices[item.ID].Version != item.Version {
+		return Device{}, ErrDeviceChanged
+	}
+	item.Version++
+	r.devices[item.ID] = item
+	return item, nil
+}
+
+func TestSaveDevice_ReappliesToTheirVersion(t *testing.T) {
+	id := uuid.New()
+	r := &versionedDevices{devices: map[uuid.UUID]Device{id: {ID: id, Version: 1}}}
+
+	// We read it, then someone else saved a new battery level.
+	ours := r.devices[id]
+	ours.RawDevice.Name = "Front Door"
+	theirs := r.devices[id]
+	theirs.RawDevice.Battery.Level = 40
+	theirs.Version++
+	r.devices[id] = theirs
+
+	saved, err := SaveDevice(context.Background(), r, ours, func(d *Device) (bool, error) {
+		d.RawDevice.Name = "Front Door"
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.RawDevice.Name != "Front Door" || saved.RawDevice.Battery.Level != 40 || saved.Version != 3 {
+		t.Fatalf("unexpected: %+v", saved)
+	}
+}
+
+func TestSaveDevice_GivesUp(t *testing.T) {
+	id := uuid.New()
+	r := &versionedDevices{devices: map[uuid.UUID]Device{id: {ID: id, Version: 1}}}
+
+	// Someone else saves it every time we read it.
+	_, err := SaveDevice(context.Background(), r, Device{ID: id}, func(d *Device) (bool, error) {
+		d.Version--
+		return true, nil
+	})
+	if err == nil || r.puts != MaxDeviceSaveAttempts {
+		t.Fatalf("expected to give up after %d attempts, was %d: %v", MaxDeviceSaveAttempts, r.puts, err)
+	}
+
+	// The change isn't needed any more.
+	saved, err := SaveDevice(context.Background(), r, Device{ID: id}, func(d *Device) (bool, error) {
+		return false, nil
+	})
+	if err != nil || saved.Version != 1 {
+		t.Fatalf("unexpected: %+v, %v", saved, err)
+	}
+
+	delete(r.devices, id)
+	if _, err := SaveDevice(context.Background(), r, Device{ID: id, Version: 1}, func(d *Device) (bool, error) {
+		return true, nil
+	}); !errors.Is(err, ErrDeviceDeleted) {
+		t.Fatalf("expected ErrDeviceDeleted but was %v", err)
+	}
+}
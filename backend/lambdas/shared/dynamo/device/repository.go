@@ -2,12 +2,14 @@ package device
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"mlock/lambdas/shared"
 	"mlock/lambdas/shared/dynamo"
 	"mlock/lambdas/shared/dynamo/auditlog"
 	"sort"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -31,6 +33,20 @@ func (r *Repository) AppendToAuditLog(ctx context.Context, device shared.Device,
 		return nil
 	}
 
+	logs := []string{}
+	for _, mlc := range managedLockCodes {
+		logs = append(logs, fmt.Sprintf("Code: %s; Start: %s; End: %s; Note: %s", mlc.Code, mlc.StartAt.Format(time.RFC3339), mlc.EndAt.Format(time.RFC3339), mlc.Note))
+	}
+
+	return r.appendToAuditLog(ctx, device, logs)
+}
+
+// AppendNoteToAuditLog is for changes that aren't to a managed lock code, e.g. to a recurring code.
+func (r *Repository) AppendNoteToAuditLog(ctx context.Context, device shared.Device, note string) error {
+	return r.appendToAuditLog(ctx, device, []string{note})
+}
+
+func (r *Repository) appendToAuditLog(ctx context.Context, device shared.Device, logs []string) error {
 	al, exists, err := auditlog.Get(ctx, device.ID)
 	if err != nil {
 		return fmt.Errorf("error getting audit log: %s", err.Error())
@@ -40,12 +56,12 @@ func (r *Repository) AppendToAuditLog(ctx context.Context, device shared.Device,
 		al = shared.AuditLog{ID: device.ID}
 	}
 
-	for _, mlc := range managedLockCodes {
+	for _, log := range logs {
 		al.Entries = append(
 			al.Entries,
 			shared.AuditLogEntry{
 				CreatedAt: time.Now(),
-				Log:       fmt.Sprintf("Code: %s; Start: %s; End: %s; Note: %s", mlc.Code, mlc.StartAt.Format(time.RFC3339), mlc.EndAt.Format(time.RFC3339), mlc.Note),
+				Log:       log,
 			},
 		)
 	}
@@ -211,6 +227,15 @@ func (r *Repository) ListForUnit(ctx context.Context, unit shared.Unit) ([]share
 }
 
 func (r *Repository) Put(ctx context.Context, item shared.Device) (shared.Device, error) {
+	return r.put(ctx, item, false)
+}
+
+// PutIfUnchanged only saves the device if nobody else has since it was read, otherwise it returns `shared.ErrDeviceChanged`.
+func (r *Repository) PutIfUnchanged(ctx context.Context, item shared.Device) (shared.Device, error) {
+	return r.put(ctx, item, true)
+}
+
+func (r *Repository) put(ctx context.Context, item shared.Device, ifUnchanged bool) (shared.Device, error) {
 	dy, err := dynamo.GetClient(ctx)
 	if err != nil {
 		return shared.Device{}, fmt.Errorf("error getting client: %s", err.Error())
@@ -222,6 +247,8 @@ func (r *Repository) Put(ctx context.Context, item shared.Device) (shared.Device
 	}
 
 	item.ManagedLockCodes = r.sortManagedLockCodes(item.ManagedLockCodes)
+	readVersion := item.Version
+	item.Version++
 
 	av, err := dynamo.MarshalMapWithOptions(item)
 	if err != nil {
@@ -232,9 +259,21 @@ func (r *Repository) Put(ctx context.Context, item shared.Device) (shared.Device
 		Item:      av,
 		TableName: aws.String(tableName),
 	}
+	if ifUnchanged {
+		// Devices saved before there were versions don't have one.
+		input.ConditionExpression = aws.String("attribute_not_exists(#version) OR #version = :version")
+		input.ExpressionAttributeNames = map[string]string{"#version": "version"}
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":version": &types.AttributeValueMemberN{Value: strconv.Itoa(readVersion)},
+		}
+	}
 
 	_, err = dy.PutItem(ctx, input)
 	if err != nil {
+		var conditionalCheckFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionalCheckFailed) {
+			return shared.Device{}, shared.ErrDeviceChanged
+		}
 		return shared.Device{}, fmt.Errorf("error putting item: %s", err.Error())
 	}
 
@@ -0,0 +1,116 @@
+package synccursor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"mlock/lambdas/shared"
+	"mlock/lambdas/shared/dynamo"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+type Repository struct{}
+
+const (
+	tableName = "SyncCursors_v1"
+)
+
+func NewRepository() *Repository {
+	return &Repository{}
+}
+
+func (r *Repository) Get(ctx context.Context, id string) (shared.SyncCursor, bool, error) {
+	dy, err := dynamo.GetClient(ctx)
+	if err != nil {
+		return shared.SyncCursor{}, false, fmt.Errorf("error getting client: %s", err.Error())
+	}
+
+	result, err := dy.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return shared.SyncCursor{}, false, fmt.Errorf("error getting item: %s", err.Error())
+	}
+	if result.Item == nil {
+		return shared.SyncCursor{}, false, nil
+	}
+
+	item := &shared.SyncCursor{}
+	err = dynamo.UnmarshalMapWithOptions(result.Item, item)
+	if err != nil {
+		return shared.SyncCursor{}, false, fmt.Errorf("error unmarshalling: %s", err.Error())
+	}
+
+	return *item, true, nil
+}
+
+func (r *Repository) Put(ctx context.Context, item shared.SyncCursor) (shared.SyncCursor, error) {
+	dy, err := dynamo.GetClient(ctx)
+	if err != nil {
+		return shared.SyncCursor{}, fmt.Errorf("error getting client: %s", err.Error())
+	}
+
+	av, err := dynamo.MarshalMapWithOptions(item)
+	if err != nil {
+		return shared.SyncCursor{}, fmt.Errorf("error marshalling map: %s", err.Error())
+	}
+
+	input := &dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(tableName),
+	}
+
+	_, err = dy.PutItem(ctx, input)
+	if err != nil {
+		return shared.SyncCursor{}, fmt.Errorf("error putting item: %s", err.Error())
+	}
+
+	return item, nil
+}
+
+func Migrate(ctx context.Context) error {
+	exists, err := dynamo.TableExists(ctx, tableName)
+	if err != nil {
+		return fmt.Errorf("error checking for table: %s", err.Error())
+	}
+	if exists {
+		return nil
+	}
+
+	dy, err := dynamo.GetClient(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting client: %s", err.Error())
+	}
+
+	input := &dynamodb.CreateTableInput{
+		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String("id"),
+				AttributeType: "S",
+			},
+		},
+		BillingMode: "PAY_PER_REQUEST",
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String("id"),
+				KeyType:       "HASH",
+			},
+		},
+		TableName: aws.String(tableName),
+	}
+
+	result, err := dy.CreateTable(ctx, input)
+	if err != nil {
+		return fmt.Errorf("error creating table: %s", err.Error())
+	}
+
+	log.Printf("created table: %s - %+v", tableName, result)
+
+	return nil
+}
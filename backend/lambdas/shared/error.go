@@ -1,6 +1,19 @@
 package shared
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// ErrDeviceChanged is returned when saving a device that someone else saved after it was read.
+var ErrDeviceChanged = errors.New("the device changed since it was read")
+
+// ErrDeviceDeleted is returned when saving a device that someone else deleted after it was read.
+var ErrDeviceDeleted = errors.New("the device was deleted since it was read")
 
 type APIError struct {
 	StatusCode int
@@ -23,3 +36,15 @@ func (e *APIError) Is(target error) bool {
 	_, ok := target.(*APIError)
 	return ok
 }
+
+// UnitErrors is for when some units failed and the others didn't, what came back for the others can still be used.
+type UnitErrors map[uuid.UUID]error
+
+func (e UnitErrors) Error() string {
+	messages := []string{}
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	sort.Strings(messages)
+	return fmt.Sprintf("%d unit(s) failed: %s", len(e), strings.Join(messages, "; "))
+}
@@ -0,0 +1,89 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Event is a lock code lifecycle transition (or something that happened to a device), so that other features don't have to parse `Note`.
+type Event struct {
+	Code              string     `json:"code"`
+	ControllerID      string     `json:"controllerId"`
+	DeviceID          uuid.UUID  `json:"deviceId"`
+	Error             string     `json:"error"`
+	ManagedLockCodeID *uuid.UUID `json:"managedLockCodeId"` // Nil for events that aren't about a managed lock code.
+	Note              string     `json:"note"`
+	OccurredAt        time.Time  `json:"occurredAt"`
+	ReservationID     string     `json:"reservationId"`
+	Type              EventType  `json:"type"`
+	UnitID            *uuid.UUID `json:"unitId"`
+}
+
+type EventType string
+
+const (
+	EventTypeCodeAddAttempted     EventType = "CodeAddAttempted"
+	EventTypeCodeEnabled          EventType = "CodeEnabled"
+	EventTypeCodeFailed           EventType = "CodeFailed"
+	EventTypeCodeRemoveAttempted  EventType = "CodeRemoveAttempted"
+	EventTypeCodeRemoved          EventType = "CodeRemoved"
+	EventTypeCodeScheduled        EventType = "CodeScheduled"
+	EventTypeControllerRebooted   EventType = "ControllerRebooted"
+	EventTypeUnmanagedCodeRemoved EventType = "UnmanagedCodeRemoved"
+)
+
+func NewDeviceEvent(t EventType, occurredAt time.Time, d Device) Event {
+	return Event{
+		ControllerID: d.ControllerID,
+		DeviceID:     d.ID,
+		OccurredAt:   occurredAt,
+		Type:         t,
+		UnitID:       d.UnitID,
+	}
+}
+
+func NewCodeEvent(t EventType, occurredAt time.Time, d Device, mlc *DeviceManagedLockCode) Event {
+	e := NewDeviceEvent(t, occurredAt, d)
+	id := mlc.ID
+	e.Code = mlc.Code
+	e.ManagedLockCodeID = &id
+	e.Note = mlc.Note
+	e.ReservationID = mlc.Reservation.ID
+	if t == EventTypeCodeFailed || t == EventTypeCodeAddAttempted || t == EventTypeCodeRemoveAttempted {
+		e.Error = mlc.LastError
+	}
+	return e
+}
+
+// EventSinks sends each event to all of the sinks, it's how more than one thing can subscribe.
+type EventSinks []interface {
+	Emit(ctx context.Context, e Event) error
+}
+
+// Emit tries every sink even if one fails, so one broken subscriber doesn't starve the others.
+func (s EventSinks) Emit(ctx context.Context, e Event) error {
+	errs := []error{}
+	for _, sink := range s {
+		if err := sink.Emit(ctx, e); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// LogEventSink writes the events to the log, which is enough to search for them in CloudWatch.
+type LogEventSink struct{}
+
+func (s LogEventSink) Emit(ctx context.Context, e Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	log.Printf("EVENT: %s\n", b)
+	return nil
+}
@@ -0,0 +1,32 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type countingEventSink struct {
+	count int
+	err   error
+}
+
+func (s *countingEventSink) Emit(ctx context.Context, e Event) error {
+	s.count++
+	return s.err
+}
+
+func TestEventSinks_EmitReachesEverySink(t *testing.T) {
+	failing := &countingEventSink{err: fmt.Errorf("broken")}
+	alsoFailing := &countingEventSink{err: fmt.Errorf("also broken")}
+	working := &countingEventSink{}
+
+	err := EventSinks{failing, working, alsoFailing}.Emit(context.Background(), NewDeviceEvent(EventTypeControllerRebooted, time.Now(), Device{}))
+	if err == nil || err.Error() != "broken\nalso broken" {
+		t.Fatalf("unexpected: %v", err)
+	}
+	if failing.count != 1 || working.count != 1 || alsoFailing.count != 1 {
+		t.Fatalf("expected every sink to get the event")
+	}
+}
@@ -4,9 +4,32 @@ import (
 	"context"
 	"fmt"
 	mshared "mlock/shared"
+	"strings"
+	"sync"
+	"time"
 )
 
-func getAuthData(ctx context.Context) (authData, error) {
+type cachedAuth struct {
+	authData  authData
+	expiresAt time.Time
+}
+
+// authCacheKey is the login's username, along with the servers it's for.
+type authCacheKey struct {
+	authServers string
+	username    string
+}
+
+// Logins are cached for as long as the process lives, even though each connection pool has its own `Cloud`.
+var (
+	authDataByKey   = map[authCacheKey]cachedAuth{}
+	authDataByKeyMu sync.Mutex
+)
+
+// Stop using a login a little before it expires, so that it doesn't expire partway through connecting.
+const authExpiryMargin = 5 * time.Minute
+
+func (c Cloud) getAuthData(ctx context.Context) (authData, error) {
 	username, err := mshared.GetConfig("EZLO_USERNAME")
 	if err != nil {
 		return authData{}, fmt.Errorf("error getting username: %s", err.Error())
@@ -17,10 +40,45 @@ func getAuthData(ctx context.Context) (authData, error) {
 		return authData{}, fmt.Errorf("error getting password: %s", err.Error())
 	}
 
-	ad, err := authenticate(ctx, username, password)
+	// Held while we log in, so that concurrent callers don't all log in at once.
+	authDataByKeyMu.Lock()
+	defer authDataByKeyMu.Unlock()
+
+	key := c.authCacheKey(username)
+	now := time.Now()
+	if cached, ok := authDataByKey[key]; ok && now.Before(cached.expiresAt) {
+		return cached.authData, nil
+	}
+
+	ad, err := c.authenticate(ctx, username, password)
 	if err != nil {
 		return authData{}, fmt.Errorf("error authenticating: %s", err.Error())
 	}
 
+	// If we don't know when it expires we log in every time, like we used to.
+	if expiresAt := ad.expiresAt(); !expiresAt.IsZero() {
+		authDataByKey[key] = cachedAuth{
+			authData:  ad,
+			expiresAt: expiresAt.Add(-1 * authExpiryMargin),
+		}
+	}
+
 	return ad, nil
 }
+
+// forgetAuthData makes the next caller log in again, e.g. when the servers stop accepting the login before it says it expires.
+func (c Cloud) forgetAuthData() {
+	authDataByKeyMu.Lock()
+	defer authDataByKeyMu.Unlock()
+
+	authServers := c.authCacheKey("").authServers
+	for key := range authDataByKey {
+		if key.authServers == authServers {
+			delete(authDataByKey, key)
+		}
+	}
+}
+
+func (c Cloud) authCacheKey(username string) authCacheKey {
+	return authCacheKey{authServers: strings.Join(c.AuthServers, ","), username: username}
+}
@@ -0,0 +1,165 @@
+package ezlo
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A port that nothing listens on, so connecting to it fails straight away.
+const deadServer = "127.0.0.1:1"
+
+// newTestAuthServer stands in for all of the servers, `serverAccount` and `serverAccountAlt` are what the login tells us to use. It returns a cloud that uses it, its own host and how many times each path was requested.
+func newTestAuthServer(t *testing.T, expires time.Time, serverAccount string, serverAccountAlt string) (Cloud, string, map[string]*atomic.Int32) {
+	requests := map[string]*atomic.Int32{
+		"account": {},
+		"auth":    {},
+		"device":  {},
+	}
+
+	identity, err := json.Marshal(map[string]interface{}{"Expires": expires.Unix(), "PK_Account": 1234})
+	assert.Nil(t, err)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/autha/auth/username/"):
+			requests["auth"].Add(1)
+			json.NewEncoder(w).Encode(authResponse{
+				Identity:          base64.StdEncoding.EncodeToString(identity),
+				IdentitySignature: "signature",
+				ServerAccount:     strings.ReplaceAll(serverAccount, "self", r.Host),
+				ServerAccountAlt:  strings.ReplaceAll(serverAccountAlt, "self", r.Host),
+			})
+		case r.URL.Path == "/account/account/account/1234/devices":
+			requests["account"].Add(1)
+			if r.Header.Get("mmsAuthSig") != "signature" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(devicesResponse{Devices: []device{
+				{PKDevice: "controller", ServerDevice: deadServer, ServerDeviceAlt: r.Host},
+			}})
+		case r.URL.Path == "/device/device/device/controller":
+			requests["device"].Add(1)
+			json.NewEncoder(w).Encode(deviceResponse{NMAControllerStatus: 1, PKDevice: "controller"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	cloud := NewCloud()
+	cloud.AuthServers = []string{deadServer, host}
+	cloud.HTTPClient = server.Client()
+
+	t.Setenv("EZLO_USERNAME", "username")
+	t.Setenv("EZLO_PASSWORD", "password")
+
+	return cloud, host, requests
+}
+
+func Test_getAuthDataIsCached(t *testing.T) {
+	cloud, _, requests := newTestAuthServer(t, time.Now().Add(24*time.Hour), "self", "")
+
+	for i := 0; i < 3; i++ {
+		ad, err := cloud.getAuthData(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, 1234, ad.Identity.PKAccount)
+	}
+	assert.Equal(t, int32(1), requests["auth"].Load())
+
+	// Another cloud has its own logins.
+	other, _, otherRequests := newTestAuthServer(t, time.Now().Add(24*time.Hour), "self", "")
+	_, err := other.getAuthData(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), otherRequests["auth"].Load())
+
+	cloud.forgetAuthData()
+	_, err = other.getAuthData(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), otherRequests["auth"].Load())
+	_, err = cloud.getAuthData(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), requests["auth"].Load())
+}
+
+func Test_getAuthDataIsNotCachedWhenExpiring(t *testing.T) {
+	cloud, _, requests := newTestAuthServer(t, time.Now().Add(time.Minute), "self", "")
+
+	for i := 0; i < 2; i++ {
+		_, err := cloud.getAuthData(context.Background())
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, int32(2), requests["auth"].Load())
+}
+
+func Test_GetControllersFailsOver(t *testing.T) {
+	// The primary account server is down, and so is the controller's primary device server.
+	cloud, _, requests := newTestAuthServer(t, time.Now().Add(24*time.Hour), deadServer, "self")
+
+	online, offline, err := NewDeviceController(NewConnectionPool().WithCloud(cloud)).GetControllers(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []deviceResponse{{NMAControllerStatus: 1, PKDevice: "controller"}}, online)
+	assert.Empty(t, offline)
+
+	assert.Equal(t, int32(1), requests["auth"].Load())
+	assert.Equal(t, int32(1), requests["account"].Load())
+	assert.Equal(t, int32(1), requests["device"].Load())
+}
+
+func Test_GetControllersForgetsRejectedLogins(t *testing.T) {
+	cloud, host, requests := newTestAuthServer(t, time.Now().Add(24*time.Hour), "self", "")
+	dc := NewDeviceController(NewConnectionPool().WithCloud(cloud))
+
+	// A login that the account server no longer accepts.
+	authDataByKeyMu.Lock()
+	authDataByKey[cloud.authCacheKey("username")] = cachedAuth{
+		authData: authData{
+			Identity: authIdentity{PKAccount: 1234},
+			Response: authResponse{IdentitySignature: "old", ServerAccount: host},
+		},
+		expiresAt: time.Now().Add(time.Hour),
+	}
+	authDataByKeyMu.Unlock()
+
+	_, _, err := dc.GetControllers(context.Background())
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), fmt.Sprintf("%d", http.StatusUnauthorized))
+	assert.Equal(t, int32(0), requests["auth"].Load())
+
+	_, _, err = dc.GetControllers(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), requests["auth"].Load())
+}
+
+func Test_withFailover(t *testing.T) {
+	tried := []string{}
+	err := withFailover([]string{"a", "b", "c"}, func(server string) error {
+		tried = append(tried, server)
+		if server == "b" {
+			return nil
+		}
+		return fmt.Errorf("%s is down", server)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b"}, tried)
+
+	err = withFailover([]string{"a", "c"}, func(server string) error {
+		return fmt.Errorf("%s is down", server)
+	})
+	assert.Equal(t, "every server failed: a: a is down; c: c is down", err.Error())
+
+	err = withFailover([]string{}, func(server string) error { return nil })
+	assert.NotNil(t, err)
+}
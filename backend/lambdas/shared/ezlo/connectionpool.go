@@ -5,91 +5,272 @@ import (
 	"fmt"
 	"log"
 	"net/url"
-	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+)
 
-	"github.com/gorilla/websocket"
+const (
+	connectTimeout   = 2 * time.Second  // Connecting to the ws should be quick.
+	maxConnectionAge = 30 * time.Minute // Reconnect every so often rather than trusting a connection forever.
+	pingInterval     = 20 * time.Second // Often enough that the relay doesn't drop an idle connection.
+	pingTimeout      = 5 * time.Second
+	readTimeout      = pingInterval + pingTimeout // Long enough for the next ping to be answered.
+	relayFallbackAge = 5 * time.Minute            // When a local hub couldn't be reached, try it again before long.
 )
 
+// ConnectionPool is safe to use from multiple goroutines. Each controller has a single websocket, which can have several commands in flight at once.
 type ConnectionPool struct {
-	connectionByControllerID map[string]*websocket.Conn
+	cloud                    Cloud
+	connectionByControllerID map[string]*poolConnection
+	dial                     func(ctx context.Context, controllerID string) (*wsClient, time.Time, error)
+	dialLocal                func(ctx context.Context, hub LocalHub) (*wsClient, error)
+	dialRelay                func(ctx context.Context, controllerID string) (*wsClient, time.Time, error)
+	localHubByControllerID   map[string]LocalHub
+	maxConnectionAge         time.Duration
+	mu                       sync.Mutex
+	pingInterval             time.Duration
+}
+
+type poolConnection struct {
+	broken    *atomic.Bool  // Set when a ping fails, the next caller gets a new connection. Each connection gets its own so an old keepalive can't mark a new one.
+	expiresAt time.Time     // When the connection is too old, or the login it used runs out.
+	mu        sync.Mutex    // Held while connecting so that we only connect once per controller.
+	stop      chan struct{} // Closed to stop the keepalive.
+	ws        *wsClient
 }
 
 func NewConnectionPool() *ConnectionPool {
-	return &ConnectionPool{
-		connectionByControllerID: map[string]*websocket.Conn{},
+	cp := &ConnectionPool{
+		cloud:                    NewCloud(),
+		connectionByControllerID: map[string]*poolConnection{},
+		dialLocal:                connectLocal,
+		localHubByControllerID:   map[string]LocalHub{},
+		maxConnectionAge:         maxConnectionAge,
+		pingInterval:             pingInterval,
 	}
+	cp.dial = cp.connect
+	cp.dialRelay = cp.connectRelay
+	return cp
+}
+
+// WithCloud talks to these servers instead of the real ones.
+func (cp *ConnectionPool) WithCloud(c Cloud) *ConnectionPool {
+	cp.cloud = c
+	return cp
+}
+
+// WithLocalHubs connects to these controllers over the LAN, falling back to the cloud relay when they can't be reached.
+func (cp *ConnectionPool) WithLocalHubs(localHubByControllerID map[string]LocalHub) *ConnectionPool {
+	cp.localHubByControllerID = localHubByControllerID
+	return cp
 }
 
 func (cp *ConnectionPool) Close() {
-	for _, c := range cp.connectionByControllerID {
-		if err := c.Close(); err != nil {
-			log.Printf("error while closing connection: %s", err.Error())
-		}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	for _, pc := range cp.connectionByControllerID {
+		pc.mu.Lock()
+		pc.close()
+		pc.mu.Unlock()
 	}
 }
 
-func (cp *ConnectionPool) GetConnection(ctx context.Context, controllerID string) (*websocket.Conn, error) {
-	if ws, ok := cp.connectionByControllerID[controllerID]; ok {
-		return ws, nil
+// Do runs the commands on the controller's connection. If a command couldn't be sent because the connection had gone away, they're retried once on a new connection. Once a command has been sent we can't tell if the hub ran it, so those aren't retried.
+func (cp *ConnectionPool) Do(ctx context.Context, controllerID string, commands func(ws *wsClient) error) error {
+	ws, err := cp.GetConnection(ctx, controllerID)
+	if err != nil {
+		return fmt.Errorf("error getting websocket: %s", err.Error())
 	}
 
-	// Connecting to the ws should be quick.
-	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
-	defer cancel()
-	ws, err := cp.connect(ctx, controllerID)
+	err = commands(ws)
+	if err == nil || !wasNotSent(err) {
+		return err
+	}
+
+	log.Printf("retrying on a new connection to %s after: %s\n", controllerID, err.Error())
+	cp.discard(controllerID, ws)
+
+	ws, err = cp.GetConnection(ctx, controllerID)
+	if err != nil {
+		return fmt.Errorf("error getting websocket: %s", err.Error())
+	}
+
+	return commands(ws)
+}
+
+// GetConnection returns the controller's connection, making a new one if there isn't one or it's no longer healthy.
+func (cp *ConnectionPool) GetConnection(ctx context.Context, controllerID string) (*wsClient, error) {
+	cp.mu.Lock()
+	pc, ok := cp.connectionByControllerID[controllerID]
+	if !ok {
+		pc = &poolConnection{}
+		cp.connectionByControllerID[controllerID] = pc
+	}
+	cp.mu.Unlock()
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.healthy(time.Now()) {
+		return pc.ws, nil
+	}
+	pc.close()
+
+	ws, expiresAt, err := cp.dial(ctx, controllerID)
 	if err != nil {
 		return nil, fmt.Errorf("error connecting: %s", err.Error())
 	}
 
-	cp.connectionByControllerID[controllerID] = ws
+	pc.broken = &atomic.Bool{}
+	pc.expiresAt = expiresAt
+	if maxExpiresAt := time.Now().Add(cp.maxConnectionAge); expiresAt.IsZero() || expiresAt.After(maxExpiresAt) {
+		pc.expiresAt = maxExpiresAt
+	}
+	pc.stop = make(chan struct{})
+	pc.ws = ws
+	go cp.keepAlive(ws, pc.broken, pc.stop)
+
 	return ws, nil
 }
 
-func (cp *ConnectionPool) connect(ctx context.Context, controllerID string) (*websocket.Conn, error) {
-	ad, err := getAuthData(ctx)
+// Subscribe returns the broadcasts from the controller's current connection. The channel is closed along with the connection, call the func when you're done with it.
+func (cp *ConnectionPool) Subscribe(ctx context.Context, controllerID string) (<-chan Broadcast, func(), error) {
+	ws, err := cp.GetConnection(ctx, controllerID)
 	if err != nil {
-		return nil, fmt.Errorf("error getting auth data: %s", err.Error())
+		return nil, nil, fmt.Errorf("error getting websocket: %s", err.Error())
 	}
 
-	device, err := getDeviceByID(ctx, ad, controllerID)
-	if err != nil {
-		return nil, fmt.Errorf("error getting device by ID (%s): %s", controllerID, err.Error())
+	broadcasts, unsubscribe := ws.subscribe()
+	return broadcasts, unsubscribe, nil
+}
+
+// discard makes sure the next caller gets a new connection, unless someone already replaced `ws`.
+func (cp *ConnectionPool) discard(controllerID string, ws *wsClient) {
+	cp.mu.Lock()
+	pc, ok := cp.connectionByControllerID[controllerID]
+	cp.mu.Unlock()
+	if !ok {
+		return
 	}
 
-	deviceResponse, err := getDevice(ctx, ad, device)
-	if err != nil {
-		return nil, fmt.Errorf("error getting device: %s", err.Error())
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.ws == ws {
+		pc.close()
 	}
+}
+
+// keepAlive pings the hub until the connection is closed. The pongs keep the reader's deadline from running out, and gorilla answers the hub's pings for us.
+func (cp *ConnectionPool) keepAlive(ws *wsClient, broken *atomic.Bool, stop chan struct{}) {
+	ticker := time.NewTicker(cp.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ws.done:
+			broken.Store(true)
+			return
+		case <-ticker.C:
+			if err := ws.ping(pingTimeout); err != nil {
+				log.Printf("error pinging, will reconnect: %s\n", err.Error())
+				broken.Store(true)
+				return
+			}
+		}
+	}
+}
+
+func (pc *poolConnection) close() {
+	if pc.ws == nil {
+		return
+	}
+
+	close(pc.stop)
+	if err := pc.ws.close(); err != nil {
+		log.Printf("error while closing connection: %s", err.Error())
+	}
+	pc.ws = nil
+}
+
+func (pc *poolConnection) healthy(now time.Time) bool {
+	return pc.ws != nil && !pc.broken.Load() && !pc.ws.stopped() && now.Before(pc.expiresAt)
+}
+
+// wasNotSent is true when the connection went away before the command could be sent.
+func wasNotSent(err error) bool {
+	return strings.Contains(err.Error(), wsNotSentMessage)
+}
 
-	r, err := regexp.Compile("wss://(.*):443")
+func (cp *ConnectionPool) connect(ctx context.Context, controllerID string) (*wsClient, time.Time, error) {
+	hub, ok := cp.localHubByControllerID[controllerID]
+	if !ok {
+		return cp.dialRelay(ctx, controllerID)
+	}
+
+	ws, err := cp.dialLocal(ctx, hub)
+	if err == nil {
+		return ws, time.Time{}, nil
+	}
+	log.Printf("error connecting to %s locally, falling back to the relay: %s\n", controllerID, err.Error())
+
+	ws, expiresAt, err := cp.dialRelay(ctx, controllerID)
 	if err != nil {
-		return nil, fmt.Errorf("error compiling regex: %s", err.Error())
+		return nil, time.Time{}, fmt.Errorf("error connecting to the relay after failing to connect locally: %s", err.Error())
 	}
 
-	wsURLs := r.FindStringSubmatch(deviceResponse.ServerRelay)
-	if c := len(wsURLs); c != 2 {
-		return nil, fmt.Errorf("unexpected match count: %d", c)
+	if maxExpiresAt := time.Now().Add(relayFallbackAge); expiresAt.IsZero() || expiresAt.After(maxExpiresAt) {
+		expiresAt = maxExpiresAt
 	}
+	return ws, expiresAt, nil
+}
 
-	u := url.URL{Scheme: "wss", Host: wsURLs[1], Path: ""}
+func (cp *ConnectionPool) connectRelay(ctx context.Context, controllerID string) (*wsClient, time.Time, error) {
+	c := cp.cloud
+	ad, err := c.getAuthData(ctx)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("error getting auth data: %s", err.Error())
+	}
 
-	ws, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	device, err := c.getDeviceByID(ctx, ad, controllerID)
 	if err != nil {
-		return nil, fmt.Errorf("dial: %s", err.Error())
+		c.forgetAuthData()
+		return nil, time.Time{}, fmt.Errorf("error getting device by ID (%s): %s", controllerID, err.Error())
 	}
 
-	if err := ws.SetReadDeadline(time.Now().Add(30 * time.Second)); err != nil {
-		return nil, fmt.Errorf("setting read deadline: %s", err.Error())
+	deviceResponse, err := c.getDevice(ctx, ad, device)
+	if err != nil {
+		c.forgetAuthData()
+		return nil, time.Time{}, fmt.Errorf("error getting device: %s", err.Error())
 	}
 
-	if err := wsLogIn(ws, ad.Response); err != nil {
-		return nil, fmt.Errorf("login: %s", err.Error())
+	u, err := url.Parse(deviceResponse.ServerRelay)
+	if err != nil || u.Scheme != "wss" || u.Host == "" {
+		return nil, time.Time{}, fmt.Errorf("unexpected relay: %s", deviceResponse.ServerRelay)
 	}
 
-	if err := wsRegisterHub(ws, device.PKDevice); err != nil {
-		return nil, fmt.Errorf("register: %s", err.Error())
+	dialCtx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+	conn, _, err := c.WSDialer.DialContext(dialCtx, u.String(), nil)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("dial: %s", err.Error())
 	}
+	ws := newWSClient(conn, readTimeout)
 
-	return ws, nil
+	if err := wsLogIn(ctx, ws, ad.Response); err != nil {
+		c.forgetAuthData()
+		ws.close()
+		return nil, time.Time{}, fmt.Errorf("login: %s", err.Error())
+	}
+
+	if err := wsRegisterHub(ctx, ws, device.PKDevice); err != nil {
+		ws.close()
+		return nil, time.Time{}, fmt.Errorf("register: %s", err.Error())
+	}
+
+	return ws, ad.expiresAt(), nil
 }
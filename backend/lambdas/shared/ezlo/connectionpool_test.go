@@ -0,0 +1,257 @@
+package ezlo
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeHub answers every command, `answer` gets the connection and command numbers (counting from 1) and can drop the connection (by returning false) or send back an error.
+type fakeHub struct {
+	answer      func(connection int, command int) (bool, *wsResponse)
+	commands    int
+	connections int
+	mu          sync.Mutex
+	pings       int
+	server      *httptest.Server
+}
+
+func newFakeHub(t *testing.T, answer func(connection int, command int) (bool, *wsResponse)) *fakeHub {
+	h := &fakeHub{answer: answer}
+	upgrader := websocket.Upgrader{}
+
+	h.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("error upgrading: %s", err.Error())
+			return
+		}
+		defer ws.Close()
+
+		h.mu.Lock()
+		h.connections++
+		connection := h.connections
+		h.mu.Unlock()
+
+		ws.SetPingHandler(func(data string) error {
+			h.mu.Lock()
+			h.pings++
+			h.mu.Unlock()
+			return ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		})
+
+		for {
+			_, message, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			req := wsResponse{}
+			if err := json.Unmarshal(message, &req); err != nil {
+				t.Errorf("error unmarshalling: %s", err.Error())
+				return
+			}
+
+			h.mu.Lock()
+			h.commands++
+			command := h.commands
+			h.mu.Unlock()
+
+			ok, resp := h.answer(connection, command)
+			if !ok {
+				return
+			}
+			if resp == nil {
+				resp = &wsResponse{}
+			}
+			resp.ID = req.ID
+			resp.Method = req.Method
+			if err := ws.WriteJSON(resp); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(h.server.Close)
+
+	return h
+}
+
+// newConnectionPool connects to the hub directly, rather than logging in to find it.
+func (h *fakeHub) newConnectionPool(expiresAt time.Time) (*ConnectionPool, *int) {
+	dials := 0
+	cp := NewConnectionPool()
+	cp.dial = func(ctx context.Context, controllerID string) (*wsClient, time.Time, error) {
+		dials++
+		ws, _, err := websocket.DefaultDialer.DialContext(ctx, "ws"+strings.TrimPrefix(h.server.URL, "http"), nil)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		return newWSClient(ws, readTimeout), expiresAt, nil
+	}
+	return cp, &dials
+}
+
+func (h *fakeHub) commandCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.commands
+}
+
+func (h *fakeHub) pingCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.pings
+}
+
+func reboot(ws *wsClient) error {
+	return wsRebootHub(context.Background(), ws)
+}
+
+func Test_ConnectionPoolReusesConnections(t *testing.T) {
+	hub := newFakeHub(t, func(connection int, command int) (bool, *wsResponse) {
+		return true, nil
+	})
+	cp, dials := hub.newConnectionPool(time.Time{})
+	defer cp.Close()
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, cp.Do(context.Background(), "controller", reboot))
+	}
+	assert.Equal(t, 1, *dials)
+
+	// Each controller gets its own.
+	assert.Nil(t, cp.Do(context.Background(), "otherController", reboot))
+	assert.Equal(t, 2, *dials)
+}
+
+func Test_ConnectionPoolRetriesOnNewConnection(t *testing.T) {
+	hub := newFakeHub(t, func(connection int, command int) (bool, *wsResponse) {
+		return true, nil
+	})
+	cp, dials := hub.newConnectionPool(time.Time{})
+	defer cp.Close()
+
+	// The connection goes away before the command is sent.
+	closed := false
+	assert.Nil(t, cp.Do(context.Background(), "controller", func(ws *wsClient) error {
+		if !closed {
+			closed = true
+			ws.close()
+		}
+		return reboot(ws)
+	}))
+	assert.Equal(t, 2, *dials)
+	assert.Equal(t, 1, hub.commandCount())
+}
+
+func Test_ConnectionPoolOnlyRetriesOnce(t *testing.T) {
+	hub := newFakeHub(t, func(connection int, command int) (bool, *wsResponse) {
+		return true, nil
+	})
+	cp, dials := hub.newConnectionPool(time.Time{})
+	defer cp.Close()
+
+	assert.NotNil(t, cp.Do(context.Background(), "controller", func(ws *wsClient) error {
+		ws.close()
+		return reboot(ws)
+	}))
+	assert.Equal(t, 2, *dials)
+}
+
+func Test_ConnectionPoolDoesNotRetrySentCommands(t *testing.T) {
+	// The hub got the command, we can't tell if it ran it.
+	hub := newFakeHub(t, func(connection int, command int) (bool, *wsResponse) {
+		return false, nil
+	})
+	cp, dials := hub.newConnectionPool(time.Time{})
+	defer cp.Close()
+
+	assert.NotNil(t, cp.Do(context.Background(), "controller", reboot))
+	assert.Equal(t, 1, *dials)
+	assert.Equal(t, 1, hub.commandCount())
+
+	// The hub is slow to answer.
+	hub = newFakeHub(t, func(connection int, command int) (bool, *wsResponse) {
+		time.Sleep(200 * time.Millisecond)
+		return true, nil
+	})
+	cp, dials = hub.newConnectionPool(time.Time{})
+	defer cp.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.NotNil(t, cp.Do(ctx, "controller", func(ws *wsClient) error {
+		return wsRebootHub(ctx, ws)
+	}))
+	assert.Equal(t, 1, *dials)
+	assert.Equal(t, 1, hub.commandCount())
+}
+
+func Test_ConnectionPoolDoesNotRetryResponseErrors(t *testing.T) {
+	hub := newFakeHub(t, func(connection int, command int) (bool, *wsResponse) {
+		resp := &wsResponse{}
+		resp.Error = &struct {
+			Code        int    `json:"code"`
+			Data        string `json:"data"`
+			Description string `json:"description"`
+		}{Code: -32500, Description: "rpc.method.notfound"}
+		return true, resp
+	})
+	cp, dials := hub.newConnectionPool(time.Time{})
+	defer cp.Close()
+
+	err := cp.Do(context.Background(), "controller", reboot)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "rpc.method.notfound")
+	assert.Equal(t, 1, *dials)
+}
+
+func Test_ConnectionPoolReconnectsWhenExpired(t *testing.T) {
+	hub := newFakeHub(t, func(connection int, command int) (bool, *wsResponse) {
+		return true, nil
+	})
+
+	// The login ran out.
+	cp, dials := hub.newConnectionPool(time.Now().Add(-1 * time.Minute))
+	assert.Nil(t, cp.Do(context.Background(), "controller", reboot))
+	assert.Nil(t, cp.Do(context.Background(), "controller", reboot))
+	assert.Equal(t, 2, *dials)
+	cp.Close()
+
+	// The connection is too old.
+	cp, dials = hub.newConnectionPool(time.Now().Add(24 * time.Hour))
+	cp.maxConnectionAge = 0
+	assert.Nil(t, cp.Do(context.Background(), "controller", reboot))
+	assert.Nil(t, cp.Do(context.Background(), "controller", reboot))
+	assert.Equal(t, 2, *dials)
+	cp.Close()
+}
+
+func Test_ConnectionPoolKeepsConnectionsAlive(t *testing.T) {
+	hub := newFakeHub(t, func(connection int, command int) (bool, *wsResponse) {
+		return true, nil
+	})
+	cp, _ := hub.newConnectionPool(time.Time{})
+	cp.pingInterval = 10 * time.Millisecond
+	defer cp.Close()
+
+	_, err := cp.GetConnection(context.Background(), "controller")
+	assert.Nil(t, err)
+
+	assert.Eventually(t, func() bool { return hub.pingCount() >= 2 }, time.Second, 10*time.Millisecond)
+
+	// The pings stop with the connection.
+	cp.Close()
+	time.Sleep(50 * time.Millisecond)
+	pings := hub.pingCount()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, pings, hub.pingCount())
+}
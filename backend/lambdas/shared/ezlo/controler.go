@@ -5,22 +5,26 @@ import (
 	"fmt"
 )
 
-func GetControllers(ctx context.Context) ([]deviceResponse, []deviceResponse, error) {
-	ad, err := getAuthData(ctx)
+// GetControllers asks the cloud which of the account's controllers are online.
+func (d *DeviceController) GetControllers(ctx context.Context) ([]deviceResponse, []deviceResponse, error) {
+	c := d.connectionPool.cloud
+	ad, err := c.getAuthData(ctx)
 	if err != nil {
 		return nil, nil, fmt.Errorf("error getting auth data: %s", err.Error())
 	}
 
-	ds, err := getDevices(ctx, ad)
+	ds, err := c.getDevices(ctx, ad)
 	if err != nil {
+		c.forgetAuthData()
 		return nil, nil, fmt.Errorf("error getting devices: %s", err.Error())
 	}
 
 	online := []deviceResponse{}
 	offline := []deviceResponse{}
-	for _, d := range ds {
-		dr, err := getDevice(ctx, ad, d)
+	for _, device := range ds {
+		dr, err := c.getDevice(ctx, ad, device)
 		if err != nil {
+			c.forgetAuthData()
 			return nil, nil, fmt.Errorf("error getting device: %s", err.Error())
 		}
 
@@ -4,18 +4,22 @@ import (
 	"context"
 	"fmt"
 	"mlock/lambdas/shared"
+	"time"
 
 	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
 )
 
 type DeviceController struct {
-	connectionPool *ConnectionPool
+	connectionPool      *ConnectionPool
+	listenCheckInterval time.Duration
+	listenRetryDelay    time.Duration
 }
 
 func NewDeviceController(cp *ConnectionPool) *DeviceController {
 	return &DeviceController{
-		connectionPool: cp,
+		connectionPool:      cp,
+		listenCheckInterval: listenCheckInterval,
+		listenRetryDelay:    listenRetryDelay,
 	}
 }
 
@@ -24,39 +28,36 @@ func (d *DeviceController) AddLockCode(ctx context.Context, device shared.Device
 		return fmt.Errorf("device doesn't have a controller ID")
 	}
 
-	ws, err := d.connectionPool.GetConnection(ctx, device.ControllerID)
-	if err != nil {
-		return fmt.Errorf("error getting websocket: %s", err.Error())
-	}
-
-	lockCodes, item, err := wsGetLockCodesForDevice(ws, device.RawDevice.ID)
-	if err != nil {
-		return fmt.Errorf("error getting lock codes for device \"%s\": %s", device.RawDevice.Name, err.Error())
-	}
+	return d.connectionPool.Do(ctx, device.ControllerID, func(ws *wsClient) error {
+		lockCodes, item, err := wsGetLockCodesForDevice(ctx, ws, device.RawDevice.ID)
+		if err != nil {
+			return fmt.Errorf("error getting lock codes for device \"%s\": %s", device.RawDevice.Name, err.Error())
+		}
 
-	if len(lockCodes) >= item.ElementsMaxNumber {
-		return fmt.Errorf("max number of lock codes already set (%d)", item.ElementsMaxNumber)
-	}
+		if len(lockCodes) >= item.ElementsMaxNumber {
+			return fmt.Errorf("max number of lock codes already set (%d)", item.ElementsMaxNumber)
+		}
 
-	for _, lc := range lockCodes {
-		if lc.Code == code {
-			// Assume this is a retry of some sort.
-			return nil
+		for _, lc := range lockCodes {
+			if lc.Code == code {
+				// Assume this is a retry of some sort.
+				return nil
+			}
 		}
-	}
 
-	lc := shared.RawDeviceLockCode{
-		Code: code,
-		Mode: "enabled",
-		Name: code,
-	}
+		lc := shared.RawDeviceLockCode{
+			Code: code,
+			Mode: "enabled",
+			Name: code,
+		}
 
-	err = wsAddLockCodeForItem(ws, item, lc)
-	if err != nil {
-		return fmt.Errorf("error adding lock code: %s", err.Error())
-	}
+		err = wsAddLockCodeForItem(ctx, ws, item, lc)
+		if err != nil {
+			return fmt.Errorf("error adding lock code: %s", err.Error())
+		}
 
-	return nil
+		return nil
+	})
 }
 
 func (d *DeviceController) GetDevices(ctx context.Context, controllerID string) ([]shared.RawDevice, error) {
@@ -64,50 +65,71 @@ func (d *DeviceController) GetDevices(ctx context.Context, controllerID string)
 		return nil, nil
 	}
 
-	ws, err := d.connectionPool.GetConnection(ctx, controllerID)
-	if err != nil {
-		return []shared.RawDevice{}, fmt.Errorf("error getting websocket: %s", err.Error())
-	}
-
-	devices, err := getRawDevices(ws)
+	var devices []shared.RawDevice
+	err := d.connectionPool.Do(ctx, controllerID, func(ws *wsClient) error {
+		var err error
+		devices, err = getRawDevices(ctx, ws)
+		if err != nil {
+			return fmt.Errorf("error getting raw devices: %s", err.Error())
+		}
+		return nil
+	})
 	if err != nil {
-		return []shared.RawDevice{}, fmt.Errorf("error getting raw devices: %s", err.Error())
+		return []shared.RawDevice{}, err
 	}
 
 	return devices, nil
 }
 
-func (d *DeviceController) RediscoverDevice(ctx context.Context, device shared.Device) error {
+func (d *DeviceController) GetLockCodes(ctx context.Context, device shared.Device) ([]shared.RawDeviceLockCode, error) {
 	if device.ControllerID == "" {
-		return fmt.Errorf("device doesn't have a controller ID")
+		return nil, fmt.Errorf("device doesn't have a controller ID")
 	}
 
-	ws, err := d.connectionPool.GetConnection(ctx, device.ControllerID)
+	var lockCodes []shared.RawDeviceLockCode
+	err := d.connectionPool.Do(ctx, device.ControllerID, func(ws *wsClient) error {
+		var err error
+		lockCodes, _, err = wsGetLockCodesForDevice(ctx, ws, device.RawDevice.ID)
+		if err != nil {
+			return fmt.Errorf("error getting lock codes for device \"%s\": %s", device.RawDevice.Name, err.Error())
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("error getting websocket: %s", err.Error())
+		return nil, err
 	}
 
-	settings, err := wsGetDeviceSettings(ws, device.RawDevice.ID)
-	if err != nil {
-		return fmt.Errorf("error getting device settings for \"%s\": %s", device.RawDevice.Name, err.Error())
+	return lockCodes, nil
+}
+
+func (d *DeviceController) RediscoverDevice(ctx context.Context, device shared.Device) error {
+	if device.ControllerID == "" {
+		return fmt.Errorf("device doesn't have a controller ID")
 	}
 
-	rediscoverSettingID := ""
-	for _, setting := range settings {
-		if setting.Label.Text == "Rediscover device" {
-			rediscoverSettingID = setting.ID
-			break
+	return d.connectionPool.Do(ctx, device.ControllerID, func(ws *wsClient) error {
+		settings, err := wsGetDeviceSettings(ctx, ws, device.RawDevice.ID)
+		if err != nil {
+			return fmt.Errorf("error getting device settings for \"%s\": %s", device.RawDevice.Name, err.Error())
 		}
-	}
-	if rediscoverSettingID == "" {
-		return fmt.Errorf("couldn't find rediscover setting")
-	}
 
-	if err := wsSetDeviceSetting(ws, rediscoverSettingID, ""); err != nil {
-		return fmt.Errorf("error rediscovering device: %s", err.Error())
-	}
+		rediscoverSettingID := ""
+		for _, setting := range settings {
+			if setting.Label.Text == "Rediscover device" {
+				rediscoverSettingID = setting.ID
+				break
+			}
+		}
+		if rediscoverSettingID == "" {
+			return fmt.Errorf("couldn't find rediscover setting")
+		}
 
-	return nil
+		if err := wsSetDeviceSetting(ctx, ws, rediscoverSettingID, ""); err != nil {
+			return fmt.Errorf("error rediscovering device: %s", err.Error())
+		}
+
+		return nil
+	})
 }
 
 func (d *DeviceController) RebootController(ctx context.Context, device shared.Device) error {
@@ -115,16 +137,12 @@ func (d *DeviceController) RebootController(ctx context.Context, device shared.D
 		return fmt.Errorf("device doesn't have a controller ID")
 	}
 
-	ws, err := d.connectionPool.GetConnection(ctx, device.ControllerID)
-	if err != nil {
-		return fmt.Errorf("error getting websocket: %s", err.Error())
-	}
-
-	if err := wsRebootHub(ws); err != nil {
-		return fmt.Errorf("error rebooting controller: %s", err.Error())
-	}
-
-	return nil
+	return d.connectionPool.Do(ctx, device.ControllerID, func(ws *wsClient) error {
+		if err := wsRebootHub(ctx, ws); err != nil {
+			return fmt.Errorf("error rebooting controller: %s", err.Error())
+		}
+		return nil
+	})
 }
 
 func (d *DeviceController) RemoveLockCode(ctx context.Context, device shared.Device, code string) error {
@@ -133,37 +151,34 @@ func (d *DeviceController) RemoveLockCode(ctx context.Context, device shared.Dev
 		return fmt.Errorf("device doesn't have a controller ID")
 	}
 
-	ws, err := d.connectionPool.GetConnection(ctx, device.ControllerID)
-	if err != nil {
-		return fmt.Errorf("error getting websocket: %s", err.Error())
-	}
-
-	lockCodes, item, err := wsGetLockCodesForDevice(ws, device.RawDevice.ID)
-	if err != nil {
-		return fmt.Errorf("error getting lock codes for device \"%s\": %s", device.RawDevice.Name, err.Error())
-	}
+	return d.connectionPool.Do(ctx, device.ControllerID, func(ws *wsClient) error {
+		lockCodes, item, err := wsGetLockCodesForDevice(ctx, ws, device.RawDevice.ID)
+		if err != nil {
+			return fmt.Errorf("error getting lock codes for device \"%s\": %s", device.RawDevice.Name, err.Error())
+		}
 
-	slot := -1
-	for _, lc := range lockCodes {
-		if lc.Code == code {
-			slot = lc.Slot
-			break
+		slot := -1
+		for _, lc := range lockCodes {
+			if lc.Code == code {
+				slot = lc.Slot
+				break
+			}
+		}
+		if slot == -1 {
+			// If we can't find it, assume this was part of a retry and it's gone now.
+			return nil
 		}
-	}
-	if slot == -1 {
-		// If we can't find it, assume this was part of a retry and it's gone now.
-		return nil
-	}
 
-	err = wsRemoveLockCodeForItem(ws, item, fmt.Sprintf("%d", slot))
-	if err != nil {
-		return fmt.Errorf("error removing lock code: %s", err.Error())
-	}
+		err = wsRemoveLockCodeForItem(ctx, ws, item, fmt.Sprintf("%d", slot))
+		if err != nil {
+			return fmt.Errorf("error removing lock code: %s", err.Error())
+		}
 
-	return nil
+		return nil
+	})
 }
 
-func wsAddLockCodeForItem(ws *websocket.Conn, item wsItem, lockCode shared.RawDeviceLockCode) error {
+func wsAddLockCodeForItem(ctx context.Context, ws *wsClient, item wsItem, lockCode shared.RawDeviceLockCode) error {
 	// https://api.ezlo.com/hub/items_api/#hubitemdictionaryvalueadd
 	// https://api.ezlo.com/devices/item_value_types/index.html
 
@@ -185,6 +200,7 @@ func wsAddLockCodeForItem(ws *websocket.Conn, item wsItem, lockCode shared.RawDe
 	}
 
 	err := wsSendCommand(
+		ctx,
 		ws,
 		id,
 		struct {
@@ -215,13 +231,14 @@ func wsAddLockCodeForItem(ws *websocket.Conn, item wsItem, lockCode shared.RawDe
 	return nil
 }
 
-func wsGetLockCodesForDevice(ws *websocket.Conn, deviceID string) ([]shared.RawDeviceLockCode, wsItem, error) {
+func wsGetLockCodesForDevice(ctx context.Context, ws *wsClient, deviceID string) ([]shared.RawDeviceLockCode, wsItem, error) {
 	id := fmt.Sprintf("hub.items.list.%s", uuid.New())
 	resp := wsItemsListResponse{}
 	type params struct {
 		DeviceIDs []string `json:"deviceIds"`
 	}
 	err := wsSendCommand(
+		ctx,
 		ws,
 		id,
 		struct {
@@ -250,7 +267,7 @@ func wsGetLockCodesForDevice(ws *websocket.Conn, deviceID string) ([]shared.RawD
 
 			if item.ElementsMaxNumber == 0 {
 				// We didn't get an max number, some locks are as low as 6, but it's probably better to not artificially limit them.
-				item.ElementsMaxNumber = 30
+				item.ElementsMaxNumber = shared.DefaultMaxLockCodes
 			}
 
 			return lockCodes, item, nil
@@ -260,7 +277,7 @@ func wsGetLockCodesForDevice(ws *websocket.Conn, deviceID string) ([]shared.RawD
 	return []shared.RawDeviceLockCode{}, wsItem{}, fmt.Errorf("couldn't find lock codes for deviceID: %s", deviceID)
 }
 
-func wsRebootHub(ws *websocket.Conn) error {
+func wsRebootHub(ctx context.Context, ws *wsClient) error {
 	/*
 		Request:
 
@@ -284,6 +301,7 @@ func wsRebootHub(ws *websocket.Conn) error {
 
 	type params struct{}
 	err := wsSendCommand(
+		ctx,
 		ws,
 		id,
 		struct {
@@ -304,7 +322,7 @@ func wsRebootHub(ws *websocket.Conn) error {
 	return nil
 }
 
-func wsRemoveLockCodeForItem(ws *websocket.Conn, item wsItem, slot string) error {
+func wsRemoveLockCodeForItem(ctx context.Context, ws *wsClient, item wsItem, slot string) error {
 	id := fmt.Sprintf("hub.item.dictionary.value.remove.%s", uuid.New())
 	resp := wsItemsListResponse{}
 
@@ -314,6 +332,7 @@ func wsRemoveLockCodeForItem(ws *websocket.Conn, item wsItem, slot string) error
 	}
 
 	err := wsSendCommand(
+		ctx,
 		ws,
 		id,
 		struct {
@@ -1,10 +1,10 @@
 package ezlo
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
 )
 
 type wsDeviceSetting struct {
@@ -41,12 +41,13 @@ type wsSetDeviceSettingResponse struct {
 	Method string `json:"method"`
 }
 
-func wsGetDeviceSettings(ws *websocket.Conn, deviceID string) ([]wsDeviceSetting, error) {
+func wsGetDeviceSettings(ctx context.Context, ws *wsClient, deviceID string) ([]wsDeviceSetting, error) {
 	method := "hub.device.settings.list"
 	id := fmt.Sprintf("%s.%s", method, uuid.New())
 	resp := wsDeviceSettingsListResponse{}
 	type params struct{}
 	err := wsSendCommand(
+		ctx,
 		ws,
 		id,
 		struct {
@@ -74,7 +75,7 @@ func wsGetDeviceSettings(ws *websocket.Conn, deviceID string) ([]wsDeviceSetting
 	return results, nil
 }
 
-func wsSetDeviceSetting(ws *websocket.Conn, settingID string, value string) error {
+func wsSetDeviceSetting(ctx context.Context, ws *wsClient, settingID string, value string) error {
 	method := "hub.device.setting.value.set"
 	id := fmt.Sprintf("%s.%s", method, uuid.New())
 	resp := wsSetDeviceSettingResponse{}
@@ -85,6 +86,7 @@ func wsSetDeviceSetting(ws *websocket.Conn, settingID string, value string) erro
 	}
 
 	err := wsSendCommand(
+		ctx,
 		ws,
 		id,
 		struct {
@@ -6,8 +6,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"mlock/lambdas/shared"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -16,8 +18,8 @@ import (
 
 type authIdentity struct {
 	// There are lot of other fields that we get back.
-	PKAccount int `json:"PK_Account"`
-	//"Expires":1635128723,
+	PKAccount int   `json:"PK_Account"`
+	Expires   int64 `json:"Expires"` // Unix time.
 	//"Generated":1635042323,
 	//"PermissionsEnabled":[
 	//  1,
@@ -62,6 +64,23 @@ type authData struct {
 	Response authResponse
 }
 
+// accountServers are the ones the login told us to use, in the order we should try them.
+func (ad authData) accountServers() []string {
+	servers := nonEmpty(ad.Response.ServerAccount, ad.Response.ServerAccountAlt)
+	if len(servers) == 0 {
+		servers = []string{defaultAccountServer}
+	}
+	return servers
+}
+
+// expiresAt is zero if we don't know when the login runs out.
+func (ad authData) expiresAt() time.Time {
+	if ad.Identity.Expires == 0 {
+		return time.Time{}
+	}
+	return time.Unix(ad.Identity.Expires, 0)
+}
+
 type device struct {
 	Blocked         int    `json:"Blocked"`
 	DeviceAssigned  string `json:"DeviceAssigned"`
@@ -184,13 +203,42 @@ type wsRegisterRequestParams struct {
 
 const ENHANCED_LOGGING = false
 
-func getRawDevices(ws *websocket.Conn) ([]shared.RawDevice, error) {
-	deviceListResp, err := wsDeviceList(ws)
+// For logins that don't tell us which account servers to use.
+const defaultAccountServer = "vera-us-oem-account11.mios.com"
+
+// Cloud is where Ezlo's servers are and how we talk to them, tests point it at a fake one (see ezlotest).
+type Cloud struct {
+	AuthServers []string // We log in with the first one that works, the login tells us which servers to use for everything else.
+	HTTPClient  *http.Client
+	WSDialer    *websocket.Dialer // For the relay's websockets.
+}
+
+func NewCloud() Cloud {
+	return Cloud{
+		AuthServers: []string{
+			"vera-us-oem-account11.mios.com",
+			"vera-us-oem-autha11.mios.com",
+		},
+		HTTPClient: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+		WSDialer: websocket.DefaultDialer,
+	}
+}
+
+// How long we'll wait for the hub to take a command and answer it, unless the context runs out first.
+const commandTimeout = 30 * time.Second
+
+// Errors with this message mean that the hub got the command and answered with an error, so `Do` doesn't retry them.
+const wsResponseErrorMessage = "error in WS response"
+
+func getRawDevices(ctx context.Context, ws *wsClient) ([]shared.RawDevice, error) {
+	deviceListResp, err := wsDeviceList(ctx, ws)
 	if err != nil {
 		return []shared.RawDevice{}, fmt.Errorf("error getting device list: %s", err.Error())
 	}
 
-	itemsByDevice, err := wsItemsByDevice(ws)
+	itemsByDevice, err := wsItemsByDevice(ctx, ws)
 	if err != nil {
 		return []shared.RawDevice{}, fmt.Errorf("error getting items by device: %s", err.Error())
 	}
@@ -223,6 +271,7 @@ func getRawDevices(ws *websocket.Conn) ([]shared.RawDevice, error) {
 				if rd.LockCodes, err = item.getLockCodes(); err != nil {
 					return []shared.RawDevice{}, fmt.Errorf("error getting lock codes: %s", err.Error())
 				}
+				rd.MaxLockCodes = item.ElementsMaxNumber
 			}
 		}
 
@@ -232,41 +281,27 @@ func getRawDevices(ws *websocket.Conn) ([]shared.RawDevice, error) {
 	return result, nil
 }
 
-func authenticate(ctx context.Context, username string, password string) (authData, error) {
-	// TODO: get a list of the endpoints and use a random one?
-	// "vera-us-oem-account12.mios.com"
-	url := fmt.Sprintf("https://vera-us-oem-account11.mios.com/autha/auth/username/%s", username)
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
-		return authData{}, fmt.Errorf("error creating request: %s", err.Error())
-	}
-
-	q := req.URL.Query()
-	q.Add("SHA1Password", password)
-	q.Add("SHA1PasswordCS", password)
-	q.Add("PK_Oem", "1")
-	q.Add("TokenVersion", "2")
-	req.URL.RawQuery = q.Encode()
+func (c Cloud) authenticate(ctx context.Context, username string, password string) (authData, error) {
+	body := authResponse{}
+	err := withFailover(c.AuthServers, func(server string) error {
+		url := fmt.Sprintf("https://%s/autha/auth/username/%s", server, username)
 
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return fmt.Errorf("error creating request: %s", err.Error())
+		}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return authData{}, fmt.Errorf("error doing request: %s", err.Error())
-	}
-	defer resp.Body.Close()
+		q := req.URL.Query()
+		q.Add("SHA1Password", password)
+		q.Add("SHA1PasswordCS", password)
+		q.Add("PK_Oem", "1")
+		q.Add("TokenVersion", "2")
+		req.URL.RawQuery = q.Encode()
 
-	respBody, err := io.ReadAll(resp.Body)
+		return c.doJSON(req, &body)
+	})
 	if err != nil {
-		return authData{}, fmt.Errorf("error reading body: %s", err.Error())
-	}
-
-	body := authResponse{}
-	if err := json.Unmarshal(respBody, &body); err != nil {
-		return authData{}, fmt.Errorf("error unmarshalling body: %s", err.Error())
+		return authData{}, err
 	}
 
 	identityString, err := base64.StdEncoding.DecodeString(body.Identity)
@@ -285,43 +320,27 @@ func authenticate(ctx context.Context, username string, password string) (authDa
 	}, nil
 }
 
-func getDevice(ctx context.Context, ad authData, d device) (deviceResponse, error) {
-	// TODO: we probably need to use the same domain that we used to auth.
-	url := fmt.Sprintf("https://vera-us-oem-account11.mios.com/device/device/device/%s", d.PKDevice)
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
-		return deviceResponse{}, fmt.Errorf("error creating request: %s", err.Error())
-	}
-
-	req.Header.Set("mmsAuth", ad.Response.Identity)
-	req.Header.Set("mmsAuthSig", ad.Response.IdentitySignature)
-
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return deviceResponse{}, fmt.Errorf("error doing request: %s", err.Error())
-	}
-	defer resp.Body.Close()
-
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return deviceResponse{}, fmt.Errorf("error reading body: %s", err.Error())
+func (c Cloud) getDevice(ctx context.Context, ad authData, d device) (deviceResponse, error) {
+	// The device knows which servers have its details, the account's servers are a fallback for when it doesn't say.
+	servers := nonEmpty(d.ServerDevice, d.ServerDeviceAlt)
+	if len(servers) == 0 {
+		servers = ad.accountServers()
 	}
 
 	body := deviceResponse{}
-	if err := json.Unmarshal(respBody, &body); err != nil {
-		return deviceResponse{}, fmt.Errorf("error unmarshalling body: %s; error: %s", string(respBody), err.Error())
+	err := withFailover(servers, func(server string) error {
+		url := fmt.Sprintf("https://%s/device/device/device/%s", server, d.PKDevice)
+		return c.getWithAuth(ctx, ad, url, &body)
+	})
+	if err != nil {
+		return deviceResponse{}, err
 	}
 
 	return body, nil
 }
 
-func getDeviceByID(ctx context.Context, ad authData, controllerID string) (device, error) {
-	devices, err := getDevices(ctx, ad)
+func (c Cloud) getDeviceByID(ctx context.Context, ad authData, controllerID string) (device, error) {
+	devices, err := c.getDevices(ctx, ad)
 	if err != nil {
 		return device{}, fmt.Errorf("error getting devices: %s", err.Error())
 	}
@@ -334,42 +353,84 @@ func getDeviceByID(ctx context.Context, ad authData, controllerID string) (devic
 
 	return device{}, fmt.Errorf("unable to find device: %+v", devices)
 }
-func getDevices(ctx context.Context, ad authData) ([]device, error) {
-	// TODO: we probably need to use the same domain that we used to auth.
-	url := fmt.Sprintf("https://vera-us-oem-account11.mios.com/account/account/account/%d/devices", ad.Identity.PKAccount)
+func (c Cloud) getDevices(ctx context.Context, ad authData) ([]device, error) {
+	body := devicesResponse{}
+	err := withFailover(ad.accountServers(), func(server string) error {
+		url := fmt.Sprintf("https://%s/account/account/account/%d/devices", server, ad.Identity.PKAccount)
+		return c.getWithAuth(ctx, ad, url, &body)
+	})
+	if err != nil {
+		return []device{}, err
+	}
+
+	return body.Devices, nil
+}
 
+// getWithAuth gets `url` as the logged in user.
+func (c Cloud) getWithAuth(ctx context.Context, ad authData, url string, out interface{}) error {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return []device{}, fmt.Errorf("error creating request: %s", err.Error())
+		return fmt.Errorf("error creating request: %s", err.Error())
 	}
 
 	req.Header.Set("mmsAuth", ad.Response.Identity)
 	req.Header.Set("mmsAuthSig", ad.Response.IdentitySignature)
 
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
+	return c.doJSON(req, out)
+}
 
-	resp, err := client.Do(req)
+func (c Cloud) doJSON(req *http.Request, out interface{}) error {
+	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
-		return []device{}, fmt.Errorf("error doing request: %s", err.Error())
+		return fmt.Errorf("error doing request: %s", err.Error())
 	}
 	defer resp.Body.Close()
 
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return []device{}, fmt.Errorf("error reading body: %s", err.Error())
+		return fmt.Errorf("error reading body: %s", err.Error())
 	}
 
-	body := devicesResponse{}
-	if err := json.Unmarshal(respBody, &body); err != nil {
-		return []device{}, fmt.Errorf("error unmarshalling body: %s; url: %s; authData: %+v; error: %s", string(respBody), url, ad, err.Error())
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code: %d; body: %s", resp.StatusCode, string(respBody))
 	}
 
-	return body.Devices, nil
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("error unmarshalling body: %s; error: %s", string(respBody), err.Error())
+	}
+
+	return nil
+}
+
+// withFailover tries each server in turn until one of them works.
+func withFailover(servers []string, try func(server string) error) error {
+	errs := []string{}
+	for _, server := range servers {
+		err := try(server)
+		if err == nil {
+			return nil
+		}
+		log.Printf("error from %s: %s\n", server, err.Error())
+		errs = append(errs, fmt.Sprintf("%s: %s", server, err.Error()))
+	}
+
+	if len(errs) == 0 {
+		return fmt.Errorf("no servers to try")
+	}
+	return fmt.Errorf("every server failed: %s", strings.Join(errs, "; "))
 }
 
-func wsSendCommand(ws *websocket.Conn, id string, request interface{}, outResponse interface{}) error {
+func nonEmpty(values ...string) []string {
+	result := []string{}
+	for _, v := range values {
+		if v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func wsSendCommand(ctx context.Context, ws *wsClient, id string, request interface{}, outResponse interface{}) error {
 	jsonReq, err := json.Marshal(request)
 	if err != nil {
 		return fmt.Errorf("marshal: %s", err.Error())
@@ -379,49 +440,31 @@ func wsSendCommand(ws *websocket.Conn, id string, request interface{}, outRespon
 		fmt.Printf("sending: %s\n", string(jsonReq))
 	}
 
-	if err := ws.WriteMessage(websocket.TextMessage, jsonReq); err != nil {
-		return fmt.Errorf("write: %s", err.Error())
+	jsonResp, err := ws.send(ctx, id, jsonReq)
+	if err != nil {
+		return err
 	}
 
-	for {
-		_, jsonResp, err := ws.ReadMessage()
-		if err != nil {
-			return fmt.Errorf("read: %s", err.Error())
-		}
-
-		resp := wsResponse{}
-		if err := json.Unmarshal(jsonResp, &resp); err != nil {
-			return fmt.Errorf("unmarshal: %s", err.Error())
-		}
-
-		if resp.ID == "ui_broadcast" {
-			// We don't care about these, try to get the next message.
-			continue
-		}
-
-		if resp.ID != id {
-			return fmt.Errorf("unexpected response ID: %s, expected: %s", resp.ID, id)
-		}
-
-		if resp.Error != nil {
-			return fmt.Errorf("error in WS response: %+v", resp.Error)
-		}
-
-		if err := json.Unmarshal(jsonResp, &outResponse); err != nil {
-			return fmt.Errorf("unmarshal: %s", err.Error())
-		}
+	resp := wsResponse{}
+	if err := json.Unmarshal(jsonResp, &resp); err != nil {
+		return fmt.Errorf("unmarshal: %s", err.Error())
+	}
 
-		if ENHANCED_LOGGING {
-			fmt.Printf("received: %s\n", string(jsonResp))
-		}
+	if resp.Error != nil {
+		return fmt.Errorf("%s: %+v", wsResponseErrorMessage, resp.Error)
+	}
 
-		return nil
+	if err := json.Unmarshal(jsonResp, &outResponse); err != nil {
+		return fmt.Errorf("unmarshal: %s", err.Error())
 	}
+
+	return nil
 }
 
-func wsLogIn(ws *websocket.Conn, ar authResponse) error {
+func wsLogIn(ctx context.Context, ws *wsClient, ar authResponse) error {
 	id := fmt.Sprintf("loginUserMios.%s", uuid.New())
 	err := wsSendCommand(
+		ctx,
 		ws,
 		id,
 		wsLogInRequest{
@@ -441,9 +484,10 @@ func wsLogIn(ws *websocket.Conn, ar authResponse) error {
 	return nil
 }
 
-func wsRegisterHub(ws *websocket.Conn, hubSerialNumber string) error {
+func wsRegisterHub(ctx context.Context, ws *wsClient, hubSerialNumber string) error {
 	id := fmt.Sprintf("register.%s", uuid.New())
 	err := wsSendCommand(
+		ctx,
 		ws,
 		id,
 		wsRegisterRequest{
@@ -462,10 +506,11 @@ func wsRegisterHub(ws *websocket.Conn, hubSerialNumber string) error {
 	return nil
 }
 
-func wsDeviceList(ws *websocket.Conn) (wsDeviceListResponse, error) {
+func wsDeviceList(ctx context.Context, ws *wsClient) (wsDeviceListResponse, error) {
 	id := fmt.Sprintf("hub.devices.list.%s", uuid.New())
 	resp := wsDeviceListResponse{}
 	err := wsSendCommand(
+		ctx,
 		ws,
 		id,
 		struct {
@@ -485,12 +530,13 @@ func wsDeviceList(ws *websocket.Conn) (wsDeviceListResponse, error) {
 	return resp, nil
 }
 
-func wsItemsByDevice(ws *websocket.Conn) (map[string][]wsItem, error) {
+func wsItemsByDevice(ctx context.Context, ws *wsClient) (map[string][]wsItem, error) {
 	itemsByDevice := map[string][]wsItem{}
 
 	id := fmt.Sprintf("hub.items.list.%s", uuid.New())
 	resp := wsItemsListResponse{}
 	err := wsSendCommand(
+		ctx,
 		ws,
 		id,
 		struct {
@@ -1,20 +1,19 @@
-package ezlo
+package ezlo_test
 
 import (
 	"context"
-	"fmt"
+	"mlock/lambdas/shared"
+	"mlock/lambdas/shared/ezlo"
+	"mlock/lambdas/shared/ezlo/ezlotest"
 	"testing"
+	"time"
 
-	"github.com/joho/godotenv"
 	"github.com/stretchr/testify/assert"
 )
 
 func Test_GetDevicesNoController(t *testing.T) {
-	assert.Nil(t, loadConfig())
-
-	cp := NewConnectionPool()
-	defer cp.Close()
-	dc := NewDeviceController(cp)
+	s := ezlotest.NewServer(t)
+	dc := newDeviceController(t, s)
 
 	ds, err := dc.GetDevices(context.Background(), "")
 	assert.Nil(t, err)
@@ -22,92 +21,256 @@ func Test_GetDevicesNoController(t *testing.T) {
 }
 
 func Test_GetDevices(t *testing.T) {
-	assert.Nil(t, loadConfig())
+	s := ezlotest.NewServer(t)
+	c := s.AddController("controller")
+	c.AddLock("lock", "Front Door", 80, "1111", "2222")
+	c.AddDevice(ezlotest.Device{Category: "switch", DeviceTypeID: "switch", ID: "switch", Name: "Lights", Reachable: true})
+	c.AddDevice(ezlotest.Device{DeviceTypeID: "0_0_0", ID: "new", Name: "Not Set Up", Reachable: true})
+	dc := newDeviceController(t, s)
+
+	ds, err := dc.GetDevices(context.Background(), "controller")
+	assert.Nil(t, err)
+	assert.Equal(t, []shared.RawDevice{
+		{
+			Battery:      shared.RawDeviceBattery{BatteryPowered: true, Level: 80},
+			Category:     "door_lock",
+			DeviceTypeID: "lock",
+			ID:           "lock",
+			LockCodes: []shared.RawDeviceLockCode{
+				{Code: "1111", Mode: "enabled", Name: "1111", Slot: 1},
+				{Code: "2222", Mode: "enabled", Name: "2222", Slot: 2},
+			},
+			MaxLockCodes: 10,
+			Name:         "Front Door",
+			Status:       shared.DeviceStatusOnline,
+		},
+		{Category: "switch", DeviceTypeID: "switch", ID: "switch", Name: "Lights", Status: shared.DeviceStatusOnline},
+		{DeviceTypeID: "0_0_0", ID: "new", Name: "Not Set Up", Status: shared.DeviceStatusOffline},
+	}, ds)
+}
 
-	cp := NewConnectionPool()
-	defer cp.Close()
-	dc := NewDeviceController(cp)
+func Test_AddLockCode(t *testing.T) {
+	s := ezlotest.NewServer(t)
+	c := s.AddController("controller")
+	c.AddLock("lock", "Front Door", 100, "1111")
+	dc := newDeviceController(t, s)
+	lock := newLock("controller", "lock")
 
-	ds, err := dc.GetDevices(context.Background(), "90029032")
+	err := dc.AddLockCode(context.Background(), lock, "2222")
 	assert.Nil(t, err)
+	assert.Equal(t, []string{"1111", "2222"}, c.Codes("lock"))
 
-	// Just check that we have at least one device (fragile).
-	assert.Greater(t, len(ds), 0)
-	assert.Equal(t, ds[0].Category, "switch")
+	// It's already there, so this is a retry.
+	err = dc.AddLockCode(context.Background(), lock, "2222")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1111", "2222"}, c.Codes("lock"))
 
-	// Uncomment to see everything in an error
-	//assert.Nil(t, ds)
+	lockCodes, err := dc.GetLockCodes(context.Background(), lock)
+	assert.Nil(t, err)
+	assert.Equal(t, []shared.RawDeviceLockCode{
+		{Code: "1111", Mode: "enabled", Name: "1111", Slot: 1},
+		{Code: "2222", Mode: "enabled", Name: "2222", Slot: 2},
+	}, lockCodes)
 }
 
-func Test_TemporarySearchDevices(t *testing.T) {
-	assert.Nil(t, loadConfig())
-
-	/*
-		for _, cID := range []string{
-			"84901957",
-			"84902125",
-			"84902278",
-			"84911082",
-			"90010778",
-			"90010799",
-			"92001809",
-		} {
-			cp := NewConnectionPool()
-			defer cp.Close()
-			dc := NewDeviceController(cp)
-
-			ds, err := dc.GetDevices(context.Background(), cID)
-			assert.Nil(t, err)
-
-			for _, d := range ds {
-				if d.DeviceTypeID == "0_0_0" || d.Name == "06B Lock 849749 (1BE469)" {
-					fmt.Printf("%s - %s - %+v\n", d.DeviceTypeID, d.Status, d)
-				}
-			}
-		}
+func Test_AddLockCodeWhenFull(t *testing.T) {
+	s := ezlotest.NewServer(t)
+	c := s.AddController("controller")
+	c.AddDevice(ezlotest.Device{
+		ID:           "lock",
+		LockCodes:    map[int]ezlotest.LockCode{1: {Code: "1111"}},
+		MaxLockCodes: 1,
+		Reachable:    true,
+	})
+	dc := newDeviceController(t, s)
 
-		// Uncomment to see everything in an error
-		assert.Nil(t, "hi")
-	*/
+	err := dc.AddLockCode(context.Background(), newLock("controller", "lock"), "2222")
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"1111"}, c.Codes("lock"))
 }
 
-func Test_AddLockCode(t *testing.T) {
-	assert.Nil(t, loadConfig())
-
-	/*
-		// We should really do some audit logging here... :(
-		err := AddLockCode(
-			context.Background(),
-			shared.Property{ControllerID: "92001809"},
-			shared.Device{RawDevice: shared.RawDevice{ID: "6159fc8e939a9313ca423558"}}, // "ZC3 (In Box)"
-			"3001",
-		)
-		assert.Nil(t, err)
-		assert.NotNil(t, err)
-	*/
+func Test_RemoveLockCode(t *testing.T) {
+	s := ezlotest.NewServer(t)
+	c := s.AddController("controller")
+	c.AddLock("lock", "Front Door", 100, "1111", "2222", "3333")
+	dc := newDeviceController(t, s)
+	lock := newLock("controller", "lock")
+
+	err := dc.RemoveLockCode(context.Background(), lock, "2222")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1111", "3333"}, c.Codes("lock"))
+
+	// It's already gone, so this is a retry.
+	err = dc.RemoveLockCode(context.Background(), lock, "2222")
+	assert.Nil(t, err)
+
+	// The free slot gets used next.
+	err = dc.AddLockCode(context.Background(), lock, "4444")
+	assert.Nil(t, err)
+	d, _ := c.Device("lock")
+	assert.Equal(t, "4444", d.LockCodes[2].Code)
 }
 
-func Test_RemoveLockCode(t *testing.T) {
-	assert.Nil(t, loadConfig())
-
-	/*
-		// We should really do some audit logging here... :(
-		err := RemoveLockCode(
-			context.Background(),
-			shared.Property{ControllerID: "92001809"},
-			shared.Device{RawDevice: shared.RawDevice{ID: "6159fc8e939a9313ca423558"}}, // "ZC3 (In Box)"
-			shared.DeviceManagedLockCode{
-				Code: "3001",
-			},
-		)
-		assert.Nil(t, err)
-		assert.NotNil(t, err)
-	*/
+func Test_RediscoverDeviceAndRebootController(t *testing.T) {
+	s := ezlotest.NewServer(t)
+	c := s.AddController("controller")
+	c.AddLock("lock", "Front Door", 100)
+	c.AddDevice(ezlotest.Device{ID: "switch", Reachable: true})
+	dc := newDeviceController(t, s)
+
+	err := dc.RediscoverDevice(context.Background(), newLock("controller", "lock"))
+	assert.Nil(t, err)
+
+	// The switch doesn't have a rediscover setting.
+	err = dc.RediscoverDevice(context.Background(), newLock("controller", "switch"))
+	assert.NotNil(t, err)
+
+	err = dc.RebootController(context.Background(), newLock("controller", "lock"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, c.RebootCount())
+
+	// Rebooting drops the connection, the next command gets a new one.
+	err = dc.AddLockCode(context.Background(), newLock("controller", "lock"), "1111")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1111"}, c.Codes("lock"))
+
+	assert.Equal(t, []string{
+		"hub.device.settings.list",
+		"hub.device.setting.value.set",
+		"hub.device.settings.list",
+		"hub.reboot",
+		"hub.items.list",
+		"hub.item.dictionary.value.add",
+	}, c.Commands())
+}
+
+func Test_DeviceControllerReconnectsAfterDroppedConnections(t *testing.T) {
+	s := ezlotest.NewServer(t)
+	c := s.AddController("controller")
+	c.AddLock("lock", "Front Door", 100)
+	dc := newDeviceController(t, s)
+
+	s.FailNext("hub.items.list", ezlotest.Failure{CloseConnection: true})
+
+	// The hub got the command before it went away, so it isn't sent again.
+	err := dc.AddLockCode(context.Background(), newLock("controller", "lock"), "1111")
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"hub.items.list"}, c.Commands())
+
+	err = dc.AddLockCode(context.Background(), newLock("controller", "lock"), "1111")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1111"}, c.Codes("lock"))
+	assert.Equal(t, []string{"hub.items.list", "hub.items.list", "hub.item.dictionary.value.add"}, c.Commands())
+
+	// We're still logged in, so the new connection doesn't need to log in again.
+	assert.Equal(t, 1, s.LoginCount())
+}
+
+func Test_DeviceControllerDoesNotRetryHubErrors(t *testing.T) {
+	s := ezlotest.NewServer(t)
+	c := s.AddController("controller")
+	c.AddLock("lock", "Front Door", 100)
+	dc := newDeviceController(t, s)
+
+	s.FailNext("hub.item.dictionary.value.add", ezlotest.Failure{Error: "busy"})
+
+	err := dc.AddLockCode(context.Background(), newLock("controller", "lock"), "1111")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "busy")
+	assert.Empty(t, c.Codes("lock"))
+	assert.Equal(t, []string{"hub.items.list", "hub.item.dictionary.value.add"}, c.Commands())
+}
+
+func Test_DeviceControllerControllerNotConnected(t *testing.T) {
+	s := ezlotest.NewServer(t)
+	c := s.AddController("controller")
+	c.AddLock("lock", "Front Door", 100)
+	c.SetOnline(false)
+	dc := newDeviceController(t, s)
+
+	_, err := dc.GetDevices(context.Background(), "controller")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), ezlotest.ControllerNotConnected)
+
+	_, err = dc.GetDevices(context.Background(), "unknown")
+	assert.NotNil(t, err)
 }
 
-func loadConfig() error {
-	if err := godotenv.Load(".env.test"); err != nil {
-		return fmt.Errorf("error loading .env file: %s", err.Error())
+func Test_ListenHearsOtherConnectionsChanges(t *testing.T) {
+	s := ezlotest.NewServer(t)
+	c := s.AddController("controller")
+	c.AddLock("lock", "Front Door", 100, "1111")
+	listener := newDeviceController(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	updates := make(chan shared.RawDeviceUpdate, 10)
+	go listener.Listen(ctx, "controller", func(u shared.RawDeviceUpdate) { updates <- u })
+
+	next := func() shared.RawDeviceUpdate {
+		select {
+		case u := <-updates:
+			return u
+		case <-time.After(time.Second):
+			t.Fatal("didn't get an update")
+			return shared.RawDeviceUpdate{}
+		}
 	}
-	return nil
+
+	// The current state, then what someone else changed.
+	u := next()
+	assert.Equal(t, []shared.RawDeviceLockCode{{Code: "1111", Mode: "enabled", Name: "1111", Slot: 1}}, u.LockCodes)
+
+	err := newDeviceController(t, s).AddLockCode(context.Background(), newLock("controller", "lock"), "2222")
+	assert.Nil(t, err)
+
+	u = next()
+	assert.Equal(t, "lock", u.ID)
+	assert.Equal(t, []shared.RawDeviceLockCode{
+		{Code: "1111", Mode: "enabled", Name: "1111", Slot: 1},
+		{Code: "2222", Mode: "enabled", Name: "2222", Slot: 2},
+	}, u.LockCodes)
+}
+
+func Test_GetControllers(t *testing.T) {
+	s := ezlotest.NewServer(t)
+	s.AddController("online")
+	s.AddController("offline").SetOnline(false)
+	dc := newDeviceController(t, s)
+
+	online, offline, err := dc.GetControllers(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, online, 1)
+	assert.Equal(t, "online", online[0].PKDevice)
+	assert.Len(t, offline, 1)
+	assert.Equal(t, "offline", offline[0].PKDevice)
+}
+
+func Test_GetControllersFailures(t *testing.T) {
+	s := ezlotest.NewServer(t)
+	s.AddController("controller")
+	dc := newDeviceController(t, s)
+
+	s.FailNext(ezlotest.MethodAuth, ezlotest.Failure{StatusCode: 503})
+	_, _, err := dc.GetControllers(context.Background())
+	assert.NotNil(t, err)
+
+	s.FailNext(ezlotest.MethodDevice, ezlotest.Failure{})
+	_, _, err = dc.GetControllers(context.Background())
+	assert.NotNil(t, err)
+
+	// A failure makes us log in again, in case it was the login's fault.
+	online, _, err := dc.GetControllers(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, online, 1)
+	assert.Equal(t, 2, s.LoginCount())
+}
+
+func newDeviceController(t *testing.T, s *ezlotest.Server) *ezlo.DeviceController {
+	return ezlo.NewDeviceController(s.NewConnectionPool(t))
+}
+
+func newLock(controllerID string, rawDeviceID string) shared.Device {
+	return shared.Device{ControllerID: controllerID, RawDevice: shared.RawDevice{ID: rawDeviceID}}
 }
@@ -0,0 +1,144 @@
+package ezlotest
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Rediscovering a device is one of its settings.
+const RediscoverSetting = "Rediscover device"
+
+// Controller is a hub behind the relay.
+type Controller struct {
+	commands  []string
+	deviceIDs []string // In the order they were added.
+	devices   map[string]*Device
+	id        string
+	online    bool
+	reboots   int
+	server    *Server
+}
+
+// Device is what the hub knows about one of its devices.
+type Device struct {
+	BatteryLevel   int
+	BatteryPowered bool
+	Category       string
+	DeviceTypeID   string
+	ID             string
+	LockCodes      map[int]LockCode // By slot, nil for devices that aren't locks.
+	MaxLockCodes   int
+	Name           string
+	Reachable      bool
+	Settings       []string // Their labels.
+}
+
+type LockCode struct {
+	Code string
+	Mode string
+	Name string
+}
+
+// AddDevice adds or replaces the device.
+func (c *Controller) AddDevice(d Device) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+
+	if _, ok := c.devices[d.ID]; !ok {
+		c.deviceIDs = append(c.deviceIDs, d.ID)
+	}
+	d.LockCodes = copyLockCodes(d.LockCodes)
+	c.devices[d.ID] = &d
+}
+
+// AddLock adds a reachable, battery powered lock with `codes` in the first slots.
+func (c *Controller) AddLock(id string, name string, batteryLevel int, codes ...string) {
+	lockCodes := map[int]LockCode{}
+	for i, code := range codes {
+		lockCodes[i+1] = LockCode{Code: code, Mode: "enabled", Name: code}
+	}
+
+	c.AddDevice(Device{
+		BatteryLevel:   batteryLevel,
+		BatteryPowered: true,
+		Category:       "door_lock",
+		DeviceTypeID:   "lock",
+		ID:             id,
+		LockCodes:      lockCodes,
+		MaxLockCodes:   10,
+		Name:           name,
+		Reachable:      true,
+		Settings:       []string{RediscoverSetting},
+	})
+}
+
+// Commands are the websocket methods the controller was sent, in order, once it was registered.
+func (c *Controller) Commands() []string {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	return append([]string{}, c.commands...)
+}
+
+// Device returns a copy of the device, so it's safe to look at while the hub is changing it.
+func (c *Controller) Device(id string) (Device, bool) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+
+	d, ok := c.devices[id]
+	if !ok {
+		return Device{}, false
+	}
+	result := *d
+	result.LockCodes = copyLockCodes(d.LockCodes)
+	return result, true
+}
+
+// Codes are the device's lock codes, ordered by slot.
+func (c *Controller) Codes(deviceID string) []string {
+	d, _ := c.Device(deviceID)
+
+	slots := []int{}
+	for slot := range d.LockCodes {
+		slots = append(slots, slot)
+	}
+	sort.Ints(slots)
+
+	codes := []string{}
+	for _, slot := range slots {
+		codes = append(codes, d.LockCodes[slot].Code)
+	}
+	return codes
+}
+
+func (c *Controller) RebootCount() int {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	return c.reboots
+}
+
+// SetOnline changes whether the relay can reach the controller. Going offline doesn't drop the connections that are already open.
+func (c *Controller) SetOnline(online bool) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	c.online = online
+}
+
+func (c *Controller) device(id string) (*Device, error) {
+	d, ok := c.devices[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown device: %s", id)
+	}
+	return d, nil
+}
+
+func copyLockCodes(lockCodes map[int]LockCode) map[int]LockCode {
+	if lockCodes == nil {
+		return nil
+	}
+
+	result := map[int]LockCode{}
+	for slot, lc := range lockCodes {
+		result[slot] = lc
+	}
+	return result
+}
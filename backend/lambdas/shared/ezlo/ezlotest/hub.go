@@ -0,0 +1,325 @@
+package ezlotest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// What the relay says when the controller it's asked to register isn't connected to it.
+const ControllerNotConnected = "cloud.error.controller_not_connected"
+
+// connection is a websocket to the relay, it needs to log in and register a controller before it can send the controller commands.
+type connection struct {
+	controller *Controller // Guarded by the server's mu.
+	loggedIn   bool
+	server     *Server
+	writeMu    sync.Mutex
+	ws         *websocket.Conn
+}
+
+type request struct {
+	ID     string          `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type responseError struct {
+	Code        int    `json:"code"`
+	Data        string `json:"data"`
+	Description string `json:"description"`
+}
+
+func (c *connection) serve() {
+	for {
+		req := request{}
+		if err := c.ws.ReadJSON(&req); err != nil {
+			return
+		}
+
+		c.record(req.Method)
+		if f, ok := c.server.nextFailure(req.Method); ok {
+			if f.CloseConnection {
+				return
+			}
+			c.writeError(req, f.Error)
+			continue
+		}
+
+		result, broadcast, err := c.handle(req)
+		if err != nil {
+			c.writeError(req, err.Error())
+			continue
+		}
+		c.write(map[string]interface{}{"id": req.ID, "method": req.Method, "error": nil, "result": result})
+
+		if broadcast != nil {
+			c.server.broadcast(broadcast.controller, "hub.item.updated", broadcast.item)
+		}
+
+		if req.Method == "hub.reboot" {
+			// The hub drops everyone while it restarts.
+			return
+		}
+	}
+}
+
+type itemBroadcast struct {
+	controller *Controller
+	item       map[string]interface{}
+}
+
+// handle answers the request, and says what to tell the controller's other connections about.
+func (c *connection) handle(req request) (interface{}, *itemBroadcast, error) {
+	s := c.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch req.Method {
+	case "loginUserMios":
+		params := struct {
+			MMSAuthSig string `json:"MMSAuthSig"`
+		}{}
+		if err := json.Unmarshal(req.Params, &params); err != nil || params.MMSAuthSig != identitySignature {
+			return nil, nil, fmt.Errorf("bad login")
+		}
+		c.loggedIn = true
+		return map[string]interface{}{}, nil, nil
+	case "register":
+		if !c.loggedIn {
+			return nil, nil, fmt.Errorf("not logged in")
+		}
+		params := struct {
+			Serial string `json:"serial"`
+		}{}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, nil, fmt.Errorf("bad params")
+		}
+		controller, ok := s.controllers[params.Serial]
+		if !ok || !controller.online {
+			return nil, nil, fmt.Errorf("%s", ControllerNotConnected)
+		}
+		c.controller = controller
+		return map[string]interface{}{}, nil, nil
+	}
+
+	controller := c.controller
+	if controller == nil {
+		return nil, nil, fmt.Errorf("not registered")
+	}
+
+	switch req.Method {
+	case "hub.devices.list":
+		devices := []map[string]interface{}{}
+		for _, id := range controller.deviceIDs {
+			devices = append(devices, deviceJSON(controller.devices[id]))
+		}
+		return map[string]interface{}{"devices": devices}, nil, nil
+	case "hub.items.list":
+		params := struct {
+			DeviceIDs []string `json:"deviceIds"`
+		}{}
+		json.Unmarshal(req.Params, &params)
+		items := []map[string]interface{}{}
+		for _, id := range controller.deviceIDs {
+			if len(params.DeviceIDs) > 0 && !contains(params.DeviceIDs, id) {
+				continue
+			}
+			items = append(items, itemsJSON(controller.devices[id])...)
+		}
+		return map[string]interface{}{"items": items}, nil, nil
+	case "hub.item.dictionary.value.add":
+		params := struct {
+			ID      string `json:"_id"`
+			Element struct {
+				Value struct {
+					Code string `json:"code"`
+					Mode string `json:"mode"`
+					Name string `json:"name"`
+				} `json:"value"`
+			} `json:"element"`
+		}{}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, nil, fmt.Errorf("bad params")
+		}
+		d, err := controller.lock(params.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(d.LockCodes) >= d.MaxLockCodes {
+			return nil, nil, fmt.Errorf("no free slots")
+		}
+		slot := 1
+		for ; ; slot++ {
+			if _, ok := d.LockCodes[slot]; !ok {
+				break
+			}
+		}
+		value := params.Element.Value
+		d.LockCodes[slot] = LockCode{Code: value.Code, Mode: value.Mode, Name: value.Name}
+		return map[string]interface{}{}, &itemBroadcast{controller, userCodesJSON(d)}, nil
+	case "hub.item.dictionary.value.remove":
+		params := struct {
+			ID  string `json:"_id"`
+			Key string `json:"key"`
+		}{}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, nil, fmt.Errorf("bad params")
+		}
+		d, err := controller.lock(params.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		slot, err := strconv.Atoi(params.Key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad key: %s", params.Key)
+		}
+		if _, ok := d.LockCodes[slot]; !ok {
+			return nil, nil, fmt.Errorf("nothing in slot %d", slot)
+		}
+		delete(d.LockCodes, slot)
+		return map[string]interface{}{}, &itemBroadcast{controller, userCodesJSON(d)}, nil
+	case "hub.device.settings.list":
+		settings := []map[string]interface{}{}
+		for _, id := range controller.deviceIDs {
+			for i, label := range controller.devices[id].Settings {
+				settings = append(settings, map[string]interface{}{
+					"_id":      settingID(id, i),
+					"deviceId": id,
+					"label":    map[string]interface{}{"text": label},
+				})
+			}
+		}
+		return map[string]interface{}{"settings": settings}, nil, nil
+	case "hub.device.setting.value.set":
+		params := struct {
+			ID string `json:"_id"`
+		}{}
+		json.Unmarshal(req.Params, &params)
+		for _, id := range controller.deviceIDs {
+			for i := range controller.devices[id].Settings {
+				if settingID(id, i) == params.ID {
+					return map[string]interface{}{}, nil, nil
+				}
+			}
+		}
+		return nil, nil, fmt.Errorf("unknown setting: %s", params.ID)
+	case "hub.reboot":
+		controller.reboots++
+		return map[string]interface{}{}, nil, nil
+	}
+
+	return nil, nil, fmt.Errorf("unknown method: %s", req.Method)
+}
+
+// record adds the command to the controller's, once one is registered.
+func (c *connection) record(method string) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+
+	if c.controller != nil {
+		c.controller.commands = append(c.controller.commands, method)
+	}
+}
+
+// lock finds the device for a user_codes item.
+func (c *Controller) lock(itemID string) (*Device, error) {
+	d, err := c.device(strings.TrimSuffix(itemID, "/user_codes"))
+	if err != nil {
+		return nil, err
+	}
+	if d.LockCodes == nil {
+		return nil, fmt.Errorf("not a lock: %s", d.ID)
+	}
+	return d, nil
+}
+
+// broadcast tells every connection that's registered to the controller.
+func (s *Server) broadcast(controller *Controller, subclass string, result interface{}) {
+	s.mu.Lock()
+	connections := []*connection{}
+	for c := range s.connections {
+		if c.controller == controller {
+			connections = append(connections, c)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, c := range connections {
+		c.write(map[string]interface{}{"id": "ui_broadcast", "msg_subclass": subclass, "result": result})
+	}
+}
+
+func (c *connection) write(v interface{}) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.ws.WriteJSON(v)
+}
+
+func (c *connection) writeError(req request, message string) {
+	c.write(map[string]interface{}{
+		"id":     req.ID,
+		"method": req.Method,
+		"error":  responseError{Code: -32500, Data: message, Description: message},
+	})
+}
+
+func deviceJSON(d *Device) map[string]interface{} {
+	return map[string]interface{}{
+		"_id":            d.ID,
+		"batteryPowered": d.BatteryPowered,
+		"category":       d.Category,
+		"deviceTypeId":   d.DeviceTypeID,
+		"name":           d.Name,
+		"reachable":      d.Reachable,
+		"status":         "idle",
+	}
+}
+
+func itemsJSON(d *Device) []map[string]interface{} {
+	items := []map[string]interface{}{}
+	if d.BatteryPowered {
+		items = append(items, map[string]interface{}{
+			"_id":      d.ID + "/battery",
+			"deviceId": d.ID,
+			"name":     "battery",
+			"value":    d.BatteryLevel,
+		})
+	}
+	if d.LockCodes != nil {
+		items = append(items, userCodesJSON(d))
+	}
+	return items
+}
+
+func userCodesJSON(d *Device) map[string]interface{} {
+	value := map[string]interface{}{}
+	for slot, lc := range d.LockCodes {
+		value[fmt.Sprintf("%d", slot)] = map[string]string{"code": lc.Code, "mode": lc.Mode, "name": lc.Name}
+	}
+
+	return map[string]interface{}{
+		"_id":               d.ID + "/user_codes",
+		"deviceId":          d.ID,
+		"elementsMaxNumber": d.MaxLockCodes,
+		"name":              "user_codes",
+		"value":             value,
+	}
+}
+
+func settingID(deviceID string, i int) string {
+	return fmt.Sprintf("%s/setting/%d", deviceID, i)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
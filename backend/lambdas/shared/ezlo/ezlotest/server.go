@@ -0,0 +1,267 @@
+// Package ezlotest is a fake Ezlo cloud for tests: the auth and account servers, and a relay with the hubs behind it.
+package ezlotest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mlock/lambdas/shared/ezlo"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The HTTP endpoints, for scripting failures alongside the websocket methods.
+const (
+	MethodAccount = "account" // The account's controllers.
+	MethodAuth    = "auth"    // Logging in.
+	MethodDevice  = "device"  // A controller's details, e.g. its relay.
+)
+
+const (
+	Password = "password"
+	Username = "username"
+)
+
+const (
+	accountID         = 1234
+	identitySignature = "signature"
+)
+
+// Failure is how the next call to a method goes wrong.
+type Failure struct {
+	CloseConnection bool   // The websocket drops without answering.
+	Error           string // The hub answers with this error.
+	StatusCode      int    // The HTTP endpoint answers with this status.
+}
+
+// Server is safe to use from multiple goroutines. It sets the credentials in the environment, so tests using it can't run in parallel.
+type Server struct {
+	connections   map[*connection]bool
+	controllers   map[string]*Controller
+	failures      map[string][]Failure
+	loginCount    int
+	mu            sync.Mutex
+	server        *httptest.Server
+	controllerIDs []string // In the order they were added.
+}
+
+// NewServer starts a server that's stopped when the test is over, connection pools use it with `Cloud`.
+func NewServer(t testing.TB) *Server {
+	s := &Server{
+		connections: map[*connection]bool{},
+		controllers: map[string]*Controller{},
+		failures:    map[string][]Failure{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/autha/auth/username/", s.handleAuth)
+	mux.HandleFunc(fmt.Sprintf("/account/account/account/%d/devices", accountID), s.handleAccount)
+	mux.HandleFunc("/device/device/device/", s.handleDevice)
+	mux.HandleFunc("/relay", s.handleRelay)
+	s.server = httptest.NewTLSServer(mux)
+
+	t.Setenv("EZLO_USERNAME", Username)
+	t.Setenv("EZLO_PASSWORD", Password)
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// Cloud sends everything to the server, trusting its certificate.
+func (s *Server) Cloud() ezlo.Cloud {
+	client := s.server.Client()
+	dialer := *websocket.DefaultDialer
+	if transport, ok := client.Transport.(*http.Transport); ok {
+		dialer.TLSClientConfig = transport.TLSClientConfig
+	}
+
+	return ezlo.Cloud{
+		AuthServers: []string{s.host()},
+		HTTPClient:  client,
+		WSDialer:    &dialer,
+	}
+}
+
+// NewConnectionPool returns a pool that uses the server, it's closed when the test is over.
+func (s *Server) NewConnectionPool(t testing.TB) *ezlo.ConnectionPool {
+	cp := ezlo.NewConnectionPool().WithCloud(s.Cloud())
+	t.Cleanup(cp.Close)
+	return cp
+}
+
+// Close drops every connection and stops the server.
+func (s *Server) Close() {
+	s.mu.Lock()
+	for c := range s.connections {
+		c.ws.Close()
+	}
+	s.mu.Unlock()
+
+	s.server.Close()
+}
+
+// AddController adds an online controller without any devices.
+func (s *Server) AddController(id string) *Controller {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := &Controller{devices: map[string]*Device{}, id: id, online: true, server: s}
+	s.controllers[id] = c
+	s.controllerIDs = append(s.controllerIDs, id)
+	return c
+}
+
+// FailNext makes the next call to `method` fail. Failures queue up, each is used once.
+func (s *Server) FailNext(method string, f Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[method] = append(s.failures[method], f)
+}
+
+// LoginCount is how many times someone logged in.
+func (s *Server) LoginCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loginCount
+}
+
+func (s *Server) host() string {
+	return strings.TrimPrefix(s.server.URL, "https://")
+}
+
+// nextFailure uses up the next failure for `method`, if there is one.
+func (s *Server) nextFailure(method string) (Failure, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	failures := s.failures[method]
+	if len(failures) == 0 {
+		return Failure{}, false
+	}
+	s.failures[method] = failures[1:]
+	return failures[0], true
+}
+
+// failHTTP answers with the next failure for `method`, if there is one.
+func (s *Server) failHTTP(w http.ResponseWriter, method string) bool {
+	f, ok := s.nextFailure(method)
+	if !ok {
+		return false
+	}
+
+	statusCode := f.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusInternalServerError
+	}
+	http.Error(w, f.Error, statusCode)
+	return true
+}
+
+func (s *Server) handleAuth(w http.ResponseWriter, r *http.Request) {
+	if s.failHTTP(w, MethodAuth) {
+		return
+	}
+
+	q := r.URL.Query()
+	if strings.TrimPrefix(r.URL.Path, "/autha/auth/username/") != Username || q.Get("SHA1Password") != Password {
+		http.Error(w, "bad username or password", http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	s.loginCount++
+	s.mu.Unlock()
+
+	identity, _ := json.Marshal(map[string]interface{}{
+		"Expires":    time.Now().Add(24 * time.Hour).Unix(),
+		"PK_Account": accountID,
+	})
+	writeJSON(w, map[string]interface{}{
+		"Identity":           base64.StdEncoding.EncodeToString(identity),
+		"IdentitySignature":  identitySignature,
+		"Server_Account":     s.host(),
+		"Server_Account_Alt": "",
+	})
+}
+
+func (s *Server) handleAccount(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) || s.failHTTP(w, MethodAccount) {
+		return
+	}
+
+	s.mu.Lock()
+	devices := []map[string]interface{}{}
+	for _, id := range s.controllerIDs {
+		devices = append(devices, map[string]interface{}{"PK_Device": id, "Server_Device": s.host()})
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, map[string]interface{}{"Devices": devices})
+}
+
+func (s *Server) handleDevice(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) || s.failHTTP(w, MethodDevice) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := strings.TrimPrefix(r.URL.Path, "/device/device/device/")
+	c, ok := s.controllers[id]
+	if !ok {
+		http.Error(w, "unknown device", http.StatusNotFound)
+		return
+	}
+
+	status := 0
+	if c.online {
+		status = 1
+	}
+	writeJSON(w, map[string]interface{}{
+		"NMAControllerStatus": status,
+		"PK_Device":           id,
+		"Server_Relay":        fmt.Sprintf("wss://%s/relay", s.host()),
+	})
+}
+
+func (s *Server) handleRelay(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	c := &connection{server: s, ws: ws}
+	s.mu.Lock()
+	s.connections[c] = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.connections, c)
+		s.mu.Unlock()
+		ws.Close()
+	}()
+
+	c.serve()
+}
+
+func authorized(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("mmsAuthSig") != identitySignature {
+		http.Error(w, "not logged in", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
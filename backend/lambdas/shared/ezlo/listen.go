@@ -0,0 +1,136 @@
+package ezlo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mlock/lambdas/shared"
+	"strings"
+	"time"
+)
+
+const (
+	listenCheckInterval = 1 * time.Minute  // How often we check that the connection we're listening on hasn't expired.
+	listenRetryDelay    = 10 * time.Second // Between attempts to reconnect.
+)
+
+// Listen passes the controller's device changes to `onUpdate` until the context is done. Every time it (re)connects it starts with each device's current state, so nothing is missed while it was disconnected.
+func (d *DeviceController) Listen(ctx context.Context, controllerID string, onUpdate func(shared.RawDeviceUpdate)) error {
+	if controllerID == "" {
+		return fmt.Errorf("missing controller ID")
+	}
+
+	for {
+		if err := d.listenOnce(ctx, controllerID, onUpdate); err != nil {
+			log.Printf("error listening to controller %s, will reconnect: %s\n", controllerID, err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(d.listenRetryDelay):
+		}
+	}
+}
+
+// listenOnce returns when the connection goes away.
+func (d *DeviceController) listenOnce(ctx context.Context, controllerID string, onUpdate func(shared.RawDeviceUpdate)) error {
+	broadcasts, unsubscribe, err := d.connectionPool.Subscribe(ctx, controllerID)
+	if err != nil {
+		return fmt.Errorf("error subscribing: %s", err.Error())
+	}
+	defer unsubscribe()
+
+	rds, err := d.GetDevices(ctx, controllerID)
+	if err != nil {
+		return fmt.Errorf("error getting devices: %s", err.Error())
+	}
+	for _, rd := range rds {
+		update := shared.RawDeviceUpdate{
+			ID:        rd.ID,
+			LockCodes: rd.LockCodes,
+		}
+		if rd.Battery.BatteryPowered {
+			level := rd.Battery.Level
+			update.BatteryLevel = &level
+		}
+		onUpdate(update)
+	}
+
+	ticker := time.NewTicker(d.listenCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case b, ok := <-broadcasts:
+			if !ok {
+				return fmt.Errorf("connection closed")
+			}
+
+			update, ok, err := d.toRawDeviceUpdate(ctx, controllerID, b)
+			if err != nil {
+				log.Printf("error handling %s from controller %s: %s\n", b.MsgSubclass, controllerID, err.Error())
+				continue
+			}
+			if ok {
+				onUpdate(update)
+			}
+		case <-ticker.C:
+			// If ours has expired the pool replaces it, which closes `broadcasts`.
+			if _, err := d.connectionPool.GetConnection(ctx, controllerID); err != nil {
+				return fmt.Errorf("error checking connection: %s", err.Error())
+			}
+		}
+	}
+}
+
+// toRawDeviceUpdate is false for broadcasts that we don't care about.
+func (d *DeviceController) toRawDeviceUpdate(ctx context.Context, controllerID string, b Broadcast) (shared.RawDeviceUpdate, bool, error) {
+	item := wsItem{}
+
+	switch {
+	case b.MsgSubclass == "hub.item.updated":
+		if err := json.Unmarshal(b.Result, &item); err != nil {
+			return shared.RawDeviceUpdate{}, false, fmt.Errorf("error unmarshalling item: %s", err.Error())
+		}
+
+		switch item.Name {
+		case "battery":
+			level, err := item.getBatteryLevel()
+			if err != nil {
+				return shared.RawDeviceUpdate{}, false, fmt.Errorf("error getting battery: %s", err.Error())
+			}
+			return shared.RawDeviceUpdate{BatteryLevel: &level, ID: item.DeviceID}, true, nil
+		case "user_codes":
+			lockCodes, err := item.getLockCodes()
+			if err != nil {
+				return shared.RawDeviceUpdate{}, false, fmt.Errorf("error getting lock codes: %s", err.Error())
+			}
+			return shared.RawDeviceUpdate{ID: item.DeviceID, LockCodes: lockCodes}, true, nil
+		}
+	case strings.HasPrefix(b.MsgSubclass, "hub.item.dictionary."):
+		if err := json.Unmarshal(b.Result, &item); err != nil {
+			return shared.RawDeviceUpdate{}, false, fmt.Errorf("error unmarshalling item: %s", err.Error())
+		}
+		if item.DeviceID == "" || (item.Name != "" && item.Name != "user_codes") {
+			return shared.RawDeviceUpdate{}, false, nil
+		}
+
+		// These only have the element that changed, so we read all of the codes again.
+		var lockCodes []shared.RawDeviceLockCode
+		err := d.connectionPool.Do(ctx, controllerID, func(ws *wsClient) error {
+			var err error
+			lockCodes, _, err = wsGetLockCodesForDevice(ctx, ws, item.DeviceID)
+			return err
+		})
+		if err != nil {
+			return shared.RawDeviceUpdate{}, false, fmt.Errorf("error getting lock codes: %s", err.Error())
+		}
+		return shared.RawDeviceUpdate{ID: item.DeviceID, LockCodes: lockCodes}, true, nil
+	}
+
+	return shared.RawDeviceUpdate{}, false, nil
+}
@@ -0,0 +1,161 @@
+package ezlo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mlock/lambdas/shared"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestConnectionPool connects every controller to a hub that `serve` plays the part of.
+func newTestConnectionPool(t *testing.T, serve func(ws *websocket.Conn)) *ConnectionPool {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("error upgrading: %s", err.Error())
+			return
+		}
+		defer ws.Close()
+		serve(ws)
+	}))
+	t.Cleanup(server.Close)
+
+	cp := NewConnectionPool()
+	cp.dial = func(ctx context.Context, controllerID string) (*wsClient, time.Time, error) {
+		ws, _, err := websocket.DefaultDialer.DialContext(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		return newWSClient(ws, readTimeout), time.Time{}, nil
+	}
+	t.Cleanup(cp.Close)
+
+	return cp
+}
+
+func Test_Listen(t *testing.T) {
+	userCodes := func(codes ...string) map[string]interface{} {
+		value := map[string]interface{}{}
+		for i, code := range codes {
+			value[fmt.Sprintf("%d", i+1)] = map[string]string{"code": code, "mode": "enabled", "name": code}
+		}
+		return map[string]interface{}{"_id": "codes", "deviceId": "lock", "name": "user_codes", "value": value}
+	}
+
+	var connections atomic.Int32
+	cp := newTestConnectionPool(t, func(ws *websocket.Conn) {
+		connection := connections.Add(1)
+		for {
+			req := wsResponse{}
+			if err := ws.ReadJSON(&req); err != nil {
+				return
+			}
+
+			switch req.Method {
+			case "hub.devices.list":
+				ws.WriteJSON(map[string]interface{}{"id": req.ID, "result": map[string]interface{}{
+					"devices": []map[string]interface{}{{"_id": "lock", "batteryPowered": true, "deviceTypeId": "lock", "reachable": true}},
+				}})
+			case "hub.items.list":
+				codes := userCodes("1111", "2222")
+				if connection == 1 {
+					codes = userCodes("1111")
+				}
+				ws.WriteJSON(map[string]interface{}{"id": req.ID, "result": map[string]interface{}{
+					"items": []map[string]interface{}{codes, {"_id": "battery", "deviceId": "lock", "name": "battery", "value": 100}},
+				}})
+
+				if connection > 1 {
+					continue
+				}
+
+				// Once we've given them the current state, things start to change.
+				ws.WriteJSON(map[string]interface{}{"id": wsBroadcastID, "msg_subclass": "hub.item.updated", "result": userCodes("1111", "2222")})
+				ws.WriteJSON(map[string]interface{}{"id": wsBroadcastID, "msg_subclass": "hub.item.updated", "result": map[string]interface{}{"_id": "battery", "deviceId": "lock", "name": "battery", "value": 80}})
+				ws.WriteJSON(map[string]interface{}{"id": wsBroadcastID, "msg_subclass": "hub.item.updated", "result": map[string]interface{}{"_id": "temperature", "deviceId": "lock", "name": "temp", "value": 21}})
+				ws.WriteJSON(map[string]interface{}{"id": wsBroadcastID, "msg_subclass": "hub.item.dictionary.updated", "result": map[string]interface{}{"_id": "codes", "deviceId": "lock"}})
+
+				// Then the connection drops.
+				return
+			}
+		}
+	})
+
+	d := NewDeviceController(cp)
+	d.listenRetryDelay = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	updates := make(chan shared.RawDeviceUpdate, 10)
+	done := make(chan error)
+	go func() {
+		done <- d.Listen(ctx, "controller", func(u shared.RawDeviceUpdate) { updates <- u })
+	}()
+
+	next := func() shared.RawDeviceUpdate {
+		select {
+		case u := <-updates:
+			return u
+		case <-time.After(time.Second):
+			t.Fatal("didn't get an update")
+			return shared.RawDeviceUpdate{}
+		}
+	}
+
+	one := []shared.RawDeviceLockCode{{Code: "1111", Mode: "enabled", Name: "1111", Slot: 1}}
+	two := append(one, shared.RawDeviceLockCode{Code: "2222", Mode: "enabled", Name: "2222", Slot: 2})
+
+	// The current state.
+	u := next()
+	assert.Equal(t, "lock", u.ID)
+	assert.Equal(t, 100, *u.BatteryLevel)
+	assert.Equal(t, one, u.LockCodes)
+
+	// The broadcasts, the temperature one is skipped.
+	u = next()
+	assert.Nil(t, u.BatteryLevel)
+	assert.Equal(t, two, u.LockCodes)
+	u = next()
+	assert.Equal(t, 80, *u.BatteryLevel)
+	assert.Nil(t, u.LockCodes)
+
+	// The dictionary update reads the codes again, from a new connection if the old one has already gone. Either way, reconnecting starts with the current state again.
+	for u = next(); u.BatteryLevel == nil; u = next() {
+		assert.Equal(t, two, u.LockCodes)
+	}
+	assert.Equal(t, 100, *u.BatteryLevel)
+	assert.Equal(t, two, u.LockCodes)
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		assert.Fail(t, "didn't stop listening")
+	}
+}
+
+func Test_toRawDeviceUpdateSkipsOtherBroadcasts(t *testing.T) {
+	d := NewDeviceController(NewConnectionPool())
+
+	for _, b := range []Broadcast{
+		{MsgSubclass: "hub.device.updated", Result: json.RawMessage(`{"_id": "lock"}`)},
+		{MsgSubclass: "hub.item.updated", Result: json.RawMessage(`{"_id": "switch", "deviceId": "lock", "name": "switch", "value": true}`)},
+		{MsgSubclass: "hub.item.dictionary.updated", Result: json.RawMessage(`{"_id": "siren", "deviceId": "lock", "name": "sounds"}`)},
+	} {
+		_, ok, err := d.toRawDeviceUpdate(context.Background(), "controller", b)
+		assert.Nil(t, err)
+		assert.False(t, ok, b.MsgSubclass)
+	}
+}
@@ -0,0 +1,153 @@
+package ezlo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mshared "mlock/shared"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// The port the hub's local API listens on, when the address doesn't say.
+const localHubPort = "17000"
+
+const localHubsConfig = "EZLO_LOCAL_HUBS"
+
+// LocalHub is how to reach a controller on the property's LAN, without going through the cloud relay. `User` and `Token` are the hub's offline credentials.
+type LocalHub struct {
+	Address           string `json:"address"`
+	CertificateSHA256 string `json:"certificateSha256"` // The hub's certificate is self signed, so we only trust the one with this fingerprint, e.g. from `openssl x509 -noout -fingerprint -sha256`.
+	Token             string `json:"token"`
+	User              string `json:"user"`
+}
+
+type wsLocalLogInRequest struct {
+	Method string                    `json:"method"`
+	ID     string                    `json:"id"`
+	Params wsLocalLogInRequestParams `json:"params"`
+}
+
+type wsLocalLogInRequestParams struct {
+	Token string `json:"token"`
+	User  string `json:"user"`
+}
+
+// GetLocalHubs reads the local hubs by controller ID from EZLO_LOCAL_HUBS, e.g. {"12345678": {"address": "192.168.1.20", "certificateSha256": "...", "user": "...", "token": "..."}}. They're optional, without any we only use the cloud relay.
+func GetLocalHubs() (map[string]LocalHub, error) {
+	hubs := map[string]LocalHub{}
+	config, err := mshared.GetConfig(localHubsConfig)
+	if err != nil {
+		return hubs, nil
+	}
+
+	if err := json.Unmarshal([]byte(config), &hubs); err != nil {
+		return nil, fmt.Errorf("error parsing local hubs: %s", err.Error())
+	}
+
+	for controllerID, hub := range hubs {
+		if hub.Address == "" || hub.User == "" || hub.Token == "" {
+			return nil, fmt.Errorf("local hub for %s needs an address, user and token", controllerID)
+		}
+		if _, err := hub.fingerprint(); err != nil {
+			return nil, fmt.Errorf("local hub for %s has a bad certificate fingerprint: %s", controllerID, err.Error())
+		}
+	}
+
+	return hubs, nil
+}
+
+func (hub LocalHub) url() string {
+	host := hub.Address
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, localHubPort)
+	}
+
+	u := url.URL{Scheme: "wss", Host: host, Path: ""}
+	return u.String()
+}
+
+// fingerprint accepts upper or lower case hex, with or without colons.
+func (hub LocalHub) fingerprint() ([]byte, error) {
+	fingerprint, err := hex.DecodeString(strings.ReplaceAll(hub.CertificateSHA256, ":", ""))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding: %s", err.Error())
+	}
+	if len(fingerprint) != sha256.Size {
+		return nil, fmt.Errorf("expected %d bytes but got %d", sha256.Size, len(fingerprint))
+	}
+	return fingerprint, nil
+}
+
+// verifyCertificate pins the hub's certificate, there's no CA to check it against.
+func (hub LocalHub) verifyCertificate(cs tls.ConnectionState) error {
+	fingerprint, err := hub.fingerprint()
+	if err != nil {
+		return fmt.Errorf("bad certificate fingerprint: %s", err.Error())
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("hub didn't send a certificate")
+	}
+
+	sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+	if !bytes.Equal(sum[:], fingerprint) {
+		return fmt.Errorf("hub's certificate doesn't match, its fingerprint is %s", hex.EncodeToString(sum[:]))
+	}
+	return nil
+}
+
+// connectLocal connects straight to the hub. There's no relay in the way, so there's nothing to register with.
+func connectLocal(ctx context.Context, hub LocalHub) (*wsClient, error) {
+	// Hubs have self signed certificates, so rather than checking the chain we check it's the one we were given.
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection:   hub.verifyCertificate,
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+	conn, _, err := dialer.DialContext(dialCtx, hub.url(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %s", err.Error())
+	}
+	ws := newWSClient(conn, readTimeout)
+
+	if err := wsLocalLogIn(ctx, ws, hub); err != nil {
+		ws.close()
+		return nil, fmt.Errorf("login: %s", err.Error())
+	}
+
+	return ws, nil
+}
+
+func wsLocalLogIn(ctx context.Context, ws *wsClient, hub LocalHub) error {
+	id := fmt.Sprintf("hub.offline.login.ui.%s", uuid.New())
+	err := wsSendCommand(
+		ctx,
+		ws,
+		id,
+		wsLocalLogInRequest{
+			Method: "hub.offline.login.ui",
+			ID:     id,
+			Params: wsLocalLogInRequestParams{
+				Token: hub.Token,
+				User:  hub.User,
+			},
+		},
+		&struct{}{},
+	)
+	if err != nil {
+		return fmt.Errorf("error sending command: %s", err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,158 @@
+package ezlo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestLocalHub serves the hub's local API over TLS with a self signed certificate, like a real hub does.
+func newTestLocalHub(t *testing.T, token string) (LocalHub, chan string) {
+	methods := make(chan string, 10)
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("error upgrading: %s", err.Error())
+			return
+		}
+		defer ws.Close()
+
+		for {
+			req := struct {
+				ID     string            `json:"id"`
+				Method string            `json:"method"`
+				Params map[string]string `json:"params"`
+			}{}
+			if err := ws.ReadJSON(&req); err != nil {
+				return
+			}
+			methods <- req.Method
+
+			switch {
+			case req.Method == "hub.offline.login.ui" && (req.Params["user"] != "user" || req.Params["token"] != token):
+				ws.WriteJSON(map[string]interface{}{"id": req.ID, "error": map[string]interface{}{"code": -32500, "description": "bad credentials"}})
+			case req.Method == "hub.devices.list":
+				ws.WriteJSON(map[string]interface{}{"id": req.ID, "result": map[string]interface{}{"devices": []map[string]interface{}{{"_id": "lock"}}}})
+			default:
+				ws.WriteJSON(map[string]interface{}{"id": req.ID, "result": map[string]interface{}{}})
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	fingerprint := sha256.Sum256(server.Certificate().Raw)
+	return LocalHub{
+		Address:           strings.TrimPrefix(server.URL, "https://"),
+		CertificateSHA256: hex.EncodeToString(fingerprint[:]),
+		Token:             "token",
+		User:              "user",
+	}, methods
+}
+
+func Test_GetLocalHubs(t *testing.T) {
+	t.Setenv(localHubsConfig, "")
+	hubs, err := GetLocalHubs()
+	assert.Nil(t, err)
+	assert.Empty(t, hubs)
+
+	// Fingerprints can be copied straight from openssl.
+	fingerprint := "AB:" + strings.Repeat("01:", 30) + "EF"
+	t.Setenv(localHubsConfig, `{"controller": {"address": "192.168.1.20", "certificateSha256": "`+fingerprint+`", "user": "user", "token": "token"}}`)
+	hubs, err = GetLocalHubs()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]LocalHub{"controller": {Address: "192.168.1.20", CertificateSHA256: fingerprint, Token: "token", User: "user"}}, hubs)
+	assert.Equal(t, "wss://192.168.1.20:17000", hubs["controller"].url())
+
+	t.Setenv(localHubsConfig, `{"controller": {"address": "192.168.1.20", "certificateSha256": "`+fingerprint+`", "user": "user"}}`)
+	_, err = GetLocalHubs()
+	assert.NotNil(t, err)
+
+	// Without a certificate to pin we'd have to trust whatever answers.
+	t.Setenv(localHubsConfig, `{"controller": {"address": "192.168.1.20", "user": "user", "token": "token"}}`)
+	_, err = GetLocalHubs()
+	assert.NotNil(t, err)
+
+	t.Setenv(localHubsConfig, `not json`)
+	_, err = GetLocalHubs()
+	assert.NotNil(t, err)
+}
+
+func Test_connectLocal(t *testing.T) {
+	hub, methods := newTestLocalHub(t, "token")
+
+	ws, err := connectLocal(context.Background(), hub)
+	assert.Nil(t, err)
+	defer ws.close()
+
+	devices, err := wsDeviceList(context.Background(), ws)
+	assert.Nil(t, err)
+	assert.Len(t, devices.Result.Devices, 1)
+
+	// There's no relay, so we don't register.
+	assert.Equal(t, "hub.offline.login.ui", <-methods)
+	assert.Equal(t, "hub.devices.list", <-methods)
+}
+
+func Test_connectLocalPinsTheCertificate(t *testing.T) {
+	hub, methods := newTestLocalHub(t, "token")
+	hub.CertificateSHA256 = strings.Repeat("00", 32)
+
+	_, err := connectLocal(context.Background(), hub)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "certificate doesn't match")
+	assert.Empty(t, methods)
+}
+
+func Test_connectLocalBadCredentials(t *testing.T) {
+	hub, _ := newTestLocalHub(t, "other token")
+
+	_, err := connectLocal(context.Background(), hub)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "bad credentials")
+}
+
+func Test_ConnectionPoolFallsBackToRelay(t *testing.T) {
+	hub, _ := newTestLocalHub(t, "token")
+
+	relayed := []string{}
+	cp := NewConnectionPool().WithLocalHubs(map[string]LocalHub{"local": hub, "down": {Address: deadServer, Token: "token", User: "user"}})
+	cp.dialRelay = func(ctx context.Context, controllerID string) (*wsClient, time.Time, error) {
+		relayed = append(relayed, controllerID)
+		return newTestWSClient(t, func(ws *websocket.Conn) { ws.ReadMessage() }), time.Now().Add(10 * time.Minute), nil
+	}
+	defer cp.Close()
+
+	for _, controllerID := range []string{"local", "down", "cloud"} {
+		_, err := cp.GetConnection(context.Background(), controllerID)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, []string{"down", "cloud"}, relayed)
+
+	// We go back to the local hub as soon as we can, rather than staying on the relay for as long as the login lasts.
+	assert.WithinDuration(t, time.Now().Add(relayFallbackAge), cp.connectionByControllerID["down"].expiresAt, time.Second)
+	assert.WithinDuration(t, time.Now().Add(10*time.Minute), cp.connectionByControllerID["cloud"].expiresAt, time.Second)
+	assert.WithinDuration(t, time.Now().Add(maxConnectionAge), cp.connectionByControllerID["local"].expiresAt, time.Second)
+}
+
+func Test_ConnectionPoolFailsWhenRelayFailsToo(t *testing.T) {
+	cp := NewConnectionPool().WithLocalHubs(map[string]LocalHub{"down": {Address: deadServer, Token: "token", User: "user"}})
+	cp.dialRelay = func(ctx context.Context, controllerID string) (*wsClient, time.Time, error) {
+		return nil, time.Time{}, fmt.Errorf("relay is down")
+	}
+	defer cp.Close()
+
+	_, err := cp.GetConnection(context.Background(), "down")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "relay is down")
+}
@@ -0,0 +1,245 @@
+package ezlo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The ID the hub uses for messages that aren't a response to anything, e.g. an item changing.
+const wsBroadcastID = "ui_broadcast"
+
+// How many broadcasts a subscriber can fall behind by before we start dropping them.
+const broadcastBufferSize = 100
+
+// Errors with this mean the hub never got the command, so it's safe to send it again.
+const wsNotSentMessage = "command wasn't sent"
+
+// Broadcast is a message the hub sends on its own, e.g. `hub.item.updated` when a lock code changes.
+type Broadcast struct {
+	MsgSubclass string          `json:"msg_subclass"`
+	Result      json.RawMessage `json:"result"`
+}
+
+// wsClient owns a hub websocket. A single reader routes each response to whoever sent the request, so several commands can be in flight at once.
+type wsClient struct {
+	done             chan struct{} // Closed once the reader stops, `err` says why.
+	err              error
+	mu               sync.Mutex
+	nextSubscriberID int
+	pending          map[string]chan []byte
+	readTimeout      time.Duration // The connection is gone if nothing's read in this long, not even a pong.
+	subscribers      map[int]chan Broadcast
+	writeMu          sync.Mutex // Gorilla only allows one writer at a time, pings are the exception.
+	ws               *websocket.Conn
+}
+
+func newWSClient(ws *websocket.Conn, readTimeout time.Duration) *wsClient {
+	c := &wsClient{
+		done:        make(chan struct{}),
+		pending:     map[string]chan []byte{},
+		readTimeout: readTimeout,
+		subscribers: map[int]chan Broadcast{},
+		ws:          ws,
+	}
+	ws.SetPongHandler(func(string) error {
+		return c.extendReadDeadline()
+	})
+	go c.read()
+	return c
+}
+
+func (c *wsClient) close() error {
+	return c.ws.Close()
+}
+
+// stopped is true once the connection is gone, nothing more will be read from it.
+func (c *wsClient) stopped() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// send writes the request and waits for the response with the same ID, until the context or `commandTimeout` runs out.
+func (c *wsClient) send(ctx context.Context, id string, request []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+
+	respCh, err := c.await(id)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", wsNotSentMessage, err.Error())
+	}
+	defer c.forget(id)
+
+	if err := c.write(ctx, request); err != nil {
+		return nil, fmt.Errorf("%s: write: %s", wsNotSentMessage, err.Error())
+	}
+
+	select {
+	case resp := <-respCh:
+		return resp, nil
+	case <-c.done:
+		return nil, fmt.Errorf("read: %s", c.err.Error())
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for response: %s", ctx.Err().Error())
+	}
+}
+
+// subscribe returns a channel with the hub's broadcasts, it's closed along with the connection. Call the func when you're done with it.
+func (c *wsClient) subscribe() (<-chan Broadcast, func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan Broadcast, broadcastBufferSize)
+	if c.stopped() {
+		close(ch)
+		return ch, func() {}
+	}
+
+	id := c.nextSubscriberID
+	c.nextSubscriberID++
+	c.subscribers[id] = ch
+
+	return ch, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if ch, ok := c.subscribers[id]; ok {
+			delete(c.subscribers, id)
+			close(ch)
+		}
+	}
+}
+
+func (c *wsClient) await(id string) (chan []byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stopped() {
+		return nil, fmt.Errorf("connection closed: %s", c.err.Error())
+	}
+	if _, ok := c.pending[id]; ok {
+		return nil, fmt.Errorf("already waiting for %s", id)
+	}
+
+	respCh := make(chan []byte, 1)
+	c.pending[id] = respCh
+	return respCh, nil
+}
+
+func (c *wsClient) forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+func (c *wsClient) write(ctx context.Context, message []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(commandTimeout)
+	}
+	if err := c.ws.SetWriteDeadline(deadline); err != nil {
+		return fmt.Errorf("setting write deadline: %s", err.Error())
+	}
+
+	return c.ws.WriteMessage(websocket.TextMessage, message)
+}
+
+// ping is safe to call alongside everything else.
+func (c *wsClient) ping(timeout time.Duration) error {
+	return c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout))
+}
+
+// extendReadDeadline is only called from the reader, pongs are handled while it's reading.
+func (c *wsClient) extendReadDeadline() error {
+	return c.ws.SetReadDeadline(time.Now().Add(c.readTimeout))
+}
+
+// read runs until the connection closes, or goes quiet for longer than `readTimeout`. Each command has its own timeout on top of that.
+func (c *wsClient) read() {
+	for {
+		if err := c.extendReadDeadline(); err != nil {
+			c.stop(err)
+			return
+		}
+
+		_, message, err := c.ws.ReadMessage()
+		if err != nil {
+			c.stop(err)
+			return
+		}
+
+		if ENHANCED_LOGGING {
+			fmt.Printf("received: %s\n", string(message))
+		}
+
+		resp := wsResponse{}
+		if err := json.Unmarshal(message, &resp); err != nil {
+			log.Printf("error unmarshalling message, skipping it: %s\n", err.Error())
+			continue
+		}
+
+		if resp.ID == wsBroadcastID {
+			c.broadcast(message)
+			continue
+		}
+
+		c.deliver(resp.ID, message)
+	}
+}
+
+func (c *wsClient) broadcast(message []byte) {
+	b := Broadcast{}
+	if err := json.Unmarshal(message, &b); err != nil {
+		log.Printf("error unmarshalling broadcast, skipping it: %s\n", err.Error())
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, ch := range c.subscribers {
+		select {
+		case ch <- b:
+		default:
+			// Don't hold up responses for a slow subscriber.
+			log.Printf("subscriber is falling behind, dropping broadcast: %s\n", b.MsgSubclass)
+		}
+	}
+}
+
+func (c *wsClient) deliver(id string, message []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	respCh, ok := c.pending[id]
+	if !ok {
+		// Probably a command that timed out.
+		log.Printf("nobody is waiting for response ID %s, skipping it\n", id)
+		return
+	}
+	delete(c.pending, id)
+	respCh <- message
+}
+
+func (c *wsClient) stop(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.err = err
+	close(c.done)
+	for id, ch := range c.subscribers {
+		delete(c.subscribers, id)
+		close(ch)
+	}
+}
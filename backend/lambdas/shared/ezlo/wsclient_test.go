@@ -0,0 +1,212 @@
+package ezlo
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestWSClient connects to a hub that `serve` plays the part of.
+func newTestWSClient(t *testing.T, serve func(ws *websocket.Conn)) *wsClient {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("error upgrading: %s", err.Error())
+			return
+		}
+		defer ws.Close()
+		serve(ws)
+	}))
+	t.Cleanup(server.Close)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.Nil(t, err)
+	c := newWSClient(ws, readTimeout)
+	t.Cleanup(func() { c.close() })
+	return c
+}
+
+func readIDs(ws *websocket.Conn, count int) []string {
+	ids := []string{}
+	for i := 0; i < count; i++ {
+		req := wsResponse{}
+		if err := ws.ReadJSON(&req); err != nil {
+			return ids
+		}
+		ids = append(ids, req.ID)
+	}
+	return ids
+}
+
+func Test_wsClientRoutesResponsesByID(t *testing.T) {
+	const count = 5
+	c := newTestWSClient(t, func(ws *websocket.Conn) {
+		ids := readIDs(ws, count)
+
+		// Noise first, then the answers backwards.
+		ws.WriteJSON(map[string]interface{}{"id": wsBroadcastID, "msg_subclass": "hub.item.updated", "result": map[string]string{}})
+		ws.WriteJSON(map[string]interface{}{"id": "someone.else", "result": map[string]string{}})
+		for i := len(ids) - 1; i >= 0; i-- {
+			ws.WriteJSON(map[string]interface{}{"id": ids[i], "result": map[string]string{"answer": ids[i]}})
+		}
+
+		readIDs(ws, 1) // Wait for the client to hang up.
+	})
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+
+			resp := struct {
+				Result struct {
+					Answer string `json:"answer"`
+				} `json:"result"`
+			}{}
+			err := wsSendCommand(context.Background(), c, id, map[string]string{"id": id, "method": "hub.items.list"}, &resp)
+			assert.Nil(t, err)
+			assert.Equal(t, id, resp.Result.Answer)
+		}(fmt.Sprintf("hub.items.list.%d", i))
+	}
+	wg.Wait()
+}
+
+func Test_wsClientBroadcastsToSubscribers(t *testing.T) {
+	c := newTestWSClient(t, func(ws *websocket.Conn) {
+		readIDs(ws, 1)
+		ws.WriteJSON(map[string]interface{}{"id": wsBroadcastID, "msg_subclass": "hub.item.updated", "result": map[string]string{"deviceId": "lock"}})
+		readIDs(ws, 1)
+	})
+
+	first, _ := c.subscribe()
+	second, unsubscribe := c.subscribe()
+	unsubscribe()
+
+	// Anything will do to get the hub to broadcast.
+	assert.Nil(t, c.write(context.Background(), []byte(`{}`)))
+
+	select {
+	case b := <-first:
+		assert.Equal(t, "hub.item.updated", b.MsgSubclass)
+		assert.JSONEq(t, `{"deviceId": "lock"}`, string(b.Result))
+	case <-time.After(time.Second):
+		assert.Fail(t, "didn't get the broadcast")
+	}
+
+	_, ok := <-second
+	assert.False(t, ok)
+
+	// Subscribers find out when the connection goes away.
+	c.close()
+	_, ok = <-first
+	assert.False(t, ok)
+}
+
+func Test_wsClientRespectsContext(t *testing.T) {
+	c := newTestWSClient(t, func(ws *websocket.Conn) {
+		readIDs(ws, 2) // Never answers.
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := wsSendCommand(ctx, c, "hub.reboot.1", map[string]string{"id": "hub.reboot.1"}, &struct{}{})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "deadline exceeded")
+	assert.Less(t, time.Since(start), time.Second)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	err = wsSendCommand(ctx, c, "hub.reboot.2", map[string]string{"id": "hub.reboot.2"}, &struct{}{})
+	assert.NotNil(t, err)
+	assert.False(t, c.stopped())
+}
+
+func Test_wsClientFailsWhenConnectionCloses(t *testing.T) {
+	c := newTestWSClient(t, func(ws *websocket.Conn) {
+		readIDs(ws, 1) // Hangs up without answering.
+	})
+
+	err := wsSendCommand(context.Background(), c, "hub.reboot.1", map[string]string{"id": "hub.reboot.1"}, &struct{}{})
+	assert.NotNil(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "read: "), err.Error())
+
+	<-c.done
+	err = wsSendCommand(context.Background(), c, "hub.reboot.2", map[string]string{"id": "hub.reboot.2"}, &struct{}{})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "connection closed")
+}
+
+func Test_wsSendCommandReturnsResponseErrors(t *testing.T) {
+	c := newTestWSClient(t, func(ws *websocket.Conn) {
+		for _, id := range readIDs(ws, 1) {
+			ws.WriteJSON(map[string]interface{}{"id": id, "error": map[string]interface{}{"code": -32500, "description": "rpc.method.notfound"}})
+		}
+		readIDs(ws, 1)
+	})
+
+	err := wsSendCommand(context.Background(), c, "hub.nope.1", map[string]string{"id": "hub.nope.1"}, &struct{}{})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), wsResponseErrorMessage)
+	assert.False(t, c.stopped())
+}
+
+func Test_wsClientStopsWhenTheHubGoesQuiet(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	answerPings := make(chan bool, 1)
+	answerPings <- true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("error upgrading: %s", err.Error())
+			return
+		}
+		defer ws.Close()
+
+		answer := true
+		ws.SetPingHandler(func(data string) error {
+			select {
+			case answer = <-answerPings:
+			default:
+			}
+			if !answer {
+				return nil
+			}
+			return ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		})
+		readIDs(ws, 1)
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.Nil(t, err)
+	c := newWSClient(conn, 100*time.Millisecond)
+	t.Cleanup(func() { c.close() })
+
+	// Pongs keep it going.
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, c.ping(time.Second))
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.False(t, c.stopped())
+
+	answerPings <- false
+	assert.Nil(t, c.ping(time.Second))
+	select {
+	case <-c.done:
+		assert.Contains(t, c.err.Error(), "timeout")
+	case <-time.After(time.Second):
+		assert.Fail(t, "didn't stop")
+	}
+}
@@ -0,0 +1,45 @@
+package shared
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"time"
+)
+
+// GuestMessage is what's available to a property's `GuestMessageTemplate`, e.g. "Your code for {{.UnitName}} is {{.Code}}, it works from {{.StartAt}} until {{.EndAt}}."
+type GuestMessage struct {
+	Code     string
+	EndAt    string
+	StartAt  string
+	UnitName string
+}
+
+const guestMessageTimeFormat = "Monday, January 2 at 3:04 PM"
+
+func NewGuestMessage(u Unit, mlc *DeviceManagedLockCode, tz *time.Location) GuestMessage {
+	return GuestMessage{
+		Code:     mlc.Code,
+		EndAt:    mlc.EndAt.In(tz).Format(guestMessageTimeFormat),
+		StartAt:  mlc.StartAt.In(tz).Format(guestMessageTimeFormat),
+		UnitName: u.Name,
+	}
+}
+
+func ValidateGuestMessageTemplate(t string) error {
+	_, err := RenderGuestMessage(t, GuestMessage{})
+	return err
+}
+
+func RenderGuestMessage(t string, m GuestMessage) (string, error) {
+	parsed, err := template.New("guestMessage").Parse(t)
+	if err != nil {
+		return "", fmt.Errorf("error parsing template: %s", err.Error())
+	}
+
+	var b bytes.Buffer
+	if err := parsed.Execute(&b, m); err != nil {
+		return "", fmt.Errorf("error executing template: %s", err.Error())
+	}
+	return b.String(), nil
+}
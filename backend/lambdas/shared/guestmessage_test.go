@@ -0,0 +1,16 @@
+package shared
+
+import "testing"
+
+func TestValidateGuestMessageTemplate(t *testing.T) {
+	for _, tmpl := range []string{"", "Your code is {{.Code}}.", "{{.UnitName}}: {{.StartAt}} - {{.EndAt}}"} {
+		if err := ValidateGuestMessageTemplate(tmpl); err != nil {
+			t.Fatalf("expected %q to be valid but was %s", tmpl, err)
+		}
+	}
+	for _, tmpl := range []string{"{{.Code", "{{.GuestName}}"} {
+		if err := ValidateGuestMessageTemplate(tmpl); err == nil {
+			t.Fatalf("expected an error for %q", tmpl)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package guestmessenger
+
+import (
+	"context"
+	"fmt"
+	"mlock/lambdas/shared"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type DeviceRepository interface {
+	AppendToAuditLog(ctx context.Context, device shared.Device, managedLockCodes []*shared.DeviceManagedLockCode) error
+	Get(ctx context.Context, id uuid.UUID) (shared.Device, bool, error)
+	List(ctx context.Context) ([]shared.Device, error)
+	PutIfUnchanged(ctx context.Context, item shared.Device) (shared.Device, error)
+}
+
+type Messenger interface {
+	SendGuestMessage(ctx context.Context, reservationID string, body string) error
+}
+
+type PropertyRepository interface {
+	List(ctx context.Context) ([]shared.Property, error)
+}
+
+type UnitRepository interface {
+	ListByID(ctx context.Context) (map[uuid.UUID]shared.Unit, error)
+}
+
+// GuestMessenger sends each guest their door code once it's enabled on every lock in the unit.
+type GuestMessenger struct {
+	clock              shared.Clock
+	deviceRepository   DeviceRepository
+	messenger          Messenger
+	propertyRepository PropertyRepository
+	timeZone           *time.Location
+	unitRepository     UnitRepository
+}
+
+// reservationCode is one device's managed lock code for a reservation, a reservation has one for each device in the unit.
+type reservationCode struct {
+	device *shared.Device
+	mlc    *shared.DeviceManagedLockCode
+}
+
+func NewGuestMessenger(dr DeviceRepository, m Messenger, pr PropertyRepository, tz *time.Location, ur UnitRepository) *GuestMessenger {
+	return &GuestMessenger{
+		clock:              shared.RealClock{},
+		deviceRepository:   dr,
+		messenger:          m,
+		propertyRepository: pr,
+		timeZone:           tz,
+		unitRepository:     ur,
+	}
+}
+
+func (g *GuestMessenger) WithClock(c shared.Clock) *GuestMessenger {
+	g.clock = c
+	return g
+}
+
+// SendMessages only returns an error if it can't get started, problems with individual reservations are added to the report.
+func (g *GuestMessenger) SendMessages(ctx context.Context, report *shared.RunReport) error {
+	properties, err := g.propertyRepository.List(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting properties: %s", err.Error())
+	}
+	propertiesByID := map[uuid.UUID]shared.Property{}
+	for _, p := range properties {
+		propertiesByID[p.ID] = p
+	}
+
+	unitsByID, err := g.unitRepository.ListByID(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting units: %s", err.Error())
+	}
+
+	devices, err := g.deviceRepository.List(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting devices: %s", err.Error())
+	}
+
+	codesByReservation := map[string][]reservationCode{}
+	reservationIDs := []string{} // So that the messages go out in a predictable order.
+	for i := range devices {
+		d := &devices[i]
+		if d.UnitID == nil {
+			continue
+		}
+		for _, mlc := range d.ManagedLockCodes {
+			if mlc.Reservation.ID == "" {
+				continue
+			}
+			if _, ok := codesByReservation[mlc.Reservation.ID]; !ok {
+				reservationIDs = append(reservationIDs, mlc.Reservation.ID)
+			}
+			codesByReservation[mlc.Reservation.ID] = append(codesByReservation[mlc.Reservation.ID], reservationCode{device: d, mlc: mlc})
+		}
+	}
+
+	changedByDevice := map[uuid.UUID][]*shared.DeviceManagedLockCode{}
+	for _, reservationID := range reservationIDs {
+		codes := codesByReservation[reservationID]
+		if !readyToSend(codes) {
+			continue
+		}
+
+		first := codes[0]
+		unit, ok := unitsByID[*first.device.UnitID]
+		if !ok || unit.GetReservationProvider() != shared.UnitReservationProviderHostaway {
+			continue // We can only message guests that booked through Hostaway.
+		}
+		property := propertiesByID[unit.PropertyID]
+		if property.GuestMessageTemplate == "" || !enabledSince(codes, property.GuestMessageTemplateSetAt) {
+			continue // The guest was given their code some other way.
+		}
+
+		body, err := shared.RenderGuestMessage(property.GuestMessageTemplate, shared.NewGuestMessage(unit, first.mlc, g.timeZone))
+		if err != nil {
+			report.AddError(shared.RunReportStageGuestMessenger, *first.device, fmt.Errorf("error rendering message for reservation %s: %s", reservationID, err.Error()))
+			continue
+		}
+
+		// Marking one of the codes is enough to stop it being sent again, so that's saved before sending in case we don't get to save afterwards.
+		now := g.clock.Now()
+		first.mlc.Reservation.GuestMessagedAt = &now
+		first.mlc.Note = "Sending the guest their door code."
+		if err := g.save(ctx, first.device, first.mlc); err != nil {
+			first.mlc.Reservation.GuestMessagedAt = nil
+			report.AddError(shared.RunReportStageGuestMessenger, *first.device, fmt.Errorf("error marking message for reservation %s as sent: %s", reservationID, err.Error()))
+			continue
+		}
+
+		if err := g.messenger.SendGuestMessage(ctx, reservationID, body); err != nil {
+			report.AddError(shared.RunReportStageGuestMessenger, *first.device, fmt.Errorf("error sending message for reservation %s: %s", reservationID, err.Error()))
+
+			first.mlc.Reservation.GuestMessagedAt = nil
+			first.mlc.Note = fmt.Sprintf("Couldn't send the guest their door code: %s", err.Error())
+			if err := g.save(ctx, first.device, first.mlc); err != nil {
+				report.AddError(shared.RunReportStageGuestMessenger, *first.device, fmt.Errorf("error unmarking message for reservation %s, it won't be tried again: %s", reservationID, err.Error()))
+			}
+			continue
+		}
+
+		for _, c := range codes {
+			c.mlc.Reservation.GuestMessagedAt = &now
+			c.mlc.Note = "Sent the guest their door code."
+			changedByDevice[c.device.ID] = append(changedByDevice[c.device.ID], c.mlc)
+		}
+	}
+
+	for i := range devices {
+		d := &devices[i]
+		changed, ok := changedByDevice[d.ID]
+		if !ok {
+			continue
+		}
+
+		// The message has already gone out and the first code says so, these just record it on the rest.
+		if err := g.save(ctx, d, changed...); err != nil {
+			report.AddError(shared.RunReportStageGuestMessenger, *d, err)
+			continue
+		}
+		report.AddProcessed(shared.RunReportStageGuestMessenger)
+	}
+
+	return nil
+}
+
+// save can be called more than once for the same device, the version is kept up to date so that the next save doesn't conflict with this one.
+func (g *GuestMessenger) save(ctx context.Context, d *shared.Device, changed ...*shared.DeviceManagedLockCode) error {
+	if err := g.deviceRepository.AppendToAuditLog(ctx, *d, changed); err != nil {
+		return fmt.Errorf("error appending to audit log: %s", err.Error())
+	}
+
+	reapplied := false
+	saved, err := shared.SaveDevice(ctx, g.deviceRepository, *d, func(fresh *shared.Device) (bool, error) {
+		reapplied = true
+		found := false
+		for _, mlc := range changed {
+			if theirs := fresh.GetManagedLockCode(mlc.ID); theirs != nil {
+				theirs.Reservation.GuestMessagedAt = mlc.Reservation.GuestMessagedAt
+				theirs.Note = mlc.Note
+				found = true
+			}
+		}
+		return found, nil
+	})
+	if err != nil {
+		return fmt.Errorf("error updating device: %s", err.Error())
+	}
+
+	// If their changes were saved too ours is out of date, so we leave it to conflict and be reapplied next time.
+	if !reapplied {
+		d.Version = saved.Version
+	}
+	return nil
+}
+
+// enabledSince is false if any of the codes were enabled before the template was set, those guests were given their code some other way.
+func enabledSince(codes []reservationCode, setAt *time.Time) bool {
+	if setAt == nil {
+		return false
+	}
+	for _, c := range codes {
+		if c.mlc.WasEnabledAt == nil || c.mlc.WasEnabledAt.Before(*setAt) {
+			return false
+		}
+	}
+	return true
+}
+
+// readyToSend is true once the code is enabled on every device, as long as we haven't already sent it.
+func readyToSend(codes []reservationCode) bool {
+	for _, c := range codes {
+		if c.mlc.Reservation.GuestMessagedAt != nil || c.mlc.Status != shared.DeviceManagedLockCodeStatus3Enabled {
+			return false
+		}
+	}
+	return len(codes) > 0
+}
@@ -0,0 +1,200 @@
+package guestmessenger_test
+
+//go:generate mockgen -source=guestmessenger.go -destination mocks/mock_guestmessenger/guestmessenger.go
+
+import (
+	"context"
+	"fmt"
+	"mlock/lambdas/shared"
+	"mlock/lambdas/shared/guestmessenger"
+	"mlock/lambdas/shared/guestmessenger/mocks/mock_guestmessenger"
+	"mlock/lambdas/shared/simulation"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+func Test_SendMessages(t *testing.T) {
+	g, dr, m, pr, ur, now := newGuestMessenger(t)
+
+	ctx := context.Background()
+	setAt := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	property := shared.Property{
+		GuestMessageTemplate:      "Your code for {{.UnitName}} is {{.Code}}, from {{.StartAt}} until {{.EndAt}}.",
+		GuestMessageTemplateSetAt: &setAt,
+		ID:                        uuid.New(),
+	}
+	unit := shared.Unit{ID: uuid.New(), Name: "01A", PropertyID: property.ID}
+	enabledAt := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	newMLC := func(reservationID string, status shared.DeviceManagedLockCodeStatus) *shared.DeviceManagedLockCode {
+		return &shared.DeviceManagedLockCode{
+			Code:         "3841",
+			EndAt:        time.Date(2026, 10, 22, 11, 30, 0, 0, time.UTC),
+			ID:           uuid.New(),
+			Reservation:  shared.DeviceManagedLockCodeReservation{ID: reservationID, Sync: true},
+			StartAt:      time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC),
+			Status:       status,
+			WasEnabledAt: &enabledAt,
+		}
+	}
+	frontDoor := shared.Device{
+		ID: uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{
+			newMLC("ready", shared.DeviceManagedLockCodeStatus3Enabled),
+			newMLC("notReady", shared.DeviceManagedLockCodeStatus3Enabled),
+		},
+		UnitID: &unit.ID,
+	}
+	garage := shared.Device{
+		ID: uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{
+			newMLC("ready", shared.DeviceManagedLockCodeStatus3Enabled),
+			newMLC("notReady", shared.DeviceManagedLockCodeStatus2Adding), // Not on every lock yet.
+		},
+		UnitID: &unit.ID,
+	}
+
+	pr.EXPECT().List(ctx).Return([]shared.Property{property}, nil)
+	ur.EXPECT().ListByID(ctx).Return(map[uuid.UUID]shared.Unit{unit.ID: unit}, nil)
+	dr.EXPECT().List(ctx).Return([]shared.Device{frontDoor, garage}, nil)
+
+	for range []shared.Device{frontDoor, frontDoor, garage} {
+		dr.EXPECT().AppendToAuditLog(ctx, gomock.Any(), gomock.Any()).Do(func(ctx context.Context, d shared.Device, mlcs []*shared.DeviceManagedLockCode) {
+			assert.Equal(t, 1, len(mlcs))
+			assert.Equal(t, "ready", mlcs[0].Reservation.ID)
+		}).Return(nil)
+	}
+
+	// It's marked as sent before it goes out, so that it can't be sent twice.
+	marked := dr.EXPECT().PutIfUnchanged(ctx, gomock.Any()).Do(func(ctx context.Context, d shared.Device) {
+		assert.Equal(t, frontDoor.ID, d.ID)
+		assert.Equal(t, now, *d.ManagedLockCodes[0].Reservation.GuestMessagedAt)
+	})
+	m.EXPECT().SendGuestMessage(ctx, "ready", "Your code for 01A is 3841, from Sunday, October 18 at 12:00 PM until Thursday, October 22 at 11:30 AM.").Return(nil).After(marked)
+
+	saved := map[uuid.UUID]shared.Device{}
+	dr.EXPECT().PutIfUnchanged(ctx, gomock.Any()).Do(func(ctx context.Context, d shared.Device) {
+		saved[d.ID] = d
+	}).Times(2)
+
+	report := shared.NewRunReport(now)
+	assert.Nil(t, g.SendMessages(ctx, report))
+	assert.Empty(t, report.Errors)
+
+	for _, d := range saved {
+		assert.Equal(t, now, *d.ManagedLockCodes[0].Reservation.GuestMessagedAt)
+		assert.Nil(t, d.ManagedLockCodes[1].Reservation.GuestMessagedAt)
+	}
+
+	// We don't send it twice.
+	pr.EXPECT().List(ctx).Return([]shared.Property{property}, nil)
+	ur.EXPECT().ListByID(ctx).Return(map[uuid.UUID]shared.Unit{unit.ID: unit}, nil)
+	dr.EXPECT().List(ctx).Return([]shared.Device{saved[frontDoor.ID], saved[garage.ID]}, nil)
+
+	report = shared.NewRunReport(now)
+	assert.Nil(t, g.SendMessages(ctx, report))
+	assert.Empty(t, report.Errors)
+}
+
+func Test_SendMessagesFailure(t *testing.T) {
+	g, dr, m, pr, ur, now := newGuestMessenger(t)
+
+	ctx := context.Background()
+	setAt := now.Add(-1 * time.Hour)
+	property := shared.Property{GuestMessageTemplate: "Your code is {{.Code}}.", GuestMessageTemplateSetAt: &setAt, ID: uuid.New()}
+	noTemplateProperty := shared.Property{ID: uuid.New()}
+	unit := shared.Unit{ID: uuid.New(), PropertyID: property.ID}
+	noTemplateUnit := shared.Unit{ID: uuid.New(), PropertyID: noTemplateProperty.ID}
+	mlc := &shared.DeviceManagedLockCode{
+		Code:         "3841",
+		Reservation:  shared.DeviceManagedLockCodeReservation{ID: "reservation"},
+		Status:       shared.DeviceManagedLockCodeStatus3Enabled,
+		WasEnabledAt: &now,
+	}
+	device := shared.Device{ID: uuid.New(), ManagedLockCodes: []*shared.DeviceManagedLockCode{mlc}, UnitID: &unit.ID}
+	noTemplateDevice := shared.Device{
+		ID: uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{{
+			Code:        "1234",
+			Reservation: shared.DeviceManagedLockCodeReservation{ID: "noTemplate"},
+			Status:      shared.DeviceManagedLockCodeStatus3Enabled,
+		}},
+		UnitID: &noTemplateUnit.ID,
+	}
+
+	pr.EXPECT().List(ctx).Return([]shared.Property{property, noTemplateProperty}, nil)
+	ur.EXPECT().ListByID(ctx).Return(map[uuid.UUID]shared.Unit{unit.ID: unit, noTemplateUnit.ID: noTemplateUnit}, nil)
+	dr.EXPECT().List(ctx).Return([]shared.Device{device, noTemplateDevice}, nil)
+
+	// It's marked as sent, then unmarked when sending fails so that it'll be tried again next time.
+	dr.EXPECT().AppendToAuditLog(ctx, gomock.Any(), []*shared.DeviceManagedLockCode{mlc}).Return(nil).Times(2)
+	marked := dr.EXPECT().PutIfUnchanged(ctx, gomock.Any()).Do(func(ctx context.Context, d shared.Device) {
+		assert.NotNil(t, d.ManagedLockCodes[0].Reservation.GuestMessagedAt)
+	})
+	sent := m.EXPECT().SendGuestMessage(ctx, "reservation", "Your code is 3841.").Return(fmt.Errorf("no conversation")).After(marked)
+	dr.EXPECT().PutIfUnchanged(ctx, gomock.Any()).Do(func(ctx context.Context, d shared.Device) {
+		assert.Nil(t, d.ManagedLockCodes[0].Reservation.GuestMessagedAt)
+	}).After(sent)
+
+	report := shared.NewRunReport(now)
+	assert.Nil(t, g.SendMessages(ctx, report))
+	assert.Equal(t, 1, len(report.Errors))
+	assert.Nil(t, mlc.Reservation.GuestMessagedAt)
+
+	// Nothing's sent if we can't mark it as sent first.
+	pr.EXPECT().List(ctx).Return([]shared.Property{property}, nil)
+	ur.EXPECT().ListByID(ctx).Return(map[uuid.UUID]shared.Unit{unit.ID: unit}, nil)
+	dr.EXPECT().List(ctx).Return([]shared.Device{device}, nil)
+	dr.EXPECT().AppendToAuditLog(ctx, gomock.Any(), gomock.Any()).Return(nil)
+	dr.EXPECT().PutIfUnchanged(ctx, gomock.Any()).Return(shared.Device{}, fmt.Errorf("conditional check failed"))
+
+	report = shared.NewRunReport(now)
+	assert.Nil(t, g.SendMessages(ctx, report))
+	assert.Equal(t, 1, len(report.Errors))
+	assert.Nil(t, mlc.Reservation.GuestMessagedAt)
+}
+
+func Test_SendMessagesSkipsCodesEnabledBeforeTheTemplate(t *testing.T) {
+	g, dr, _, pr, ur, now := newGuestMessenger(t)
+
+	ctx := context.Background()
+	setAt := now.Add(-1 * time.Hour)
+	enabledAt := setAt.Add(-1 * time.Minute)
+	property := shared.Property{GuestMessageTemplate: "Your code is {{.Code}}.", GuestMessageTemplateSetAt: &setAt, ID: uuid.New()}
+	unit := shared.Unit{ID: uuid.New(), PropertyID: property.ID}
+	device := shared.Device{
+		ID: uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{{
+			Code:         "3841",
+			Reservation:  shared.DeviceManagedLockCodeReservation{ID: "reservation"},
+			Status:       shared.DeviceManagedLockCodeStatus3Enabled,
+			WasEnabledAt: &enabledAt,
+		}},
+		UnitID: &unit.ID,
+	}
+
+	pr.EXPECT().List(ctx).Return([]shared.Property{property}, nil)
+	ur.EXPECT().ListByID(ctx).Return(map[uuid.UUID]shared.Unit{unit.ID: unit}, nil)
+	dr.EXPECT().List(ctx).Return([]shared.Device{device}, nil)
+
+	report := shared.NewRunReport(now)
+	assert.Nil(t, g.SendMessages(ctx, report))
+	assert.Empty(t, report.Errors)
+}
+
+func newGuestMessenger(t *testing.T) (*guestmessenger.GuestMessenger, *mock_guestmessenger.MockDeviceRepository, *mock_guestmessenger.MockMessenger, *mock_guestmessenger.MockPropertyRepository, *mock_guestmessenger.MockUnitRepository, time.Time) {
+	ctrl := gomock.NewController(t)
+
+	dr := mock_guestmessenger.NewMockDeviceRepository(ctrl)
+	m := mock_guestmessenger.NewMockMessenger(ctrl)
+	pr := mock_guestmessenger.NewMockPropertyRepository(ctrl)
+	ur := mock_guestmessenger.NewMockUnitRepository(ctrl)
+
+	now := time.Date(2026, 10, 18, 12, 5, 0, 0, time.UTC)
+	g := guestmessenger.NewGuestMessenger(dr, m, pr, time.UTC, ur).WithClock(simulation.NewClock(now))
+
+	return g, dr, m, pr, ur, now
+}
@@ -0,0 +1,219 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: guestmessenger.go
+//
+// Generated by this command:
+//
+//	mockgen -source=guestmessenger.go -destination mocks/mock_guestmessenger/guestmessenger.go
+//
+
+// Package mock_guestmessenger is a generated GoMock package.
+package mock_guestmessenger
+
+import (
+	context "context"
+	shared "mlock/lambdas/shared"
+	reflect "reflect"
+
+	uuid "github.com/google/uuid"
+	gomock "go.uber.org/mock/gomock"
+)
+
+// MockDeviceRepository is a mock of DeviceRepository interface.
+type MockDeviceRepository struct {
+	ctrl     *gomock.Controller
+	recorder *MockDeviceRepositoryMockRecorder
+	isgomock struct{}
+}
+
+// MockDeviceRepositoryMockRecorder is the mock recorder for MockDeviceRepository.
+type MockDeviceRepositoryMockRecorder struct {
+	mock *MockDeviceRepository
+}
+
+// NewMockDeviceRepository creates a new mock instance.
+func NewMockDeviceRepository(ctrl *gomock.Controller) *MockDeviceRepository {
+	mock := &MockDeviceRepository{ctrl: ctrl}
+	mock.recorder = &MockDeviceRepositoryMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockDeviceRepository) EXPECT() *MockDeviceRepositoryMockRecorder {
+	return m.recorder
+}
+
+// AppendToAuditLog mocks base method.
+func (m *MockDeviceRepository) AppendToAuditLog(ctx context.Context, device shared.Device, managedLockCodes []*shared.DeviceManagedLockCode) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AppendToAuditLog", ctx, device, managedLockCodes)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AppendToAuditLog indicates an expected call of AppendToAuditLog.
+func (mr *MockDeviceRepositoryMockRecorder) AppendToAuditLog(ctx, device, managedLockCodes any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AppendToAuditLog", reflect.TypeOf((*MockDeviceRepository)(nil).AppendToAuditLog), ctx, device, managedLockCodes)
+}
+
+// Get mocks base method.
+func (m *MockDeviceRepository) Get(ctx context.Context, id uuid.UUID) (shared.Device, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Get", ctx, id)
+	ret0, _ := ret[0].(shared.Device)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// Get indicates an expected call of Get.
+func (mr *MockDeviceRepositoryMockRecorder) Get(ctx, id any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockDeviceRepository)(nil).Get), ctx, id)
+}
+
+// List mocks base method.
+func (m *MockDeviceRepository) List(ctx context.Context) ([]shared.Device, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "List", ctx)
+	ret0, _ := ret[0].([]shared.Device)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// List indicates an expected call of List.
+func (mr *MockDeviceRepositoryMockRecorder) List(ctx any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockDeviceRepository)(nil).List), ctx)
+}
+
+// PutIfUnchanged mocks base method.
+func (m *MockDeviceRepository) PutIfUnchanged(ctx context.Context, item shared.Device) (shared.Device, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PutIfUnchanged", ctx, item)
+	ret0, _ := ret[0].(shared.Device)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PutIfUnchanged indicates an expected call of PutIfUnchanged.
+func (mr *MockDeviceRepositoryMockRecorder) PutIfUnchanged(ctx, item any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PutIfUnchanged", reflect.TypeOf((*MockDeviceRepository)(nil).PutIfUnchanged), ctx, item)
+}
+
+// MockMessenger is a mock of Messenger interface.
+type MockMessenger struct {
+	ctrl     *gomock.Controller
+	recorder *MockMessengerMockRecorder
+	isgomock struct{}
+}
+
+// MockMessengerMockRecorder is the mock recorder for MockMessenger.
+type MockMessengerMockRecorder struct {
+	mock *MockMessenger
+}
+
+// NewMockMessenger creates a new mock instance.
+func NewMockMessenger(ctrl *gomock.Controller) *MockMessenger {
+	mock := &MockMessenger{ctrl: ctrl}
+	mock.recorder = &MockMessengerMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockMessenger) EXPECT() *MockMessengerMockRecorder {
+	return m.recorder
+}
+
+// SendGuestMessage mocks base method.
+func (m *MockMessenger) SendGuestMessage(ctx context.Context, reservationID, body string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SendGuestMessage", ctx, reservationID, body)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SendGuestMessage indicates an expected call of SendGuestMessage.
+func (mr *MockMessengerMockRecorder) SendGuestMessage(ctx, reservationID, body any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SendGuestMessage", reflect.TypeOf((*MockMessenger)(nil).SendGuestMessage), ctx, reservationID, body)
+}
+
+// MockPropertyRepository is a mock of PropertyRepository interface.
+type MockPropertyRepository struct {
+	ctrl     *gomock.Controller
+	recorder *MockPropertyRepositoryMockRecorder
+	isgomock struct{}
+}
+
+// MockPropertyRepositoryMockRecorder is the mock recorder for MockPropertyRepository.
+type MockPropertyRepositoryMockRecorder struct {
+	mock *MockPropertyRepository
+}
+
+// NewMockPropertyRepository creates a new mock instance.
+func NewMockPropertyRepository(ctrl *gomock.Controller) *MockPropertyRepository {
+	mock := &MockPropertyRepository{ctrl: ctrl}
+	mock.recorder = &MockPropertyRepositoryMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockPropertyRepository) EXPECT() *MockPropertyRepositoryMockRecorder {
+	return m.recorder
+}
+
+// List mocks base method.
+func (m *MockPropertyRepository) List(ctx context.Context) ([]shared.Property, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "List", ctx)
+	ret0, _ := ret[0].([]shared.Property)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// List indicates an expected call of List.
+func (mr *MockPropertyRepositoryMockRecorder) List(ctx any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockPropertyRepository)(nil).List), ctx)
+}
+
+// MockUnitRepository is a mock of UnitRepository interface.
+type MockUnitRepository struct {
+	ctrl     *gomock.Controller
+	recorder *MockUnitRepositoryMockRecorder
+	isgomock struct{}
+}
+
+// MockUnitRepositoryMockRecorder is the mock recorder for MockUnitRepository.
+type MockUnitRepositoryMockRecorder struct {
+	mock *MockUnitRepository
+}
+
+// NewMockUnitRepository creates a new mock instance.
+func NewMockUnitRepository(ctrl *gomock.Controller) *MockUnitRepository {
+	mock := &MockUnitRepository{ctrl: ctrl}
+	mock.recorder = &MockUnitRepositoryMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockUnitRepository) EXPECT() *MockUnitRepositoryMockRecorder {
+	return m.recorder
+}
+
+// ListByID mocks base method.
+func (m *MockUnitRepository) ListByID(ctx context.Context) (map[uuid.UUID]shared.Unit, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListByID", ctx)
+	ret0, _ := ret[0].(map[uuid.UUID]shared.Unit)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListByID indicates an expected call of ListByID.
+func (mr *MockUnitRepositoryMockRecorder) ListByID(ctx any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListByID", reflect.TypeOf((*MockUnitRepository)(nil).ListByID), ctx)
+}
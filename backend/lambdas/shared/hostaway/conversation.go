@@ -0,0 +1,99 @@
+package hostaway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+type conversation struct {
+	ID            int `json:"id"`
+	ReservationID int `json:"reservationId"`
+}
+
+type conversationsPage struct {
+	Status string         `json:"status"`
+	Result []conversation `json:"result"`
+}
+
+type conversationMessage struct {
+	Body              string `json:"body"`
+	CommunicationType string `json:"communicationType"`
+}
+
+type conversationMessageResponse struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// SendGuestMessage posts to the reservation's conversation, which goes out through whichever channel the guest booked on.
+func (r *Repository) SendGuestMessage(ctx context.Context, reservationID string, body string) error {
+	accessToken, err := r.getAccessToken(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting access token: %s", err.Error())
+	}
+
+	page, err := getPage(conversationsPage{}, r, ctx, accessToken, "conversations", 0, 1, []string{fmt.Sprintf("reservationId=%s", reservationID)})
+	if err != nil {
+		return fmt.Errorf("error getting conversations: %s", err.Error())
+	}
+	if page.Status != "success" {
+		return fmt.Errorf("error getting conversations, non-success status: %s", page.Status)
+	}
+	if len(page.Result) == 0 {
+		return fmt.Errorf("no conversation found for reservation %s", reservationID)
+	}
+
+	reqBody, err := json.Marshal(conversationMessage{
+		Body:              body,
+		CommunicationType: "channel",
+	})
+	if err != nil {
+		return fmt.Errorf("error marshalling body: %s", err.Error())
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		fmt.Sprintf("%s/v1/conversations/%d/messages", r.hostawayURL, page.Result[0].ID),
+		bytes.NewReader(reqBody),
+	)
+	if err != nil {
+		return fmt.Errorf("error creating request: %s", err.Error())
+	}
+	req.Header.Add("Authorization", "Bearer "+accessToken.AccessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error doing request: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading body: %s", err.Error())
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("non-200 status code: %d, body: %s", resp.StatusCode, string(respBody))
+	}
+
+	var respData conversationMessageResponse
+	if err := json.Unmarshal(respBody, &respData); err != nil {
+		return fmt.Errorf("error unmarshalling body: %s", err.Error())
+	}
+	if respData.Status != "success" {
+		return fmt.Errorf("error sending message, non-success status: %s %s", respData.Status, respData.Message)
+	}
+
+	return nil
+}
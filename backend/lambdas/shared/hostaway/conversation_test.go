@@ -0,0 +1,73 @@
+package hostaway_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"mlock/lambdas/shared/hostaway"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SendGuestMessage(t *testing.T) {
+	t.Setenv("HOSTAWAY_ACCOUNT_ID", "123")
+	t.Setenv("HOSTAWAY_API_KEY", "456")
+
+	var sent map[string]string
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/accessTokens", func(w http.ResponseWriter, r *http.Request) {
+		mockJSON, _ := json.Marshal(authData{
+			AccessToken: "accessTokenValue",
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(mockJSON)
+	})
+	mux.HandleFunc("/v1/conversations", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "21107569", r.URL.Query().Get("reservationId"))
+		assert.Equal(t, "Bearer accessTokenValue", r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","result":[{"id":42,"reservationId":21107569}]}`))
+	})
+	mux.HandleFunc("/v1/conversations/42/messages", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		assert.Nil(t, json.Unmarshal(body, &sent))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success"}`))
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	err := hostaway.NewRepository(time.UTC, server.URL).SendGuestMessage(context.Background(), "21107569", "Your code is 3841.")
+	assert.Nil(t, err)
+	assert.Equal(t, "Your code is 3841.", sent["body"])
+	assert.Equal(t, "channel", sent["communicationType"])
+}
+
+func Test_SendGuestMessageNoConversation(t *testing.T) {
+	t.Setenv("HOSTAWAY_ACCOUNT_ID", "123")
+	t.Setenv("HOSTAWAY_API_KEY", "456")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/accessTokens", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token":"accessTokenValue"}`))
+	})
+	mux.HandleFunc("/v1/conversations", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"success","result":[]}`))
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	err := hostaway.NewRepository(time.UTC, server.URL).SendGuestMessage(context.Background(), "21107569", "Your code is 3841.")
+	assert.NotNil(t, err)
+}
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	mshared "mlock/shared"
@@ -22,6 +23,30 @@ type authData struct {
 	TokenType   string `json:"token_type"`
 }
 
+// cachedToken is an access token along with when we need to stop using it.
+type cachedToken struct {
+	authData  authData
+	expiresAt time.Time
+}
+
+// Access tokens are good for a long time, so they're kept for as long as the Lambda stays warm. They're keyed by the Hostaway URL and account.
+var (
+	accessTokens   = map[string]cachedToken{}
+	accessTokensMu sync.Mutex
+)
+
+// Stop using a token a little before it expires, so that it doesn't expire partway through a run.
+const accessTokenExpiryMargin = 5 * time.Minute
+
+// We only ask for reservations that overlap this window. Codes for guests that checked out more than a couple of days ago are long gone, and we don't need codes for anything more than a year out.
+const (
+	reservationLookAhead  = 365 * 24 * time.Hour
+	reservationLookBehind = 48 * time.Hour
+)
+
+// The window keeps the number of reservations down, this is just in case Hostaway ignores it.
+const maxReservationPages = 100
+
 type listing struct {
 	DoorSecurityCode    string `json:"doorSecurityCode"`
 	ID                  int    `json:"id"`
@@ -48,6 +73,11 @@ type reservation struct {
 	Status                string `json:"status"`
 }
 
+type reservationResponse struct {
+	Status string      `json:"status"`
+	Result reservation `json:"result"`
+}
+
 type reservationUpdateResponse struct {
 	Status  string `json:"status"`
 	Message string `json:"message"`
@@ -61,9 +91,24 @@ type reservationsPage struct {
 	// Offset int           `json:"offset"`
 }
 
+// Reservations with these statuses aren't (or are no longer) staying with us.
+var statusesToIgnore = []string{
+	"cancelled",
+	"declined",
+	"inquiry",
+	"inquiryNotPossible",
+	"inquiryPreapproved",
+}
+
+type CodeGenerator interface {
+	Generate(ctx context.Context, unit shared.Unit) (string, error)
+}
+
 type Repository struct {
-	hostawayURL string
-	timeZone    *time.Location
+	clock         shared.Clock
+	codeGenerator CodeGenerator
+	hostawayURL   string
+	timeZone      *time.Location
 }
 
 func NewRepository(timeZone *time.Location, hostawayURL string) *Repository {
@@ -72,11 +117,23 @@ func NewRepository(timeZone *time.Location, hostawayURL string) *Repository {
 	}
 
 	return &Repository{
+		clock:       shared.RealClock{},
 		hostawayURL: hostawayURL,
 		timeZone:    timeZone,
 	}
 }
 
+func (r *Repository) WithClock(c shared.Clock) *Repository {
+	r.clock = c
+	return r
+}
+
+// WithCodeGenerator is used for reservations that don't have a door code, instead of the listing's door code or the end of the reservation ID.
+func (r *Repository) WithCodeGenerator(g CodeGenerator) *Repository {
+	r.codeGenerator = g
+	return r
+}
+
 func (r *Repository) Get(ctx context.Context, unit shared.Unit) ([]shared.Reservation, error) {
 	reservations, err := r.GetForUnits(ctx, []shared.Unit{unit})
 	if err != nil {
@@ -103,24 +160,21 @@ func (r *Repository) GetForUnits(ctx context.Context, units []shared.Unit) (map[
 	for _, reservation := range reservations {
 		for _, unit := range units {
 			if unit.GetRemotePropertyID() == reservation.ListingMapID {
-				startDate, err := time.ParseInLocation("2006-01-02", reservation.ArrivalDate, r.timeZone)
-				if err != nil {
-					return map[uuid.UUID][]shared.Reservation{}, fmt.Errorf("error parsing start date: %s", err.Error())
-				}
-				// If they say they're going to be later than 4pm, assume 4pm.
-				checkInHour := min(reservation.CheckInTime, 16)
-				startDate = startDate.Add(time.Duration(checkInHour) * time.Hour)
-
-				endDate, err := time.ParseInLocation("2006-01-02", reservation.DepartureDate, r.timeZone)
+				startDate, endDate, err := r.getCheckInAndCheckOut(reservation)
 				if err != nil {
-					return map[uuid.UUID][]shared.Reservation{}, fmt.Errorf("error parsing end date: %s", err.Error())
+					return map[uuid.UUID][]shared.Reservation{}, err
 				}
-				// If they say they're going to be earlier than 11am, assume 11am.
-				checkOutHour := max(reservation.CheckOutTime, 11)
-				endDate = endDate.Add(time.Duration(checkOutHour) * time.Hour)
 
 				// This probably isn't the best place to do this, but if the `DoorCode` isn't set, set it.
-				if reservation.DoorCode == "" {
+				if reservation.DoorCode == "" && r.codeGenerator != nil {
+					reservation.DoorCode, err = r.codeGenerator.Generate(ctx, unit)
+					if err != nil {
+						return map[uuid.UUID][]shared.Reservation{}, fmt.Errorf("error generating door code: %s", err.Error())
+					}
+					if err := r.setDoorCode(ctx, accessToken, reservation.HostawayReservationID, reservation.DoorCode); err != nil {
+						return map[uuid.UUID][]shared.Reservation{}, fmt.Errorf("error setting door code: %s", err.Error())
+					}
+				} else if reservation.DoorCode == "" {
 					if len(listings) == 0 {
 						listings, err = r.getListingsByID(ctx, accessToken)
 						if err != nil {
@@ -154,6 +208,83 @@ func (r *Repository) GetForUnits(ctx context.Context, units []shared.Unit) (map[
 	return reservationsByUnit, nil
 }
 
+// GetChangedUnits returns the units with a reservation that was booked, changed or canceled since `since`. Hostaway only filters activity by day, so it can include reservations from earlier that day too.
+func (r *Repository) GetChangedUnits(ctx context.Context, units []shared.Unit, since time.Time) (map[uuid.UUID]bool, error) {
+	accessToken, err := r.getAccessToken(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting access token: %s", err.Error())
+	}
+
+	reservations, err := r.listReservations(ctx, accessToken, units, []string{
+		fmt.Sprintf("latestActivityStart=%s", since.In(r.timeZone).Format("2006-01-02")),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error getting reservations: %s", err.Error())
+	}
+
+	changed := map[uuid.UUID]bool{}
+	for _, reservation := range reservations {
+		for _, unit := range units {
+			if unit.GetRemotePropertyID() == reservation.ListingMapID {
+				changed[unit.ID] = true
+			}
+		}
+	}
+
+	return changed, nil
+}
+
+// GetStatus looks up a single reservation, it's how we find out that a guest who's already staying with us canceled or left early.
+func (r *Repository) GetStatus(ctx context.Context, unit shared.Unit, reservationID string) (shared.ReservationStatus, bool, error) {
+	accessToken, err := r.getAccessToken(ctx)
+	if err != nil {
+		return shared.ReservationStatus{}, false, fmt.Errorf("error getting access token: %s", err.Error())
+	}
+
+	reservation, ok, err := r.getReservation(ctx, accessToken, reservationID)
+	if err != nil {
+		return shared.ReservationStatus{}, false, fmt.Errorf("error getting reservation: %s", err.Error())
+	}
+	if !ok {
+		return shared.ReservationStatus{}, false, nil
+	}
+
+	_, end, err := r.getCheckInAndCheckOut(reservation)
+	if err != nil {
+		return shared.ReservationStatus{}, false, err
+	}
+
+	status := shared.ReservationStatus{End: end}
+	for _, s := range statusesToIgnore {
+		if reservation.Status == s {
+			status.Canceled = true
+		}
+	}
+
+	return status, true, nil
+}
+
+func (r *Repository) getCheckInAndCheckOut(reservation reservation) (time.Time, time.Time, error) {
+	startDate, err := time.ParseInLocation("2006-01-02", reservation.ArrivalDate, r.timeZone)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("error parsing start date: %s", err.Error())
+	}
+	// If they say they're going to be later than 4pm, assume 4pm.
+	checkInHour := min(reservation.CheckInTime, 16)
+	startDate = startDate.Add(time.Duration(checkInHour) * time.Hour)
+
+	endDate, err := time.ParseInLocation("2006-01-02", reservation.DepartureDate, r.timeZone)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("error parsing end date: %s", err.Error())
+	}
+	// If they say they're going to be earlier than 11am, assume 11am.
+	checkOutHour := max(reservation.CheckOutTime, 11)
+	endDate = endDate.Add(time.Duration(checkOutHour) * time.Hour)
+
+	return startDate, endDate, nil
+}
+
+// getAccessToken only asks Hostaway for a new token when we don't have one that's still good.
 func (r *Repository) getAccessToken(ctx context.Context) (authData, error) {
 	accountId, err := mshared.GetConfig("HOSTAWAY_ACCOUNT_ID")
 	if err != nil {
@@ -165,6 +296,32 @@ func (r *Repository) getAccessToken(ctx context.Context) (authData, error) {
 		return authData{}, fmt.Errorf("error getting apiKey: %s", err.Error())
 	}
 
+	// Held while we ask for a new token, so that concurrent callers don't all ask at once.
+	accessTokensMu.Lock()
+	defer accessTokensMu.Unlock()
+
+	key := r.hostawayURL + "|" + accountId
+	now := r.clock.Now()
+	if cached, ok := accessTokens[key]; ok && now.Before(cached.expiresAt) {
+		return cached.authData, nil
+	}
+
+	body, err := r.requestAccessToken(ctx, accountId, apiKey)
+	if err != nil {
+		return authData{}, err
+	}
+
+	if body.AccessToken != "" && body.ExpiresIn > 0 {
+		accessTokens[key] = cachedToken{
+			authData:  body,
+			expiresAt: now.Add(time.Duration(body.ExpiresIn)*time.Second - accessTokenExpiryMargin),
+		}
+	}
+
+	return body, nil
+}
+
+func (r *Repository) requestAccessToken(ctx context.Context, accountId string, apiKey string) (authData, error) {
 	bodyData := url.Values{
 		"grant_type":    {"client_credentials"},
 		"client_id":     {accountId},
@@ -193,6 +350,10 @@ func (r *Repository) getAccessToken(ctx context.Context) (authData, error) {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode >= 300 {
+		return authData{}, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return authData{}, fmt.Errorf("error reading body: %s", err.Error())
@@ -233,16 +394,45 @@ func (r *Repository) getListingsByID(ctx context.Context, authToken authData) (m
 	return result, nil
 }
 
+// getReservations returns the reservations in the window that are (or will be) staying with us.
 func (r *Repository) getReservations(ctx context.Context, authToken authData, units []shared.Unit) ([]reservation, error) {
-	twoDaysAgo := time.Now().Add(-48 * time.Hour).Format("2006-01-02")
-	extraParameters := []string{"sortOrder=arrivalDate"}
+	reservations, err := r.listReservations(ctx, authToken, units, []string{})
+	if err != nil {
+		return []reservation{}, err
+	}
+
+	result := []reservation{}
+ReservationLoop:
+	for _, reservation := range reservations {
+		for _, statusToIgnore := range statusesToIgnore {
+			if reservation.Status == statusToIgnore {
+				continue ReservationLoop
+			}
+		}
+		if reservation.Status != "new" && reservation.Status != "modified" && reservation.Status != "ownerStay" {
+			fmt.Printf("unhandled reservation status: %s for hostaway reservation ID: %s\n", reservation.Status, reservation.HostawayReservationID)
+		}
+		result = append(result, reservation)
+	}
+	return result, nil
+}
+
+// listReservations pages through every reservation in the window, whatever its status.
+func (r *Repository) listReservations(ctx context.Context, authToken authData, units []shared.Unit, extraParameters []string) ([]reservation, error) {
+	now := r.clock.Now().In(r.timeZone)
+	parameters := append([]string{
+		"sortOrder=arrivalDate",
+		fmt.Sprintf("departureStartDate=%s", now.Add(-reservationLookBehind).Format("2006-01-02")),
+		fmt.Sprintf("arrivalEndDate=%s", now.Add(reservationLookAhead).Format("2006-01-02")),
+	}, extraParameters...)
 	if len(units) == 1 {
-		extraParameters = append(extraParameters, fmt.Sprintf("listingId=%d", units[0].GetRemotePropertyID()))
+		parameters = append(parameters, fmt.Sprintf("listingId=%d", units[0].GetRemotePropertyID()))
 	}
+
 	result := []reservation{}
 	page := 0
 	for {
-		pageResult, err := getPage(reservationsPage{}, r, ctx, authToken, "reservations", page, 500, extraParameters)
+		pageResult, err := getPage(reservationsPage{}, r, ctx, authToken, "reservations", page, 500, parameters)
 		if err != nil {
 			return []reservation{}, fmt.Errorf("error getting reservations page: %s", err.Error())
 		}
@@ -253,34 +443,59 @@ func (r *Repository) getReservations(ctx context.Context, authToken authData, un
 		if len(pageResult.Result) == 0 {
 			return result, nil
 		}
-		if page > 9999 {
+		if page >= maxReservationPages {
 			return []reservation{}, fmt.Errorf("too many pages: %d", page)
 		}
-	ReservationLoop:
-		for _, reservation := range pageResult.Result {
-			for _, statusToIgnore := range []string{
-				"cancelled",
-				"declined",
-				"inquiry",
-				"inquiryNotPossible",
-				"inquiryPreapproved",
-			} {
-				if reservation.Status == statusToIgnore {
-					continue ReservationLoop
-				}
-			}
-			if reservation.Status != "new" && reservation.Status != "modified" && reservation.Status != "ownerStay" {
-				fmt.Printf("unhandled reservation status: %s for hostaway reservation ID: %s\n", reservation.Status, reservation.HostawayReservationID)
-			}
-			if reservation.DepartureDate < twoDaysAgo {
-				continue
-			}
-			result = append(result, reservation)
-		}
+		result = append(result, pageResult.Result...)
 		page++
 	}
 }
 
+func (r *Repository) getReservation(ctx context.Context, authToken authData, reservationID string) (reservation, bool, error) {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodGet,
+		fmt.Sprintf("%s/v1/reservations/%s", r.hostawayURL, url.PathEscape(reservationID)),
+		nil,
+	)
+	if err != nil {
+		return reservation{}, false, fmt.Errorf("error creating request: %s", err.Error())
+	}
+	req.Header.Add("Authorization", "Bearer "+authToken.AccessToken)
+
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return reservation{}, false, fmt.Errorf("error doing request: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return reservation{}, false, nil
+	}
+	if resp.StatusCode >= 300 {
+		return reservation{}, false, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return reservation{}, false, fmt.Errorf("error reading body: %s", err.Error())
+	}
+
+	var body reservationResponse
+	if err := json.Unmarshal(respBody, &body); err != nil {
+		return reservation{}, false, fmt.Errorf("error unmarshalling body: %s", err.Error())
+	}
+	if body.Status != "success" {
+		return reservation{}, false, fmt.Errorf("non-success status: %s", body.Status)
+	}
+
+	return body.Result, true, nil
+}
+
 func getPage[T any](
 	emptyT T,
 	r *Repository,
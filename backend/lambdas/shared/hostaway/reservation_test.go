@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"mlock/lambdas/shared"
 	"mlock/lambdas/shared/hostaway"
+	"mlock/lambdas/shared/simulation"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -190,6 +191,94 @@ func Test_aFewThings(t *testing.T) {
 	assert.Equal(t, "21107569", reservation.TransactionNumber)
 }
 
+func Test_accessTokenIsCached(t *testing.T) {
+	t.Setenv("HOSTAWAY_ACCOUNT_ID", "123")
+	t.Setenv("HOSTAWAY_API_KEY", "456")
+
+	tokenRequests := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/accessTokens", func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests++
+		mockJSON, _ := json.Marshal(authData{
+			AccessToken: fmt.Sprintf("accessTokenValue%d", tokenRequests),
+			ExpiresIn:   3600,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(mockJSON)
+	})
+	mux.HandleFunc("/v1/reservations/21107569", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, fmt.Sprintf("Bearer accessTokenValue%d", tokenRequests), r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	now := time.Now()
+	clock := simulation.NewClock(now)
+	r := hostaway.NewRepository(time.UTC, server.URL).WithClock(clock)
+
+	for i := 0; i < 3; i++ {
+		_, _, err := r.GetStatus(context.Background(), shared.Unit{}, "21107569")
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 1, tokenRequests)
+
+	// A new repository (e.g. the next run in a warm Lambda) uses the same token.
+	_, _, err := hostaway.NewRepository(time.UTC, server.URL).WithClock(clock).GetStatus(context.Background(), shared.Unit{}, "21107569")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, tokenRequests)
+
+	// We don't wait until the last second.
+	clock.Set(now.Add(58 * time.Minute))
+	_, _, err = r.GetStatus(context.Background(), shared.Unit{}, "21107569")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, tokenRequests)
+}
+
+func Test_GetChangedUnits(t *testing.T) {
+	t.Setenv("HOSTAWAY_ACCOUNT_ID", "123")
+	t.Setenv("HOSTAWAY_API_KEY", "456")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/accessTokens", func(w http.ResponseWriter, r *http.Request) {
+		mockJSON, _ := json.Marshal(authData{AccessToken: "accessTokenValue"})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(mockJSON)
+	})
+	mux.HandleFunc("/v1/reservations", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		assert.Equal(t, "2024-03-01", query.Get("latestActivityStart"))
+		assert.Equal(t, "2024-02-28", query.Get("departureStartDate"))
+		assert.Equal(t, "2025-03-01", query.Get("arrivalEndDate"))
+
+		result := []reservation{}
+		if query.Get("offset") == "0" {
+			result = []reservation{
+				// Canceled reservations count as a change.
+				{HostawayReservationID: "1", ListingMapID: 25, Status: "cancelled"},
+				{HostawayReservationID: "2", ListingMapID: 99, Status: "new"},
+			}
+		}
+		mockJSON, _ := json.Marshal(reservationsPage{Result: result, Status: "success"})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(mockJSON)
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	r := hostaway.NewRepository(time.UTC, server.URL).WithClock(simulation.NewClock(now))
+
+	changedUnit := shared.Unit{ID: uuid.New(), RemotePropertyURL: "https://dashboard.hostaway.com/listing/25"}
+	unchangedUnit := shared.Unit{ID: uuid.New(), RemotePropertyURL: "https://dashboard.hostaway.com/listing/26"}
+
+	changed, err := r.GetChangedUnits(context.Background(), []shared.Unit{changedUnit, unchangedUnit}, now.Add(-5*time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, map[uuid.UUID]bool{changedUnit.ID: true}, changed)
+}
+
 func loadConfig() error {
 	if err := godotenv.Load(".env.test"); err != nil {
 		return fmt.Errorf("error loading .env file: %s", err.Error())
@@ -0,0 +1,57 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: reservation.go
+//
+// Generated by this command:
+//
+//	mockgen -source=reservation.go -destination mocks/mock_ical/reservation.go
+//
+
+// Package mock_ical is a generated GoMock package.
+package mock_ical
+
+import (
+	context "context"
+	shared "mlock/lambdas/shared"
+	reflect "reflect"
+
+	gomock "go.uber.org/mock/gomock"
+)
+
+// MockCodeGenerator is a mock of CodeGenerator interface.
+type MockCodeGenerator struct {
+	ctrl     *gomock.Controller
+	recorder *MockCodeGeneratorMockRecorder
+	isgomock struct{}
+}
+
+// MockCodeGeneratorMockRecorder is the mock recorder for MockCodeGenerator.
+type MockCodeGeneratorMockRecorder struct {
+	mock *MockCodeGenerator
+}
+
+// NewMockCodeGenerator creates a new mock instance.
+func NewMockCodeGenerator(ctrl *gomock.Controller) *MockCodeGenerator {
+	mock := &MockCodeGenerator{ctrl: ctrl}
+	mock.recorder = &MockCodeGeneratorMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockCodeGenerator) EXPECT() *MockCodeGeneratorMockRecorder {
+	return m.recorder
+}
+
+// GenerateForReservation mocks base method.
+func (m *MockCodeGenerator) GenerateForReservation(ctx context.Context, unit shared.Unit, reservationID string) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GenerateForReservation", ctx, unit, reservationID)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GenerateForReservation indicates an expected call of GenerateForReservation.
+func (mr *MockCodeGeneratorMockRecorder) GenerateForReservation(ctx, unit, reservationID any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GenerateForReservation", reflect.TypeOf((*MockCodeGenerator)(nil).GenerateForReservation), ctx, unit, reservationID)
+}
@@ -0,0 +1,297 @@
+package ical
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"mlock/lambdas/shared"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type CodeGenerator interface {
+	GenerateForReservation(ctx context.Context, unit shared.Unit, reservationID string) (string, error)
+}
+
+// Repository gets reservations from iCal feeds (e.g. Airbnb and VRBO), it only looks at the units that use the iCal provider.
+type Repository struct {
+	client        *http.Client
+	clock         shared.Clock
+	codeGenerator CodeGenerator
+	timeZone      *time.Location
+}
+
+type event struct {
+	Description string
+	End         time.Time
+	EndIsDate   bool
+	Start       time.Time
+	StartIsDate bool
+	Status      string
+	Summary     string
+	UID         string
+}
+
+var phoneLast4Regex = regexp.MustCompile(`(?i)phone number \(last 4 digits\):\s*(\d{4})`)
+
+// NewRepository needs a code generator for the reservations that don't come with a door code.
+func NewRepository(timeZone *time.Location, codeGenerator CodeGenerator) *Repository {
+	return &Repository{
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+		clock:         shared.RealClock{},
+		codeGenerator: codeGenerator,
+		timeZone:      timeZone,
+	}
+}
+
+func (r *Repository) WithClock(c shared.Clock) *Repository {
+	r.clock = c
+	return r
+}
+
+func (r *Repository) Get(ctx context.Context, unit shared.Unit) ([]shared.Reservation, error) {
+	reservations, err := r.GetForUnits(ctx, []shared.Unit{unit})
+	if err != nil {
+		return nil, fmt.Errorf("error getting reservations: %s", err.Error())
+	}
+	return reservations[unit.ID], nil
+}
+
+// GetForUnits keeps going when a unit's feed fails, those units are left out and returned in a `shared.UnitErrors`.
+func (r *Repository) GetForUnits(ctx context.Context, units []shared.Unit) (map[uuid.UUID][]shared.Reservation, error) {
+	reservationsByUnit := map[uuid.UUID][]shared.Reservation{}
+	unitErrors := shared.UnitErrors{}
+
+	for _, unit := range units {
+		if unit.GetReservationProvider() != shared.UnitReservationProviderICal {
+			continue
+		}
+
+		reservations, err := r.getForUnit(ctx, unit)
+		if err != nil {
+			unitErrors[unit.ID] = fmt.Errorf("error getting reservations for unit %s: %s", unit.Name, err.Error())
+			continue
+		}
+		reservationsByUnit[unit.ID] = reservations
+	}
+
+	if len(unitErrors) > 0 {
+		return reservationsByUnit, unitErrors
+	}
+	return reservationsByUnit, nil
+}
+
+func (r *Repository) getForUnit(ctx context.Context, unit shared.Unit) ([]shared.Reservation, error) {
+	if unit.ICalFeed == nil {
+		return nil, fmt.Errorf("unit uses iCal but doesn't have a feed")
+	}
+
+	body, err := r.getFeed(ctx, unit.ICalFeed.URL)
+	if err != nil {
+		return nil, fmt.Errorf("error getting feed: %s", err.Error())
+	}
+
+	events, err := parseEvents(body, r.timeZone)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing feed: %s", err.Error())
+	}
+
+	return r.toReservations(ctx, unit, events)
+}
+
+func (r *Repository) toReservations(ctx context.Context, unit shared.Unit, events []event) ([]shared.Reservation, error) {
+	feed := unit.ICalFeed
+	twoDaysAgo := r.clock.Now().Add(-48 * time.Hour)
+
+	reservations := []shared.Reservation{}
+	for _, e := range events {
+		if isBlock(e) {
+			continue
+		}
+
+		start := e.Start
+		if e.StartIsDate {
+			start = start.Add(time.Duration(feed.CheckInHour) * time.Hour)
+		}
+		end := e.End
+		if e.EndIsDate {
+			end = end.Add(time.Duration(feed.CheckOutHour) * time.Hour)
+		}
+		if end.Before(twoDaysAgo) {
+			continue
+		}
+
+		doorCode, err := r.doorCode(ctx, unit, e)
+		if err != nil {
+			return nil, fmt.Errorf("error getting door code for %s: %s", e.UID, err.Error())
+		}
+
+		reservations = append(reservations, shared.Reservation{
+			DoorCode:          doorCode,
+			End:               end,
+			ID:                e.UID,
+			Start:             start,
+			TransactionNumber: e.UID,
+		})
+	}
+
+	return reservations, nil
+}
+
+// isBlock is true for events that aren't guests, e.g. the dates the host blocked off or that are between stays.
+func isBlock(e event) bool {
+	if strings.EqualFold(e.Status, "CANCELLED") {
+		return true
+	}
+	summary := strings.ToLower(e.Summary)
+	return strings.Contains(summary, "not available") || strings.Contains(summary, "blocked")
+}
+
+func (r *Repository) doorCode(ctx context.Context, unit shared.Unit, e event) (string, error) {
+	feed := unit.ICalFeed
+	switch feed.DoorCodeStrategy {
+	case shared.ICalDoorCodeStrategyStatic:
+		return feed.StaticDoorCode, nil
+	case shared.ICalDoorCodeStrategyPhoneLast4:
+		if match := phoneLast4Regex.FindStringSubmatch(e.Description); len(match) == 2 {
+			return match[1], nil
+		}
+	}
+
+	return r.codeGenerator.GenerateForReservation(ctx, unit, e.UID)
+}
+
+func (r *Repository) getFeed(ctx context.Context, feedURL string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feedURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %s", err.Error())
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error doing request: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading body: %s", err.Error())
+	}
+
+	return string(body), nil
+}
+
+func parseEvents(body string, timeZone *time.Location) ([]event, error) {
+	events := []event{}
+
+	var current *event
+	for _, line := range unfold(body) {
+		name, params, value := parseLine(line)
+
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			current = &event{}
+		case name == "END" && value == "VEVENT":
+			if current == nil {
+				return nil, fmt.Errorf("END:VEVENT without BEGIN:VEVENT")
+			}
+			if current.UID == "" || current.Start.IsZero() || current.End.IsZero() {
+				return nil, fmt.Errorf("event is missing UID, DTSTART or DTEND")
+			}
+			events = append(events, *current)
+			current = nil
+		case current == nil:
+			continue
+		case name == "DTSTART":
+			t, isDate, err := parseTime(value, params, timeZone)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing DTSTART: %s", err.Error())
+			}
+			current.Start, current.StartIsDate = t, isDate
+		case name == "DTEND":
+			t, isDate, err := parseTime(value, params, timeZone)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing DTEND: %s", err.Error())
+			}
+			current.End, current.EndIsDate = t, isDate
+		case name == "DESCRIPTION":
+			current.Description = unescape(value)
+		case name == "STATUS":
+			current.Status = value
+		case name == "SUMMARY":
+			current.Summary = unescape(value)
+		case name == "UID":
+			current.UID = value
+		}
+	}
+
+	return events, nil
+}
+
+// unfold joins the lines that were folded onto the next line (they start with a space or a tab).
+func unfold(body string) []string {
+	lines := []string{}
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// parseLine splits e.g. `DTSTART;VALUE=DATE:20261005` into the name, parameters, and value.
+func parseLine(line string) (string, map[string]string, string) {
+	nameAndParams, value, _ := strings.Cut(line, ":")
+	parts := strings.Split(nameAndParams, ";")
+
+	params := map[string]string{}
+	for _, p := range parts[1:] {
+		k, v, _ := strings.Cut(p, "=")
+		params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+	}
+
+	return strings.ToUpper(parts[0]), params, value
+}
+
+func parseTime(value string, params map[string]string, timeZone *time.Location) (time.Time, bool, error) {
+	if params["VALUE"] == "DATE" || len(value) == 8 {
+		t, err := time.ParseInLocation("20060102", value, timeZone)
+		return t, true, err
+	}
+
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse("20060102T150405Z", value)
+		return t, false, err
+	}
+
+	loc := timeZone
+	if tzid, ok := params["TZID"]; ok {
+		l, err := time.LoadLocation(tzid)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("unknown time zone: %s", tzid)
+		}
+		loc = l
+	}
+	t, err := time.ParseInLocation("20060102T150405", value, loc)
+	return t, false, err
+}
+
+func unescape(value string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(value)
+}
@@ -0,0 +1,197 @@
+package ical_test
+
+//go:generate mockgen -source=reservation.go -destination mocks/mock_ical/reservation.go
+
+import (
+	"context"
+	"errors"
+	"mlock/lambdas/shared"
+	"mlock/lambdas/shared/ical"
+	"mlock/lambdas/shared/ical/mocks/mock_ical"
+	"mlock/lambdas/shared/simulation"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+func feed(start time.Time) string {
+	day := func(n int) string {
+		return start.AddDate(0, 0, n).Format("20060102")
+	}
+	return strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//Airbnb Inc//Hosting Calendar 0.8.8//EN",
+		"BEGIN:VEVENT",
+		"DTSTART;VALUE=DATE:" + day(1),
+		"DTEND;VALUE=DATE:" + day(3),
+		"UID:1418fb94e984-reserved@airbnb.com",
+		"DESCRIPTION:Reservation URL: https://www.airbnb.com/hosting/reservations/details/HM\\n",
+		" ABCDEF\\nPhone Number (Last 4 Digits): 4321",
+		"SUMMARY:Reserved",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"DTSTART;VALUE=DATE:" + day(4),
+		"DTEND;VALUE=DATE:" + day(6),
+		"UID:7f2c-blocked@airbnb.com",
+		"SUMMARY:Airbnb (Not available)",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"DTSTART:" + day(7) + "T230000Z",
+		"DTEND;TZID=America/Denver:" + day(9) + "T100000",
+		"UID:vrbo-123",
+		"SUMMARY:Reserved - Jane",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"DTSTART;VALUE=DATE:" + day(-10),
+		"DTEND;VALUE=DATE:" + day(-8),
+		"UID:long-gone",
+		"SUMMARY:Reserved",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}, "\r\n")
+}
+
+func Test_GetForUnits(t *testing.T) {
+	tz, err := time.LoadLocation("America/Denver")
+	assert.Nil(t, err)
+
+	year, month, d := time.Now().In(tz).Date()
+	today := time.Date(year, month, d, 0, 0, 0, 0, tz)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(feed(today)))
+	}))
+	defer server.Close()
+
+	icalUnit := shared.Unit{
+		ICalFeed: &shared.UnitICalFeed{
+			CheckInHour:      16,
+			CheckOutHour:     11,
+			DoorCodeStrategy: shared.ICalDoorCodeStrategyPhoneLast4,
+			URL:              server.URL,
+		},
+		ID:                  uuid.New(),
+		ReservationProvider: shared.UnitReservationProviderICal,
+	}
+	hostawayUnit := shared.Unit{ID: uuid.New()}
+
+	cg := mock_ical.NewMockCodeGenerator(gomock.NewController(t))
+	cg.EXPECT().GenerateForReservation(gomock.Any(), icalUnit, "vrbo-123").Return("8642", nil)
+
+	reservations, err := ical.NewRepository(tz, cg).GetForUnits(context.Background(), []shared.Unit{icalUnit, hostawayUnit})
+	assert.Nil(t, err)
+
+	assert.Equal(t, 1, len(reservations))
+	rs := reservations[icalUnit.ID]
+	assert.Equal(t, 2, len(rs))
+
+	assert.Equal(t, "1418fb94e984-reserved@airbnb.com", rs[0].ID)
+	assert.Equal(t, "4321", rs[0].DoorCode)
+	assert.True(t, today.AddDate(0, 0, 1).Add(16*time.Hour).Equal(rs[0].Start))
+	assert.True(t, today.AddDate(0, 0, 3).Add(11*time.Hour).Equal(rs[0].End))
+
+	// Times that are set on the event are used as is. There's no phone number, so it gets a generated code.
+	assert.Equal(t, "vrbo-123", rs[1].ID)
+	assert.Equal(t, "8642", rs[1].DoorCode)
+	assert.True(t, time.Date(year, month, d+7, 23, 0, 0, 0, time.UTC).Equal(rs[1].Start))
+	assert.True(t, today.AddDate(0, 0, 9).Add(10*time.Hour).Equal(rs[1].End))
+}
+
+func Test_DoorCodeStrategies(t *testing.T) {
+	start := time.Now()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(feed(start)))
+	}))
+	defer server.Close()
+
+	unit := shared.Unit{
+		ICalFeed: &shared.UnitICalFeed{
+			DoorCodeStrategy: shared.ICalDoorCodeStrategyStatic,
+			StaticDoorCode:   "2468",
+			URL:              server.URL,
+		},
+		ID:                  uuid.New(),
+		ReservationProvider: shared.UnitReservationProviderICal,
+	}
+
+	cg := mock_ical.NewMockCodeGenerator(gomock.NewController(t))
+	r := ical.NewRepository(time.UTC, cg)
+
+	rs, err := r.Get(context.Background(), unit)
+	assert.Nil(t, err)
+	for _, res := range rs {
+		assert.Equal(t, "2468", res.DoorCode)
+	}
+
+	// The UID strategy leaves it to the code generator.
+	unit.ICalFeed.DoorCodeStrategy = shared.ICalDoorCodeStrategyUID
+	cg.EXPECT().GenerateForReservation(gomock.Any(), unit, "1418fb94e984-reserved@airbnb.com").Return("3841", nil)
+	cg.EXPECT().GenerateForReservation(gomock.Any(), unit, "vrbo-123").Return("5190", nil)
+	rs, err = r.Get(context.Background(), unit)
+	assert.Nil(t, err)
+	assert.Equal(t, "3841", rs[0].DoorCode)
+	assert.Equal(t, "5190", rs[1].DoorCode)
+}
+
+func Test_UsesTheClock(t *testing.T) {
+	now := time.Now()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(feed(now)))
+	}))
+	defer server.Close()
+
+	unit := shared.Unit{
+		ICalFeed:            &shared.UnitICalFeed{DoorCodeStrategy: shared.ICalDoorCodeStrategyStatic, StaticDoorCode: "2468", URL: server.URL},
+		ID:                  uuid.New(),
+		ReservationProvider: shared.UnitReservationProviderICal,
+	}
+
+	// Three weeks ago, the reservation that's long gone now hadn't happened yet.
+	rs, err := ical.NewRepository(time.UTC, nil).WithClock(simulation.NewClock(now.AddDate(0, 0, -21))).Get(context.Background(), unit)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(rs))
+	assert.Equal(t, "long-gone", rs[2].ID)
+}
+
+func Test_BadFeed(t *testing.T) {
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer bad.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(feed(time.Now())))
+	}))
+	defer good.Close()
+
+	badUnit := shared.Unit{
+		ICalFeed:            &shared.UnitICalFeed{DoorCodeStrategy: shared.ICalDoorCodeStrategyStatic, StaticDoorCode: "2468", URL: bad.URL},
+		ID:                  uuid.New(),
+		ReservationProvider: shared.UnitReservationProviderICal,
+	}
+	goodUnit := shared.Unit{
+		ICalFeed:            &shared.UnitICalFeed{DoorCodeStrategy: shared.ICalDoorCodeStrategyStatic, StaticDoorCode: "2468", URL: good.URL},
+		ID:                  uuid.New(),
+		ReservationProvider: shared.UnitReservationProviderICal,
+	}
+	r := ical.NewRepository(time.UTC, nil)
+
+	_, err := r.Get(context.Background(), badUnit)
+	assert.NotNil(t, err)
+
+	// One bad feed doesn't stop the others.
+	reservations, err := r.GetForUnits(context.Background(), []shared.Unit{badUnit, goodUnit})
+	unitErrors := shared.UnitErrors{}
+	assert.True(t, errors.As(err, &unitErrors))
+	assert.Contains(t, unitErrors, badUnit.ID)
+	assert.NotContains(t, reservations, badUnit.ID)
+	assert.Equal(t, 2, len(reservations[goodUnit.ID]))
+}
@@ -3,32 +3,71 @@ package lockengine
 import (
 	"context"
 	"fmt"
+	"log"
 	"mlock/lambdas/shared"
 	"strings"
 	"time"
+
+	"github.com/google/uuid"
 )
 
 type DeviceController interface {
 	AddLockCode(ctx context.Context, device shared.Device, code string) error
+	GetLockCodes(ctx context.Context, device shared.Device) ([]shared.RawDeviceLockCode, error)
 	RemoveLockCode(ctx context.Context, device shared.Device, code string) error
 }
 
 type DeviceRepository interface {
 	AppendToAuditLog(ctx context.Context, device shared.Device, managedLockCodes []*shared.DeviceManagedLockCode) error
+	Get(ctx context.Context, id uuid.UUID) (shared.Device, bool, error)
 	ListActive(ctx context.Context) ([]shared.Device, error)
-	Put(ctx context.Context, item shared.Device) (shared.Device, error)
+	PutIfUnchanged(ctx context.Context, item shared.Device) (shared.Device, error)
+}
+
+type PropertyRepository interface {
+	List(ctx context.Context) ([]shared.Property, error)
+}
+
+type UnitRepository interface {
+	ListByID(ctx context.Context) (map[uuid.UUID]shared.Unit, error)
 }
 
 type EmailService interface {
 	SendEmailToDevelopers(ctx context.Context, subject string, body string) error
 }
 
+type EventSink interface {
+	Emit(ctx context.Context, e shared.Event) error
+}
+
 type LockEngine struct {
-	deviceController DeviceController
-	deviceRepository DeviceRepository
-	emailService     EmailService
-	frontEndDomain   string
-	timeZone         *time.Location
+	clock              shared.Clock
+	deviceController   DeviceController
+	deviceIDs          map[uuid.UUID]bool // Nil (along with `unitIDs`) means every device.
+	deviceRepository   DeviceRepository
+	emailService       EmailService
+	eventSink          EventSink
+	frontEndDomain     string
+	maxWorkers         int
+	propertyRepository PropertyRepository
+	retryPolicy        RetryPolicy
+	timeZone           *time.Location
+	unitIDs            map[uuid.UUID]bool // Nil (along with `deviceIDs`) means every unit.
+	unitRepository     UnitRepository
+}
+
+// RetryPolicy controls how often we'll try to add a code before giving up and marking it as failed. Removals are retried for as long as the code is on the lock, we let someone know once they've used up `MaxAttempts`.
+type RetryPolicy struct {
+	InitialBackoff time.Duration
+	MaxAttempts    int
+	MaxBackoff     time.Duration
+}
+
+// With these values we'll keep trying for a little over 4 hours, which gives rebooting the controller a chance to help.
+var DefaultRetryPolicy = RetryPolicy{
+	InitialBackoff: 5 * time.Minute,
+	MaxAttempts:    8,
+	MaxBackoff:     1 * time.Hour,
 }
 
 type lockState struct {
@@ -41,166 +80,404 @@ func NewLockEngine(
 	dc DeviceController,
 	dr DeviceRepository,
 	es EmailService,
+	ev EventSink,
 	fed string,
+	pr PropertyRepository,
 	tz *time.Location,
+	ur UnitRepository,
 ) *LockEngine {
 	return &LockEngine{
-		deviceController: dc,
-		deviceRepository: dr,
-		emailService:     es,
-		frontEndDomain:   fed,
-		timeZone:         tz,
+		clock:              shared.RealClock{},
+		deviceController:   dc,
+		deviceRepository:   dr,
+		emailService:       es,
+		eventSink:          ev,
+		frontEndDomain:     fed,
+		maxWorkers:         shared.DefaultMaxControllerWorkers,
+		propertyRepository: pr,
+		retryPolicy:        DefaultRetryPolicy,
+		timeZone:           tz,
+		unitRepository:     ur,
+	}
+}
+
+// WithClock is for driving the lock engine with something other than the wall clock (e.g. a simulation).
+func (l *LockEngine) WithClock(c shared.Clock) *LockEngine {
+	l.clock = c
+	return l
+}
+
+// WithUnits limits the run to the units' devices, e.g. when a webhook tells us one of them changed.
+func (l *LockEngine) WithUnits(unitIDs []uuid.UUID) *LockEngine {
+	l.unitIDs = map[uuid.UUID]bool{}
+	for _, id := range unitIDs {
+		l.unitIDs[id] = true
+	}
+	return l
+}
+
+// WithDevices limits the run to the devices, e.g. when someone edits one of its lock codes. It can be combined with `WithUnits`.
+func (l *LockEngine) WithDevices(deviceIDs []uuid.UUID) *LockEngine {
+	l.deviceIDs = map[uuid.UUID]bool{}
+	for _, id := range deviceIDs {
+		l.deviceIDs[id] = true
 	}
+	return l
 }
 
-func (l *LockEngine) UpdateLocks(ctx context.Context) error {
+func (r RetryPolicy) attemptIsDue(now time.Time, mlc *shared.DeviceManagedLockCode) bool {
+	if mlc.Attempts == 0 || mlc.LastAttemptAt == nil {
+		return true
+	}
+	return !now.Before(mlc.LastAttemptAt.Add(r.backoff(mlc.Attempts)))
+}
+
+func (r RetryPolicy) backoff(attempts int) time.Duration {
+	backoff := r.InitialBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= r.MaxBackoff {
+			return r.MaxBackoff
+		}
+	}
+	return backoff
+}
+
+func (r RetryPolicy) exhausted(mlc *shared.DeviceManagedLockCode) bool {
+	return mlc.Attempts >= r.MaxAttempts
+}
+
+// UpdateLocks only returns an error if it can't get started, problems with individual devices are added to the report.
+func (l *LockEngine) UpdateLocks(ctx context.Context, report *shared.RunReport) error {
 	ds, err := l.deviceRepository.ListActive(ctx)
 	if err != nil {
 		return fmt.Errorf("error getting devices: %s", err.Error())
 	}
+	if l.unitIDs != nil || l.deviceIDs != nil {
+		filtered := []shared.Device{}
+		for _, d := range ds {
+			if l.deviceIDs[d.ID] || (d.UnitID != nil && l.unitIDs[*d.UnitID]) {
+				filtered = append(filtered, d)
+			}
+		}
+		ds = filtered
+	}
 
-	now := time.Now()
-	nearPast := now.Add(-1 * time.Hour * 24 * 7)
+	policies, err := l.getUnmanagedLockCodePolicies(ctx, ds)
+	if err != nil {
+		return fmt.Errorf("error getting unmanaged lock code policies: %s", err.Error())
+	}
 
-	for _, d := range ds {
-		lockStates := l.getLockStates(now, d)
+	now := l.clock.Now()
 
-		needToSave, err := l.calculateAndSendLockCommands(ctx, d, lockStates)
-		if err != nil {
-			return fmt.Errorf("error calculating and sending lock commands: %s", err.Error())
+	// Each controller has a single websocket, so devices on the same controller are handled one at a time.
+	controllerIDs, devicesByController := shared.GroupDevicesByController(ds)
+
+	shared.RunPerKey(controllerIDs, l.maxWorkers, func(controllerID string) {
+		for _, d := range devicesByController[controllerID] {
+			if err := l.updateDevice(ctx, now, d, policies[d.ID]); err != nil {
+				report.AddError(shared.RunReportStageLockEngine, d, err)
+				continue
+			}
+			report.AddProcessed(shared.RunReportStageLockEngine)
 		}
+	})
+
+	return nil
+}
 
-		nonDeletedMLCs := []*shared.DeviceManagedLockCode{}
+// UpdateLock is `UpdateLocks` for a single device that we already have, e.g. when its controller tells us its codes changed.
+func (l *LockEngine) UpdateLock(ctx context.Context, d shared.Device) error {
+	policy, err := l.UnmanagedLockCodePolicy(ctx, d)
+	if err != nil {
+		return fmt.Errorf("error getting unmanaged lock code policy: %s", err.Error())
+	}
 
-		for i, mlc := range d.ManagedLockCodes {
-			if mlc.EndAt.Before(nearPast) && mlc.Status == shared.DeviceManagedLockCodeStatus5Complete {
-				justUpdated := false
-				for _, m := range needToSave {
-					if m == mlc {
-						justUpdated = true
-						break
-					}
-				}
-				if !justUpdated {
-					d.ManagedLockCodes[i].Note = "Deleting code as it completed a while ago."
-					needToSave = append(needToSave, d.ManagedLockCodes[i])
-					continue
-				}
+	return l.updateDevice(ctx, l.clock.Now(), d, policy)
+}
+
+// UnmanagedLockCodePolicy combines the device's policy with its property's.
+func (l *LockEngine) UnmanagedLockCodePolicy(ctx context.Context, d shared.Device) (shared.UnmanagedLockCodePolicy, error) {
+	policies, err := l.getUnmanagedLockCodePolicies(ctx, []shared.Device{d})
+	if err != nil {
+		return shared.UnmanagedLockCodePolicy{}, err
+	}
+	return policies[d.ID], nil
+}
+
+func (l *LockEngine) getUnmanagedLockCodePolicies(ctx context.Context, ds []shared.Device) (map[uuid.UUID]shared.UnmanagedLockCodePolicy, error) {
+	units, err := l.unitRepository.ListByID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting units: %s", err.Error())
+	}
+
+	properties, err := l.propertyRepository.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting properties: %s", err.Error())
+	}
+	propertiesByID := map[uuid.UUID]shared.Property{}
+	for _, p := range properties {
+		propertiesByID[p.ID] = p
+	}
+
+	policies := map[uuid.UUID]shared.UnmanagedLockCodePolicy{}
+	for _, d := range ds {
+		var propertyPolicy *shared.UnmanagedLockCodePolicy
+		if d.UnitID != nil {
+			if u, ok := units[*d.UnitID]; ok {
+				propertyPolicy = propertiesByID[u.PropertyID].UnmanagedLockCodePolicy
 			}
-			nonDeletedMLCs = append(nonDeletedMLCs, d.ManagedLockCodes[i])
 		}
-		d.ManagedLockCodes = nonDeletedMLCs
+		policies[d.ID] = shared.EffectiveUnmanagedLockCodePolicy(propertyPolicy, d.UnmanagedLockCodePolicy)
+	}
 
-		if len(needToSave) > 0 {
-			if err := l.deviceRepository.AppendToAuditLog(ctx, d, needToSave); err != nil {
-				return fmt.Errorf("error appending to audit log: %s", err.Error())
-			}
+	return policies, nil
+}
+
+func (l *LockEngine) updateDevice(ctx context.Context, now time.Time, d shared.Device, policy shared.UnmanagedLockCodePolicy) error {
+	plan := l.Plan(now, d, policy)
+
+	needToSave, unmanagedRemoved, err := l.applyPlan(ctx, d, plan)
+	if err != nil {
+		return fmt.Errorf("error applying plan: %s", err.Error())
+	}
 
-			if _, err := l.deviceRepository.Put(ctx, d); err != nil {
-				return fmt.Errorf("error putting device: %s", err.Error())
+	failed := []*shared.DeviceManagedLockCode{}
+	stuck := []*shared.DeviceManagedLockCode{}
+	for _, sc := range plan.StatusChanges {
+		if sc.To == shared.DeviceManagedLockCodeStatus6Failed {
+			failed = append(failed, sc.mlc)
+		}
+		// Only on the attempt that used them up, so that we don't send an email every time it's retried.
+		if sc.command == PlanCommandTypeRemove && sc.mlc.Status == shared.DeviceManagedLockCodeStatus4Removing && sc.mlc.Attempts == l.retryPolicy.MaxAttempts {
+			stuck = append(stuck, sc.mlc)
+		}
+	}
+
+	nonDeletedMLCs := []*shared.DeviceManagedLockCode{}
+MLCLoop:
+	for i, mlc := range d.ManagedLockCodes {
+		for _, pd := range plan.Deletions {
+			if pd.mlc == mlc {
+				d.ManagedLockCodes[i].Note = pd.Note
+				needToSave = append(needToSave, d.ManagedLockCodes[i])
+				continue MLCLoop
 			}
+		}
+		nonDeletedMLCs = append(nonDeletedMLCs, d.ManagedLockCodes[i])
+	}
+	d.ManagedLockCodes = nonDeletedMLCs
 
-			/*
-				if err := l.sendEmailForAuditLogs(ctx, d, needToSave); err != nil {
-					return fmt.Errorf("error sending email: %s", err.Error())
-				}
-			*/
+	if len(needToSave) > 0 {
+		if err := l.deviceRepository.AppendToAuditLog(ctx, d, needToSave); err != nil {
+			return fmt.Errorf("error appending to audit log: %s", err.Error())
 		}
+
+		// The commands have already been sent, so if someone else saved the device since we read it we copy the results over to their version rather than planning again.
+		if _, err := shared.SaveDevice(ctx, l.deviceRepository, d, func(fresh *shared.Device) (bool, error) {
+			reapplyPlan(fresh, plan)
+			return true, nil
+		}); err != nil {
+			return fmt.Errorf("error putting device: %s", err.Error())
+		}
+
+		l.emitEvents(ctx, d, plan, unmanagedRemoved)
+
+		if len(failed) > 0 || len(stuck) > 0 {
+			if err := l.sendEmailForFailures(ctx, d, failed, stuck); err != nil {
+				return fmt.Errorf("error sending failure email: %s", err.Error())
+			}
+		}
+
+		/*
+			if err := l.sendEmailForAuditLogs(ctx, d, needToSave); err != nil {
+				return fmt.Errorf("error sending email: %s", err.Error())
+			}
+		*/
 	}
 
 	return nil
 }
 
-func (l *LockEngine) calculateAndSendLockCommands(ctx context.Context, device shared.Device, lockStates map[string]*lockState) ([]*shared.DeviceManagedLockCode, error) {
+// reapplyPlan makes the plan's changes to a newer copy of the device. The lock engine only owns each code's status, so someone editing a code in the meantime keeps their changes; a code they deleted stays deleted.
+func reapplyPlan(d *shared.Device, plan Plan) {
+	for _, sc := range plan.StatusChanges {
+		if mlc := d.GetManagedLockCode(sc.ManagedLockCodeID); mlc != nil {
+			mlc.CopyStatusFrom(sc.mlc)
+		}
+	}
+
+	deleted := map[uuid.UUID]bool{}
+	for _, pd := range plan.Deletions {
+		deleted[pd.ManagedLockCodeID] = true
+	}
+	kept := []*shared.DeviceManagedLockCode{}
+	for _, mlc := range d.ManagedLockCodes {
+		if !deleted[mlc.ID] {
+			kept = append(kept, mlc)
+		}
+	}
+	d.ManagedLockCodes = kept
+}
+
+// emitEvents is best effort, the changes have already been saved so a sink that's having problems shouldn't cause them to be retried.
+func (l *LockEngine) emitEvents(ctx context.Context, d shared.Device, plan Plan, unmanagedRemoved []PlanUnmanagedRemoval) {
+	events := []shared.Event{}
+	for _, sc := range plan.StatusChanges {
+		if sc.command == PlanCommandTypeAdd {
+			events = append(events, shared.NewCodeEvent(shared.EventTypeCodeAddAttempted, plan.GeneratedAt, d, sc.mlc))
+		} else if sc.command == PlanCommandTypeRemove {
+			events = append(events, shared.NewCodeEvent(shared.EventTypeCodeRemoveAttempted, plan.GeneratedAt, d, sc.mlc))
+		}
+
+		switch sc.mlc.Status {
+		case shared.DeviceManagedLockCodeStatus3Enabled:
+			events = append(events, shared.NewCodeEvent(shared.EventTypeCodeEnabled, plan.GeneratedAt, d, sc.mlc))
+		case shared.DeviceManagedLockCodeStatus5Complete:
+			events = append(events, shared.NewCodeEvent(shared.EventTypeCodeRemoved, plan.GeneratedAt, d, sc.mlc))
+		case shared.DeviceManagedLockCodeStatus6Failed:
+			events = append(events, shared.NewCodeEvent(shared.EventTypeCodeFailed, plan.GeneratedAt, d, sc.mlc))
+		}
+	}
+	for _, ur := range unmanagedRemoved {
+		e := shared.NewDeviceEvent(shared.EventTypeUnmanagedCodeRemoved, plan.GeneratedAt, d)
+		e.Code = ur.Code
+		e.Note = ur.Note
+		events = append(events, e)
+	}
+
+	for _, e := range events {
+		if err := l.eventSink.Emit(ctx, e); err != nil {
+			fmt.Printf("error emitting %s event for %s: %s\n", e.Type, d.RawDevice.Name, err.Error())
+		}
+	}
+}
+
+// applyPlan returns the managed lock codes that need to be saved, and the unmanaged codes that were removed.
+func (l *LockEngine) applyPlan(ctx context.Context, device shared.Device, plan Plan) ([]*shared.DeviceManagedLockCode, []PlanUnmanagedRemoval, error) {
 	needToSave := []*shared.DeviceManagedLockCode{}
+	unmanagedRemoved := []PlanUnmanagedRemoval{}
 
 	enhancedLogging := device.RawDevice.Name == ""
 	if enhancedLogging {
-		fmt.Printf("vvv calculateAndSendLockCommands for %s vvv\n", device.RawDevice.Name)
-	}
-
-	for code, ls := range lockStates {
-		if ls.Exists {
-			if len(ls.RequestToAdd) > 0 {
-				for _, mlc := range ls.RequestToRemove {
-					if mlc.Status != shared.DeviceManagedLockCodeStatus5Complete {
-						if err := mlc.SetStatus(shared.DeviceManagedLockCodeStatus5Complete); err != nil {
-							return []*shared.DeviceManagedLockCode{}, err
-						}
-						mlc.Note = "Leaving lock code as it's in use."
-						needToSave = append(needToSave, mlc)
-					}
-				}
-				for _, mlc := range ls.RequestToAdd {
-					if mlc.Status != shared.DeviceManagedLockCodeStatus3Enabled {
-						if err := mlc.SetStatus(shared.DeviceManagedLockCodeStatus3Enabled); err != nil {
-							return []*shared.DeviceManagedLockCode{}, err
-						}
-						mlc.Note = "Lock code present."
-						needToSave = append(needToSave, mlc)
-					}
-				}
-			} else if len(ls.RequestToRemove) > 0 {
-				note := "Attempting to remove lock code."
-				err := l.deviceController.RemoveLockCode(ctx, device, code)
-				if err != nil {
-					// TODO: log metric?
-					fmt.Printf("error removing lock code: %s", err.Error())
-					note = "Error attempting to remove lock code."
-				}
+		fmt.Printf("vvv applyPlan for %s vvv\n", device.RawDevice.Name)
+	}
 
-				for _, mlc := range ls.RequestToRemove {
-					if err := mlc.SetStatus(shared.DeviceManagedLockCodeStatus4Removing); err != nil {
-						return []*shared.DeviceManagedLockCode{}, err
-					}
-					mlc.Note = note
-					needToSave = append(needToSave, mlc)
-				}
+	type commandResult struct {
+		confirmed bool
+		err       error
+		note      string
+	}
+	results := map[string]commandResult{}
+	for _, c := range plan.Commands {
+		result := commandResult{}
+		switch c.Type {
+		case PlanCommandTypeAdd:
+			if err := l.deviceController.AddLockCode(ctx, device, c.Code); err != nil {
+				// TODO: log metric?
+				msg := fmt.Sprintf("error adding lock code: %s", err.Error())
+				fmt.Print(msg)
+				result.err = err
+				result.note = msg
+			} else {
+				result.confirmed, result.err = l.verifyLockCode(ctx, device, c.Code, true)
 			}
-		} else { // !ls.Exists
-			if len(ls.RequestToAdd) > 0 {
-				note := "Attempting to add lock code."
-				err := l.deviceController.AddLockCode(ctx, device, code)
-				if err != nil {
-					// TODO: log metric?
-					msg := fmt.Sprintf("error adding lock code: %s", err.Error())
-					fmt.Print(msg)
-					note = msg
-				}
+		case PlanCommandTypeRemove:
+			if err := l.deviceController.RemoveLockCode(ctx, device, c.Code); err != nil {
+				// TODO: log metric?
+				fmt.Printf("error removing lock code: %s", err.Error())
+				result.err = err
+				result.note = "Error attempting to remove lock code."
+			} else {
+				result.confirmed, result.err = l.verifyLockCode(ctx, device, c.Code, false)
+			}
+		default:
+			return []*shared.DeviceManagedLockCode{}, []PlanUnmanagedRemoval{}, fmt.Errorf("unhandled command type %s", c.Type)
+		}
+		results[c.Code] = result
+	}
 
-				for _, mlc := range ls.RequestToAdd {
-					if err := mlc.SetStatus(shared.DeviceManagedLockCodeStatus2Adding); err != nil {
-						return []*shared.DeviceManagedLockCode{}, err
-					}
-					mlc.Note = note
-					needToSave = append(needToSave, mlc)
-				}
+	for _, sc := range plan.StatusChanges {
+		if err := sc.mlc.SetStatusAt(sc.To, plan.GeneratedAt); err != nil {
+			return []*shared.DeviceManagedLockCode{}, []PlanUnmanagedRemoval{}, err
+		}
+		sc.mlc.Note = sc.Note
+
+		if sc.command != "" {
+			result := results[sc.Code]
+			sc.mlc.RecordAttempt(plan.GeneratedAt, result.err)
+			if result.note != "" {
+				sc.mlc.Note = result.note
 			}
 
-			for _, mlc := range ls.RequestToRemove {
-				if mlc.Status != shared.DeviceManagedLockCodeStatus5Complete {
-					if err := mlc.SetStatus(shared.DeviceManagedLockCodeStatus5Complete); err != nil {
-						return []*shared.DeviceManagedLockCode{}, err
-					}
-					mlc.Note = "Code was removed."
-					if len(ls.RequestToAdd) > 0 {
-						mlc.Note = "Code is currently in use; nothing more to do."
-					}
-
-					needToSave = append(needToSave, mlc)
+			if result.confirmed {
+				status := shared.DeviceManagedLockCodeStatus3Enabled
+				note := "Lock code added and confirmed."
+				if sc.command == PlanCommandTypeRemove {
+					status = shared.DeviceManagedLockCodeStatus5Complete
+					note = "Lock code removed and confirmed."
+				}
+				if err := sc.mlc.SetStatusAt(status, plan.GeneratedAt); err != nil {
+					return []*shared.DeviceManagedLockCode{}, []PlanUnmanagedRemoval{}, err
 				}
+				sc.mlc.Note = note
 			}
 		}
+
+		needToSave = append(needToSave, sc.mlc)
+	}
+
+	for _, ur := range plan.UnmanagedRemovals {
+		result := results[ur.Code]
+		if result.err != nil {
+			fmt.Printf("error removing unmanaged lock code from %s: %s\n", device.RawDevice.Name, result.err.Error())
+			continue
+		}
+		unmanagedRemoved = append(unmanagedRemoved, ur)
+
+		// This isn't a managed lock code, it's only used so that the removal shows up in the audit log.
+		needToSave = append(needToSave, &shared.DeviceManagedLockCode{
+			Code:    ur.Code,
+			EndAt:   plan.GeneratedAt,
+			Note:    ur.Note,
+			StartAt: ur.FirstSeenAt,
+		})
 	}
 
 	if enhancedLogging {
 		for _, n := range needToSave {
-			fmt.Printf("---- calculateAndSendLockCommands; need to save: %+v\n", n)
+			fmt.Printf("---- applyPlan; need to save: %+v\n", n)
 		}
-		fmt.Printf("^^^ calculateAndSendLockCommands for %s - need to save: %+v ^^^\n", device.RawDevice.Name, needToSave)
+		fmt.Printf("^^^ applyPlan for %s - need to save: %+v ^^^\n", device.RawDevice.Name, needToSave)
 	}
 
-	return needToSave, nil
+	return needToSave, unmanagedRemoved, nil
+}
+
+// verifyLockCode re-reads the codes from the device to see if a command took effect. Not seeing the change, or not being able to re-read the codes, is returned as an error so the attempt is recorded and retried.
+func (l *LockEngine) verifyLockCode(ctx context.Context, device shared.Device, code string, shouldBePresent bool) (bool, error) {
+	lockCodes, err := l.deviceController.GetLockCodes(ctx, device)
+	if err != nil {
+		log.Printf("error verifying lock code on %s: %s\n", device.RawDevice.Name, err.Error())
+		return false, fmt.Errorf("unverified, error getting lock codes: %s", err.Error())
+	}
+
+	present := false
+	for _, lc := range lockCodes {
+		if lc.Code == code {
+			present = true
+			break
+		}
+	}
+
+	if present != shouldBePresent {
+		if shouldBePresent {
+			return false, fmt.Errorf("lock code not found on the device after adding it")
+		}
+		return false, fmt.Errorf("lock code still on the device after removing it")
+	}
+
+	return true, nil
 }
 
 func (l *LockEngine) getLockStates(now time.Time, d shared.Device) map[string]*lockState {
@@ -211,16 +488,23 @@ func (l *LockEngine) getLockStates(now time.Time, d shared.Device) map[string]*l
 			continue
 		}
 
+		exists := false
+		for _, lc := range d.RawDevice.LockCodes {
+			if lc.Code == mlc.Code {
+				exists = true
+				break
+			}
+		}
+
+		// We've given up on adding it, someone will need to edit it to try again. If it's on the lock anyway it still gets removed when it ends.
+		if mlc.Status == shared.DeviceManagedLockCodeStatus6Failed && (mlc.CodeShouldBePresent(now) || !exists) {
+			continue
+		}
+
 		ls, ok := lockStates[mlc.Code]
 		if !ok {
-			ls = &lockState{}
+			ls = &lockState{Exists: exists}
 			lockStates[mlc.Code] = ls
-			for _, lc := range d.RawDevice.LockCodes {
-				if lc.Code == mlc.Code {
-					ls.Exists = true
-					break
-				}
-			}
 		}
 
 		if mlc.CodeShouldBePresent(now) {
@@ -233,6 +517,36 @@ func (l *LockEngine) getLockStates(now time.Time, d shared.Device) map[string]*l
 	return lockStates
 }
 
+// sendEmailForFailures covers the adds we gave up on, and the removals that are still being retried after `MaxAttempts`.
+func (l *LockEngine) sendEmailForFailures(ctx context.Context, d shared.Device, failed []*shared.DeviceManagedLockCode, stuck []*shared.DeviceManagedLockCode) error {
+	var sb strings.Builder
+
+	link := fmt.Sprintf("%s/devices/%s", l.frontEndDomain, d.ID)
+	if len(failed) > 0 {
+		sb.WriteString(fmt.Sprintf("Gave up on lock codes for device: <a href=\"%s\">%s</a>", link, d.RawDevice.Name))
+		sb.WriteString("<ul>")
+		for _, m := range failed {
+			sb.WriteString(fmt.Sprintf("<li>Code: %s, Attempts: %d, Last Error: %s</li>", m.Code, m.Attempts, m.LastError))
+		}
+		sb.WriteString("</ul>")
+	}
+	if len(stuck) > 0 {
+		sb.WriteString(fmt.Sprintf("Still trying to remove lock codes from device: <a href=\"%s\">%s</a>", link, d.RawDevice.Name))
+		sb.WriteString("<ul>")
+		for _, m := range stuck {
+			sb.WriteString(fmt.Sprintf("<li>Code: %s, Attempts: %d, Last Error: %s</li>", m.Code, m.Attempts, m.LastError))
+		}
+		sb.WriteString("</ul>")
+	}
+
+	subject := fmt.Sprintf("zcclock - Lock Code(s) Failed - %s", d.RawDevice.Name)
+	if err := l.emailService.SendEmailToDevelopers(ctx, subject, sb.String()); err != nil {
+		return fmt.Errorf("error sending email: %s", err.Error())
+	}
+
+	return nil
+}
+
 func (l *LockEngine) sendEmailForAuditLogs(ctx context.Context, d shared.Device, needToSave []*shared.DeviceManagedLockCode) error {
 	var sb strings.Builder
 
@@ -244,7 +558,7 @@ func (l *LockEngine) sendEmailForAuditLogs(ctx context.Context, d shared.Device,
 	}
 	sb.WriteString("</ul>")
 
-	now := time.Now().In(l.timeZone)
+	now := l.clock.Now().In(l.timeZone)
 	startOfWeek := now.AddDate(0, 0, -1*int(now.Weekday()))
 	weekOf := startOfWeek.Format("week of 01/02/2006")
 
@@ -0,0 +1,97 @@
+package lockengine_test
+
+import (
+	"context"
+	"fmt"
+	"mlock/lambdas/shared"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+func Test_EventsForEnabledCode(t *testing.T) {
+	ctx := context.Background()
+	unitID := uuid.New()
+	mlc := &shared.DeviceManagedLockCode{
+		Code:        "1234",
+		EndAt:       time.Now().Add(4 * time.Hour),
+		ID:          uuid.New(),
+		Reservation: shared.DeviceManagedLockCodeReservation{ID: "reservation"},
+		Status:      shared.DeviceManagedLockCodeStatus1Scheduled,
+		StartAt:     time.Now().Add(-1 * time.Minute),
+	}
+	d := shared.Device{
+		ID:               uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{mlc},
+		UnitID:           &unitID,
+	}
+
+	le, dc, dr, ev := newLockEngineWithEventSink(t)
+
+	dr.EXPECT().ListActive(ctx).Return([]shared.Device{d}, nil)
+	dc.EXPECT().AddLockCode(ctx, d, mlc.Code).Return(nil)
+	dc.EXPECT().GetLockCodes(ctx, d).Return([]shared.RawDeviceLockCode{{Code: mlc.Code}}, nil)
+	dr.EXPECT().AppendToAuditLog(ctx, d, []*shared.DeviceManagedLockCode{mlc}).Return(nil)
+	dr.EXPECT().PutIfUnchanged(ctx, d).Return(shared.Device{}, nil)
+
+	events := []shared.Event{}
+	ev.EXPECT().Emit(ctx, gomock.Any()).Do(func(ctx context.Context, e shared.Event) {
+		events = append(events, e)
+	}).Return(nil).Times(2)
+
+	report := shared.NewRunReport(time.Now())
+	err := le.UpdateLocks(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+
+	assert.Equal(t, shared.EventTypeCodeAddAttempted, events[0].Type)
+	assert.Equal(t, shared.EventTypeCodeEnabled, events[1].Type)
+	for _, e := range events {
+		assert.Equal(t, d.ID, e.DeviceID)
+		assert.Equal(t, unitID, *e.UnitID)
+		assert.Equal(t, mlc.ID, *e.ManagedLockCodeID)
+		assert.Equal(t, "reservation", e.ReservationID)
+		assert.Equal(t, "1234", e.Code)
+	}
+}
+
+func Test_EventsForFailedCode(t *testing.T) {
+	// Giving up on a code should say why, and a sink that's having problems shouldn't stop the device from being processed.
+
+	ctx := context.Background()
+	lastAttemptAt := time.Now().Add(-2 * time.Hour)
+	mlc := &shared.DeviceManagedLockCode{
+		Attempts:      8,
+		Code:          "1234",
+		EndAt:         time.Now().Add(4 * time.Hour),
+		ID:            uuid.New(),
+		LastAttemptAt: &lastAttemptAt,
+		LastError:     "timed out",
+		Status:        shared.DeviceManagedLockCodeStatus2Adding,
+		StartAt:       time.Now().Add(-3 * time.Hour),
+	}
+	d := shared.Device{
+		ID:               uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{mlc},
+	}
+
+	le, _, dr, ev := newLockEngineWithEventSink(t)
+
+	dr.EXPECT().ListActive(ctx).Return([]shared.Device{d}, nil)
+	dr.EXPECT().AppendToAuditLog(ctx, d, []*shared.DeviceManagedLockCode{mlc}).Return(nil)
+	dr.EXPECT().PutIfUnchanged(ctx, d).Return(shared.Device{}, nil)
+	ev.EXPECT().Emit(ctx, gomock.Any()).Do(func(ctx context.Context, e shared.Event) {
+		assert.Equal(t, shared.EventTypeCodeFailed, e.Type)
+		assert.Equal(t, "timed out", e.Error)
+	}).Return(fmt.Errorf("sink is down"))
+
+	report := shared.NewRunReport(time.Now())
+	err := le.UpdateLocks(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus6Failed, mlc.Status)
+}
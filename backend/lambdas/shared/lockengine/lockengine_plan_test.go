@@ -0,0 +1,233 @@
+package lockengine_test
+
+import (
+	"mlock/lambdas/shared"
+	"mlock/lambdas/shared/lockengine"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_PlanDoesNotChangeAnything(t *testing.T) {
+	// A plan should describe the commands and status changes without sending or saving anything.
+
+	now := time.Now()
+	toAdd := &shared.DeviceManagedLockCode{
+		Code:    "1111",
+		EndAt:   now.Add(1 * time.Hour),
+		ID:      uuid.New(),
+		Status:  shared.DeviceManagedLockCodeStatus1Scheduled,
+		StartAt: now.Add(-1 * time.Hour),
+	}
+	toRemove := &shared.DeviceManagedLockCode{
+		Code:    "2222",
+		EndAt:   now.Add(-1 * time.Hour),
+		ID:      uuid.New(),
+		Status:  shared.DeviceManagedLockCodeStatus3Enabled,
+		StartAt: now.Add(-2 * time.Hour),
+	}
+	toDelete := &shared.DeviceManagedLockCode{
+		Code:    "3333",
+		EndAt:   now.Add(-1 * time.Hour * 24 * 8),
+		ID:      uuid.New(),
+		Status:  shared.DeviceManagedLockCodeStatus5Complete,
+		StartAt: now.Add(-1 * time.Hour * 24 * 9),
+	}
+	device := shared.Device{
+		ID:               uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{toAdd, toRemove, toDelete},
+		RawDevice: shared.RawDevice{
+			LockCodes: []shared.RawDeviceLockCode{
+				{
+					Code: toRemove.Code,
+				},
+			},
+		},
+	}
+
+	// None of the mocks have expectations, the test will fail if they're called.
+	le, _, _ := newLockEngine(t)
+
+	plan := le.Plan(now, device, shared.UnmanagedLockCodePolicy{})
+
+	assert.Equal(t, device.ID, plan.DeviceID)
+	// Removals go first, so that they free up slots for the adds.
+	assert.Equal(t, []lockengine.PlanCommand{
+		{
+			Code:               toRemove.Code,
+			ManagedLockCodeIDs: []uuid.UUID{toRemove.ID},
+			Type:               lockengine.PlanCommandTypeRemove,
+		},
+		{
+			Code:               toAdd.Code,
+			ManagedLockCodeIDs: []uuid.UUID{toAdd.ID},
+			Type:               lockengine.PlanCommandTypeAdd,
+		},
+	}, plan.Commands)
+
+	assert.Equal(t, 2, len(plan.StatusChanges))
+	assert.Equal(t, toRemove.ID, plan.StatusChanges[0].ManagedLockCodeID)
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus3Enabled, plan.StatusChanges[0].From)
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus4Removing, plan.StatusChanges[0].To)
+	assert.Equal(t, toAdd.ID, plan.StatusChanges[1].ManagedLockCodeID)
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus1Scheduled, plan.StatusChanges[1].From)
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus2Adding, plan.StatusChanges[1].To)
+
+	assert.Equal(t, 1, len(plan.Deletions))
+	assert.Equal(t, toDelete.ID, plan.Deletions[0].ManagedLockCodeID)
+
+	// Nothing should have been touched.
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus1Scheduled, toAdd.Status)
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus3Enabled, toRemove.Status)
+	assert.Equal(t, 3, len(device.ManagedLockCodes))
+	assert.Equal(t, "", toAdd.Note)
+}
+
+func Test_PlanEmpty(t *testing.T) {
+	// A code that's enabled and present shouldn't need anything.
+
+	now := time.Now()
+	device := shared.Device{
+		ID: uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{
+			{
+				Code:    "1111",
+				EndAt:   now.Add(1 * time.Hour),
+				Status:  shared.DeviceManagedLockCodeStatus3Enabled,
+				StartAt: now.Add(-1 * time.Hour),
+			},
+		},
+		RawDevice: shared.RawDevice{
+			LockCodes: []shared.RawDeviceLockCode{
+				{
+					Code: "1111",
+				},
+			},
+		},
+	}
+
+	le, _, _ := newLockEngine(t)
+
+	plan := le.Plan(now, device, shared.UnmanagedLockCodePolicy{})
+	assert.True(t, plan.IsEmpty())
+}
+
+func Test_PlanPrioritizesSoonestWhenNearlyFull(t *testing.T) {
+	// With only one free slot, the code that started first should be added and the other deferred.
+
+	now := time.Now()
+	later := &shared.DeviceManagedLockCode{
+		Code:    "1111",
+		EndAt:   now.Add(4 * time.Hour),
+		ID:      uuid.New(),
+		Status:  shared.DeviceManagedLockCodeStatus1Scheduled,
+		StartAt: now.Add(-1 * time.Minute),
+	}
+	sooner := &shared.DeviceManagedLockCode{
+		Code:    "2222",
+		EndAt:   now.Add(4 * time.Hour),
+		ID:      uuid.New(),
+		Status:  shared.DeviceManagedLockCodeStatus1Scheduled,
+		StartAt: now.Add(-1 * time.Hour),
+	}
+	device := shared.Device{
+		ID:               uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{later, sooner},
+		RawDevice: shared.RawDevice{
+			LockCodes: []shared.RawDeviceLockCode{
+				{
+					Code: "9999",
+				},
+			},
+			MaxLockCodes: 2,
+		},
+	}
+
+	le, _, _ := newLockEngine(t)
+
+	plan := le.Plan(now, device, shared.UnmanagedLockCodePolicy{})
+
+	assert.Equal(t, []lockengine.PlanCommand{
+		{
+			Code:               sooner.Code,
+			ManagedLockCodeIDs: []uuid.UUID{sooner.ID},
+			Type:               lockengine.PlanCommandTypeAdd,
+		},
+	}, plan.Commands)
+	assert.Equal(t, 1, len(plan.StatusChanges))
+	assert.Equal(t, sooner.ID, plan.StatusChanges[0].ManagedLockCodeID)
+
+	assert.Equal(t, 1, len(plan.Deferrals))
+	assert.Equal(t, later.Code, plan.Deferrals[0].Code)
+	assert.Equal(t, []uuid.UUID{later.ID}, plan.Deferrals[0].ManagedLockCodeIDs)
+}
+
+func Test_PlanCountsSlotsFreedByRemovals(t *testing.T) {
+	// The device is full, but removing the finished code and an unmanaged one makes room for both adds.
+
+	now := time.Now()
+	first := &shared.DeviceManagedLockCode{
+		Code:    "1111",
+		EndAt:   now.Add(4 * time.Hour),
+		ID:      uuid.New(),
+		Status:  shared.DeviceManagedLockCodeStatus1Scheduled,
+		StartAt: now.Add(-1 * time.Hour),
+	}
+	second := &shared.DeviceManagedLockCode{
+		Code:    "2222",
+		EndAt:   now.Add(4 * time.Hour),
+		ID:      uuid.New(),
+		Status:  shared.DeviceManagedLockCodeStatus1Scheduled,
+		StartAt: now.Add(-1 * time.Minute),
+	}
+	finished := &shared.DeviceManagedLockCode{
+		Code:    "8888",
+		EndAt:   now.Add(-1 * time.Hour),
+		ID:      uuid.New(),
+		Status:  shared.DeviceManagedLockCodeStatus3Enabled,
+		StartAt: now.Add(-24 * time.Hour),
+	}
+	device := shared.Device{
+		ID:               uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{first, second, finished},
+		RawDevice: shared.RawDevice{
+			LockCodes: []shared.RawDeviceLockCode{
+				{Code: finished.Code, Slot: 1},
+				{Code: "9999", Slot: 2},
+			},
+			MaxLockCodes: 2,
+		},
+		UnmanagedLockCodesSeenAt: map[string]time.Time{"9999": now.Add(-48 * time.Hour)},
+	}
+
+	le, _, _ := newLockEngine(t)
+
+	plan := le.Plan(now, device, shared.UnmanagedLockCodePolicy{AutoRemove: true})
+
+	assert.Empty(t, plan.Deferrals)
+	assert.Equal(t, []lockengine.PlanCommand{
+		{Code: finished.Code, ManagedLockCodeIDs: []uuid.UUID{finished.ID}, Type: lockengine.PlanCommandTypeRemove},
+		{Code: "9999", ManagedLockCodeIDs: []uuid.UUID{}, Type: lockengine.PlanCommandTypeRemove},
+		{Code: first.Code, ManagedLockCodeIDs: []uuid.UUID{first.ID}, Type: lockengine.PlanCommandTypeAdd},
+		{Code: second.Code, ManagedLockCodeIDs: []uuid.UUID{second.ID}, Type: lockengine.PlanCommandTypeAdd},
+	}, plan.Commands)
+}
+
+func Test_PlanOnlyNeedsTheTimeZone(t *testing.T) {
+	// A dry run builds the lock engine without a controller, device repository or email service.
+	le := lockengine.NewLockEngine(nil, nil, nil, shared.LogEventSink{}, "", nil, time.UTC, nil)
+
+	now := time.Now()
+	mlc := &shared.DeviceManagedLockCode{
+		Code:    "1111",
+		EndAt:   now.Add(1 * time.Hour),
+		ID:      uuid.New(),
+		Status:  shared.DeviceManagedLockCodeStatus1Scheduled,
+		StartAt: now.Add(-1 * time.Hour),
+	}
+
+	plan := le.Plan(now, shared.Device{ID: uuid.New(), ManagedLockCodes: []*shared.DeviceManagedLockCode{mlc}}, shared.UnmanagedLockCodePolicy{})
+	assert.Len(t, plan.Commands, 1)
+}
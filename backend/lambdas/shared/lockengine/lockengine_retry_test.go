@@ -0,0 +1,360 @@
+package lockengine_test
+
+import (
+	"context"
+	"fmt"
+	"mlock/lambdas/shared"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_AddConfirmed(t *testing.T) {
+	// The code shows up when we re-read the lock, so we can skip straight to enabled.
+
+	ctx := context.Background()
+	mlc := &shared.DeviceManagedLockCode{
+		Code:    "1234",
+		EndAt:   time.Now().Add(4 * time.Hour),
+		Status:  shared.DeviceManagedLockCodeStatus1Scheduled,
+		StartAt: time.Now().Add(-1 * time.Minute),
+	}
+	d := shared.Device{
+		ID:               uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{mlc},
+	}
+
+	le, dc, dr := newLockEngine(t)
+
+	dr.EXPECT().ListActive(ctx).Return([]shared.Device{d}, nil)
+	dc.EXPECT().AddLockCode(ctx, d, mlc.Code).Return(nil)
+	dc.EXPECT().GetLockCodes(ctx, d).Return([]shared.RawDeviceLockCode{{Code: mlc.Code}}, nil)
+	dr.EXPECT().AppendToAuditLog(ctx, d, []*shared.DeviceManagedLockCode{mlc}).Return(nil)
+	dr.EXPECT().PutIfUnchanged(ctx, d).Return(shared.Device{}, nil)
+
+	report := shared.NewRunReport(time.Now())
+	err := le.UpdateLocks(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus3Enabled, mlc.Status)
+	assert.Equal(t, 1, mlc.Attempts)
+	assert.NotNil(t, mlc.StartedAddingAt)
+	assert.NotNil(t, mlc.WasEnabledAt)
+}
+
+func Test_AddErrorIsRecorded(t *testing.T) {
+	// The controller returns an error, we should count the attempt and keep the error.
+
+	ctx := context.Background()
+	mlc := &shared.DeviceManagedLockCode{
+		Code:    "1234",
+		EndAt:   time.Now().Add(4 * time.Hour),
+		Status:  shared.DeviceManagedLockCodeStatus1Scheduled,
+		StartAt: time.Now().Add(-1 * time.Minute),
+	}
+	d := shared.Device{
+		ID:               uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{mlc},
+	}
+
+	le, dc, dr := newLockEngine(t)
+
+	dr.EXPECT().ListActive(ctx).Return([]shared.Device{d}, nil)
+	dc.EXPECT().AddLockCode(ctx, d, mlc.Code).Return(fmt.Errorf("max number of lock codes already set (6)"))
+	dr.EXPECT().AppendToAuditLog(ctx, d, []*shared.DeviceManagedLockCode{mlc}).Return(nil)
+	dr.EXPECT().PutIfUnchanged(ctx, d).Return(shared.Device{}, nil)
+
+	report := shared.NewRunReport(time.Now())
+	err := le.UpdateLocks(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus2Adding, mlc.Status)
+	assert.Equal(t, 1, mlc.Attempts)
+	assert.NotNil(t, mlc.LastAttemptAt)
+	assert.Equal(t, "max number of lock codes already set (6)", mlc.LastError)
+}
+
+func Test_AddingBacksOff(t *testing.T) {
+	// We just tried to add the code, so we shouldn't try again yet.
+
+	ctx := context.Background()
+	lastAttemptAt := time.Now().Add(-1 * time.Minute)
+	mlc := &shared.DeviceManagedLockCode{
+		Attempts:      1,
+		Code:          "1234",
+		EndAt:         time.Now().Add(4 * time.Hour),
+		LastAttemptAt: &lastAttemptAt,
+		Status:        shared.DeviceManagedLockCodeStatus2Adding,
+		StartAt:       time.Now().Add(-1 * time.Hour),
+	}
+	d := shared.Device{
+		ID:               uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{mlc},
+	}
+
+	// Nothing other than listing is expected.
+	le, _, dr := newLockEngine(t)
+	dr.EXPECT().ListActive(ctx).Return([]shared.Device{d}, nil)
+
+	report := shared.NewRunReport(time.Now())
+	err := le.UpdateLocks(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus2Adding, mlc.Status)
+	assert.Equal(t, 1, mlc.Attempts)
+}
+
+func Test_AddingRetriesAfterBackoff(t *testing.T) {
+	// It's been long enough since the last attempt, try again.
+
+	ctx := context.Background()
+	lastAttemptAt := time.Now().Add(-11 * time.Minute)
+	mlc := &shared.DeviceManagedLockCode{
+		Attempts:      2,
+		Code:          "1234",
+		EndAt:         time.Now().Add(4 * time.Hour),
+		LastAttemptAt: &lastAttemptAt,
+		Status:        shared.DeviceManagedLockCodeStatus2Adding,
+		StartAt:       time.Now().Add(-1 * time.Hour),
+	}
+	d := shared.Device{
+		ID:               uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{mlc},
+	}
+
+	le, dc, dr := newLockEngine(t)
+
+	dr.EXPECT().ListActive(ctx).Return([]shared.Device{d}, nil)
+	dc.EXPECT().AddLockCode(ctx, d, mlc.Code).Return(nil)
+	dc.EXPECT().GetLockCodes(ctx, d).Return([]shared.RawDeviceLockCode{}, nil)
+	dr.EXPECT().AppendToAuditLog(ctx, d, []*shared.DeviceManagedLockCode{mlc}).Return(nil)
+	dr.EXPECT().PutIfUnchanged(ctx, d).Return(shared.Device{}, nil)
+
+	report := shared.NewRunReport(time.Now())
+	err := le.UpdateLocks(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus2Adding, mlc.Status)
+	assert.Equal(t, 3, mlc.Attempts)
+	assert.Equal(t, "lock code not found on the device after adding it", mlc.LastError)
+}
+
+func Test_AddingRetrySucceedsClearsLastError(t *testing.T) {
+	// The retry worked, so the error from the attempt before shouldn't stick around.
+
+	ctx := context.Background()
+	lastAttemptAt := time.Now().Add(-11 * time.Minute)
+	mlc := &shared.DeviceManagedLockCode{
+		Attempts:      2,
+		Code:          "1234",
+		EndAt:         time.Now().Add(4 * time.Hour),
+		LastAttemptAt: &lastAttemptAt,
+		LastError:     "lock code not found on the device after adding it",
+		Status:        shared.DeviceManagedLockCodeStatus2Adding,
+		StartAt:       time.Now().Add(-1 * time.Hour),
+	}
+	d := shared.Device{
+		ID:               uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{mlc},
+	}
+
+	le, dc, dr := newLockEngine(t)
+
+	dr.EXPECT().ListActive(ctx).Return([]shared.Device{d}, nil)
+	dc.EXPECT().AddLockCode(ctx, d, mlc.Code).Return(nil)
+	dc.EXPECT().GetLockCodes(ctx, d).Return([]shared.RawDeviceLockCode{{Code: mlc.Code}}, nil)
+	dr.EXPECT().AppendToAuditLog(ctx, d, []*shared.DeviceManagedLockCode{mlc}).Return(nil)
+	dr.EXPECT().PutIfUnchanged(ctx, d).Return(shared.Device{}, nil)
+
+	report := shared.NewRunReport(time.Now())
+	err := le.UpdateLocks(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus3Enabled, mlc.Status)
+	assert.Equal(t, 3, mlc.Attempts)
+	assert.Empty(t, mlc.LastError)
+}
+
+func Test_AddingFailsAfterMaxAttempts(t *testing.T) {
+	// We've run out of attempts, the code should move to the terminal failed status.
+
+	ctx := context.Background()
+	lastAttemptAt := time.Now().Add(-2 * time.Hour)
+	mlc := &shared.DeviceManagedLockCode{
+		Attempts:      8,
+		Code:          "1234",
+		EndAt:         time.Now().Add(4 * time.Hour),
+		LastAttemptAt: &lastAttemptAt,
+		LastError:     "some error",
+		Status:        shared.DeviceManagedLockCodeStatus2Adding,
+		StartAt:       time.Now().Add(-6 * time.Hour),
+	}
+	d := shared.Device{
+		ID:               uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{mlc},
+	}
+
+	le, _, dr := newLockEngine(t)
+
+	dr.EXPECT().ListActive(ctx).Return([]shared.Device{d}, nil)
+	dr.EXPECT().AppendToAuditLog(ctx, d, []*shared.DeviceManagedLockCode{mlc}).Return(nil)
+	dr.EXPECT().PutIfUnchanged(ctx, d).Return(shared.Device{}, nil)
+
+	report := shared.NewRunReport(time.Now())
+	err := le.UpdateLocks(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus6Failed, mlc.Status)
+	assert.NotNil(t, mlc.WasFailedAt)
+	assert.Equal(t, "some error", mlc.LastError)
+	assert.Equal(t, "Giving up after 8 attempts; last error: some error", mlc.Note)
+}
+
+func Test_FailedIsTerminal(t *testing.T) {
+	// Once failed, the engine should leave the code alone.
+
+	ctx := context.Background()
+	mlc := &shared.DeviceManagedLockCode{
+		Attempts: 8,
+		Code:     "1234",
+		EndAt:    time.Now().Add(4 * time.Hour),
+		Status:   shared.DeviceManagedLockCodeStatus6Failed,
+		StartAt:  time.Now().Add(-6 * time.Hour),
+	}
+	d := shared.Device{
+		ID:               uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{mlc},
+	}
+
+	le, _, dr := newLockEngine(t)
+	dr.EXPECT().ListActive(ctx).Return([]shared.Device{d}, nil)
+
+	report := shared.NewRunReport(time.Now())
+	err := le.UpdateLocks(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus6Failed, mlc.Status)
+}
+
+func Test_RemovingKeepsRetryingAfterMaxAttempts(t *testing.T) {
+	// The guest has left, so we keep trying to remove the code rather than giving up on it.
+
+	ctx := context.Background()
+	lastAttemptAt := time.Now().Add(-2 * time.Hour)
+	mlc := &shared.DeviceManagedLockCode{
+		Attempts:      8,
+		Code:          "1234",
+		EndAt:         time.Now().Add(-6 * time.Hour),
+		LastAttemptAt: &lastAttemptAt,
+		LastError:     "some error",
+		Status:        shared.DeviceManagedLockCodeStatus4Removing,
+		StartAt:       time.Now().Add(-24 * time.Hour),
+	}
+	d := shared.Device{
+		ID:               uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{mlc},
+		RawDevice:        shared.RawDevice{LockCodes: []shared.RawDeviceLockCode{{Code: mlc.Code, Slot: 1}}},
+	}
+
+	le, dc, dr := newLockEngine(t)
+
+	dr.EXPECT().ListActive(ctx).Return([]shared.Device{d}, nil)
+	dc.EXPECT().RemoveLockCode(ctx, d, mlc.Code).Return(nil)
+	dc.EXPECT().GetLockCodes(ctx, d).Return([]shared.RawDeviceLockCode{{Code: mlc.Code, Slot: 1}}, nil)
+	dr.EXPECT().AppendToAuditLog(ctx, d, []*shared.DeviceManagedLockCode{mlc}).Return(nil)
+	dr.EXPECT().PutIfUnchanged(ctx, d).Return(shared.Device{}, nil)
+
+	report := shared.NewRunReport(time.Now())
+	err := le.UpdateLocks(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus4Removing, mlc.Status)
+	assert.Nil(t, mlc.WasFailedAt)
+	assert.Equal(t, 9, mlc.Attempts)
+	assert.Equal(t, "lock code still on the device after removing it", mlc.LastError)
+
+	// It backs off no further than the longest backoff.
+	lastAttemptAt = time.Now().Add(-30 * time.Minute)
+	mlc.LastAttemptAt = &lastAttemptAt
+	dr.EXPECT().ListActive(ctx).Return([]shared.Device{d}, nil)
+
+	report = shared.NewRunReport(time.Now())
+	assert.Nil(t, le.UpdateLocks(ctx, report))
+	assert.Equal(t, 9, mlc.Attempts)
+}
+
+func Test_FailedCodeOnTheLockIsRemoved(t *testing.T) {
+	// We gave up on it before it ended (e.g. under an older policy), but it's on the lock so it still needs to come off.
+
+	ctx := context.Background()
+	mlc := &shared.DeviceManagedLockCode{
+		Attempts: 8,
+		Code:     "1234",
+		EndAt:    time.Now().Add(-1 * time.Hour),
+		Status:   shared.DeviceManagedLockCodeStatus6Failed,
+		StartAt:  time.Now().Add(-24 * time.Hour),
+	}
+	d := shared.Device{
+		ID:               uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{mlc},
+		RawDevice:        shared.RawDevice{LockCodes: []shared.RawDeviceLockCode{{Code: mlc.Code, Slot: 1}}},
+	}
+
+	le, dc, dr := newLockEngine(t)
+
+	dr.EXPECT().ListActive(ctx).Return([]shared.Device{d}, nil)
+	dc.EXPECT().RemoveLockCode(ctx, d, mlc.Code).Return(nil)
+	dc.EXPECT().GetLockCodes(ctx, d).Return([]shared.RawDeviceLockCode{}, nil)
+	dr.EXPECT().AppendToAuditLog(ctx, d, []*shared.DeviceManagedLockCode{mlc}).Return(nil)
+	dr.EXPECT().PutIfUnchanged(ctx, d).Return(shared.Device{}, nil)
+
+	report := shared.NewRunReport(time.Now())
+	err := le.UpdateLocks(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus5Complete, mlc.Status)
+}
+
+func Test_VerifyErrorIsRecorded(t *testing.T) {
+	// We couldn't re-read the codes, the attempt counts and says why.
+
+	ctx := context.Background()
+	mlc := &shared.DeviceManagedLockCode{
+		Code:    "1234",
+		EndAt:   time.Now().Add(4 * time.Hour),
+		Status:  shared.DeviceManagedLockCodeStatus1Scheduled,
+		StartAt: time.Now().Add(-1 * time.Minute),
+	}
+	d := shared.Device{
+		ID:               uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{mlc},
+	}
+
+	le, dc, dr := newLockEngine(t)
+
+	dr.EXPECT().ListActive(ctx).Return([]shared.Device{d}, nil)
+	dc.EXPECT().AddLockCode(ctx, d, mlc.Code).Return(nil)
+	dc.EXPECT().GetLockCodes(ctx, d).Return(nil, fmt.Errorf("controller offline"))
+	dr.EXPECT().AppendToAuditLog(ctx, d, []*shared.DeviceManagedLockCode{mlc}).Return(nil)
+	dr.EXPECT().PutIfUnchanged(ctx, d).Return(shared.Device{}, nil)
+
+	report := shared.NewRunReport(time.Now())
+	err := le.UpdateLocks(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus2Adding, mlc.Status)
+	assert.Equal(t, 1, mlc.Attempts)
+	assert.Equal(t, "unverified, error getting lock codes: controller offline", mlc.LastError)
+}
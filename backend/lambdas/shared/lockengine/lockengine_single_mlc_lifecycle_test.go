@@ -44,8 +44,10 @@ func Test_ScheduledBeforeNotExists(t *testing.T) {
 
 	s.generateLockengineSingleMLCLifecycleTest(false)
 
-	err := s.le.UpdateLocks(s.ctx)
+	report := shared.NewRunReport(time.Now())
+	err := s.le.UpdateLocks(s.ctx, report)
 	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
 
 	assert.Equal(t, shared.DeviceManagedLockCodeStatus1Scheduled, s.mlc.Status)
 }
@@ -65,8 +67,10 @@ func Test_ScheduledBeforeExists(t *testing.T) {
 
 	s.generateLockengineSingleMLCLifecycleTest(true)
 
-	err := s.le.UpdateLocks(s.ctx)
+	report := shared.NewRunReport(time.Now())
+	err := s.le.UpdateLocks(s.ctx, report)
 	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
 
 	assert.Equal(t, shared.DeviceManagedLockCodeStatus1Scheduled, s.mlc.Status)
 }
@@ -87,11 +91,14 @@ func Test_ScheduledStartedNotExists(t *testing.T) {
 	s.generateLockengineSingleMLCLifecycleTest(false)
 
 	s.dc.EXPECT().AddLockCode(s.ctx, s.d, s.mlc.Code).Return(nil)
+	s.dc.EXPECT().GetLockCodes(s.ctx, s.d).Return([]shared.RawDeviceLockCode{}, nil) // The lock hasn't picked it up yet.
 	s.dr.EXPECT().AppendToAuditLog(s.ctx, s.d, []*shared.DeviceManagedLockCode{s.mlc}).Return(nil)
-	s.dr.EXPECT().Put(s.ctx, s.d).Return(shared.Device{}, nil)
+	s.dr.EXPECT().PutIfUnchanged(s.ctx, s.d).Return(shared.Device{}, nil)
 
-	err := s.le.UpdateLocks(s.ctx)
+	report := shared.NewRunReport(time.Now())
+	err := s.le.UpdateLocks(s.ctx, report)
 	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
 
 	assert.Equal(t, shared.DeviceManagedLockCodeStatus2Adding, s.mlc.Status)
 }
@@ -112,10 +119,12 @@ func Test_ScheduledStartedExists(t *testing.T) {
 	s.generateLockengineSingleMLCLifecycleTest(true)
 
 	s.dr.EXPECT().AppendToAuditLog(s.ctx, s.d, []*shared.DeviceManagedLockCode{s.mlc}).Return(nil)
-	s.dr.EXPECT().Put(s.ctx, s.d).Return(shared.Device{}, nil)
+	s.dr.EXPECT().PutIfUnchanged(s.ctx, s.d).Return(shared.Device{}, nil)
 
-	err := s.le.UpdateLocks(s.ctx)
+	report := shared.NewRunReport(time.Now())
+	err := s.le.UpdateLocks(s.ctx, report)
 	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
 
 	assert.Equal(t, shared.DeviceManagedLockCodeStatus3Enabled, s.mlc.Status)
 }
@@ -135,11 +144,14 @@ func Test_AddingStartedNotExists(t *testing.T) {
 	s.generateLockengineSingleMLCLifecycleTest(false)
 
 	s.dc.EXPECT().AddLockCode(s.ctx, s.d, s.mlc.Code).Return(nil)
+	s.dc.EXPECT().GetLockCodes(s.ctx, s.d).Return([]shared.RawDeviceLockCode{}, nil) // The lock hasn't picked it up yet.
 	s.dr.EXPECT().AppendToAuditLog(s.ctx, s.d, []*shared.DeviceManagedLockCode{s.mlc}).Return(nil)
-	s.dr.EXPECT().Put(s.ctx, s.d).Return(shared.Device{}, nil)
+	s.dr.EXPECT().PutIfUnchanged(s.ctx, s.d).Return(shared.Device{}, nil)
 
-	err := s.le.UpdateLocks(s.ctx)
+	report := shared.NewRunReport(time.Now())
+	err := s.le.UpdateLocks(s.ctx, report)
 	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
 
 	assert.Equal(t, shared.DeviceManagedLockCodeStatus2Adding, s.mlc.Status)
 }
@@ -159,10 +171,12 @@ func Test_AddingStartedExists(t *testing.T) {
 	s.generateLockengineSingleMLCLifecycleTest(true)
 
 	s.dr.EXPECT().AppendToAuditLog(s.ctx, s.d, []*shared.DeviceManagedLockCode{s.mlc}).Return(nil)
-	s.dr.EXPECT().Put(s.ctx, s.d).Return(shared.Device{}, nil)
+	s.dr.EXPECT().PutIfUnchanged(s.ctx, s.d).Return(shared.Device{}, nil)
 
-	err := s.le.UpdateLocks(s.ctx)
+	report := shared.NewRunReport(time.Now())
+	err := s.le.UpdateLocks(s.ctx, report)
 	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
 
 	assert.Equal(t, shared.DeviceManagedLockCodeStatus3Enabled, s.mlc.Status)
 }
@@ -181,8 +195,10 @@ func Test_EnabledStartedExists(t *testing.T) {
 
 	s.generateLockengineSingleMLCLifecycleTest(true)
 
-	err := s.le.UpdateLocks(s.ctx)
+	report := shared.NewRunReport(time.Now())
+	err := s.le.UpdateLocks(s.ctx, report)
 	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
 
 	assert.Equal(t, shared.DeviceManagedLockCodeStatus3Enabled, s.mlc.Status)
 }
@@ -202,11 +218,14 @@ func Test_EnabledStartedNotExists(t *testing.T) {
 	s.generateLockengineSingleMLCLifecycleTest(false)
 
 	s.dc.EXPECT().AddLockCode(s.ctx, s.d, s.mlc.Code).Return(nil)
+	s.dc.EXPECT().GetLockCodes(s.ctx, s.d).Return([]shared.RawDeviceLockCode{}, nil) // The lock hasn't picked it up yet.
 	s.dr.EXPECT().AppendToAuditLog(s.ctx, s.d, []*shared.DeviceManagedLockCode{s.mlc}).Return(nil)
-	s.dr.EXPECT().Put(s.ctx, s.d).Return(shared.Device{}, nil)
+	s.dr.EXPECT().PutIfUnchanged(s.ctx, s.d).Return(shared.Device{}, nil)
 
-	err := s.le.UpdateLocks(s.ctx)
+	report := shared.NewRunReport(time.Now())
+	err := s.le.UpdateLocks(s.ctx, report)
 	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
 
 	assert.Equal(t, shared.DeviceManagedLockCodeStatus2Adding, s.mlc.Status)
 }
@@ -226,11 +245,14 @@ func Test_EnabledEndedExists(t *testing.T) {
 	s.generateLockengineSingleMLCLifecycleTest(true)
 
 	s.dc.EXPECT().RemoveLockCode(s.ctx, s.d, s.mlc.Code).Return(nil)
+	s.dc.EXPECT().GetLockCodes(s.ctx, s.d).Return(s.d.RawDevice.LockCodes, nil) // The lock hasn't removed it yet.
 	s.dr.EXPECT().AppendToAuditLog(s.ctx, s.d, []*shared.DeviceManagedLockCode{s.mlc}).Return(nil)
-	s.dr.EXPECT().Put(s.ctx, s.d).Return(shared.Device{}, nil)
+	s.dr.EXPECT().PutIfUnchanged(s.ctx, s.d).Return(shared.Device{}, nil)
 
-	err := s.le.UpdateLocks(s.ctx)
+	report := shared.NewRunReport(time.Now())
+	err := s.le.UpdateLocks(s.ctx, report)
 	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
 
 	assert.Equal(t, shared.DeviceManagedLockCodeStatus4Removing, s.mlc.Status)
 }
@@ -250,11 +272,14 @@ func Test_RemovingEndedExists(t *testing.T) {
 	s.generateLockengineSingleMLCLifecycleTest(true)
 
 	s.dc.EXPECT().RemoveLockCode(s.ctx, s.d, s.mlc.Code).Return(nil)
+	s.dc.EXPECT().GetLockCodes(s.ctx, s.d).Return(s.d.RawDevice.LockCodes, nil) // The lock hasn't removed it yet.
 	s.dr.EXPECT().AppendToAuditLog(s.ctx, s.d, []*shared.DeviceManagedLockCode{s.mlc}).Return(nil)
-	s.dr.EXPECT().Put(s.ctx, s.d).Return(shared.Device{}, nil)
+	s.dr.EXPECT().PutIfUnchanged(s.ctx, s.d).Return(shared.Device{}, nil)
 
-	err := s.le.UpdateLocks(s.ctx)
+	report := shared.NewRunReport(time.Now())
+	err := s.le.UpdateLocks(s.ctx, report)
 	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
 
 	assert.Equal(t, shared.DeviceManagedLockCodeStatus4Removing, s.mlc.Status)
 }
@@ -274,10 +299,12 @@ func Test_RemovingEndedNotExists(t *testing.T) {
 	s.generateLockengineSingleMLCLifecycleTest(false)
 
 	s.dr.EXPECT().AppendToAuditLog(s.ctx, s.d, []*shared.DeviceManagedLockCode{s.mlc}).Return(nil)
-	s.dr.EXPECT().Put(s.ctx, s.d).Return(shared.Device{}, nil)
+	s.dr.EXPECT().PutIfUnchanged(s.ctx, s.d).Return(shared.Device{}, nil)
 
-	err := s.le.UpdateLocks(s.ctx)
+	report := shared.NewRunReport(time.Now())
+	err := s.le.UpdateLocks(s.ctx, report)
 	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
 
 	assert.Equal(t, shared.DeviceManagedLockCodeStatus5Complete, s.mlc.Status)
 }
@@ -296,8 +323,10 @@ func Test_CompletedEndedNotExists(t *testing.T) {
 
 	s.generateLockengineSingleMLCLifecycleTest(false)
 
-	err := s.le.UpdateLocks(s.ctx)
+	report := shared.NewRunReport(time.Now())
+	err := s.le.UpdateLocks(s.ctx, report)
 	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
 
 	assert.Equal(t, shared.DeviceManagedLockCodeStatus5Complete, s.mlc.Status)
 }
@@ -317,11 +346,14 @@ func Test_CompletedEndedExists(t *testing.T) {
 	s.generateLockengineSingleMLCLifecycleTest(true)
 
 	s.dc.EXPECT().RemoveLockCode(s.ctx, s.d, s.mlc.Code).Return(nil)
+	s.dc.EXPECT().GetLockCodes(s.ctx, s.d).Return(s.d.RawDevice.LockCodes, nil) // The lock hasn't removed it yet.
 	s.dr.EXPECT().AppendToAuditLog(s.ctx, s.d, []*shared.DeviceManagedLockCode{s.mlc}).Return(nil)
-	s.dr.EXPECT().Put(s.ctx, s.d).Return(shared.Device{}, nil)
+	s.dr.EXPECT().PutIfUnchanged(s.ctx, s.d).Return(shared.Device{}, nil)
 
-	err := s.le.UpdateLocks(s.ctx)
+	report := shared.NewRunReport(time.Now())
+	err := s.le.UpdateLocks(s.ctx, report)
 	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
 
 	assert.Equal(t, shared.DeviceManagedLockCodeStatus4Removing, s.mlc.Status)
 }
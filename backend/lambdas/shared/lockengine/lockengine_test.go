@@ -4,6 +4,7 @@ package lockengine_test
 
 import (
 	"context"
+	"fmt"
 	"mlock/lambdas/shared"
 	"mlock/lambdas/shared/lockengine"
 	"mlock/lambdas/shared/lockengine/mocks/mock_lockengine"
@@ -48,17 +49,20 @@ func Test_AddLockCode(t *testing.T) {
 	le, dc, dr := newLockEngine(t)
 
 	dc.EXPECT().AddLockCode(ctx, device, code).Return(nil)
+	dc.EXPECT().GetLockCodes(ctx, device).Return([]shared.RawDeviceLockCode{}, nil) // The lock hasn't picked it up yet.
 
 	dr.EXPECT().ListActive(ctx).Return(
 		[]shared.Device{device},
 		nil,
 	)
-	dr.EXPECT().Put(ctx, device).Return(shared.Device{}, nil)
+	dr.EXPECT().PutIfUnchanged(ctx, device).Return(shared.Device{}, nil)
 
 	dr.EXPECT().AppendToAuditLog(ctx, device, []*shared.DeviceManagedLockCode{managedLockCode}).Return(nil)
 
-	err := le.UpdateLocks(ctx)
+	report := shared.NewRunReport(time.Now())
+	err := le.UpdateLocks(ctx, report)
 	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
 
 	assert.Equal(t, shared.DeviceManagedLockCodeStatus2Adding, managedLockCode.Status)
 }
@@ -103,10 +107,12 @@ func Test_LeaveLockCode_MultipleMLC(t *testing.T) {
 	)
 
 	dr.EXPECT().AppendToAuditLog(ctx, device, []*shared.DeviceManagedLockCode{expiredManagedLockCode}).Return(nil)
-	dr.EXPECT().Put(ctx, device).Return(shared.Device{}, nil)
+	dr.EXPECT().PutIfUnchanged(ctx, device).Return(shared.Device{}, nil)
 
-	err := le.UpdateLocks(ctx)
+	report := shared.NewRunReport(time.Now())
+	err := le.UpdateLocks(ctx, report)
 	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
 
 	assert.Equal(t, shared.DeviceManagedLockCodeStatus3Enabled, activeManagedLockCode.Status)
 	assert.Equal(t, shared.DeviceManagedLockCodeStatus5Complete, expiredManagedLockCode.Status)
@@ -141,8 +147,10 @@ func Test_LeaveLockCode_SingleMLC(t *testing.T) {
 		nil,
 	)
 
-	err := le.UpdateLocks(ctx)
+	report := shared.NewRunReport(time.Now())
+	err := le.UpdateLocks(ctx, report)
 	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
 
 	assert.Equal(t, shared.DeviceManagedLockCodeStatus3Enabled, managedLockCode.Status)
 }
@@ -154,8 +162,10 @@ func Test_NoDevices(t *testing.T) {
 	le, _, dr := newLockEngine(t)
 	dr.EXPECT().ListActive(ctx).Return([]shared.Device{}, nil)
 
-	err := le.UpdateLocks(ctx)
+	report := shared.NewRunReport(time.Now())
+	err := le.UpdateLocks(ctx, report)
 	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
 
 	// Since we didn't mock the DeviceController.* methods, this test will fail if any of them are called.
 }
@@ -186,17 +196,20 @@ func Test_RemoveLockCode(t *testing.T) {
 	le, dc, dr := newLockEngine(t)
 
 	dc.EXPECT().RemoveLockCode(ctx, device, code).Return(nil)
+	dc.EXPECT().GetLockCodes(ctx, device).Return(device.RawDevice.LockCodes, nil) // The lock hasn't removed it yet.
 
 	dr.EXPECT().ListActive(ctx).Return(
 		[]shared.Device{device},
 		nil,
 	)
-	dr.EXPECT().Put(ctx, device).Return(shared.Device{}, nil)
+	dr.EXPECT().PutIfUnchanged(ctx, device).Return(shared.Device{}, nil)
 
 	dr.EXPECT().AppendToAuditLog(ctx, device, []*shared.DeviceManagedLockCode{managedLockCode}).Return(nil)
 
-	err := le.UpdateLocks(ctx)
+	report := shared.NewRunReport(time.Now())
+	err := le.UpdateLocks(ctx, report)
 	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
 
 	assert.Equal(t, shared.DeviceManagedLockCodeStatus4Removing, managedLockCode.Status)
 }
@@ -294,7 +307,7 @@ func Test_deleteOneButNotAllMLCs(t *testing.T) {
 		assert.Equal(t, "0006", mlc.Code)
 	}).Return(nil)
 
-	dr.EXPECT().Put(
+	dr.EXPECT().PutIfUnchanged(
 		ctx,
 		gomock.Any(),
 	).Do(func(ctx context.Context, d shared.Device) {
@@ -304,20 +317,286 @@ func Test_deleteOneButNotAllMLCs(t *testing.T) {
 		assert.Equal(t, "9999", mlc.Code)
 	}).Return(shared.Device{}, nil)
 
-	err := le.UpdateLocks(ctx)
+	report := shared.NewRunReport(time.Now())
+	err := le.UpdateLocks(ctx, report)
 	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
 }
 
 func newLockEngine(t *testing.T) (*lockengine.LockEngine, *mock_lockengine.MockDeviceController, *mock_lockengine.MockDeviceRepository) {
+	le, dc, dr, ev := newLockEngineWithEventSink(t)
+
+	// Tests that care about the events can use `newLockEngineWithEventSink`.
+	ev.EXPECT().Emit(gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+
+	return le, dc, dr
+}
+
+func newLockEngineWithEventSink(t *testing.T) (*lockengine.LockEngine, *mock_lockengine.MockDeviceController, *mock_lockengine.MockDeviceRepository, *mock_lockengine.MockEventSink) {
 	ctrl := gomock.NewController(t)
 
 	dc := mock_lockengine.NewMockDeviceController(ctrl)
 	dr := mock_lockengine.NewMockDeviceRepository(ctrl)
 	es := mock_lockengine.NewMockEmailService(ctrl)
+	ev := mock_lockengine.NewMockEventSink(ctrl)
+	pr := mock_lockengine.NewMockPropertyRepository(ctrl)
+	ur := mock_lockengine.NewMockUnitRepository(ctrl)
 
 	// This is probably temporary so we'll just completely mock it out all the way for now.
 	es.EXPECT().SendEmailToDevelopers(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
 
-	le := lockengine.NewLockEngine(dc, dr, es, "", time.UTC)
-	return le, dc, dr
+	// Only used for the unmanaged lock code policies, tests that care can set them on the device.
+	pr.EXPECT().List(gomock.Any()).Return([]shared.Property{}, nil).AnyTimes()
+	ur.EXPECT().ListByID(gomock.Any()).Return(map[uuid.UUID]shared.Unit{}, nil).AnyTimes()
+
+	le := lockengine.NewLockEngine(dc, dr, es, ev, "", pr, time.UTC, ur)
+	return le, dc, dr, ev
+}
+
+func Test_MultipleControllers(t *testing.T) {
+	// Devices on different controllers are handled concurrently, each one should still be updated.
+
+	ctx := context.Background()
+	devices := []shared.Device{}
+	mlcs := []*shared.DeviceManagedLockCode{}
+	for i := 0; i < 4; i++ {
+		mlc := &shared.DeviceManagedLockCode{
+			Code:    fmt.Sprintf("000%d", i),
+			EndAt:   time.Now().Add(1 * time.Hour),
+			Status:  shared.DeviceManagedLockCodeStatus1Scheduled,
+			StartAt: time.Now().Add(-1 * time.Hour),
+		}
+		mlcs = append(mlcs, mlc)
+		devices = append(devices, shared.Device{
+			ControllerID:     fmt.Sprintf("controller-%d", i%2),
+			ID:               uuid.New(),
+			ManagedLockCodes: []*shared.DeviceManagedLockCode{mlc},
+		})
+	}
+
+	le, dc, dr := newLockEngine(t)
+
+	dr.EXPECT().ListActive(ctx).Return(devices, nil)
+	for i, d := range devices {
+		dc.EXPECT().AddLockCode(ctx, d, mlcs[i].Code).Return(nil)
+		dc.EXPECT().GetLockCodes(ctx, d).Return([]shared.RawDeviceLockCode{}, nil)
+		dr.EXPECT().AppendToAuditLog(ctx, d, []*shared.DeviceManagedLockCode{mlcs[i]}).Return(nil)
+		dr.EXPECT().PutIfUnchanged(ctx, d).Return(shared.Device{}, nil)
+	}
+
+	report := shared.NewRunReport(time.Now())
+	err := le.UpdateLocks(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+
+	for _, mlc := range mlcs {
+		assert.Equal(t, shared.DeviceManagedLockCodeStatus2Adding, mlc.Status)
+	}
+}
+
+func Test_BadDeviceDoesNotStopOthers(t *testing.T) {
+	// Failing to save one device shouldn't stop the next one on the same controller from being updated.
+
+	ctx := context.Background()
+	badMLC := &shared.DeviceManagedLockCode{
+		Code:    "1111",
+		EndAt:   time.Now().Add(1 * time.Hour),
+		Status:  shared.DeviceManagedLockCodeStatus1Scheduled,
+		StartAt: time.Now().Add(-1 * time.Hour),
+	}
+	goodMLC := &shared.DeviceManagedLockCode{
+		Code:    "2222",
+		EndAt:   time.Now().Add(1 * time.Hour),
+		Status:  shared.DeviceManagedLockCodeStatus1Scheduled,
+		StartAt: time.Now().Add(-1 * time.Hour),
+	}
+	badDevice := shared.Device{
+		ControllerID:     "controller",
+		ID:               uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{badMLC},
+	}
+	goodDevice := shared.Device{
+		ControllerID:     "controller",
+		ID:               uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{goodMLC},
+	}
+
+	le, dc, dr := newLockEngine(t)
+
+	dr.EXPECT().ListActive(ctx).Return([]shared.Device{badDevice, goodDevice}, nil)
+
+	dc.EXPECT().AddLockCode(ctx, badDevice, badMLC.Code).Return(nil)
+	dc.EXPECT().GetLockCodes(ctx, badDevice).Return([]shared.RawDeviceLockCode{}, nil)
+	dr.EXPECT().AppendToAuditLog(ctx, badDevice, []*shared.DeviceManagedLockCode{badMLC}).Return(fmt.Errorf("boom"))
+
+	dc.EXPECT().AddLockCode(ctx, goodDevice, goodMLC.Code).Return(nil)
+	dc.EXPECT().GetLockCodes(ctx, goodDevice).Return([]shared.RawDeviceLockCode{}, nil)
+	dr.EXPECT().AppendToAuditLog(ctx, goodDevice, []*shared.DeviceManagedLockCode{goodMLC}).Return(nil)
+	dr.EXPECT().PutIfUnchanged(ctx, goodDevice).Return(shared.Device{}, nil)
+
+	report := shared.NewRunReport(time.Now())
+	err := le.UpdateLocks(ctx, report)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 1, len(report.Errors))
+	assert.Equal(t, badDevice.ID, report.Errors[0].DeviceID)
+	assert.Equal(t, "error appending to audit log: boom", report.Errors[0].Error)
+	assert.Equal(t, 1, report.DevicesProcessed[shared.RunReportStageLockEngine])
+}
+
+func Test_WithUnits(t *testing.T) {
+	// Only the unit's devices are touched, the others (including devices without a unit) are left for the full poll.
+
+	ctx := context.Background()
+	unitID := uuid.New()
+	otherUnitID := uuid.New()
+	newDevice := func(unitID *uuid.UUID) (shared.Device, *shared.DeviceManagedLockCode) {
+		mlc := &shared.DeviceManagedLockCode{
+			Code:    "5566",
+			EndAt:   time.Now().Add(1 * time.Hour),
+			Status:  shared.DeviceManagedLockCodeStatus1Scheduled,
+			StartAt: time.Now().Add(-1 * time.Hour),
+		}
+		return shared.Device{ID: uuid.New(), ManagedLockCodes: []*shared.DeviceManagedLockCode{mlc}, UnitID: unitID}, mlc
+	}
+	device, mlc := newDevice(&unitID)
+	otherDevice, otherMLC := newDevice(&otherUnitID)
+	noUnitDevice, noUnitMLC := newDevice(nil)
+
+	le, dc, dr := newLockEngine(t)
+	le = le.WithUnits([]uuid.UUID{unitID})
+
+	dr.EXPECT().ListActive(ctx).Return([]shared.Device{otherDevice, device, noUnitDevice}, nil)
+	dc.EXPECT().AddLockCode(ctx, device, "5566").Return(nil)
+	dc.EXPECT().GetLockCodes(ctx, device).Return([]shared.RawDeviceLockCode{}, nil)
+	dr.EXPECT().AppendToAuditLog(ctx, device, []*shared.DeviceManagedLockCode{mlc}).Return(nil)
+	dr.EXPECT().PutIfUnchanged(ctx, device).Return(shared.Device{}, nil)
+
+	report := shared.NewRunReport(time.Now())
+	err := le.UpdateLocks(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus2Adding, mlc.Status)
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus1Scheduled, otherMLC.Status)
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus1Scheduled, noUnitMLC.Status)
+}
+
+func Test_WithDevices(t *testing.T) {
+	// Devices can be picked on their own (e.g. one without a unit) or alongside a unit's devices.
+
+	ctx := context.Background()
+	unitID := uuid.New()
+	newDevice := func(unitID *uuid.UUID) (shared.Device, *shared.DeviceManagedLockCode) {
+		mlc := &shared.DeviceManagedLockCode{
+			Code:    "5566",
+			EndAt:   time.Now().Add(1 * time.Hour),
+			Status:  shared.DeviceManagedLockCodeStatus1Scheduled,
+			StartAt: time.Now().Add(-1 * time.Hour),
+		}
+		return shared.Device{ID: uuid.New(), ManagedLockCodes: []*shared.DeviceManagedLockCode{mlc}, UnitID: unitID}, mlc
+	}
+	device, mlc := newDevice(&unitID)
+	noUnitDevice, noUnitMLC := newDevice(nil)
+	otherDevice, otherMLC := newDevice(nil)
+
+	le, dc, dr := newLockEngine(t)
+	le = le.WithUnits([]uuid.UUID{unitID}).WithDevices([]uuid.UUID{noUnitDevice.ID})
+
+	dr.EXPECT().ListActive(ctx).Return([]shared.Device{otherDevice, device, noUnitDevice}, nil)
+	for _, d := range []shared.Device{device, noUnitDevice} {
+		dc.EXPECT().AddLockCode(ctx, d, "5566").Return(nil)
+		dc.EXPECT().GetLockCodes(ctx, d).Return([]shared.RawDeviceLockCode{}, nil)
+		dr.EXPECT().AppendToAuditLog(ctx, d, d.ManagedLockCodes).Return(nil)
+		dr.EXPECT().PutIfUnchanged(ctx, d).Return(shared.Device{}, nil)
+	}
+
+	report := shared.NewRunReport(time.Now())
+	err := le.UpdateLocks(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus2Adding, mlc.Status)
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus2Adding, noUnitMLC.Status)
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus1Scheduled, otherMLC.Status)
+}
+
+func Test_UpdateLock(t *testing.T) {
+	// The controller told us the code is on the lock, so there's nothing to send.
+
+	ctx := context.Background()
+	mlc := &shared.DeviceManagedLockCode{
+		Code:    "1234",
+		EndAt:   time.Now().Add(1 * time.Hour),
+		Status:  shared.DeviceManagedLockCodeStatus2Adding,
+		StartAt: time.Now().Add(-1 * time.Hour),
+	}
+	d := shared.Device{
+		ID:               uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{mlc},
+		RawDevice: shared.RawDevice{
+			LockCodes: []shared.RawDeviceLockCode{{Code: "1234"}},
+		},
+	}
+
+	le, _, dr := newLockEngine(t)
+
+	dr.EXPECT().AppendToAuditLog(ctx, d, []*shared.DeviceManagedLockCode{mlc}).Return(nil)
+	dr.EXPECT().PutIfUnchanged(ctx, d).Return(shared.Device{}, nil)
+
+	err := le.UpdateLock(ctx, d)
+	assert.Nil(t, err)
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus3Enabled, mlc.Status)
+}
+
+func Test_UpdateLocksKeepsConcurrentChanges(t *testing.T) {
+	// Someone else saved the device while we were adding the code, we keep their changes and add ours.
+
+	ctx := context.Background()
+	mlc := &shared.DeviceManagedLockCode{
+		Code:    "1234",
+		EndAt:   time.Now().Add(4 * time.Hour),
+		ID:      uuid.New(),
+		Status:  shared.DeviceManagedLockCodeStatus1Scheduled,
+		StartAt: time.Now().Add(-1 * time.Minute),
+	}
+	d := shared.Device{
+		ID:               uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{mlc},
+		Version:          1,
+	}
+
+	// The battery changed, and someone added another code.
+	theirs := shared.Device{
+		ID: d.ID,
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{
+			{Code: mlc.Code, EndAt: mlc.EndAt, ID: mlc.ID, Status: shared.DeviceManagedLockCodeStatus1Scheduled, StartAt: mlc.StartAt},
+			{Code: "5678", EndAt: mlc.EndAt, ID: uuid.New(), Status: shared.DeviceManagedLockCodeStatus1Scheduled, StartAt: mlc.StartAt},
+		},
+		RawDevice: shared.RawDevice{Battery: shared.RawDeviceBattery{BatteryPowered: true, Level: 40}},
+		Version:   2,
+	}
+
+	le, dc, dr := newLockEngine(t)
+
+	dr.EXPECT().ListActive(ctx).Return([]shared.Device{d}, nil)
+	dc.EXPECT().AddLockCode(ctx, gomock.Any(), mlc.Code).Return(nil)
+	dc.EXPECT().GetLockCodes(ctx, gomock.Any()).Return([]shared.RawDeviceLockCode{{Code: mlc.Code}}, nil)
+	dr.EXPECT().AppendToAuditLog(ctx, gomock.Any(), gomock.Any()).Return(nil)
+	gomock.InOrder(
+		dr.EXPECT().PutIfUnchanged(ctx, gomock.Any()).Return(shared.Device{}, shared.ErrDeviceChanged),
+		dr.EXPECT().Get(ctx, d.ID).Return(theirs, true, nil),
+		dr.EXPECT().PutIfUnchanged(ctx, gomock.Any()).Do(func(ctx context.Context, saved shared.Device) {
+			assert.Equal(t, 2, saved.Version)
+			assert.Equal(t, 40, saved.RawDevice.Battery.Level)
+			assert.Equal(t, 2, len(saved.ManagedLockCodes))
+			assert.Equal(t, shared.DeviceManagedLockCodeStatus3Enabled, saved.ManagedLockCodes[0].Status)
+			assert.Equal(t, 1, saved.ManagedLockCodes[0].Attempts)
+			assert.Equal(t, shared.DeviceManagedLockCodeStatus1Scheduled, saved.ManagedLockCodes[1].Status)
+		}).Return(shared.Device{}, nil),
+	)
+
+	report := shared.NewRunReport(time.Now())
+	assert.Nil(t, le.UpdateLocks(ctx, report))
+	assert.Empty(t, report.Errors)
 }
@@ -0,0 +1,87 @@
+package lockengine_test
+
+import (
+	"context"
+	"mlock/lambdas/shared"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+func Test_RemoveUnmanagedLockCode(t *testing.T) {
+	// A stray code that's been around longer than the grace period should be removed, but not the allowed or new ones.
+
+	ctx := context.Background()
+	now := time.Now()
+	d := shared.Device{
+		ID: uuid.New(),
+		RawDevice: shared.RawDevice{
+			LockCodes: []shared.RawDeviceLockCode{
+				{Code: "0000"}, // Allowed.
+				{Code: "1111"}, // Stray.
+				{Code: "2222"}, // Too new.
+			},
+		},
+		UnmanagedLockCodePolicy: &shared.UnmanagedLockCodePolicy{
+			AllowedCodes:         []string{"0000"},
+			AutoRemove:           true,
+			GracePeriodInMinutes: 30,
+		},
+		UnmanagedLockCodesSeenAt: map[string]time.Time{
+			"0000": now.Add(-24 * time.Hour),
+			"1111": now.Add(-1 * time.Hour),
+			"2222": now.Add(-1 * time.Minute),
+		},
+	}
+
+	le, dc, dr := newLockEngine(t)
+
+	dr.EXPECT().ListActive(ctx).Return([]shared.Device{d}, nil)
+	dc.EXPECT().RemoveLockCode(ctx, gomock.Any(), "1111").Return(nil)
+	dc.EXPECT().GetLockCodes(ctx, gomock.Any()).Return([]shared.RawDeviceLockCode{{Code: "0000"}, {Code: "2222"}}, nil)
+	dr.EXPECT().AppendToAuditLog(ctx, gomock.Any(), gomock.Any()).Do(func(ctx context.Context, ad shared.Device, managedLockCodes []*shared.DeviceManagedLockCode) {
+		assert.Equal(t, d.ID, ad.ID)
+		assert.Equal(t, 1, len(managedLockCodes))
+		assert.Equal(t, "1111", managedLockCodes[0].Code)
+		assert.Contains(t, managedLockCodes[0].Note, "Removing unmanaged lock code")
+	}).Return(nil)
+	dr.EXPECT().PutIfUnchanged(ctx, gomock.Any()).Do(func(ctx context.Context, pd shared.Device) {
+		// The audit log entry shouldn't turn into a managed lock code.
+		assert.Equal(t, d.ID, pd.ID)
+		assert.Equal(t, 0, len(pd.ManagedLockCodes))
+	}).Return(shared.Device{}, nil)
+
+	report := shared.NewRunReport(time.Now())
+	err := le.UpdateLocks(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+}
+
+func Test_LeaveUnmanagedLockCodeWithoutAutoRemove(t *testing.T) {
+	// Without opting in, we shouldn't touch codes we didn't add.
+
+	ctx := context.Background()
+	d := shared.Device{
+		ID: uuid.New(),
+		RawDevice: shared.RawDevice{
+			LockCodes: []shared.RawDeviceLockCode{
+				{Code: "1111"},
+			},
+		},
+		UnmanagedLockCodesSeenAt: map[string]time.Time{
+			"1111": time.Now().Add(-24 * time.Hour),
+		},
+	}
+
+	// Nothing other than listing is expected.
+	le, _, dr := newLockEngine(t)
+	dr.EXPECT().ListActive(ctx).Return([]shared.Device{d}, nil)
+
+	report := shared.NewRunReport(time.Now())
+	err := le.UpdateLocks(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+}
@@ -14,6 +14,7 @@ import (
 	shared "mlock/lambdas/shared"
 	reflect "reflect"
 
+	uuid "github.com/google/uuid"
 	gomock "go.uber.org/mock/gomock"
 )
 
@@ -55,6 +56,21 @@ func (mr *MockDeviceControllerMockRecorder) AddLockCode(ctx, device, code any) *
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddLockCode", reflect.TypeOf((*MockDeviceController)(nil).AddLockCode), ctx, device, code)
 }
 
+// GetLockCodes mocks base method.
+func (m *MockDeviceController) GetLockCodes(ctx context.Context, device shared.Device) ([]shared.RawDeviceLockCode, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetLockCodes", ctx, device)
+	ret0, _ := ret[0].([]shared.RawDeviceLockCode)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetLockCodes indicates an expected call of GetLockCodes.
+func (mr *MockDeviceControllerMockRecorder) GetLockCodes(ctx, device any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetLockCodes", reflect.TypeOf((*MockDeviceController)(nil).GetLockCodes), ctx, device)
+}
+
 // RemoveLockCode mocks base method.
 func (m *MockDeviceController) RemoveLockCode(ctx context.Context, device shared.Device, code string) error {
 	m.ctrl.T.Helper()
@@ -107,6 +123,22 @@ func (mr *MockDeviceRepositoryMockRecorder) AppendToAuditLog(ctx, device, manage
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AppendToAuditLog", reflect.TypeOf((*MockDeviceRepository)(nil).AppendToAuditLog), ctx, device, managedLockCodes)
 }
 
+// Get mocks base method.
+func (m *MockDeviceRepository) Get(ctx context.Context, id uuid.UUID) (shared.Device, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Get", ctx, id)
+	ret0, _ := ret[0].(shared.Device)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// Get indicates an expected call of Get.
+func (mr *MockDeviceRepositoryMockRecorder) Get(ctx, id any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockDeviceRepository)(nil).Get), ctx, id)
+}
+
 // ListActive mocks base method.
 func (m *MockDeviceRepository) ListActive(ctx context.Context) ([]shared.Device, error) {
 	m.ctrl.T.Helper()
@@ -122,19 +154,97 @@ func (mr *MockDeviceRepositoryMockRecorder) ListActive(ctx any) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListActive", reflect.TypeOf((*MockDeviceRepository)(nil).ListActive), ctx)
 }
 
-// Put mocks base method.
-func (m *MockDeviceRepository) Put(ctx context.Context, item shared.Device) (shared.Device, error) {
+// PutIfUnchanged mocks base method.
+func (m *MockDeviceRepository) PutIfUnchanged(ctx context.Context, item shared.Device) (shared.Device, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Put", ctx, item)
+	ret := m.ctrl.Call(m, "PutIfUnchanged", ctx, item)
 	ret0, _ := ret[0].(shared.Device)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// Put indicates an expected call of Put.
-func (mr *MockDeviceRepositoryMockRecorder) Put(ctx, item any) *gomock.Call {
+// PutIfUnchanged indicates an expected call of PutIfUnchanged.
+func (mr *MockDeviceRepositoryMockRecorder) PutIfUnchanged(ctx, item any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PutIfUnchanged", reflect.TypeOf((*MockDeviceRepository)(nil).PutIfUnchanged), ctx, item)
+}
+
+// MockPropertyRepository is a mock of PropertyRepository interface.
+type MockPropertyRepository struct {
+	ctrl     *gomock.Controller
+	recorder *MockPropertyRepositoryMockRecorder
+	isgomock struct{}
+}
+
+// MockPropertyRepositoryMockRecorder is the mock recorder for MockPropertyRepository.
+type MockPropertyRepositoryMockRecorder struct {
+	mock *MockPropertyRepository
+}
+
+// NewMockPropertyRepository creates a new mock instance.
+func NewMockPropertyRepository(ctrl *gomock.Controller) *MockPropertyRepository {
+	mock := &MockPropertyRepository{ctrl: ctrl}
+	mock.recorder = &MockPropertyRepositoryMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockPropertyRepository) EXPECT() *MockPropertyRepositoryMockRecorder {
+	return m.recorder
+}
+
+// List mocks base method.
+func (m *MockPropertyRepository) List(ctx context.Context) ([]shared.Property, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "List", ctx)
+	ret0, _ := ret[0].([]shared.Property)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// List indicates an expected call of List.
+func (mr *MockPropertyRepositoryMockRecorder) List(ctx any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockPropertyRepository)(nil).List), ctx)
+}
+
+// MockUnitRepository is a mock of UnitRepository interface.
+type MockUnitRepository struct {
+	ctrl     *gomock.Controller
+	recorder *MockUnitRepositoryMockRecorder
+	isgomock struct{}
+}
+
+// MockUnitRepositoryMockRecorder is the mock recorder for MockUnitRepository.
+type MockUnitRepositoryMockRecorder struct {
+	mock *MockUnitRepository
+}
+
+// NewMockUnitRepository creates a new mock instance.
+func NewMockUnitRepository(ctrl *gomock.Controller) *MockUnitRepository {
+	mock := &MockUnitRepository{ctrl: ctrl}
+	mock.recorder = &MockUnitRepositoryMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockUnitRepository) EXPECT() *MockUnitRepositoryMockRecorder {
+	return m.recorder
+}
+
+// ListByID mocks base method.
+func (m *MockUnitRepository) ListByID(ctx context.Context) (map[uuid.UUID]shared.Unit, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListByID", ctx)
+	ret0, _ := ret[0].(map[uuid.UUID]shared.Unit)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListByID indicates an expected call of ListByID.
+func (mr *MockUnitRepositoryMockRecorder) ListByID(ctx any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Put", reflect.TypeOf((*MockDeviceRepository)(nil).Put), ctx, item)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListByID", reflect.TypeOf((*MockUnitRepository)(nil).ListByID), ctx)
 }
 
 // MockEmailService is a mock of EmailService interface.
@@ -174,3 +284,41 @@ func (mr *MockEmailServiceMockRecorder) SendEmailToDevelopers(ctx, subject, body
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SendEmailToDevelopers", reflect.TypeOf((*MockEmailService)(nil).SendEmailToDevelopers), ctx, subject, body)
 }
+
+// MockEventSink is a mock of EventSink interface.
+type MockEventSink struct {
+	ctrl     *gomock.Controller
+	recorder *MockEventSinkMockRecorder
+	isgomock struct{}
+}
+
+// MockEventSinkMockRecorder is the mock recorder for MockEventSink.
+type MockEventSinkMockRecorder struct {
+	mock *MockEventSink
+}
+
+// NewMockEventSink creates a new mock instance.
+func NewMockEventSink(ctrl *gomock.Controller) *MockEventSink {
+	mock := &MockEventSink{ctrl: ctrl}
+	mock.recorder = &MockEventSinkMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockEventSink) EXPECT() *MockEventSinkMockRecorder {
+	return m.recorder
+}
+
+// Emit mocks base method.
+func (m *MockEventSink) Emit(ctx context.Context, e shared.Event) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Emit", ctx, e)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Emit indicates an expected call of Emit.
+func (mr *MockEventSinkMockRecorder) Emit(ctx, e any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Emit", reflect.TypeOf((*MockEventSink)(nil).Emit), ctx, e)
+}
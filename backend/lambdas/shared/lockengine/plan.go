@@ -0,0 +1,298 @@
+package lockengine
+
+import (
+	"fmt"
+	"mlock/lambdas/shared"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Plan is what `UpdateLocks` would do for a single device. Building a plan doesn't talk to the controller or save anything.
+type Plan struct {
+	Commands      []PlanCommand      `json:"commands"`
+	Deferrals     []PlanDeferral     `json:"deferrals"`
+	Deletions     []PlanDeletion     `json:"deletions"`
+	DeviceID      uuid.UUID          `json:"deviceId"`
+	GeneratedAt   time.Time          `json:"generatedAt"`
+	StatusChanges []PlanStatusChange `json:"statusChanges"`
+
+	UnmanagedRemovals []PlanUnmanagedRemoval `json:"unmanagedRemovals"`
+}
+
+type PlanCommand struct {
+	Code               string          `json:"code"`
+	ManagedLockCodeIDs []uuid.UUID     `json:"managedLockCodeIds"`
+	Type               PlanCommandType `json:"type"`
+}
+
+type PlanCommandType string
+
+const (
+	PlanCommandTypeAdd    PlanCommandType = "Add"
+	PlanCommandTypeRemove PlanCommandType = "Remove"
+)
+
+// PlanDeferral is a code we'd like to add but are holding off on because the device is out of slots.
+type PlanDeferral struct {
+	Code               string      `json:"code"`
+	ManagedLockCodeIDs []uuid.UUID `json:"managedLockCodeIds"`
+	Note               string      `json:"note"`
+}
+
+type PlanDeletion struct {
+	Code              string    `json:"code"`
+	ManagedLockCodeID uuid.UUID `json:"managedLockCodeId"`
+	Note              string    `json:"note"`
+
+	mlc *shared.DeviceManagedLockCode
+}
+
+// PlanUnmanagedRemoval is a code we didn't add that the policy says should be removed, it has a matching remove command.
+type PlanUnmanagedRemoval struct {
+	Code        string    `json:"code"`
+	FirstSeenAt time.Time `json:"firstSeenAt"`
+	Note        string    `json:"note"`
+}
+
+type PlanStatusChange struct {
+	Code              string                             `json:"code"`
+	From              shared.DeviceManagedLockCodeStatus `json:"from"`
+	ManagedLockCodeID uuid.UUID                          `json:"managedLockCodeId"`
+	Note              string                             `json:"note"`
+	To                shared.DeviceManagedLockCodeStatus `json:"to"`
+
+	// The command (if any) that the change depends on, the note is updated if the command fails.
+	command PlanCommandType
+	mlc     *shared.DeviceManagedLockCode
+}
+
+// IsEmpty is true if applying the plan wouldn't do anything, deferrals don't count.
+func (p *Plan) IsEmpty() bool {
+	return len(p.Commands) == 0 && len(p.Deletions) == 0 && len(p.StatusChanges) == 0 && len(p.UnmanagedRemovals) == 0
+}
+
+func (l *LockEngine) Plan(now time.Time, d shared.Device, policy shared.UnmanagedLockCodePolicy) Plan {
+	plan := Plan{
+		Commands:      []PlanCommand{},
+		Deferrals:     []PlanDeferral{},
+		Deletions:     []PlanDeletion{},
+		DeviceID:      d.ID,
+		GeneratedAt:   now,
+		StatusChanges: []PlanStatusChange{},
+
+		UnmanagedRemovals: []PlanUnmanagedRemoval{},
+	}
+
+	lockStates := l.getLockStates(now, d)
+
+	// Map iteration order is random, sort so that the plan (and the order we send commands) is stable.
+	codes := []string{}
+	for code := range lockStates {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	// Removals are planned first so that the adds can use the slots they free up, and so that they're sent first.
+	for _, code := range codes {
+		ls := lockStates[code]
+		if ls.Exists {
+			if len(ls.RequestToAdd) > 0 {
+				for _, mlc := range ls.RequestToRemove {
+					if mlc.Status != shared.DeviceManagedLockCodeStatus5Complete {
+						plan.addStatusChange(mlc, shared.DeviceManagedLockCodeStatus5Complete, "Leaving lock code as it's in use.", "")
+					}
+				}
+				for _, mlc := range ls.RequestToAdd {
+					if mlc.Status != shared.DeviceManagedLockCodeStatus3Enabled {
+						plan.addStatusChange(mlc, shared.DeviceManagedLockCodeStatus3Enabled, "Lock code present.", "")
+					}
+				}
+			} else if len(ls.RequestToRemove) > 0 {
+				toAttempt := l.planRetries(now, &plan, ls.RequestToRemove, shared.DeviceManagedLockCodeStatus4Removing)
+				if len(toAttempt) > 0 {
+					plan.addCommand(code, PlanCommandTypeRemove, toAttempt)
+					for _, mlc := range toAttempt {
+						plan.addStatusChange(mlc, shared.DeviceManagedLockCodeStatus4Removing, "Attempting to remove lock code.", PlanCommandTypeRemove)
+					}
+				}
+			}
+		} else { // !ls.Exists
+			for _, mlc := range ls.RequestToRemove {
+				if mlc.Status != shared.DeviceManagedLockCodeStatus5Complete {
+					note := "Code was removed."
+					if len(ls.RequestToAdd) > 0 {
+						note = "Code is currently in use; nothing more to do."
+					}
+					plan.addStatusChange(mlc, shared.DeviceManagedLockCodeStatus5Complete, note, "")
+				}
+			}
+		}
+	}
+
+	l.planUnmanagedRemovals(now, &plan, d, policy)
+
+	addable := l.prioritizeAdds(&plan, d, codes, lockStates)
+	for _, code := range codes {
+		ls := lockStates[code]
+		if ls.Exists || len(ls.RequestToAdd) == 0 || !addable[code] {
+			continue
+		}
+		toAttempt := l.planRetries(now, &plan, ls.RequestToAdd, shared.DeviceManagedLockCodeStatus2Adding)
+		if len(toAttempt) > 0 {
+			plan.addCommand(code, PlanCommandTypeAdd, toAttempt)
+			for _, mlc := range toAttempt {
+				plan.addStatusChange(mlc, shared.DeviceManagedLockCodeStatus2Adding, "Attempting to add lock code.", PlanCommandTypeAdd)
+			}
+		}
+	}
+
+	nearPast := now.Add(-1 * shared.ManagedLockCodeRetention)
+	for _, mlc := range d.ManagedLockCodes {
+		isDone := mlc.Status == shared.DeviceManagedLockCodeStatus5Complete || mlc.Status == shared.DeviceManagedLockCodeStatus6Failed
+		if mlc.EndAt.Before(nearPast) && isDone && !plan.changesStatus(mlc) {
+			note := "Deleting code as it completed a while ago."
+			if mlc.Status == shared.DeviceManagedLockCodeStatus6Failed {
+				note = "Deleting code as it failed a while ago."
+			}
+			plan.Deletions = append(plan.Deletions, PlanDeletion{
+				Code:              mlc.Code,
+				ManagedLockCodeID: mlc.ID,
+				Note:              note,
+				mlc:               mlc,
+			})
+		}
+	}
+
+	return plan
+}
+
+// prioritizeAdds returns the codes we have room to add, counting the slots that the plan's removals will free up. When there isn't room for all of them, the ones for the soonest reservations win and the rest are deferred until a slot frees up.
+func (l *LockEngine) prioritizeAdds(plan *Plan, d shared.Device, codes []string, lockStates map[string]*lockState) map[string]bool {
+	toAdd := []string{}
+	startsAt := map[string]time.Time{}
+	for _, code := range codes {
+		ls := lockStates[code]
+		if ls.Exists || len(ls.RequestToAdd) == 0 {
+			continue
+		}
+		toAdd = append(toAdd, code)
+		for _, mlc := range ls.RequestToAdd {
+			if s, ok := startsAt[code]; !ok || mlc.StartAt.Before(s) {
+				startsAt[code] = mlc.StartAt
+			}
+		}
+	}
+
+	// Stable so that codes starting at the same time stay in code order.
+	sort.SliceStable(toAdd, func(a, b int) bool {
+		return startsAt[toAdd[a]].Before(startsAt[toAdd[b]])
+	})
+
+	used := d.MaxLockCodes() - d.SlotUsage().Free
+	free := d.SlotUsage().Free
+	for _, c := range plan.Commands {
+		if c.Type == PlanCommandTypeRemove {
+			free++
+		}
+	}
+
+	addable := map[string]bool{}
+	for i, code := range toAdd {
+		if i < free {
+			addable[code] = true
+			continue
+		}
+
+		ids := []uuid.UUID{}
+		for _, mlc := range lockStates[code].RequestToAdd {
+			ids = append(ids, mlc.ID)
+		}
+		plan.Deferrals = append(plan.Deferrals, PlanDeferral{
+			Code:               code,
+			ManagedLockCodeIDs: ids,
+			Note:               fmt.Sprintf("Waiting for a free slot (%d of %d used).", used, d.MaxLockCodes()),
+		})
+	}
+
+	return addable
+}
+
+func (l *LockEngine) planUnmanagedRemovals(now time.Time, plan *Plan, d shared.Device, policy shared.UnmanagedLockCodePolicy) {
+	if !policy.AutoRemove {
+		return
+	}
+
+	for _, lc := range d.GenerateUnmanagedLockCodes() {
+		if policy.Allows(lc.Code) {
+			continue
+		}
+
+		// We only know how long it's been there once the device has been refreshed.
+		seenAt, ok := d.UnmanagedLockCodesSeenAt[lc.Code]
+		if !ok || now.Before(seenAt.Add(policy.GracePeriod())) {
+			continue
+		}
+
+		plan.addCommand(lc.Code, PlanCommandTypeRemove, nil)
+		plan.UnmanagedRemovals = append(plan.UnmanagedRemovals, PlanUnmanagedRemoval{
+			Code:        lc.Code,
+			FirstSeenAt: seenAt,
+			Note:        fmt.Sprintf("Removing unmanaged lock code, first seen at %s.", seenAt.In(l.timeZone).Format(time.RFC1123)),
+		})
+	}
+}
+
+// planRetries applies the retry policy to codes that are already being added or removed. It returns the codes that we should (re)send a command for; adds that have run out of attempts are failed, removals keep going at the longest backoff so that a guest's code doesn't stay on the lock.
+func (l *LockEngine) planRetries(now time.Time, plan *Plan, mlcs []*shared.DeviceManagedLockCode, inProgress shared.DeviceManagedLockCodeStatus) []*shared.DeviceManagedLockCode {
+	toAttempt := []*shared.DeviceManagedLockCode{}
+	for _, mlc := range mlcs {
+		if mlc.Status != inProgress {
+			toAttempt = append(toAttempt, mlc)
+			continue
+		}
+		if inProgress == shared.DeviceManagedLockCodeStatus2Adding && l.retryPolicy.exhausted(mlc) {
+			plan.addStatusChange(mlc, shared.DeviceManagedLockCodeStatus6Failed, fmt.Sprintf("Giving up after %d attempts; last error: %s", mlc.Attempts, mlc.LastError), "")
+			continue
+		}
+		if !l.retryPolicy.attemptIsDue(now, mlc) {
+			continue
+		}
+		toAttempt = append(toAttempt, mlc)
+	}
+	return toAttempt
+}
+
+func (p *Plan) addCommand(code string, t PlanCommandType, mlcs []*shared.DeviceManagedLockCode) {
+	ids := []uuid.UUID{}
+	for _, mlc := range mlcs {
+		ids = append(ids, mlc.ID)
+	}
+	p.Commands = append(p.Commands, PlanCommand{
+		Code:               code,
+		ManagedLockCodeIDs: ids,
+		Type:               t,
+	})
+}
+
+func (p *Plan) addStatusChange(mlc *shared.DeviceManagedLockCode, to shared.DeviceManagedLockCodeStatus, note string, command PlanCommandType) {
+	p.StatusChanges = append(p.StatusChanges, PlanStatusChange{
+		Code:              mlc.Code,
+		From:              mlc.Status,
+		ManagedLockCodeID: mlc.ID,
+		Note:              note,
+		To:                to,
+		command:           command,
+		mlc:               mlc,
+	})
+}
+
+func (p *Plan) changesStatus(mlc *shared.DeviceManagedLockCode) bool {
+	for _, sc := range p.StatusChanges {
+		if sc.mlc == mlc {
+			return true
+		}
+	}
+	return false
+}
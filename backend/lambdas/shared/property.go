@@ -1,9 +1,17 @@
 package shared
 
-import "github.com/google/uuid"
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
 
 type Property struct {
-	ID        uuid.UUID `json:"id"`
-	Name      string    `json:"name"`
-	UpdatedBy string    `json:"updatedBy"`
+	GuestMessageTemplate      string                   `json:"guestMessageTemplate"`      // Sent to the guest once their code is enabled, see `GuestMessage`. Empty doesn't send anything.
+	GuestMessageTemplateSetAt *time.Time               `json:"guestMessageTemplateSetAt"` // When the template was set, codes that were enabled before then don't get a message.
+	ID                        uuid.UUID                `json:"id"`
+	Name                      string                   `json:"name"`
+	ReservationBuffers        *ReservationBuffers      `json:"reservationBuffers"` // Nil uses the defaults, a unit can override them.
+	UnmanagedLockCodePolicy   *UnmanagedLockCodePolicy `json:"unmanagedLockCodePolicy"`
+	UpdatedBy                 string                   `json:"updatedBy"`
 }
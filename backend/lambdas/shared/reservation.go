@@ -9,3 +9,9 @@ type Reservation struct {
 	DoorCode          string    `json:"doorCode"`
 	TransactionNumber string    `json:"transactionNumber"`
 }
+
+// ReservationStatus is what the provider knows about a single reservation, including canceled ones that it leaves out of the usual list.
+type ReservationStatus struct {
+	Canceled bool      `json:"canceled"`
+	End      time.Time `json:"end"` // Check-out, which moves earlier if the stay was cut short.
+}
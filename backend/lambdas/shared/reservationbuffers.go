@@ -0,0 +1,59 @@
+package shared
+
+import (
+	"fmt"
+	"time"
+)
+
+// ReservationBuffers moves a reservation's lock code away from check-in and check-out. It can be set on a property and on a unit, see `EffectiveReservationBuffers`.
+type ReservationBuffers struct {
+	EndInMinutes   *int `json:"endInMinutes"`   // Relative to check-out, e.g. 30 keeps the code working for 30 minutes after.
+	StartInMinutes *int `json:"startInMinutes"` // Relative to check-in, e.g. -240 enables the code 4 hours before.
+}
+
+// EffectiveReservationBuffers starts with the defaults, then the property's buffers, then the unit's. Either can set just one of the buffers.
+func EffectiveReservationBuffers(property *ReservationBuffers, unit *ReservationBuffers) ReservationBuffers {
+	end := ReservationEndBufferInMinutes
+	start := ReservationStartBufferInMinutes
+
+	for _, b := range []*ReservationBuffers{property, unit} {
+		if b == nil {
+			continue
+		}
+		if b.EndInMinutes != nil {
+			end = *b.EndInMinutes
+		}
+		if b.StartInMinutes != nil {
+			start = *b.StartInMinutes
+		}
+	}
+
+	return ReservationBuffers{
+		EndInMinutes:   &end,
+		StartInMinutes: &start,
+	}
+}
+
+func (b *ReservationBuffers) Validate() error {
+	if b.StartInMinutes != nil && *b.StartInMinutes > 0 {
+		return fmt.Errorf("the start buffer can't be after check-in")
+	}
+	if b.EndInMinutes != nil && *b.EndInMinutes < 0 {
+		return fmt.Errorf("the end buffer can't be before check-out")
+	}
+	return nil
+}
+
+func (b *ReservationBuffers) End() time.Duration {
+	if b.EndInMinutes == nil {
+		return ReservationEndBufferInMinutes * time.Minute
+	}
+	return time.Duration(*b.EndInMinutes) * time.Minute
+}
+
+func (b *ReservationBuffers) Start() time.Duration {
+	if b.StartInMinutes == nil {
+		return ReservationStartBufferInMinutes * time.Minute
+	}
+	return time.Duration(*b.StartInMinutes) * time.Minute
+}
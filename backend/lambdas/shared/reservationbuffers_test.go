@@ -0,0 +1,69 @@
+package shared
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestEffectiveReservationBuffers(t *testing.T) {
+	sixHoursEarly := -360
+	oneHourEarly := -60
+	anHourLate := 60
+
+	b := EffectiveReservationBuffers(nil, nil)
+	if b.Start() != -4*time.Hour || b.End() != 30*time.Minute {
+		t.Fatalf("expected the defaults but was %s and %s", b.Start(), b.End())
+	}
+
+	property := &ReservationBuffers{EndInMinutes: &anHourLate, StartInMinutes: &sixHoursEarly}
+	b = EffectiveReservationBuffers(property, nil)
+	if b.Start() != -6*time.Hour || b.End() != 1*time.Hour {
+		t.Fatalf("expected the property's but was %s and %s", b.Start(), b.End())
+	}
+
+	// The unit only overrides the start.
+	b = EffectiveReservationBuffers(property, &ReservationBuffers{StartInMinutes: &oneHourEarly})
+	if b.Start() != -1*time.Hour || b.End() != 1*time.Hour {
+		t.Fatalf("unexpected: %s and %s", b.Start(), b.End())
+	}
+}
+
+func TestReservationBuffers_Validate(t *testing.T) {
+	late := 60
+	early := -60
+	if err := (&ReservationBuffers{StartInMinutes: &late}).Validate(); err == nil {
+		t.Fatal("expected an error for starting after check-in")
+	}
+	if err := (&ReservationBuffers{EndInMinutes: &early}).Validate(); err == nil {
+		t.Fatal("expected an error for ending before check-out")
+	}
+	if err := (&ReservationBuffers{EndInMinutes: &late, StartInMinutes: &early}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnit_OccupancyStatusForDay(t *testing.T) {
+	oneHourEarly := -60
+	buffers := EffectiveReservationBuffers(nil, &ReservationBuffers{StartInMinutes: &oneHourEarly})
+
+	u := Unit{ID: uuid.New()}
+	date := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	checkIn := date.Add(15 * time.Hour)
+	checkOut := date.AddDate(0, 0, 2).Add(11 * time.Hour)
+	d := Device{
+		ManagedLockCodes: []*DeviceManagedLockCode{{
+			EndAt:       checkOut.Add(buffers.End()),
+			Reservation: DeviceManagedLockCodeReservation{ID: "reservation"},
+			StartAt:     checkIn.Add(buffers.Start()),
+		}},
+		UnitID: &u.ID,
+	}
+
+	// The code is enabled at 2pm, but the guest doesn't arrive until 3pm.
+	os := u.OccupancyStatusForDay([]Device{d}, date.Add(14*time.Hour+30*time.Minute), buffers)
+	if os.At.Occupied || os.Noon.Occupied || !os.FourPM.Occupied {
+		t.Fatalf("unexpected: %+v", os)
+	}
+}
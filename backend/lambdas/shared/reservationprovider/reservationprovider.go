@@ -0,0 +1,149 @@
+package reservationprovider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mlock/lambdas/shared"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Provider interface {
+	GetForUnits(ctx context.Context, units []shared.Unit) (map[uuid.UUID][]shared.Reservation, error)
+}
+
+// StatusProvider is for providers that can look up a single reservation, an iCal feed can't tell a canceled reservation from one that's over.
+type StatusProvider interface {
+	GetStatus(ctx context.Context, unit shared.Unit, reservationID string) (shared.ReservationStatus, bool, error)
+}
+
+// ChangeProvider is for providers that can tell us which units had reservations change, an iCal feed has to be fetched to find out.
+type ChangeProvider interface {
+	GetChangedUnits(ctx context.Context, units []shared.Unit, since time.Time) (map[uuid.UUID]bool, error)
+}
+
+// Repository sends each unit to the provider it uses (see `Unit.ReservationProvider`) and merges the results.
+type Repository struct {
+	providers map[string]Provider
+}
+
+func NewRepository(hostaway Provider, ical Provider) *Repository {
+	return &Repository{
+		providers: map[string]Provider{
+			shared.UnitReservationProviderHostaway: hostaway,
+			shared.UnitReservationProviderICal:     ical,
+		},
+	}
+}
+
+func (r *Repository) Get(ctx context.Context, unit shared.Unit) ([]shared.Reservation, error) {
+	reservations, err := r.GetForUnits(ctx, []shared.Unit{unit})
+	if err != nil {
+		return nil, fmt.Errorf("error getting reservations: %s", err.Error())
+	}
+
+	if rs, ok := reservations[unit.ID]; ok {
+		return rs, nil
+	}
+	return []shared.Reservation{}, nil
+}
+
+// GetForUnits passes on a `shared.UnitErrors` along with the reservations for the units that didn't fail.
+func (r *Repository) GetForUnits(ctx context.Context, units []shared.Unit) (map[uuid.UUID][]shared.Reservation, error) {
+	unitsByProvider, err := r.unitsByProvider(units)
+	if err != nil {
+		return nil, err
+	}
+
+	reservationsByUnit := map[uuid.UUID][]shared.Reservation{}
+	unitErrors := shared.UnitErrors{}
+	for _, provider := range []string{shared.UnitReservationProviderHostaway, shared.UnitReservationProviderICal} {
+		if len(unitsByProvider[provider]) == 0 {
+			continue
+		}
+
+		reservations, err := r.providers[provider].GetForUnits(ctx, unitsByProvider[provider])
+		if err != nil {
+			providerUnitErrors := shared.UnitErrors{}
+			if !errors.As(err, &providerUnitErrors) {
+				return nil, fmt.Errorf("error getting %s reservations: %s", provider, err.Error())
+			}
+			for id, err := range providerUnitErrors {
+				unitErrors[id] = err
+			}
+		}
+		for id, rs := range reservations {
+			reservationsByUnit[id] = rs
+		}
+	}
+
+	if len(unitErrors) > 0 {
+		return reservationsByUnit, unitErrors
+	}
+	return reservationsByUnit, nil
+}
+
+// GetChangedUnits returns the units whose reservations might have changed since `since`. Units with a provider that can't tell us are always included.
+func (r *Repository) GetChangedUnits(ctx context.Context, units []shared.Unit, since time.Time) (map[uuid.UUID]bool, error) {
+	unitsByProvider, err := r.unitsByProvider(units)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := map[uuid.UUID]bool{}
+	for _, provider := range []string{shared.UnitReservationProviderHostaway, shared.UnitReservationProviderICal} {
+		if len(unitsByProvider[provider]) == 0 {
+			continue
+		}
+
+		cp, ok := r.providers[provider].(ChangeProvider)
+		if !ok {
+			for _, u := range unitsByProvider[provider] {
+				changed[u.ID] = true
+			}
+			continue
+		}
+
+		providerChanged, err := cp.GetChangedUnits(ctx, unitsByProvider[provider], since)
+		if err != nil {
+			return nil, fmt.Errorf("error getting changed %s units: %s", provider, err.Error())
+		}
+		for id := range providerChanged {
+			changed[id] = true
+		}
+	}
+
+	return changed, nil
+}
+
+// GetStatus returns false if the reservation wasn't found, or the unit's provider can't look it up.
+func (r *Repository) GetStatus(ctx context.Context, unit shared.Unit, reservationID string) (shared.ReservationStatus, bool, error) {
+	provider, ok := r.providers[unit.GetReservationProvider()]
+	if !ok {
+		return shared.ReservationStatus{}, false, fmt.Errorf("unit %s has an unknown reservation provider: %s", unit.Name, unit.GetReservationProvider())
+	}
+
+	sp, ok := provider.(StatusProvider)
+	if !ok {
+		return shared.ReservationStatus{}, false, nil
+	}
+
+	return sp.GetStatus(ctx, unit, reservationID)
+}
+
+func (r *Repository) unitsByProvider(units []shared.Unit) (map[string][]shared.Unit, error) {
+	unitsByProvider := map[string][]shared.Unit{}
+	for _, u := range units {
+		provider := u.GetReservationProvider()
+		if _, ok := r.providers[provider]; !ok {
+			return nil, fmt.Errorf("unit %s has an unknown reservation provider: %s", u.Name, provider)
+		}
+		if provider == shared.UnitReservationProviderHostaway && u.RemotePropertyURL == "" {
+			continue // Not connected to anything yet.
+		}
+		unitsByProvider[provider] = append(unitsByProvider[provider], u)
+	}
+	return unitsByProvider, nil
+}
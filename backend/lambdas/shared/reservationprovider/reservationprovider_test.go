@@ -0,0 +1,112 @@
+package reservationprovider_test
+
+import (
+	"context"
+	"mlock/lambdas/shared"
+	"mlock/lambdas/shared/reservationprovider"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeProvider struct {
+	calledWith []shared.Unit
+	doorCode   string
+}
+
+func (p *fakeProvider) GetForUnits(ctx context.Context, units []shared.Unit) (map[uuid.UUID][]shared.Reservation, error) {
+	p.calledWith = units
+	reservations := map[uuid.UUID][]shared.Reservation{}
+	for _, u := range units {
+		reservations[u.ID] = []shared.Reservation{{ID: u.Name, DoorCode: p.doorCode}}
+	}
+	return reservations, nil
+}
+
+type fakeStatusProvider struct {
+	fakeProvider
+	status shared.ReservationStatus
+}
+
+func (p *fakeStatusProvider) GetStatus(ctx context.Context, unit shared.Unit, reservationID string) (shared.ReservationStatus, bool, error) {
+	return p.status, true, nil
+}
+
+type fakeChangeProvider struct {
+	fakeProvider
+	changed map[uuid.UUID]bool
+	since   time.Time
+}
+
+func (p *fakeChangeProvider) GetChangedUnits(ctx context.Context, units []shared.Unit, since time.Time) (map[uuid.UUID]bool, error) {
+	p.calledWith = units
+	p.since = since
+	return p.changed, nil
+}
+
+func Test_GetForUnits(t *testing.T) {
+	hostaway := &fakeProvider{doorCode: "1111"}
+	ical := &fakeProvider{doorCode: "2222"}
+
+	hostawayUnit := shared.Unit{ID: uuid.New(), Name: "hostaway", RemotePropertyURL: "https://dashboard.hostaway.com/listing/1"}
+	notConnectedUnit := shared.Unit{ID: uuid.New(), Name: "not connected"}
+	icalUnit := shared.Unit{ID: uuid.New(), Name: "ical", ReservationProvider: shared.UnitReservationProviderICal}
+
+	reservations, err := reservationprovider.NewRepository(hostaway, ical).GetForUnits(
+		context.Background(),
+		[]shared.Unit{hostawayUnit, notConnectedUnit, icalUnit},
+	)
+	assert.Nil(t, err)
+
+	assert.Equal(t, []shared.Unit{hostawayUnit}, hostaway.calledWith)
+	assert.Equal(t, []shared.Unit{icalUnit}, ical.calledWith)
+	assert.Equal(t, 2, len(reservations))
+	assert.Equal(t, "1111", reservations[hostawayUnit.ID][0].DoorCode)
+	assert.Equal(t, "2222", reservations[icalUnit.ID][0].DoorCode)
+}
+
+func Test_UnknownProvider(t *testing.T) {
+	unit := shared.Unit{ID: uuid.New(), ReservationProvider: "booking.com"}
+
+	_, err := reservationprovider.NewRepository(&fakeProvider{}, &fakeProvider{}).GetForUnits(context.Background(), []shared.Unit{unit})
+	assert.NotNil(t, err)
+}
+
+func Test_GetStatus(t *testing.T) {
+	hostaway := &fakeStatusProvider{status: shared.ReservationStatus{Canceled: true}}
+	r := reservationprovider.NewRepository(hostaway, &fakeProvider{})
+
+	status, ok, err := r.GetStatus(context.Background(), shared.Unit{ID: uuid.New()}, "reservation")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.True(t, status.Canceled)
+
+	// iCal can't look up a single reservation.
+	_, ok, err = r.GetStatus(context.Background(), shared.Unit{ID: uuid.New(), ReservationProvider: shared.UnitReservationProviderICal}, "reservation")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func Test_GetChangedUnits(t *testing.T) {
+	changedUnit := shared.Unit{ID: uuid.New(), Name: "changed", RemotePropertyURL: "https://dashboard.hostaway.com/listing/1"}
+	unchangedUnit := shared.Unit{ID: uuid.New(), Name: "unchanged", RemotePropertyURL: "https://dashboard.hostaway.com/listing/2"}
+	notConnectedUnit := shared.Unit{ID: uuid.New(), Name: "not connected"}
+	icalUnit := shared.Unit{ID: uuid.New(), Name: "ical", ReservationProvider: shared.UnitReservationProviderICal}
+
+	hostaway := &fakeChangeProvider{changed: map[uuid.UUID]bool{changedUnit.ID: true}}
+	since := time.Now().Add(-5 * time.Minute)
+
+	changed, err := reservationprovider.NewRepository(hostaway, &fakeProvider{}).GetChangedUnits(
+		context.Background(),
+		[]shared.Unit{changedUnit, unchangedUnit, notConnectedUnit, icalUnit},
+		since,
+	)
+	assert.Nil(t, err)
+
+	assert.Equal(t, []shared.Unit{changedUnit, unchangedUnit}, hostaway.calledWith)
+	assert.Equal(t, since, hostaway.since)
+	// We can't tell if an iCal feed changed without fetching it.
+	assert.Equal(t, map[uuid.UUID]bool{changedUnit.ID: true, icalUnit.ID: true}, changed)
+}
@@ -0,0 +1,216 @@
+package shared
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RRule is the subset of an iCalendar (RFC 5545) recurrence rule that we need for things like cleaners, e.g. "FREQ=WEEKLY;BYDAY=TU,FR".
+type RRule struct {
+	ByDay    []time.Weekday
+	Count    int // Zero if not set.
+	Freq     string
+	Interval int
+	Until    *time.Time
+	// UNTIL was a date without a time, so it includes the whole day.
+	UntilIsDate bool
+	// UNTIL didn't end in "Z", so it's a wall time in dtstart's time zone rather than an instant. Always true when `UntilIsDate` is.
+	UntilIsLocal bool
+}
+
+const (
+	RRuleFreqDaily  = "DAILY"
+	RRuleFreqWeekly = "WEEKLY"
+)
+
+var rruleWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+func ParseRRule(s string) (RRule, error) {
+	r := RRule{Interval: 1}
+
+	s = strings.TrimPrefix(strings.TrimSpace(s), "RRULE:")
+	if s == "" {
+		return RRule{}, fmt.Errorf("empty rule")
+	}
+
+	for _, part := range strings.Split(s, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return RRule{}, fmt.Errorf("unable to parse part: %s", part)
+		}
+		key, value := strings.ToUpper(kv[0]), strings.ToUpper(kv[1])
+
+		switch key {
+		case "FREQ":
+			if value != RRuleFreqDaily && value != RRuleFreqWeekly {
+				return RRule{}, fmt.Errorf("unsupported frequency: %s", value)
+			}
+			r.Freq = value
+		case "INTERVAL":
+			i, err := strconv.Atoi(value)
+			if err != nil || i < 1 {
+				return RRule{}, fmt.Errorf("invalid interval: %s", value)
+			}
+			r.Interval = i
+		case "COUNT":
+			c, err := strconv.Atoi(value)
+			if err != nil || c < 1 {
+				return RRule{}, fmt.Errorf("invalid count: %s", value)
+			}
+			r.Count = c
+		case "UNTIL":
+			until, layout, err := parseRRuleTime(value)
+			if err != nil {
+				return RRule{}, fmt.Errorf("invalid until: %s", err.Error())
+			}
+			r.Until = &until
+			r.UntilIsDate = layout == rruleDateLayout
+			r.UntilIsLocal = layout != rruleUTCLayout
+		case "BYDAY":
+			for _, d := range strings.Split(value, ",") {
+				wd, ok := rruleWeekdays[d]
+				if !ok {
+					return RRule{}, fmt.Errorf("unsupported day: %s", d)
+				}
+				r.ByDay = append(r.ByDay, wd)
+			}
+		case "WKST":
+			if value != "MO" {
+				return RRule{}, fmt.Errorf("unsupported week start: %s", value)
+			}
+		default:
+			return RRule{}, fmt.Errorf("unsupported part: %s", key)
+		}
+	}
+
+	if r.Freq == "" {
+		return RRule{}, fmt.Errorf("missing frequency")
+	}
+	if r.Count > 0 && r.Until != nil {
+		return RRule{}, fmt.Errorf("can't have both count and until")
+	}
+
+	return r, nil
+}
+
+const (
+	rruleDateLayout  = "20060102"
+	rruleLocalLayout = "20060102T150405"
+	rruleUTCLayout   = "20060102T150405Z"
+)
+
+// parseRRuleTime also returns which layout matched, since that says how to interpret the time.
+func parseRRuleTime(value string) (time.Time, string, error) {
+	for _, layout := range []string{rruleUTCLayout, rruleLocalLayout, rruleDateLayout} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, layout, nil
+		}
+	}
+	return time.Time{}, "", fmt.Errorf("unable to parse time: %s", value)
+}
+
+// until is the last moment an occurrence can start, in `loc`.
+func (r *RRule) until(loc *time.Location) *time.Time {
+	if r.Until == nil || !r.UntilIsLocal {
+		return r.Until
+	}
+
+	year, month, day := r.Until.Date()
+	if r.UntilIsDate {
+		until := time.Date(year, month, day+1, 0, 0, 0, 0, loc).Add(-1 * time.Nanosecond)
+		return &until
+	}
+
+	hour, min, sec := r.Until.Clock()
+	until := time.Date(year, month, day, hour, min, sec, 0, loc)
+	return &until
+}
+
+// Occurrences returns the start of each occurrence in [from, to). The time of day comes from dtstart in its location, so it stays the same across daylight saving changes. Like RFC 5545, dtstart is always the first occurrence (and counts towards COUNT) even if its day isn't in BYDAY.
+func (r *RRule) Occurrences(dtstart time.Time, from time.Time, to time.Time) []time.Time {
+	occurrences := []time.Time{}
+
+	loc := dtstart.Location()
+	year, month, day := dtstart.Date()
+	hour, min, sec := dtstart.Clock()
+	startDate := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	until := r.until(loc)
+
+	// Weeks start on Monday (WKST=MO).
+	startWeek := startDate.AddDate(0, 0, -1*((int(startDate.Weekday())+6)%7))
+
+	byDay := r.ByDay
+	if len(byDay) == 0 {
+		byDay = []time.Weekday{dtstart.Weekday()}
+	}
+
+	// Without COUNT there's nothing to count, so we can skip ahead to the day before `from` (in case it's a different day in `loc`).
+	date := startDate
+	if r.Count == 0 {
+		fromYear, fromMonth, fromDay := from.In(loc).Date()
+		if fromDate := time.Date(fromYear, fromMonth, fromDay-1, 0, 0, 0, 0, time.UTC); fromDate.After(startDate) {
+			date = fromDate
+		}
+	}
+
+	count := 0
+	for ; ; date = date.AddDate(0, 0, 1) {
+		occurrence := time.Date(date.Year(), date.Month(), date.Day(), hour, min, sec, 0, loc)
+		if !occurrence.Before(to) {
+			break
+		}
+		if until != nil && occurrence.After(*until) {
+			break
+		}
+		if r.Count > 0 && count >= r.Count {
+			break
+		}
+
+		if !date.Equal(startDate) && !r.matches(date, startDate, startWeek, byDay) {
+			continue
+		}
+
+		count++
+		if !occurrence.Before(from) {
+			occurrences = append(occurrences, occurrence)
+		}
+	}
+
+	return occurrences
+}
+
+func (r *RRule) matches(date time.Time, startDate time.Time, startWeek time.Time, byDay []time.Weekday) bool {
+	days := int(date.Sub(startDate).Hours() / 24)
+
+	switch r.Freq {
+	case RRuleFreqDaily:
+		if days%r.Interval != 0 {
+			return false
+		}
+		if len(r.ByDay) == 0 {
+			return true
+		}
+	case RRuleFreqWeekly:
+		weeks := int(date.Sub(startWeek).Hours()/24) / 7
+		if weeks%r.Interval != 0 {
+			return false
+		}
+	}
+
+	for _, wd := range byDay {
+		if date.Weekday() == wd {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+package shared
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRRule_Invalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"BYDAY=TU",
+		"FREQ=MONTHLY",
+		"FREQ=WEEKLY;BYDAY=1TU",
+		"FREQ=DAILY;INTERVAL=0",
+		"FREQ=DAILY;COUNT=2;UNTIL=20261231",
+		"FREQ=DAILY;BYHOUR=10",
+	} {
+		if _, err := ParseRRule(s); err == nil {
+			t.Fatalf("expected an error for %q", s)
+		}
+	}
+}
+
+func TestRRule_Occurrences_Weekly(t *testing.T) {
+	tz, _ := time.LoadLocation("America/Denver")
+	r, err := ParseRRule("RRULE:FREQ=WEEKLY;BYDAY=TU,FR")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Friday.
+	dtstart := time.Date(2026, 10, 2, 10, 0, 0, 0, tz)
+	occurrences := r.Occurrences(dtstart, dtstart, time.Date(2026, 10, 14, 0, 0, 0, 0, tz))
+
+	expected := []time.Time{
+		time.Date(2026, 10, 2, 10, 0, 0, 0, tz),
+		time.Date(2026, 10, 6, 10, 0, 0, 0, tz),
+		time.Date(2026, 10, 9, 10, 0, 0, 0, tz),
+		time.Date(2026, 10, 13, 10, 0, 0, 0, tz),
+	}
+	if len(occurrences) != len(expected) {
+		t.Fatalf("unexpected: %v", occurrences)
+	}
+	for i := range expected {
+		if !occurrences[i].Equal(expected[i]) {
+			t.Fatalf("expected %s but was %s", expected[i], occurrences[i])
+		}
+	}
+}
+
+func TestRRule_Occurrences_IntervalAndCount(t *testing.T) {
+	r, err := ParseRRule("FREQ=DAILY;INTERVAL=2;COUNT=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dtstart := time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)
+	occurrences := r.Occurrences(dtstart, dtstart.Add(24*time.Hour), dtstart.AddDate(0, 1, 0))
+
+	// The first occurrence counts, even though it's before `from`.
+	if len(occurrences) != 2 || occurrences[0].Day() != 3 || occurrences[1].Day() != 5 {
+		t.Fatalf("unexpected: %v", occurrences)
+	}
+}
+
+func TestRRule_Occurrences_Until(t *testing.T) {
+	r, err := ParseRRule("FREQ=WEEKLY;INTERVAL=2;UNTIL=20261101T000000Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dtstart := time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)
+	occurrences := r.Occurrences(dtstart, dtstart, dtstart.AddDate(1, 0, 0))
+
+	if len(occurrences) != 3 || occurrences[1].Day() != 15 || occurrences[2].Day() != 29 {
+		t.Fatalf("unexpected: %v", occurrences)
+	}
+}
+
+func TestRRule_Occurrences_UntilDate(t *testing.T) {
+	tz, _ := time.LoadLocation("America/Denver")
+	r, err := ParseRRule("FREQ=DAILY;UNTIL=20261003")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The 3rd at 20:00 in Denver is already the 4th in UTC, but it's still on the last day.
+	dtstart := time.Date(2026, 10, 1, 20, 0, 0, 0, tz)
+	occurrences := r.Occurrences(dtstart, dtstart, dtstart.AddDate(0, 1, 0))
+
+	if len(occurrences) != 3 || occurrences[2].Day() != 3 {
+		t.Fatalf("unexpected: %v", occurrences)
+	}
+}
+
+func TestRRule_Occurrences_UntilLocalTime(t *testing.T) {
+	tz, _ := time.LoadLocation("America/Denver")
+	r, err := ParseRRule("FREQ=DAILY;UNTIL=20261003T090000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dtstart := time.Date(2026, 10, 1, 9, 0, 0, 0, tz)
+	occurrences := r.Occurrences(dtstart, dtstart, dtstart.AddDate(0, 1, 0))
+
+	if len(occurrences) != 3 || occurrences[2].Day() != 3 {
+		t.Fatalf("unexpected: %v", occurrences)
+	}
+}
+
+func TestRRule_Occurrences_DaylightSaving(t *testing.T) {
+	tz, _ := time.LoadLocation("America/Denver")
+	r, err := ParseRRule("FREQ=DAILY")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Daylight saving ends on November 1st.
+	dtstart := time.Date(2026, 10, 31, 10, 0, 0, 0, tz)
+	occurrences := r.Occurrences(dtstart, dtstart, dtstart.AddDate(0, 0, 2))
+
+	if len(occurrences) != 2 {
+		t.Fatalf("unexpected: %v", occurrences)
+	}
+	for _, o := range occurrences {
+		if o.Hour() != 10 {
+			t.Fatalf("expected 10:00 local but was %s", o)
+		}
+	}
+}
+
+func TestDeviceRecurringLockCode_Windows(t *testing.T) {
+	tz, _ := time.LoadLocation("America/Denver")
+	rlc := DeviceRecurringLockCode{
+		Code:     "1234",
+		EndAt:    time.Date(2026, 10, 2, 15, 0, 0, 0, tz),
+		RRule:    "FREQ=WEEKLY;BYDAY=TU,FR",
+		StartAt:  time.Date(2026, 10, 2, 10, 0, 0, 0, tz),
+		TimeZone: "America/Denver",
+	}
+	if err := rlc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// In the middle of Tuesday's occurrence, which should still be included.
+	now := time.Date(2026, 10, 6, 12, 0, 0, 0, tz)
+	windows, err := rlc.Windows(now, now.Add(RecurringLockCodeLookAhead*2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(windows) != 2 {
+		t.Fatalf("unexpected: %+v", windows)
+	}
+	if !windows[0].StartAt.Equal(time.Date(2026, 10, 6, 10, 0, 0, 0, tz)) || !windows[0].EndAt.Equal(time.Date(2026, 10, 6, 15, 0, 0, 0, tz)) {
+		t.Fatalf("unexpected: %+v", windows[0])
+	}
+	if !windows[1].StartAt.Equal(time.Date(2026, 10, 9, 10, 0, 0, 0, tz)) {
+		t.Fatalf("unexpected: %+v", windows[1])
+	}
+}
+
+func TestDeviceRecurringLockCode_Validate(t *testing.T) {
+	start := time.Now()
+	rlc := DeviceRecurringLockCode{
+		Code:     "1234",
+		EndAt:    start.Add(1 * time.Hour),
+		RRule:    "FREQ=DAILY",
+		StartAt:  start,
+		TimeZone: "Not/AZone",
+	}
+	if err := rlc.Validate(); err == nil {
+		t.Fatal("expected an error for a bad time zone")
+	}
+
+	rlc.TimeZone = ""
+	if err := rlc.Validate(); err == nil {
+		t.Fatal("expected an error for a missing time zone")
+	}
+
+	rlc.TimeZone = "UTC"
+	rlc.EndAt = start.Add(-1 * time.Hour)
+	if err := rlc.Validate(); err == nil {
+		t.Fatal("expected an error for ending before starting")
+	}
+}
+
+func TestRRule_Occurrences_DTStartNotInByDay(t *testing.T) {
+	r, err := ParseRRule("FREQ=WEEKLY;BYDAY=TU,FR;COUNT=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Monday, it's the first occurrence and counts towards COUNT.
+	dtstart := time.Date(2026, 10, 5, 10, 0, 0, 0, time.UTC)
+	occurrences := r.Occurrences(dtstart, dtstart, dtstart.AddDate(0, 1, 0))
+
+	if len(occurrences) != 3 || occurrences[0].Day() != 5 || occurrences[1].Day() != 6 || occurrences[2].Day() != 9 {
+		t.Fatalf("unexpected: %v", occurrences)
+	}
+}
+
+func TestRRule_Occurrences_SkipsAheadToFrom(t *testing.T) {
+	r, err := ParseRRule("FREQ=WEEKLY;INTERVAL=2;BYDAY=TU")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tuesday, years before `from`. The interval still counts from dtstart's week.
+	dtstart := time.Date(2020, 1, 7, 10, 0, 0, 0, time.UTC)
+	from := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	occurrences := r.Occurrences(dtstart, from, from.AddDate(0, 1, 0))
+
+	if len(occurrences) != 2 || occurrences[0].Day() != 6 || occurrences[1].Day() != 20 {
+		t.Fatalf("unexpected: %v", occurrences)
+	}
+}
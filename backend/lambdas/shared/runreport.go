@@ -0,0 +1,162 @@
+package shared
+
+import (
+	"fmt"
+	"html"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RunReport collects what happened to each device during a run so that one bad device doesn't stop the rest from being processed. It's safe to use from multiple goroutines.
+type RunReport struct {
+	DevicesProcessed map[string]int   `json:"devicesProcessed"` // By stage.
+	Errors           []RunReportError `json:"errors"`
+	StartedAt        time.Time        `json:"startedAt"`
+	Warnings         []RunReportError `json:"warnings"` // Things someone should look at that didn't stop the device from being processed.
+
+	mu sync.Mutex
+}
+
+type RunReportError struct {
+	DeviceID   uuid.UUID `json:"deviceId"`
+	DeviceName string    `json:"deviceName"`
+	Error      string    `json:"error"`
+	Stage      string    `json:"stage"`
+}
+
+const (
+	RunReportStageGuestMessenger = "Guest Messenger"
+	RunReportStageLockEngine     = "Lock Engine"
+	RunReportStageScheduler      = "Scheduler"
+)
+
+// The order stages happen in during a run, for showing them in the report.
+var runReportStages = []string{RunReportStageScheduler, RunReportStageLockEngine, RunReportStageGuestMessenger}
+
+func NewRunReport(startedAt time.Time) *RunReport {
+	return &RunReport{
+		DevicesProcessed: map[string]int{},
+		Errors:           []RunReportError{},
+		StartedAt:        startedAt,
+		Warnings:         []RunReportError{},
+	}
+}
+
+func (r *RunReport) AddError(stage string, d Device, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Errors = append(r.Errors, RunReportError{
+		DeviceID:   d.ID,
+		DeviceName: d.RawDevice.Name,
+		Error:      err.Error(),
+		Stage:      stage,
+	})
+}
+
+func (r *RunReport) AddProcessed(stage string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.DevicesProcessed[stage]++
+}
+
+// AddWarning skips warnings that are already in the report, a device that's retried after a conflicting save gives the same ones again.
+func (r *RunReport) AddWarning(stage string, d Device, message string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	w := RunReportError{
+		DeviceID:   d.ID,
+		DeviceName: d.RawDevice.Name,
+		Error:      message,
+		Stage:      stage,
+	}
+	if slices.Contains(r.Warnings, w) {
+		return
+	}
+	r.Warnings = append(r.Warnings, w)
+}
+
+func (r *RunReport) HasErrors() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.Errors) > 0
+}
+
+func (r *RunReport) HasWarnings() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.Warnings) > 0
+}
+
+// Err is nil if nothing failed.
+func (r *RunReport) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.Errors) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%d device error(s), first: %s (%s): %s", len(r.Errors), r.Errors[0].DeviceName, r.Errors[0].Stage, r.Errors[0].Error)
+}
+
+func (r *RunReport) HTML(frontEndDomain string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var sb strings.Builder
+
+	sb.WriteString(fmt.Sprintf("<p>Run started at %s.</p>", r.StartedAt.Format(time.RFC1123)))
+
+	sb.WriteString("<h1>Devices Processed</h1>")
+	sb.WriteString("<ul>")
+	for _, stage := range r.stages() {
+		sb.WriteString(fmt.Sprintf("<li>%s: %d</li>", stage, r.DevicesProcessed[stage]))
+	}
+	sb.WriteString("</ul>")
+
+	writeEntries := func(title string, entries []RunReportError) {
+		if len(entries) == 0 {
+			return
+		}
+		sb.WriteString(fmt.Sprintf("<h1>%s</h1>", title))
+		sb.WriteString("<ul>")
+		for _, e := range entries {
+			link := fmt.Sprintf("%s/devices/%s", frontEndDomain, e.DeviceID)
+			sb.WriteString(fmt.Sprintf(
+				"<li>Device: <a href=\"%s\">%s</a>, Stage: %s, Message: %s</li>",
+				link,
+				html.EscapeString(e.DeviceName),
+				e.Stage,
+				html.EscapeString(e.Error),
+			))
+		}
+		sb.WriteString("</ul>")
+	}
+	writeEntries("Errors", r.Errors)
+	writeEntries("Warnings", r.Warnings)
+
+	return sb.String()
+}
+
+// stages are the known stages in run order, then any others that processed devices.
+func (r *RunReport) stages() []string {
+	stages := append([]string{}, runReportStages...)
+	others := []string{}
+	for stage := range r.DevicesProcessed {
+		if !slices.Contains(stages, stage) {
+			others = append(others, stage)
+		}
+	}
+	slices.Sort(others)
+
+	return append(stages, others...)
+}
@@ -0,0 +1,38 @@
+package shared
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestRunReport_HTMLShowsEveryStage(t *testing.T) {
+	r := NewRunReport(time.Now())
+	r.AddProcessed(RunReportStageGuestMessenger)
+	r.AddProcessed(RunReportStageGuestMessenger)
+	r.AddProcessed("Something New")
+
+	h := r.HTML("https://example.com")
+	for _, want := range []string{
+		"<li>Scheduler: 0</li><li>Lock Engine: 0</li><li>Guest Messenger: 2</li>",
+		"<li>Something New: 1</li>",
+	} {
+		if !strings.Contains(h, want) {
+			t.Fatalf("expected %q in %q", want, h)
+		}
+	}
+}
+
+func TestRunReport_AddWarningSkipsRepeats(t *testing.T) {
+	r := NewRunReport(time.Now())
+	d := Device{ID: uuid.New()}
+	r.AddWarning(RunReportStageScheduler, d, "Reservation overlaps another.")
+	r.AddWarning(RunReportStageScheduler, d, "Reservation overlaps another.")
+	r.AddWarning(RunReportStageLockEngine, d, "Reservation overlaps another.")
+
+	if len(r.Warnings) != 2 {
+		t.Fatalf("expected 2 warnings, got %d", len(r.Warnings))
+	}
+}
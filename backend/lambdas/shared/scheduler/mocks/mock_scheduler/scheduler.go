@@ -13,6 +13,7 @@ import (
 	context "context"
 	shared "mlock/lambdas/shared"
 	reflect "reflect"
+	time "time"
 
 	uuid "github.com/google/uuid"
 	gomock "go.uber.org/mock/gomock"
@@ -56,6 +57,22 @@ func (mr *MockDeviceRepositoryMockRecorder) AppendToAuditLog(ctx, device, manage
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AppendToAuditLog", reflect.TypeOf((*MockDeviceRepository)(nil).AppendToAuditLog), ctx, device, managedLockCodes)
 }
 
+// Get mocks base method.
+func (m *MockDeviceRepository) Get(ctx context.Context, id uuid.UUID) (shared.Device, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Get", ctx, id)
+	ret0, _ := ret[0].(shared.Device)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// Get indicates an expected call of Get.
+func (mr *MockDeviceRepositoryMockRecorder) Get(ctx, id any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockDeviceRepository)(nil).Get), ctx, id)
+}
+
 // List mocks base method.
 func (m *MockDeviceRepository) List(ctx context.Context) ([]shared.Device, error) {
 	m.ctrl.T.Helper()
@@ -71,19 +88,96 @@ func (mr *MockDeviceRepositoryMockRecorder) List(ctx any) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockDeviceRepository)(nil).List), ctx)
 }
 
-// Put mocks base method.
-func (m *MockDeviceRepository) Put(ctx context.Context, item shared.Device) (shared.Device, error) {
+// PutIfUnchanged mocks base method.
+func (m *MockDeviceRepository) PutIfUnchanged(ctx context.Context, item shared.Device) (shared.Device, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Put", ctx, item)
+	ret := m.ctrl.Call(m, "PutIfUnchanged", ctx, item)
 	ret0, _ := ret[0].(shared.Device)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// Put indicates an expected call of Put.
-func (mr *MockDeviceRepositoryMockRecorder) Put(ctx, item any) *gomock.Call {
+// PutIfUnchanged indicates an expected call of PutIfUnchanged.
+func (mr *MockDeviceRepositoryMockRecorder) PutIfUnchanged(ctx, item any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PutIfUnchanged", reflect.TypeOf((*MockDeviceRepository)(nil).PutIfUnchanged), ctx, item)
+}
+
+// MockEventSink is a mock of EventSink interface.
+type MockEventSink struct {
+	ctrl     *gomock.Controller
+	recorder *MockEventSinkMockRecorder
+	isgomock struct{}
+}
+
+// MockEventSinkMockRecorder is the mock recorder for MockEventSink.
+type MockEventSinkMockRecorder struct {
+	mock *MockEventSink
+}
+
+// NewMockEventSink creates a new mock instance.
+func NewMockEventSink(ctrl *gomock.Controller) *MockEventSink {
+	mock := &MockEventSink{ctrl: ctrl}
+	mock.recorder = &MockEventSinkMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockEventSink) EXPECT() *MockEventSinkMockRecorder {
+	return m.recorder
+}
+
+// Emit mocks base method.
+func (m *MockEventSink) Emit(ctx context.Context, e shared.Event) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Emit", ctx, e)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Emit indicates an expected call of Emit.
+func (mr *MockEventSinkMockRecorder) Emit(ctx, e any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Put", reflect.TypeOf((*MockDeviceRepository)(nil).Put), ctx, item)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Emit", reflect.TypeOf((*MockEventSink)(nil).Emit), ctx, e)
+}
+
+// MockPropertyRepository is a mock of PropertyRepository interface.
+type MockPropertyRepository struct {
+	ctrl     *gomock.Controller
+	recorder *MockPropertyRepositoryMockRecorder
+	isgomock struct{}
+}
+
+// MockPropertyRepositoryMockRecorder is the mock recorder for MockPropertyRepository.
+type MockPropertyRepositoryMockRecorder struct {
+	mock *MockPropertyRepository
+}
+
+// NewMockPropertyRepository creates a new mock instance.
+func NewMockPropertyRepository(ctrl *gomock.Controller) *MockPropertyRepository {
+	mock := &MockPropertyRepository{ctrl: ctrl}
+	mock.recorder = &MockPropertyRepositoryMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockPropertyRepository) EXPECT() *MockPropertyRepositoryMockRecorder {
+	return m.recorder
+}
+
+// List mocks base method.
+func (m *MockPropertyRepository) List(ctx context.Context) ([]shared.Property, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "List", ctx)
+	ret0, _ := ret[0].([]shared.Property)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// List indicates an expected call of List.
+func (mr *MockPropertyRepositoryMockRecorder) List(ctx any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockPropertyRepository)(nil).List), ctx)
 }
 
 // MockReservationRepository is a mock of ReservationRepository interface.
@@ -110,6 +204,21 @@ func (m *MockReservationRepository) EXPECT() *MockReservationRepositoryMockRecor
 	return m.recorder
 }
 
+// GetChangedUnits mocks base method.
+func (m *MockReservationRepository) GetChangedUnits(ctx context.Context, units []shared.Unit, since time.Time) (map[uuid.UUID]bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetChangedUnits", ctx, units, since)
+	ret0, _ := ret[0].(map[uuid.UUID]bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetChangedUnits indicates an expected call of GetChangedUnits.
+func (mr *MockReservationRepositoryMockRecorder) GetChangedUnits(ctx, units, since any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetChangedUnits", reflect.TypeOf((*MockReservationRepository)(nil).GetChangedUnits), ctx, units, since)
+}
+
 // GetForUnits mocks base method.
 func (m *MockReservationRepository) GetForUnits(ctx context.Context, units []shared.Unit) (map[uuid.UUID][]shared.Reservation, error) {
 	m.ctrl.T.Helper()
@@ -125,6 +234,77 @@ func (mr *MockReservationRepositoryMockRecorder) GetForUnits(ctx, units any) *go
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetForUnits", reflect.TypeOf((*MockReservationRepository)(nil).GetForUnits), ctx, units)
 }
 
+// GetStatus mocks base method.
+func (m *MockReservationRepository) GetStatus(ctx context.Context, unit shared.Unit, reservationID string) (shared.ReservationStatus, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetStatus", ctx, unit, reservationID)
+	ret0, _ := ret[0].(shared.ReservationStatus)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// GetStatus indicates an expected call of GetStatus.
+func (mr *MockReservationRepositoryMockRecorder) GetStatus(ctx, unit, reservationID any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetStatus", reflect.TypeOf((*MockReservationRepository)(nil).GetStatus), ctx, unit, reservationID)
+}
+
+// MockSyncCursorRepository is a mock of SyncCursorRepository interface.
+type MockSyncCursorRepository struct {
+	ctrl     *gomock.Controller
+	recorder *MockSyncCursorRepositoryMockRecorder
+	isgomock struct{}
+}
+
+// MockSyncCursorRepositoryMockRecorder is the mock recorder for MockSyncCursorRepository.
+type MockSyncCursorRepositoryMockRecorder struct {
+	mock *MockSyncCursorRepository
+}
+
+// NewMockSyncCursorRepository creates a new mock instance.
+func NewMockSyncCursorRepository(ctrl *gomock.Controller) *MockSyncCursorRepository {
+	mock := &MockSyncCursorRepository{ctrl: ctrl}
+	mock.recorder = &MockSyncCursorRepositoryMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockSyncCursorRepository) EXPECT() *MockSyncCursorRepositoryMockRecorder {
+	return m.recorder
+}
+
+// Get mocks base method.
+func (m *MockSyncCursorRepository) Get(ctx context.Context, id string) (shared.SyncCursor, bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Get", ctx, id)
+	ret0, _ := ret[0].(shared.SyncCursor)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// Get indicates an expected call of Get.
+func (mr *MockSyncCursorRepositoryMockRecorder) Get(ctx, id any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockSyncCursorRepository)(nil).Get), ctx, id)
+}
+
+// Put mocks base method.
+func (m *MockSyncCursorRepository) Put(ctx context.Context, item shared.SyncCursor) (shared.SyncCursor, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Put", ctx, item)
+	ret0, _ := ret[0].(shared.SyncCursor)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Put indicates an expected call of Put.
+func (mr *MockSyncCursorRepositoryMockRecorder) Put(ctx, item any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Put", reflect.TypeOf((*MockSyncCursorRepository)(nil).Put), ctx, item)
+}
+
 // MockUnitRepository is a mock of UnitRepository interface.
 type MockUnitRepository struct {
 	ctrl     *gomock.Controller
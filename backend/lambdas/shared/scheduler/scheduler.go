@@ -2,75 +2,440 @@ package scheduler
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"mlock/lambdas/shared"
+	"sort"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 type Scheduler struct {
-	dr  DeviceRepository
-	now time.Time
-	rr  ReservationRepository
-	ur  UnitRepository
+	deviceIDs map[uuid.UUID]bool // Nil (along with `unitIDs`) means every device.
+	dr        DeviceRepository
+	ev        EventSink
+	now       time.Time
+	pr        PropertyRepository
+	rr        ReservationRepository
+	sr        SyncCursorRepository // Nil means we always fetch every unit's reservations.
+	unitIDs   map[uuid.UUID]bool   // Nil (along with `deviceIDs`) means every unit.
+	ur        UnitRepository
 }
 
+// We still fetch every unit's reservations this often, in case we missed a change (or something other than a reservation changed, like a unit's buffers).
+const fullSyncInterval = 1 * time.Hour
+
 type DeviceRepository interface {
 	AppendToAuditLog(ctx context.Context, device shared.Device, managedLockCodes []*shared.DeviceManagedLockCode) error
+	Get(ctx context.Context, id uuid.UUID) (shared.Device, bool, error)
 	List(ctx context.Context) ([]shared.Device, error)
-	Put(ctx context.Context, item shared.Device) (shared.Device, error)
+	PutIfUnchanged(ctx context.Context, item shared.Device) (shared.Device, error)
+}
+
+type EventSink interface {
+	Emit(ctx context.Context, e shared.Event) error
+}
+
+type PropertyRepository interface {
+	List(ctx context.Context) ([]shared.Property, error)
 }
 
 type ReservationRepository interface {
+	GetChangedUnits(ctx context.Context, units []shared.Unit, since time.Time) (map[uuid.UUID]bool, error)
 	GetForUnits(ctx context.Context, units []shared.Unit) (map[uuid.UUID][]shared.Reservation, error)
+	GetStatus(ctx context.Context, unit shared.Unit, reservationID string) (shared.ReservationStatus, bool, error)
+}
+
+type SyncCursorRepository interface {
+	Get(ctx context.Context, id string) (shared.SyncCursor, bool, error)
+	Put(ctx context.Context, item shared.SyncCursor) (shared.SyncCursor, error)
 }
 
 type UnitRepository interface {
 	List(ctx context.Context) ([]shared.Unit, error)
 }
 
-func NewScheduler(dr DeviceRepository, now time.Time, rr ReservationRepository, ur UnitRepository) *Scheduler {
+func NewScheduler(dr DeviceRepository, ev EventSink, now time.Time, pr PropertyRepository, rr ReservationRepository, ur UnitRepository) *Scheduler {
 	return &Scheduler{
 		dr:  dr,
+		ev:  ev,
 		now: now,
+		pr:  pr,
 		rr:  rr,
 		ur:  ur,
 	}
 }
 
-func (s *Scheduler) ReconcileReservationsAndLockCodes(ctx context.Context) error {
+// WithUnits limits the run to the units' reservations and devices, e.g. when a webhook tells us one of them changed.
+func (s *Scheduler) WithUnits(unitIDs []uuid.UUID) *Scheduler {
+	s.unitIDs = map[uuid.UUID]bool{}
+	for _, id := range unitIDs {
+		s.unitIDs[id] = true
+	}
+	return s
+}
+
+// WithDevices limits the run to the devices (and their units' reservations), e.g. when someone edits one of its lock codes. It can be combined with `WithUnits`.
+func (s *Scheduler) WithDevices(deviceIDs []uuid.UUID) *Scheduler {
+	s.deviceIDs = map[uuid.UUID]bool{}
+	for _, id := range deviceIDs {
+		s.deviceIDs[id] = true
+	}
+	return s
+}
+
+// WithIncrementalSync only fetches reservations for the units that had one change since the last successful run, with a full sync every `fullSyncInterval`. It's ignored when the run is limited to some units or devices.
+func (s *Scheduler) WithIncrementalSync(sr SyncCursorRepository) *Scheduler {
+	s.sr = sr
+	return s
+}
+
+// ReconcileReservationsAndLockCodes only returns an error if it can't get started, problems with individual devices are added to the report.
+func (s *Scheduler) ReconcileReservationsAndLockCodes(ctx context.Context, report *shared.RunReport) error {
+	targeted := s.unitIDs != nil || s.deviceIDs != nil
+
+	devices, err := s.dr.List(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting devices: %s", err.Error())
+	}
+	if targeted {
+		devices = s.filterDevices(devices)
+	}
+
 	units, err := s.ur.List(ctx)
 	if err != nil {
 		return fmt.Errorf("error getting units: %s", err.Error())
 	}
+	if targeted {
+		units = filterUnits(units, devices)
+	}
+
+	var cursor shared.SyncCursor
+	incremental := false
+	if s.sr != nil && !targeted {
+		cursor, incremental = s.getSyncCursor(ctx)
+	}
+
+	// Units that we know haven't changed keep their reservation lock codes as they are.
+	syncUnits := units
+	unchanged := map[uuid.UUID]bool{}
+	if incremental {
+		changed, err := s.rr.GetChangedUnits(ctx, units, cursor.SyncedAt)
+		if err != nil {
+			return fmt.Errorf("error getting changed units: %s", err.Error())
+		}
+		syncUnits = []shared.Unit{}
+		for _, u := range units {
+			if changed[u.ID] {
+				syncUnits = append(syncUnits, u)
+			} else {
+				unchanged[u.ID] = true
+			}
+		}
+	}
 
 	// Could be more selective and only use the units that have a device associated with them, but hopefully that's a minor optimization that doesn't matter.
-	reservationsByUnit, err := s.rr.GetForUnits(ctx, units)
-	if err != nil {
+	reservationsByUnit, err := s.rr.GetForUnits(ctx, syncUnits)
+	unitErrors := shared.UnitErrors{}
+	if err != nil && !errors.As(err, &unitErrors) {
 		return fmt.Errorf("error getting reservations: %s", err.Error())
 	}
+	// We don't know what the units that failed have, so their reservation lock codes are left alone too.
+	for unitID := range unitErrors {
+		unchanged[unitID] = true
+	}
 
-	devices, err := s.dr.List(ctx)
+	properties, err := s.pr.List(ctx)
 	if err != nil {
-		return fmt.Errorf("error getting devices: %s", err.Error())
+		return fmt.Errorf("error getting properties: %s", err.Error())
+	}
+	propertiesByID := map[uuid.UUID]shared.Property{}
+	for _, p := range properties {
+		propertiesByID[p.ID] = p
+	}
+	buffersByUnit := map[uuid.UUID]shared.ReservationBuffers{}
+	unitsByID := map[uuid.UUID]shared.Unit{}
+	for _, u := range units {
+		unitsByID[u.ID] = u
+
+		var p *shared.Property
+		if property, ok := propertiesByID[u.PropertyID]; ok {
+			p = &property
+		}
+		buffersByUnit[u.ID] = u.GetReservationBuffers(p)
 	}
 
+	failed := false
 	for _, d := range devices {
-		if err := s.processDevice(ctx, d, reservationsByUnit); err != nil {
-			return fmt.Errorf("error processing device: %s", err.Error())
+		if d.UnitID != nil && unitErrors[*d.UnitID] != nil {
+			report.AddError(shared.RunReportStageScheduler, d, unitErrors[*d.UnitID])
+			failed = true
+		}
+		if err := s.processDevice(ctx, d, unitsByID, unchanged, reservationsByUnit, buffersByUnit, report); err != nil {
+			report.AddError(shared.RunReportStageScheduler, d, err)
+			failed = true
+			continue
+		}
+		report.AddProcessed(shared.RunReportStageScheduler)
+	}
+
+	// A device that failed might not fail next time, but its reservations won't look like they changed.
+	if s.sr != nil && !targeted && !failed {
+		cursor.ID = shared.SyncCursorIDReservations
+		cursor.SyncedAt = s.now
+		if !incremental {
+			cursor.FullSyncedAt = s.now
+		}
+		if _, err := s.sr.Put(ctx, cursor); err != nil {
+			log.Printf("error saving sync cursor, the next run will fetch more than it needs to: %s\n", err.Error())
 		}
 	}
 
 	return nil
 }
 
-func (s *Scheduler) processDevice(ctx context.Context, device shared.Device, reservationsByUnit map[uuid.UUID][]shared.Reservation) error {
-	if device.UnitID == nil {
+// getSyncCursor returns false if this run needs to fetch every unit's reservations.
+func (s *Scheduler) getSyncCursor(ctx context.Context) (shared.SyncCursor, bool) {
+	cursor, ok, err := s.sr.Get(ctx, shared.SyncCursorIDReservations)
+	if err != nil {
+		// Fetching everything is slower, but it's always right.
+		log.Printf("error getting sync cursor, fetching every unit's reservations: %s\n", err.Error())
+		return shared.SyncCursor{}, false
+	}
+	if !ok {
+		return shared.SyncCursor{}, false
+	}
+	return cursor, s.now.Sub(cursor.FullSyncedAt) < fullSyncInterval
+}
+
+func (s *Scheduler) filterDevices(devices []shared.Device) []shared.Device {
+	filtered := []shared.Device{}
+	for _, d := range devices {
+		if s.deviceIDs[d.ID] || (d.UnitID != nil && s.unitIDs[*d.UnitID]) {
+			filtered = append(filtered, d)
+		}
+	}
+	return filtered
+}
+
+// filterUnits keeps the units that the devices belong to, those are the only reservations we need.
+func filterUnits(units []shared.Unit, devices []shared.Device) []shared.Unit {
+	unitIDs := map[uuid.UUID]bool{}
+	for _, d := range devices {
+		if d.UnitID != nil {
+			unitIDs[*d.UnitID] = true
+		}
+	}
+
+	filtered := []shared.Unit{}
+	for _, u := range units {
+		if unitIDs[u.ID] {
+			filtered = append(filtered, u)
+		}
+	}
+	return filtered
+}
+
+func (s *Scheduler) processDevice(
+	ctx context.Context,
+	device shared.Device,
+	unitsByID map[uuid.UUID]shared.Unit,
+	unchanged map[uuid.UUID]bool,
+	reservationsByUnit map[uuid.UUID][]shared.Reservation,
+	buffersByUnit map[uuid.UUID]shared.ReservationBuffers,
+	report *shared.RunReport,
+) error {
+	reconcile := func(device *shared.Device) ([]*shared.DeviceManagedLockCode, error) {
+		return s.reconcileDevice(ctx, device, unitsByID, unchanged, reservationsByUnit, buffersByUnit, report)
+	}
+
+	needToSave, err := reconcile(&device)
+	if err != nil {
+		return err
+	}
+	if len(needToSave) == 0 {
 		return nil
 	}
 
+	// Someone else (e.g. the listener) saved the device since we read it, so we reconcile their version instead.
+	if _, err := shared.SaveDevice(ctx, s.dr, device, func(fresh *shared.Device) (bool, error) {
+		changes, err := reconcile(fresh)
+		device, needToSave = *fresh, changes
+		return len(changes) > 0, err
+	}); err != nil {
+		return fmt.Errorf("error updating device: %s", err.Error())
+	}
+	if len(needToSave) == 0 {
+		return nil
+	}
+
+	if err := s.dr.AppendToAuditLog(ctx, device, needToSave); err != nil {
+		return fmt.Errorf("error appending to audit log: %s", err.Error())
+	}
+
+	for _, mlc := range needToSave {
+		if mlc.Status != shared.DeviceManagedLockCodeStatus1Scheduled || mlc.StartAt.Equal(mlc.EndAt) {
+			continue // Only the new (or rescheduled) codes, not the ones we just canceled.
+		}
+		if err := s.ev.Emit(ctx, shared.NewCodeEvent(shared.EventTypeCodeScheduled, s.now, device, mlc)); err != nil {
+			log.Printf("error emitting event for %s: %s\n", device.RawDevice.Name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// reconcileDevice changes the device's managed lock codes to match its recurring codes and its unit's reservations, and returns the ones it changed.
+func (s *Scheduler) reconcileDevice(
+	ctx context.Context,
+	device *shared.Device,
+	unitsByID map[uuid.UUID]shared.Unit,
+	unchanged map[uuid.UUID]bool,
+	reservationsByUnit map[uuid.UUID][]shared.Reservation,
+	buffersByUnit map[uuid.UUID]shared.ReservationBuffers,
+	report *shared.RunReport,
+) ([]*shared.DeviceManagedLockCode, error) {
+	needToSave, err := s.reconcileRecurringLockCodes(device)
+	if err != nil {
+		return nil, fmt.Errorf("error reconciling recurring lock codes: %s", err.Error())
+	}
+
+	if device.UnitID != nil && !unchanged[*device.UnitID] {
+		// A unit we don't know about still gets the default buffers.
+		unit, ok := unitsByID[*device.UnitID]
+		if !ok {
+			unit = shared.Unit{ID: *device.UnitID}
+		}
+		buffers, ok := buffersByUnit[*device.UnitID]
+		if !ok {
+			buffers = shared.EffectiveReservationBuffers(nil, nil)
+		}
+
+		reservationChanges, err := s.reconcileReservations(ctx, device, unit, reservationsByUnit[*device.UnitID], buffers, report)
+		if err != nil {
+			return nil, err
+		}
+		needToSave = append(needToSave, reservationChanges...)
+	}
+
+	return needToSave, nil
+}
+
+// reconcileRecurringLockCodes creates managed lock codes for the upcoming occurrences of each recurring code, and ends the ones that no longer match (e.g. the schedule was edited or the recurring code was deleted).
+func (s *Scheduler) reconcileRecurringLockCodes(device *shared.Device) ([]*shared.DeviceManagedLockCode, error) {
+	type occurrenceKey struct {
+		id      uuid.UUID
+		startAt int64
+	}
+
+	existing := map[occurrenceKey]*shared.DeviceManagedLockCode{}
+	for _, mlc := range device.ManagedLockCodes {
+		if mlc.RecurringLockCodeID == nil {
+			continue
+		}
+		key := occurrenceKey{id: *mlc.RecurringLockCodeID, startAt: mlc.StartAt.Unix()}
+		// An occurrence that's replaced because its code changed is ended early, the replacement is the one to keep in line with the schedule.
+		if other, ok := existing[key]; ok && other.EndAt.After(mlc.EndAt) {
+			continue
+		}
+		existing[key] = mlc
+	}
+
+	needToSave := []*shared.DeviceManagedLockCode{}
+	expected := map[occurrenceKey]bool{}
+
+	for _, rlc := range device.RecurringLockCodes {
+		windows, err := rlc.Windows(s.now, s.now.Add(shared.RecurringLockCodeLookAhead))
+		if err != nil {
+			return nil, fmt.Errorf("error expanding recurring lock code %s: %s", rlc.ID, err.Error())
+		}
+
+		for _, w := range windows {
+			key := occurrenceKey{id: rlc.ID, startAt: w.StartAt.Unix()}
+			expected[key] = true
+
+			rlcID := rlc.ID
+			schedule := func(note string) {
+				newMLC := &shared.DeviceManagedLockCode{
+					Code:                rlc.Code,
+					EndAt:               w.EndAt,
+					ID:                  uuid.New(),
+					Note:                note,
+					RecurringLockCodeID: &rlcID,
+					Status:              shared.DeviceManagedLockCodeStatus1Scheduled,
+					StartAt:             w.StartAt,
+				}
+
+				device.ManagedLockCodes = append(device.ManagedLockCodes, newMLC)
+				needToSave = append(needToSave, newMLC)
+			}
+
+			mlc, ok := existing[key]
+			if !ok {
+				schedule(fmt.Sprintf("Automatically created for recurring code (%s)", rlc.RRule))
+			} else if !mlc.IsDone() {
+				if mlc.Code != rlc.Code && mlc.Status != shared.DeviceManagedLockCodeStatus1Scheduled {
+					// The old code may already be on the lock, so it needs to be removed rather than swapped out from under the lock engine.
+					mlc.Note = "The recurring code's code changed; moving the end time to now so it's removed"
+					mlc.EndAt = s.now
+					needToSave = append(needToSave, mlc)
+					schedule(fmt.Sprintf("Replaces %s, the recurring code's code changed (%s)", mlc.ID, rlc.RRule))
+					continue
+				}
+
+				changedFields := []string{}
+				if mlc.Code != rlc.Code {
+					changedFields = append(changedFields, "code")
+					mlc.Code = rlc.Code
+				}
+				if !mlc.EndAt.Equal(w.EndAt) {
+					changedFields = append(changedFields, "end")
+					mlc.EndAt = w.EndAt
+				}
+
+				if len(changedFields) > 0 {
+					mlc.Note = fmt.Sprintf("Updating to match recurring code (fields: %v)", changedFields)
+					needToSave = append(needToSave, mlc)
+				}
+			}
+		}
+	}
+
+	for key, mlc := range existing {
+		if expected[key] || mlc.IsDone() || mlc.HasEnded(s.now) {
+			continue
+		}
+
+		if mlc.Status == shared.DeviceManagedLockCodeStatus1Scheduled {
+			mlc.Note = "No longer part of the recurring code's schedule; moving the start and end times to now"
+			mlc.StartAt = s.now
+			mlc.EndAt = s.now
+			needToSave = append(needToSave, mlc)
+		} else if mlc.Status == shared.DeviceManagedLockCodeStatus2Adding || mlc.Status == shared.DeviceManagedLockCodeStatus3Enabled {
+			mlc.Note = "No longer part of the recurring code's schedule; moving the end time to now"
+			mlc.EndAt = s.now
+			needToSave = append(needToSave, mlc)
+		}
+	}
+
+	// Map iteration order is random, keep the audit log stable.
+	sort.Slice(needToSave, func(a, b int) bool {
+		return needToSave[a].StartAt.Before(needToSave[b].StartAt)
+	})
+
+	return needToSave, nil
+}
+
+func (s *Scheduler) reconcileReservations(
+	ctx context.Context,
+	device *shared.Device,
+	unit shared.Unit,
+	reservations []shared.Reservation,
+	buffers shared.ReservationBuffers,
+	report *shared.RunReport,
+) ([]*shared.DeviceManagedLockCode, error) {
 	mlcByReservation := map[string]*shared.DeviceManagedLockCode{}
 	for _, mlc := range device.ManagedLockCodes {
 		if mlc.Reservation.ID != "" {
@@ -78,15 +443,15 @@ func (s *Scheduler) processDevice(ctx context.Context, device shared.Device, res
 		}
 	}
 
-	relevantReservations, err := s.getRelevantReservations(reservationsByUnit[*device.UnitID])
+	relevantReservations, err := s.getRelevantReservations(reservations)
 	if err != nil {
-		return fmt.Errorf("error getting relevant reservations: %s", err.Error())
+		return nil, fmt.Errorf("error getting relevant reservations: %s", err.Error())
 	}
 
 	// We want the lock codes to start and end with a buffer.
 	for id, r := range relevantReservations {
-		r.Start = r.Start.Add(shared.ReservationStartBufferInMinutes * time.Minute)
-		r.End = r.End.Add(shared.ReservationEndBufferInMinutes * time.Minute)
+		r.Start = r.Start.Add(buffers.Start())
+		r.End = r.End.Add(buffers.End())
 		relevantReservations[id] = r
 	}
 
@@ -94,7 +459,7 @@ func (s *Scheduler) processDevice(ctx context.Context, device shared.Device, res
 
 	for _, reservation := range relevantReservations {
 		if reservation.DoorCode == "" {
-			return fmt.Errorf("reservation %s has no door code", reservation.ID)
+			return nil, fmt.Errorf("reservation %s has no door code", reservation.ID)
 		}
 		mlc, ok := mlcByReservation[reservation.ID]
 		if !ok {
@@ -139,9 +504,30 @@ func (s *Scheduler) processDevice(ctx context.Context, device shared.Device, res
 		}
 	}
 
+	// We don't control the door codes, so the best we can do is let someone know that two guests will share a code.
+	for _, mlc := range needToSave {
+		for _, c := range device.FindLockCodeConflicts(mlc) {
+			msg := fmt.Sprintf(
+				"Code %s for reservation %s overlaps with the same code for %s (%s - %s).",
+				mlc.Code,
+				mlc.Reservation.ID,
+				describeOwner(c),
+				c.StartAt.Format(time.RFC1123),
+				c.EndAt.Format(time.RFC1123),
+			)
+			mlc.Note = fmt.Sprintf("%s; %s", mlc.Note, msg)
+			report.AddWarning(shared.RunReportStageScheduler, *device, msg)
+		}
+	}
+
 	for _, mlc := range device.ManagedLockCodes {
 		if mlc.Reservation.ID != "" && mlc.Reservation.Sync {
 			if _, ok := relevantReservations[mlc.Reservation.ID]; !ok {
+				if !mlc.EndAt.After(s.now) {
+					// Already over (or we already canceled it), moving it again would only add noise to the audit log.
+					continue
+				}
+
 				if mlc.Status == shared.DeviceManagedLockCodeStatus1Scheduled {
 					log.Printf("DEBUG: canceling reservation %s from device %s", mlc.Reservation.ID, device.RawDevice.Name)
 					mlc.Note = "Reservation disappeared, assuming it was canceled; moving the start and end times to now"
@@ -154,28 +540,71 @@ func (s *Scheduler) processDevice(ctx context.Context, device shared.Device, res
 					mlc.EndAt = s.now
 					needToSave = append(needToSave, mlc)
 				} else if mlc.Status == shared.DeviceManagedLockCodeStatus3Enabled {
-					// The reservation drops off the calendar at midnight (or there about) the day before it ends.
-				} else if mlc.Status == shared.DeviceManagedLockCodeStatus4Removing || mlc.Status == shared.DeviceManagedLockCodeStatus5Complete {
+					// The reservation drops off the calendar at midnight (or there about) the day before it ends, so we have to ask whether the guest actually canceled or left early.
+					changed, err := s.endEnabledLockCodeEarly(ctx, unit, mlc, buffers)
+					if err != nil {
+						report.AddWarning(shared.RunReportStageScheduler, *device, fmt.Sprintf("Unable to check on reservation %s: %s", mlc.Reservation.ID, err.Error()))
+					} else if changed {
+						needToSave = append(needToSave, mlc)
+					}
+				} else if mlc.Status == shared.DeviceManagedLockCodeStatus4Removing || mlc.Status == shared.DeviceManagedLockCodeStatus5Complete || mlc.Status == shared.DeviceManagedLockCodeStatus6Failed {
 					// Do nothing.
 				} else {
-					return fmt.Errorf("unhandled status %s", mlc.Status)
+					return nil, fmt.Errorf("unhandled status %s", mlc.Status)
 				}
 			}
 		}
 	}
 
-	if len(needToSave) > 0 {
-		if err := s.dr.AppendToAuditLog(ctx, device, needToSave); err != nil {
-			return fmt.Errorf("error appending to audit log: %s", err.Error())
-		}
+	return needToSave, nil
+}
 
-		_, err = s.dr.Put(ctx, device)
-		if err != nil {
-			return fmt.Errorf("error updating device: %s", err.Error())
-		}
+// endEnabledLockCodeEarly ends the code of a guest who's already arrived if their reservation was canceled or cut short. It returns true if it changed the code.
+func (s *Scheduler) endEnabledLockCodeEarly(ctx context.Context, unit shared.Unit, mlc *shared.DeviceManagedLockCode, buffers shared.ReservationBuffers) (bool, error) {
+	status, ok, err := s.rr.GetStatus(ctx, unit, mlc.Reservation.ID)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, nil // Either it's gone or the provider can't tell us, leave the code until it ends.
 	}
 
-	return nil
+	if status.Canceled {
+		log.Printf("DEBUG: ending the code for canceled reservation %s early", mlc.Reservation.ID)
+		mlc.Note = "Reservation was canceled after the code was enabled; moving the end time to now"
+		mlc.EndAt = s.now
+		return true, nil
+	}
+
+	endAt := status.End.Add(buffers.End())
+	if !endAt.Before(mlc.EndAt) {
+		return false, nil
+	}
+	if endAt.Before(s.now) {
+		endAt = s.now
+	}
+
+	log.Printf("DEBUG: ending the code for shortened reservation %s early", mlc.Reservation.ID)
+	mlc.Note = fmt.Sprintf(
+		"Reservation was shortened to check out at %s; moving the end time to %s",
+		status.End.Format(time.RFC1123),
+		endAt.Format(time.RFC1123),
+	)
+	mlc.EndAt = endAt
+	return true, nil
+}
+
+func describeOwner(mlc *shared.DeviceManagedLockCode) string {
+	if mlc.RecurringLockCodeID != nil {
+		return "a recurring code"
+	}
+	if mlc.UnitLockCodeID != nil {
+		return "a code for the whole unit"
+	}
+	if mlc.Reservation.ID == "" {
+		return "a code added by hand"
+	}
+	return fmt.Sprintf("reservation %s", mlc.Reservation.ID)
 }
 
 func (s *Scheduler) getRelevantReservations(reservations []shared.Reservation) (map[string]shared.Reservation, error) {
@@ -4,6 +4,7 @@ package scheduler_test
 
 import (
 	"context"
+	"fmt"
 	"mlock/lambdas/shared"
 	"mlock/lambdas/shared/scheduler"
 	"mlock/lambdas/shared/scheduler/mocks/mock_scheduler"
@@ -94,7 +95,7 @@ func Test_addMLC(t *testing.T) {
 		assert.Equal(t, shared.DeviceManagedLockCodeStatus1Scheduled, mlc.Status)
 	}).Return(nil)
 
-	dr.EXPECT().Put(
+	dr.EXPECT().PutIfUnchanged(
 		ctx,
 		gomock.Any(),
 	).Do(func(ctx context.Context, d shared.Device) {
@@ -102,8 +103,10 @@ func Test_addMLC(t *testing.T) {
 		assert.Equal(t, 2, len(d.ManagedLockCodes))
 	})
 
-	err := s.ReconcileReservationsAndLockCodes(ctx)
+	report := shared.NewRunReport(time.Now())
+	err := s.ReconcileReservationsAndLockCodes(ctx, report)
 	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
 }
 
 func Test_noEditMLC(t *testing.T) {
@@ -157,8 +160,10 @@ func Test_noEditMLC(t *testing.T) {
 
 	// No dr.AppendToAuditLog or dr.Put because there are no modifications.
 
-	err := s.ReconcileReservationsAndLockCodes(ctx)
+	report := shared.NewRunReport(time.Now())
+	err := s.ReconcileReservationsAndLockCodes(ctx, report)
 	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
 }
 
 func Test_noSyncMLC(t *testing.T) {
@@ -212,8 +217,10 @@ func Test_noSyncMLC(t *testing.T) {
 
 	// No dr.AppendToAuditLog or dr.Put because there are no modifications.
 
-	err := s.ReconcileReservationsAndLockCodes(ctx)
+	report := shared.NewRunReport(time.Now())
+	err := s.ReconcileReservationsAndLockCodes(ctx, report)
 	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
 }
 
 func Test_editMLC(t *testing.T) {
@@ -283,7 +290,7 @@ func Test_editMLC(t *testing.T) {
 		assert.Equal(t, reservation.End.Add(30*time.Minute), mlc.EndAt)
 	}).Return(nil)
 
-	dr.EXPECT().Put(
+	dr.EXPECT().PutIfUnchanged(
 		ctx,
 		gomock.Any(),
 	).Do(func(ctx context.Context, d shared.Device) {
@@ -291,8 +298,10 @@ func Test_editMLC(t *testing.T) {
 		assert.Equal(t, 1, len(d.ManagedLockCodes))
 	})
 
-	err := s.ReconcileReservationsAndLockCodes(ctx)
+	report := shared.NewRunReport(time.Now())
+	err := s.ReconcileReservationsAndLockCodes(ctx, report)
 	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
 }
 
 func Test_recentlyEndedReservation(t *testing.T) {
@@ -336,8 +345,10 @@ func Test_recentlyEndedReservation(t *testing.T) {
 
 	// No dr.AppendToAuditLog or dr.Put because there are no modifications.
 
-	err := s.ReconcileReservationsAndLockCodes(ctx)
+	report := shared.NewRunReport(time.Now())
+	err := s.ReconcileReservationsAndLockCodes(ctx, report)
 	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
 }
 
 func Test_recentlyEndedMLC(t *testing.T) {
@@ -383,8 +394,158 @@ func Test_recentlyEndedMLC(t *testing.T) {
 
 	// No dr.AppendToAuditLog or dr.Put because there are no modifications.
 
-	err := s.ReconcileReservationsAndLockCodes(ctx)
+	report := shared.NewRunReport(time.Now())
+	err := s.ReconcileReservationsAndLockCodes(ctx, report)
 	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+}
+
+func Test_canceledEnabledMLC(t *testing.T) {
+	// End an enabled MLC now if its reservation disappeared because it was canceled.
+
+	s, dr, now, rr, ur := newScheduler(t, time.Now())
+
+	ctx := context.Background()
+	unit := shared.Unit{
+		ID: uuid.New(),
+	}
+	managedLockCode := &shared.DeviceManagedLockCode{
+		ID: uuid.New(),
+		Reservation: shared.DeviceManagedLockCodeReservation{
+			ID:   "canceledReservation",
+			Sync: true,
+		},
+		Code:    "1111",
+		StartAt: now.Add(-24 * time.Hour),
+		EndAt:   now.Add(48 * time.Hour),
+		Status:  shared.DeviceManagedLockCodeStatus3Enabled,
+	}
+	device := shared.Device{
+		ID:               uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{managedLockCode},
+		UnitID:           &unit.ID,
+	}
+
+	ur.EXPECT().List(ctx).Return(
+		[]shared.Unit{unit},
+		nil,
+	)
+
+	rr.EXPECT().GetForUnits(ctx, []shared.Unit{unit}).Return(
+		map[uuid.UUID][]shared.Reservation{},
+		nil,
+	)
+
+	rr.EXPECT().GetStatus(ctx, unit, "canceledReservation").Return(
+		shared.ReservationStatus{Canceled: true, End: now.Add(48 * time.Hour)},
+		true,
+		nil,
+	)
+
+	dr.EXPECT().List(ctx).Return(
+		[]shared.Device{device},
+		nil,
+	)
+
+	dr.EXPECT().AppendToAuditLog(
+		ctx,
+		gomock.Any(),
+		gomock.Any(),
+	).Do(func(ctx context.Context, d shared.Device, managedLockCodes []*shared.DeviceManagedLockCode) {
+		assert.Equal(t, 1, len(managedLockCodes))
+		assert.Equal(t, now, managedLockCodes[0].EndAt)
+		assert.Contains(t, managedLockCodes[0].Note, "canceled")
+	}).Return(nil)
+
+	dr.EXPECT().PutIfUnchanged(ctx, gomock.Any())
+
+	report := shared.NewRunReport(time.Now())
+	err := s.ReconcileReservationsAndLockCodes(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+}
+
+func Test_shortenedEnabledMLC(t *testing.T) {
+	// Move the end of an enabled MLC up if the guest is leaving early, and leave it alone if they aren't.
+
+	s, dr, now, rr, ur := newScheduler(t, time.Now())
+
+	ctx := context.Background()
+	unit := shared.Unit{
+		ID: uuid.New(),
+	}
+	shortened := &shared.DeviceManagedLockCode{
+		ID: uuid.New(),
+		Reservation: shared.DeviceManagedLockCodeReservation{
+			ID:   "shortenedReservation",
+			Sync: true,
+		},
+		Code:    "1111",
+		StartAt: now.Add(-24 * time.Hour),
+		EndAt:   now.Add(48 * time.Hour),
+		Status:  shared.DeviceManagedLockCodeStatus3Enabled,
+	}
+	unchanged := &shared.DeviceManagedLockCode{
+		ID: uuid.New(),
+		Reservation: shared.DeviceManagedLockCodeReservation{
+			ID:   "unchangedReservation",
+			Sync: true,
+		},
+		Code:    "2222",
+		StartAt: now.Add(-24 * time.Hour),
+		EndAt:   now.Add(12 * time.Hour),
+		Status:  shared.DeviceManagedLockCodeStatus3Enabled,
+	}
+	device := shared.Device{
+		ID:               uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{shortened, unchanged},
+		UnitID:           &unit.ID,
+	}
+
+	ur.EXPECT().List(ctx).Return(
+		[]shared.Unit{unit},
+		nil,
+	)
+
+	rr.EXPECT().GetForUnits(ctx, []shared.Unit{unit}).Return(
+		map[uuid.UUID][]shared.Reservation{},
+		nil,
+	)
+
+	rr.EXPECT().GetStatus(ctx, unit, "shortenedReservation").Return(
+		shared.ReservationStatus{End: now.Add(2 * time.Hour)},
+		true,
+		nil,
+	)
+
+	rr.EXPECT().GetStatus(ctx, unit, "unchangedReservation").Return(
+		shared.ReservationStatus{End: now.Add(12*time.Hour - 30*time.Minute)},
+		true,
+		nil,
+	)
+
+	dr.EXPECT().List(ctx).Return(
+		[]shared.Device{device},
+		nil,
+	)
+
+	dr.EXPECT().AppendToAuditLog(
+		ctx,
+		gomock.Any(),
+		gomock.Any(),
+	).Do(func(ctx context.Context, d shared.Device, managedLockCodes []*shared.DeviceManagedLockCode) {
+		assert.Equal(t, 1, len(managedLockCodes))
+		assert.Equal(t, shortened.ID, managedLockCodes[0].ID)
+		assert.Equal(t, now.Add(2*time.Hour+30*time.Minute), managedLockCodes[0].EndAt)
+		assert.Contains(t, managedLockCodes[0].Note, "shortened")
+	}).Return(nil)
+
+	dr.EXPECT().PutIfUnchanged(ctx, gomock.Any())
+
+	report := shared.NewRunReport(time.Now())
+	err := s.ReconcileReservationsAndLockCodes(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
 }
 
 func Test_editMLCWithNoReservation(t *testing.T) {
@@ -455,18 +616,731 @@ func Test_editMLCWithNoReservation(t *testing.T) {
 			nil,
 		)
 
-		err := s.ReconcileReservationsAndLockCodes(ctx)
+		report := shared.NewRunReport(time.Now())
+		err := s.ReconcileReservationsAndLockCodes(ctx, report)
 		assert.Nil(t, err)
+		assert.Empty(t, report.Errors)
+	}
+}
+
+func Test_badDeviceDoesNotStopOthers(t *testing.T) {
+	// A reservation without a door code on the first device shouldn't stop the second device from getting its code.
+
+	s, dr, now, rr, ur := newScheduler(t, time.Now())
+
+	ctx := context.Background()
+	badUnit := shared.Unit{
+		ID: uuid.New(),
+	}
+	goodUnit := shared.Unit{
+		ID: uuid.New(),
+	}
+	badDevice := shared.Device{
+		ID:     uuid.New(),
+		UnitID: &badUnit.ID,
+	}
+	goodDevice := shared.Device{
+		ID:     uuid.New(),
+		UnitID: &goodUnit.ID,
+	}
+
+	ur.EXPECT().List(ctx).Return(
+		[]shared.Unit{badUnit, goodUnit},
+		nil,
+	)
+
+	rr.EXPECT().GetForUnits(ctx, []shared.Unit{badUnit, goodUnit}).Return(
+		map[uuid.UUID][]shared.Reservation{
+			badUnit.ID: {
+				{
+					ID:    "noDoorCode",
+					Start: now,
+					End:   now.Add(1 * time.Hour),
+				},
+			},
+			goodUnit.ID: {
+				{
+					ID:       "doorCode",
+					Start:    now,
+					End:      now.Add(1 * time.Hour),
+					DoorCode: "1234",
+				},
+			},
+		},
+		nil,
+	)
+
+	dr.EXPECT().List(ctx).Return(
+		[]shared.Device{badDevice, goodDevice},
+		nil,
+	)
+
+	dr.EXPECT().AppendToAuditLog(ctx, gomock.Any(), gomock.Any()).Do(func(ctx context.Context, d shared.Device, managedLockCodes []*shared.DeviceManagedLockCode) {
+		assert.Equal(t, goodDevice.ID, d.ID)
+	}).Return(nil)
+	dr.EXPECT().PutIfUnchanged(ctx, gomock.Any()).Do(func(ctx context.Context, d shared.Device) {
+		assert.Equal(t, goodDevice.ID, d.ID)
+		assert.Equal(t, 1, len(d.ManagedLockCodes))
+	})
+
+	report := shared.NewRunReport(time.Now())
+	err := s.ReconcileReservationsAndLockCodes(ctx, report)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 1, len(report.Errors))
+	assert.Equal(t, badDevice.ID, report.Errors[0].DeviceID)
+	assert.Equal(t, shared.RunReportStageScheduler, report.Errors[0].Stage)
+	assert.Equal(t, "reservation noDoorCode has no door code", report.Errors[0].Error)
+	assert.Equal(t, 1, report.DevicesProcessed[shared.RunReportStageScheduler])
+	assert.NotNil(t, report.Err())
+}
+
+func Test_unitWithFailedReservationsIsLeftAlone(t *testing.T) {
+	// We couldn't get the unit's reservations, that doesn't mean they were all canceled.
+
+	s, dr, now, rr, ur := newScheduler(t, time.Now())
+
+	ctx := context.Background()
+	unit := shared.Unit{ID: uuid.New()}
+	device := shared.Device{
+		ID: uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{{
+			Code:        "1234",
+			EndAt:       now.Add(24 * time.Hour),
+			ID:          uuid.New(),
+			Reservation: shared.DeviceManagedLockCodeReservation{ID: "reservation", Sync: true},
+			Status:      shared.DeviceManagedLockCodeStatus3Enabled,
+			StartAt:     now.Add(-24 * time.Hour),
+		}},
+		UnitID: &unit.ID,
+	}
+
+	ur.EXPECT().List(ctx).Return([]shared.Unit{unit}, nil)
+	rr.EXPECT().GetForUnits(ctx, []shared.Unit{unit}).Return(map[uuid.UUID][]shared.Reservation{}, shared.UnitErrors{unit.ID: fmt.Errorf("feed is down")})
+	dr.EXPECT().List(ctx).Return([]shared.Device{device}, nil)
+
+	report := shared.NewRunReport(now)
+	err := s.ReconcileReservationsAndLockCodes(ctx, report)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(report.Errors))
+	assert.Equal(t, "feed is down", report.Errors[0].Error)
+	assert.True(t, now.Add(24*time.Hour).Equal(device.ManagedLockCodes[0].EndAt))
+}
+
+func Test_conflictingCodeIsReported(t *testing.T) {
+	// A new reservation that reuses a code that's still in use should be added, but someone should hear about it.
+
+	s, dr, now, rr, ur := newScheduler(t, time.Now())
+
+	ctx := context.Background()
+	unit := shared.Unit{
+		ID: uuid.New(),
+	}
+	existing := &shared.DeviceManagedLockCode{
+		Code:    "1234",
+		EndAt:   now.Add(2 * time.Hour),
+		ID:      uuid.New(),
+		Status:  shared.DeviceManagedLockCodeStatus3Enabled,
+		StartAt: now.Add(-1 * time.Hour),
+	}
+	device := shared.Device{
+		ID:               uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{existing},
+		UnitID:           &unit.ID,
+	}
+
+	ur.EXPECT().List(ctx).Return([]shared.Unit{unit}, nil)
+	rr.EXPECT().GetForUnits(ctx, []shared.Unit{unit}).Return(
+		map[uuid.UUID][]shared.Reservation{
+			unit.ID: {
+				{
+					ID:       "reservation",
+					Start:    now.Add(1 * time.Hour),
+					End:      now.Add(24 * time.Hour),
+					DoorCode: "1234",
+				},
+			},
+		},
+		nil,
+	)
+	dr.EXPECT().List(ctx).Return([]shared.Device{device}, nil)
+	dr.EXPECT().AppendToAuditLog(ctx, gomock.Any(), gomock.Any()).Return(nil)
+	dr.EXPECT().PutIfUnchanged(ctx, gomock.Any()).Do(func(ctx context.Context, d shared.Device) {
+		assert.Equal(t, 2, len(d.ManagedLockCodes))
+		assert.Contains(t, d.ManagedLockCodes[1].Note, "overlaps with the same code for a code added by hand")
+	})
+
+	report := shared.NewRunReport(time.Now())
+	err := s.ReconcileReservationsAndLockCodes(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+
+	assert.Equal(t, 1, len(report.Warnings))
+	assert.Equal(t, device.ID, report.Warnings[0].DeviceID)
+}
+
+func Test_recurringLockCode(t *testing.T) {
+	// Upcoming occurrences of a recurring code get their own managed lock codes, even without a unit.
+
+	tz, err := time.LoadLocation("America/Denver")
+	assert.Nil(t, err)
+
+	// A Monday morning.
+	s, dr, now, rr, ur := newScheduler(t, time.Date(2026, 10, 19, 8, 0, 0, 0, tz))
+
+	ctx := context.Background()
+	rlc := &shared.DeviceRecurringLockCode{
+		Code:     "5555",
+		EndAt:    time.Date(2026, 10, 2, 15, 0, 0, 0, tz),
+		ID:       uuid.New(),
+		RRule:    "FREQ=WEEKLY;BYDAY=TU,FR",
+		StartAt:  time.Date(2026, 10, 2, 10, 0, 0, 0, tz),
+		TimeZone: "America/Denver",
+	}
+	device := shared.Device{
+		ID:                 uuid.New(),
+		RecurringLockCodes: []*shared.DeviceRecurringLockCode{rlc},
+	}
+
+	ur.EXPECT().List(ctx).Return([]shared.Unit{}, nil)
+	rr.EXPECT().GetForUnits(ctx, []shared.Unit{}).Return(map[uuid.UUID][]shared.Reservation{}, nil)
+	dr.EXPECT().List(ctx).Return([]shared.Device{device}, nil)
+	dr.EXPECT().AppendToAuditLog(ctx, gomock.Any(), gomock.Any()).Return(nil)
+	dr.EXPECT().PutIfUnchanged(ctx, gomock.Any()).Do(func(ctx context.Context, d shared.Device) {
+		assert.Equal(t, 1, len(d.ManagedLockCodes))
+
+		mlc := d.ManagedLockCodes[0]
+		assert.Equal(t, "5555", mlc.Code)
+		assert.Equal(t, rlc.ID, *mlc.RecurringLockCodeID)
+		assert.Equal(t, shared.DeviceManagedLockCodeStatus1Scheduled, mlc.Status)
+		assert.True(t, time.Date(2026, 10, 20, 10, 0, 0, 0, tz).Equal(mlc.StartAt))
+		assert.True(t, time.Date(2026, 10, 20, 15, 0, 0, 0, tz).Equal(mlc.EndAt))
+	})
+
+	report := shared.NewRunReport(now)
+	err = s.ReconcileReservationsAndLockCodes(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+}
+
+func Test_deletedRecurringLockCode(t *testing.T) {
+	// Occurrences of a recurring code that was deleted should be ended.
+
+	s, dr, now, rr, ur := newScheduler(t, time.Now())
+
+	ctx := context.Background()
+	rlcID := uuid.New()
+	scheduled := &shared.DeviceManagedLockCode{
+		Code:                "5555",
+		EndAt:               now.Add(5 * time.Hour),
+		ID:                  uuid.New(),
+		RecurringLockCodeID: &rlcID,
+		Status:              shared.DeviceManagedLockCodeStatus1Scheduled,
+		StartAt:             now.Add(1 * time.Hour),
+	}
+	enabled := &shared.DeviceManagedLockCode{
+		Code:                "5555",
+		EndAt:               now.Add(1 * time.Hour),
+		ID:                  uuid.New(),
+		RecurringLockCodeID: &rlcID,
+		Status:              shared.DeviceManagedLockCodeStatus3Enabled,
+		StartAt:             now.Add(-4 * time.Hour),
+	}
+	device := shared.Device{
+		ID:               uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{scheduled, enabled},
+	}
+
+	ur.EXPECT().List(ctx).Return([]shared.Unit{}, nil)
+	rr.EXPECT().GetForUnits(ctx, []shared.Unit{}).Return(map[uuid.UUID][]shared.Reservation{}, nil)
+	dr.EXPECT().List(ctx).Return([]shared.Device{device}, nil)
+	dr.EXPECT().AppendToAuditLog(ctx, gomock.Any(), gomock.Any()).Do(func(ctx context.Context, d shared.Device, managedLockCodes []*shared.DeviceManagedLockCode) {
+		assert.Equal(t, 2, len(managedLockCodes))
+	})
+	dr.EXPECT().PutIfUnchanged(ctx, gomock.Any()).Do(func(ctx context.Context, d shared.Device) {
+		assert.Equal(t, 2, len(d.ManagedLockCodes))
+		assert.Equal(t, now, d.ManagedLockCodes[0].StartAt)
+		assert.Equal(t, now, d.ManagedLockCodes[0].EndAt)
+		assert.Equal(t, now.Add(-4*time.Hour), d.ManagedLockCodes[1].StartAt)
+		assert.Equal(t, now, d.ManagedLockCodes[1].EndAt)
+	})
+
+	report := shared.NewRunReport(now)
+	err := s.ReconcileReservationsAndLockCodes(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+}
+
+func Test_recurringLockCodeChangedCode(t *testing.T) {
+	// The code changed while an occurrence was on the lock, the old code has to be removed and the new one added.
+
+	tz, err := time.LoadLocation("America/Denver")
+	assert.Nil(t, err)
+
+	// A Tuesday, during an occurrence.
+	s, dr, now, rr, ur := newScheduler(t, time.Date(2026, 10, 20, 12, 0, 0, 0, tz))
+
+	ctx := context.Background()
+	rlc := &shared.DeviceRecurringLockCode{
+		Code:     "6666",
+		EndAt:    time.Date(2026, 10, 2, 15, 0, 0, 0, tz),
+		ID:       uuid.New(),
+		RRule:    "FREQ=WEEKLY;BYDAY=TU,FR",
+		StartAt:  time.Date(2026, 10, 2, 10, 0, 0, 0, tz),
+		TimeZone: "America/Denver",
 	}
+	enabled := &shared.DeviceManagedLockCode{
+		Code:                "5555",
+		EndAt:               time.Date(2026, 10, 20, 15, 0, 0, 0, tz),
+		ID:                  uuid.New(),
+		RecurringLockCodeID: &rlc.ID,
+		Status:              shared.DeviceManagedLockCodeStatus3Enabled,
+		StartAt:             time.Date(2026, 10, 20, 10, 0, 0, 0, tz),
+	}
+	device := shared.Device{
+		ID:                 uuid.New(),
+		ManagedLockCodes:   []*shared.DeviceManagedLockCode{enabled},
+		RecurringLockCodes: []*shared.DeviceRecurringLockCode{rlc},
+	}
+
+	ur.EXPECT().List(ctx).Return([]shared.Unit{}, nil).Times(2)
+	rr.EXPECT().GetForUnits(ctx, []shared.Unit{}).Return(map[uuid.UUID][]shared.Reservation{}, nil).Times(2)
+	dr.EXPECT().List(ctx).Return([]shared.Device{device}, nil)
+	dr.EXPECT().AppendToAuditLog(ctx, gomock.Any(), gomock.Any()).Return(nil)
+	dr.EXPECT().PutIfUnchanged(ctx, gomock.Any()).DoAndReturn(func(ctx context.Context, d shared.Device) (shared.Device, error) {
+		device = d
+		return d, nil
+	})
+
+	report := shared.NewRunReport(now)
+	err = s.ReconcileReservationsAndLockCodes(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+
+	assert.Equal(t, 2, len(device.ManagedLockCodes))
+
+	// It ends now so the lock engine removes it.
+	assert.Equal(t, "5555", enabled.Code)
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus3Enabled, enabled.Status)
+	assert.True(t, now.Equal(enabled.EndAt))
+
+	replacement := device.ManagedLockCodes[1]
+	assert.Equal(t, "6666", replacement.Code)
+	assert.Equal(t, rlc.ID, *replacement.RecurringLockCodeID)
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus1Scheduled, replacement.Status)
+	assert.True(t, enabled.StartAt.Equal(replacement.StartAt))
+	assert.True(t, time.Date(2026, 10, 20, 15, 0, 0, 0, tz).Equal(replacement.EndAt))
+
+	// The next run leaves them alone.
+	dr.EXPECT().List(ctx).Return([]shared.Device{device}, nil)
+	err = s.ReconcileReservationsAndLockCodes(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+}
+
+func Test_codeScheduledEvent(t *testing.T) {
+	now := time.Now()
+	s, dr, ev, rr, ur := newSchedulerWithEventSink(t, now)
+
+	ctx := context.Background()
+	unit := shared.Unit{
+		ID: uuid.New(),
+	}
+	device := shared.Device{
+		ID:     uuid.New(),
+		UnitID: &unit.ID,
+	}
+
+	ur.EXPECT().List(ctx).Return([]shared.Unit{unit}, nil)
+	rr.EXPECT().GetForUnits(ctx, []shared.Unit{unit}).Return(
+		map[uuid.UUID][]shared.Reservation{
+			unit.ID: {
+				{
+					ID:       "reservation",
+					Start:    now.Add(24 * time.Hour),
+					End:      now.Add(48 * time.Hour),
+					DoorCode: "1234",
+				},
+			},
+		},
+		nil,
+	)
+	dr.EXPECT().List(ctx).Return([]shared.Device{device}, nil)
+	dr.EXPECT().AppendToAuditLog(ctx, gomock.Any(), gomock.Any()).Return(nil)
+	dr.EXPECT().PutIfUnchanged(ctx, gomock.Any()).Return(shared.Device{}, nil)
+	ev.EXPECT().Emit(ctx, gomock.Any()).Do(func(ctx context.Context, e shared.Event) {
+		assert.Equal(t, shared.EventTypeCodeScheduled, e.Type)
+		assert.Equal(t, device.ID, e.DeviceID)
+		assert.Equal(t, unit.ID, *e.UnitID)
+		assert.Equal(t, "reservation", e.ReservationID)
+		assert.Equal(t, "1234", e.Code)
+		assert.NotNil(t, e.ManagedLockCodeID)
+	}).Return(nil)
+
+	report := shared.NewRunReport(now)
+	err := s.ReconcileReservationsAndLockCodes(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+}
+
+func Test_reconcilesTheirVersionWhenTheDeviceChanged(t *testing.T) {
+	// The listener saved a new battery level after we read the device, we schedule the code on its version.
+
+	now := time.Now()
+	s, dr, rr, ur := newSchedulerForConflicts(t, now)
+
+	ctx := context.Background()
+	unit := shared.Unit{ID: uuid.New()}
+	device := shared.Device{ID: uuid.New(), UnitID: &unit.ID, Version: 1}
+	theirs := device
+	theirs.RawDevice.Battery = shared.RawDeviceBattery{BatteryPowered: true, Level: 40}
+	theirs.Version = 2
+
+	ur.EXPECT().List(ctx).Return([]shared.Unit{unit}, nil)
+	rr.EXPECT().GetForUnits(ctx, []shared.Unit{unit}).Return(
+		map[uuid.UUID][]shared.Reservation{
+			unit.ID: {{ID: "reservation", Start: now.Add(24 * time.Hour), End: now.Add(48 * time.Hour), DoorCode: "1234"}},
+		},
+		nil,
+	)
+	dr.EXPECT().List(ctx).Return([]shared.Device{device}, nil)
+	gomock.InOrder(
+		dr.EXPECT().PutIfUnchanged(ctx, gomock.Any()).Return(shared.Device{}, shared.ErrDeviceChanged),
+		dr.EXPECT().Get(ctx, device.ID).Return(theirs, true, nil),
+		dr.EXPECT().PutIfUnchanged(ctx, gomock.Any()).Do(func(ctx context.Context, d shared.Device) {
+			assert.Equal(t, 2, d.Version)
+			assert.Equal(t, 40, d.RawDevice.Battery.Level)
+			assert.Equal(t, 1, len(d.ManagedLockCodes))
+			assert.Equal(t, "1234", d.ManagedLockCodes[0].Code)
+		}).Return(shared.Device{}, nil),
+	)
+	dr.EXPECT().AppendToAuditLog(ctx, gomock.Any(), gomock.Any()).Do(func(ctx context.Context, d shared.Device, mlcs []*shared.DeviceManagedLockCode) {
+		assert.Equal(t, 1, len(mlcs))
+	}).Return(nil)
+
+	report := shared.NewRunReport(now)
+	assert.Nil(t, s.ReconcileReservationsAndLockCodes(ctx, report))
+	assert.Empty(t, report.Errors)
+}
+
+func newSchedulerForConflicts(t *testing.T, now time.Time) (*scheduler.Scheduler, *mock_scheduler.MockDeviceRepository, *mock_scheduler.MockReservationRepository, *mock_scheduler.MockUnitRepository) {
+	s, dr, ev, rr, ur := newSchedulerWithEventSink(t, now)
+	ev.EXPECT().Emit(gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	return s, dr, rr, ur
+}
+
+func Test_reservationBuffers(t *testing.T) {
+	// The property's buffers apply to its units, a unit can override one of them.
+
+	now := time.Now()
+	sixHoursEarly := -360
+	oneHourEarly := -60
+	anHourLate := 60
+	property := shared.Property{
+		ID: uuid.New(),
+		ReservationBuffers: &shared.ReservationBuffers{
+			EndInMinutes:   &anHourLate,
+			StartInMinutes: &sixHoursEarly,
+		},
+	}
+	s, dr, ev, rr, ur := newSchedulerWithProperties(t, now, []shared.Property{property})
+	ev.EXPECT().Emit(gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+
+	ctx := context.Background()
+	propertyUnit := shared.Unit{
+		ID:         uuid.New(),
+		PropertyID: property.ID,
+	}
+	overriddenUnit := shared.Unit{
+		ID:                 uuid.New(),
+		PropertyID:         property.ID,
+		ReservationBuffers: &shared.ReservationBuffers{StartInMinutes: &oneHourEarly},
+	}
+	propertyDevice := shared.Device{
+		ID:     uuid.New(),
+		UnitID: &propertyUnit.ID,
+	}
+	overriddenDevice := shared.Device{
+		ID:     uuid.New(),
+		UnitID: &overriddenUnit.ID,
+	}
+	reservation := shared.Reservation{
+		ID:                "reservation",
+		Start:             now.Add(24 * time.Hour),
+		End:               now.Add(48 * time.Hour),
+		DoorCode:          "9876",
+		TransactionNumber: "12345678",
+	}
+
+	ur.EXPECT().List(ctx).Return(
+		[]shared.Unit{propertyUnit, overriddenUnit},
+		nil,
+	)
+
+	rr.EXPECT().GetForUnits(ctx, []shared.Unit{propertyUnit, overriddenUnit}).Return(
+		map[uuid.UUID][]shared.Reservation{
+			propertyUnit.ID:   {reservation},
+			overriddenUnit.ID: {reservation},
+		},
+		nil,
+	)
+
+	dr.EXPECT().List(ctx).Return(
+		[]shared.Device{propertyDevice, overriddenDevice},
+		nil,
+	)
+
+	dr.EXPECT().AppendToAuditLog(ctx, gomock.Any(), gomock.Any()).Return(nil).Times(2)
+
+	saved := map[uuid.UUID]shared.Device{}
+	dr.EXPECT().PutIfUnchanged(ctx, gomock.Any()).Do(func(ctx context.Context, d shared.Device) {
+		saved[d.ID] = d
+	}).Times(2)
+
+	report := shared.NewRunReport(now)
+	err := s.ReconcileReservationsAndLockCodes(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+
+	mlc := saved[propertyDevice.ID].ManagedLockCodes[0]
+	assert.Equal(t, reservation.Start.Add(-6*time.Hour), mlc.StartAt)
+	assert.Equal(t, reservation.End.Add(1*time.Hour), mlc.EndAt)
+
+	mlc = saved[overriddenDevice.ID].ManagedLockCodes[0]
+	assert.Equal(t, reservation.Start.Add(-1*time.Hour), mlc.StartAt)
+	assert.Equal(t, reservation.End.Add(1*time.Hour), mlc.EndAt)
+}
+
+func Test_withUnits(t *testing.T) {
+	// Only the unit's reservations are fetched and only its devices are updated.
+
+	s, dr, now, rr, ur := newScheduler(t, time.Now())
+	ctx := context.Background()
+
+	unit := shared.Unit{ID: uuid.New()}
+	otherUnit := shared.Unit{ID: uuid.New()}
+	s = s.WithUnits([]uuid.UUID{unit.ID})
+
+	device := shared.Device{ID: uuid.New(), UnitID: &unit.ID}
+	// This one would have its code canceled if it were processed.
+	otherDevice := shared.Device{
+		ID: uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{{
+			Code:        "1111",
+			EndAt:       now.Add(48 * time.Hour),
+			Reservation: shared.DeviceManagedLockCodeReservation{ID: "otherReservation", Sync: true},
+			StartAt:     now.Add(24 * time.Hour),
+			Status:      shared.DeviceManagedLockCodeStatus1Scheduled,
+		}},
+		UnitID: &otherUnit.ID,
+	}
+	reservation := shared.Reservation{
+		ID:                "reservation",
+		Start:             now.Add(24 * time.Hour),
+		End:               now.Add(48 * time.Hour),
+		DoorCode:          "9876",
+		TransactionNumber: "12345678",
+	}
+
+	ur.EXPECT().List(ctx).Return([]shared.Unit{otherUnit, unit}, nil)
+	rr.EXPECT().GetForUnits(ctx, []shared.Unit{unit}).Return(
+		map[uuid.UUID][]shared.Reservation{unit.ID: {reservation}},
+		nil,
+	)
+	dr.EXPECT().List(ctx).Return([]shared.Device{otherDevice, device}, nil)
+
+	dr.EXPECT().AppendToAuditLog(ctx, gomock.Any(), gomock.Any()).Return(nil)
+	dr.EXPECT().PutIfUnchanged(ctx, gomock.Any()).Do(func(ctx context.Context, d shared.Device) {
+		assert.Equal(t, device.ID, d.ID)
+		assert.Equal(t, 1, len(d.ManagedLockCodes))
+	})
+
+	report := shared.NewRunReport(now)
+	err := s.ReconcileReservationsAndLockCodes(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+}
+
+func Test_withDevices(t *testing.T) {
+	// Only the device is updated, but it still needs its unit's reservations.
+
+	s, dr, now, rr, ur := newScheduler(t, time.Now())
+	ctx := context.Background()
+
+	unit := shared.Unit{ID: uuid.New()}
+	otherUnit := shared.Unit{ID: uuid.New()}
+
+	device := shared.Device{ID: uuid.New(), UnitID: &unit.ID}
+	// Shares the unit, but wasn't asked for.
+	sameUnitDevice := shared.Device{ID: uuid.New(), UnitID: &unit.ID}
+	otherDevice := shared.Device{ID: uuid.New(), UnitID: &otherUnit.ID}
+	s = s.WithDevices([]uuid.UUID{device.ID})
+
+	reservation := shared.Reservation{
+		ID:                "reservation",
+		Start:             now.Add(24 * time.Hour),
+		End:               now.Add(48 * time.Hour),
+		DoorCode:          "9876",
+		TransactionNumber: "12345678",
+	}
+
+	dr.EXPECT().List(ctx).Return([]shared.Device{otherDevice, sameUnitDevice, device}, nil)
+	ur.EXPECT().List(ctx).Return([]shared.Unit{otherUnit, unit}, nil)
+	rr.EXPECT().GetForUnits(ctx, []shared.Unit{unit}).Return(
+		map[uuid.UUID][]shared.Reservation{unit.ID: {reservation}},
+		nil,
+	)
+
+	dr.EXPECT().AppendToAuditLog(ctx, gomock.Any(), gomock.Any()).Return(nil)
+	dr.EXPECT().PutIfUnchanged(ctx, gomock.Any()).Do(func(ctx context.Context, d shared.Device) {
+		assert.Equal(t, device.ID, d.ID)
+		assert.Equal(t, 1, len(d.ManagedLockCodes))
+	})
+
+	report := shared.NewRunReport(now)
+	err := s.ReconcileReservationsAndLockCodes(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+}
+
+func Test_incrementalSync(t *testing.T) {
+	// Only the units with changed reservations are fetched, devices in the other units keep their codes.
+
+	s, dr, now, rr, ur := newScheduler(t, time.Now())
+	ctx := context.Background()
+	sr := mock_scheduler.NewMockSyncCursorRepository(gomock.NewController(t))
+	s = s.WithIncrementalSync(sr)
+
+	changedUnit := shared.Unit{ID: uuid.New()}
+	unchangedUnit := shared.Unit{ID: uuid.New()}
+	device := shared.Device{ID: uuid.New(), UnitID: &changedUnit.ID}
+	// This one would have its code canceled if its reservations were fetched.
+	unchangedDevice := shared.Device{
+		ID: uuid.New(),
+		ManagedLockCodes: []*shared.DeviceManagedLockCode{{
+			Code:        "1111",
+			EndAt:       now.Add(48 * time.Hour),
+			Reservation: shared.DeviceManagedLockCodeReservation{ID: "otherReservation", Sync: true},
+			StartAt:     now.Add(24 * time.Hour),
+			Status:      shared.DeviceManagedLockCodeStatus1Scheduled,
+		}},
+		UnitID: &unchangedUnit.ID,
+	}
+	reservation := shared.Reservation{
+		ID:                "reservation",
+		Start:             now.Add(24 * time.Hour),
+		End:               now.Add(48 * time.Hour),
+		DoorCode:          "9876",
+		TransactionNumber: "12345678",
+	}
+	cursor := shared.SyncCursor{
+		FullSyncedAt: now.Add(-30 * time.Minute),
+		ID:           shared.SyncCursorIDReservations,
+		SyncedAt:     now.Add(-5 * time.Minute),
+	}
+
+	dr.EXPECT().List(ctx).Return([]shared.Device{unchangedDevice, device}, nil)
+	ur.EXPECT().List(ctx).Return([]shared.Unit{unchangedUnit, changedUnit}, nil)
+	sr.EXPECT().Get(ctx, shared.SyncCursorIDReservations).Return(cursor, true, nil)
+	rr.EXPECT().GetChangedUnits(ctx, []shared.Unit{unchangedUnit, changedUnit}, cursor.SyncedAt).Return(map[uuid.UUID]bool{changedUnit.ID: true}, nil)
+	rr.EXPECT().GetForUnits(ctx, []shared.Unit{changedUnit}).Return(
+		map[uuid.UUID][]shared.Reservation{changedUnit.ID: {reservation}},
+		nil,
+	)
+
+	dr.EXPECT().AppendToAuditLog(ctx, gomock.Any(), gomock.Any()).Return(nil)
+	dr.EXPECT().PutIfUnchanged(ctx, gomock.Any()).Do(func(ctx context.Context, d shared.Device) {
+		assert.Equal(t, device.ID, d.ID)
+	})
+	sr.EXPECT().Put(ctx, shared.SyncCursor{
+		FullSyncedAt: cursor.FullSyncedAt,
+		ID:           shared.SyncCursorIDReservations,
+		SyncedAt:     now,
+	}).Return(shared.SyncCursor{}, nil)
+
+	report := shared.NewRunReport(now)
+	err := s.ReconcileReservationsAndLockCodes(ctx, report)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Errors)
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus1Scheduled, unchangedDevice.ManagedLockCodes[0].Status)
+}
+
+func Test_incrementalSyncFull(t *testing.T) {
+	// Every unit is fetched once in a while, and when something goes wrong the cursor is left alone so that we try again.
+
+	s, dr, now, rr, ur := newScheduler(t, time.Now())
+	ctx := context.Background()
+	sr := mock_scheduler.NewMockSyncCursorRepository(gomock.NewController(t))
+	s = s.WithIncrementalSync(sr)
+
+	unit := shared.Unit{ID: uuid.New()}
+	device := shared.Device{ID: uuid.New(), UnitID: &unit.ID}
+	reservation := shared.Reservation{
+		ID:                "reservation",
+		Start:             now.Add(24 * time.Hour),
+		End:               now.Add(48 * time.Hour),
+		DoorCode:          "9876",
+		TransactionNumber: "12345678",
+	}
+
+	dr.EXPECT().List(ctx).Return([]shared.Device{device}, nil).Times(2)
+	ur.EXPECT().List(ctx).Return([]shared.Unit{unit}, nil).Times(2)
+	sr.EXPECT().Get(ctx, shared.SyncCursorIDReservations).Return(shared.SyncCursor{
+		FullSyncedAt: now.Add(-2 * time.Hour),
+		ID:           shared.SyncCursorIDReservations,
+		SyncedAt:     now.Add(-5 * time.Minute),
+	}, true, nil).Times(2)
+	rr.EXPECT().GetForUnits(ctx, []shared.Unit{unit}).Return(
+		map[uuid.UUID][]shared.Reservation{unit.ID: {reservation}},
+		nil,
+	).Times(2)
+
+	// The first run saves the device, the audit log only has what was saved.
+	dr.EXPECT().AppendToAuditLog(ctx, gomock.Any(), gomock.Any()).Return(nil)
+	gomock.InOrder(
+		dr.EXPECT().PutIfUnchanged(ctx, gomock.Any()).Return(shared.Device{}, nil),
+		dr.EXPECT().PutIfUnchanged(ctx, gomock.Any()).Return(shared.Device{}, fmt.Errorf("throttled")),
+	)
+	sr.EXPECT().Put(ctx, shared.SyncCursor{
+		FullSyncedAt: now,
+		ID:           shared.SyncCursorIDReservations,
+		SyncedAt:     now,
+	}).Return(shared.SyncCursor{}, nil)
+
+	report := shared.NewRunReport(now)
+	assert.Nil(t, s.ReconcileReservationsAndLockCodes(ctx, report))
+	assert.Empty(t, report.Errors)
+
+	// The second one can't.
+	report = shared.NewRunReport(now)
+	assert.Nil(t, s.ReconcileReservationsAndLockCodes(ctx, report))
+	assert.Equal(t, 1, len(report.Errors))
 }
 
 func newScheduler(t *testing.T, now time.Time) (*scheduler.Scheduler, *mock_scheduler.MockDeviceRepository, time.Time, *mock_scheduler.MockReservationRepository, *mock_scheduler.MockUnitRepository) {
+	s, dr, ev, rr, ur := newSchedulerWithEventSink(t, now)
+
+	// Tests that care about the events can use `newSchedulerWithEventSink`.
+	ev.EXPECT().Emit(gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+
+	return s, dr, now, rr, ur
+}
+
+func newSchedulerWithEventSink(t *testing.T, now time.Time) (*scheduler.Scheduler, *mock_scheduler.MockDeviceRepository, *mock_scheduler.MockEventSink, *mock_scheduler.MockReservationRepository, *mock_scheduler.MockUnitRepository) {
+	return newSchedulerWithProperties(t, now, []shared.Property{})
+}
+
+func newSchedulerWithProperties(t *testing.T, now time.Time, properties []shared.Property) (*scheduler.Scheduler, *mock_scheduler.MockDeviceRepository, *mock_scheduler.MockEventSink, *mock_scheduler.MockReservationRepository, *mock_scheduler.MockUnitRepository) {
 	ctrl := gomock.NewController(t)
 
 	dr := mock_scheduler.NewMockDeviceRepository(ctrl)
+	ev := mock_scheduler.NewMockEventSink(ctrl)
+	pr := mock_scheduler.NewMockPropertyRepository(ctrl)
 	rr := mock_scheduler.NewMockReservationRepository(ctrl)
 	ur := mock_scheduler.NewMockUnitRepository(ctrl)
 
-	s := scheduler.NewScheduler(dr, now, rr, ur)
-	return s, dr, now, rr, ur
+	pr.EXPECT().List(gomock.Any()).Return(properties, nil).AnyTimes()
+
+	s := scheduler.NewScheduler(dr, ev, now, pr, rr, ur)
+	return s, dr, ev, rr, ur
 }
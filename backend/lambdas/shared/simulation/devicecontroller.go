@@ -0,0 +1,187 @@
+package simulation
+
+import (
+	"context"
+	"fmt"
+	"mlock/lambdas/shared"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DeviceController pretends to be the locks. Changes take `Latency` to show up, controllers can have outages, and commands for a device can be made to fail.
+type DeviceController struct {
+	Latency time.Duration
+
+	clock    *Clock
+	devices  map[uuid.UUID]*simulatedLock
+	failures map[uuid.UUID]int
+	mu       sync.Mutex
+	outages  []Outage
+}
+
+type Outage struct {
+	ControllerID string
+	EndAt        time.Time
+	StartAt      time.Time
+}
+
+type simulatedLock struct {
+	codes   map[string]bool
+	pending []pendingChange
+}
+
+type pendingChange struct {
+	add  bool
+	at   time.Time
+	code string
+}
+
+func NewDeviceController(clock *Clock) *DeviceController {
+	return &DeviceController{
+		clock:    clock,
+		devices:  map[uuid.UUID]*simulatedLock{},
+		failures: map[uuid.UUID]int{},
+	}
+}
+
+func (c *DeviceController) AddLockCode(ctx context.Context, device shared.Device, code string) error {
+	return c.change(device, code, true)
+}
+
+func (c *DeviceController) RemoveLockCode(ctx context.Context, device shared.Device, code string) error {
+	return c.change(device, code, false)
+}
+
+func (c *DeviceController) GetLockCodes(ctx context.Context, device shared.Device) ([]shared.RawDeviceLockCode, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.isOffline(device.ControllerID) {
+		return nil, fmt.Errorf("controller %s is offline", device.ControllerID)
+	}
+
+	return c.lockCodes(device.ID), nil
+}
+
+// AddOutage makes the controller unreachable between the start and end.
+func (c *DeviceController) AddOutage(o Outage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.outages = append(c.outages, o)
+}
+
+// FailNext makes the next `n` commands for the device fail.
+func (c *DeviceController) FailNext(deviceID uuid.UUID, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.failures[deviceID] = n
+}
+
+func (c *DeviceController) IsOffline(controllerID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.isOffline(controllerID)
+}
+
+// LockCodes is what's actually on the lock right now, regardless of outages.
+func (c *DeviceController) LockCodes(deviceID uuid.UUID) []shared.RawDeviceLockCode {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lockCodes(deviceID)
+}
+
+// SetLockCode puts a code on the lock right away, e.g. one someone added at the keypad.
+func (c *DeviceController) SetLockCode(deviceID uuid.UUID, code string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lock(deviceID).codes[code] = true
+}
+
+func (c *DeviceController) change(device shared.Device, code string, add bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.isOffline(device.ControllerID) {
+		return fmt.Errorf("controller %s is offline", device.ControllerID)
+	}
+	if c.failures[device.ID] > 0 {
+		c.failures[device.ID]--
+		return fmt.Errorf("simulated failure")
+	}
+
+	l := c.lock(device.ID)
+	l.pending = append(l.pending, pendingChange{
+		add:  add,
+		at:   c.clock.Now().Add(c.Latency),
+		code: code,
+	})
+	c.applyPending(l)
+
+	return nil
+}
+
+func (c *DeviceController) isOffline(controllerID string) bool {
+	now := c.clock.Now()
+	for _, o := range c.outages {
+		if o.ControllerID == controllerID && !now.Before(o.StartAt) && now.Before(o.EndAt) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *DeviceController) lock(deviceID uuid.UUID) *simulatedLock {
+	l, ok := c.devices[deviceID]
+	if !ok {
+		l = &simulatedLock{codes: map[string]bool{}}
+		c.devices[deviceID] = l
+	}
+	return l
+}
+
+func (c *DeviceController) lockCodes(deviceID uuid.UUID) []shared.RawDeviceLockCode {
+	l := c.lock(deviceID)
+	c.applyPending(l)
+
+	codes := []string{}
+	for code := range l.codes {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	lcs := []shared.RawDeviceLockCode{}
+	for i, code := range codes {
+		lcs = append(lcs, shared.RawDeviceLockCode{
+			Code: code,
+			Mode: shared.DeviceCodeModeEnabled,
+			Slot: i + 1,
+		})
+	}
+	return lcs
+}
+
+func (c *DeviceController) applyPending(l *simulatedLock) {
+	now := c.clock.Now()
+
+	remaining := []pendingChange{}
+	for _, p := range l.pending {
+		if p.at.After(now) {
+			remaining = append(remaining, p)
+			continue
+		}
+		if p.add {
+			l.codes[p.code] = true
+		} else {
+			delete(l.codes, p.code)
+		}
+	}
+	l.pending = remaining
+}
@@ -0,0 +1,313 @@
+package simulation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mlock/lambdas/shared"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DeviceRepository keeps copies of the devices (like a real database would) so that changes only stick when they're saved.
+type DeviceRepository struct {
+	AuditLog []AuditLogEntry
+
+	clock   *Clock
+	devices map[uuid.UUID]shared.Device
+	ids     []uuid.UUID
+	mu      sync.Mutex
+}
+
+type AuditLogEntry struct {
+	DeviceID        uuid.UUID
+	ManagedLockCode shared.DeviceManagedLockCode
+	RecordedAt      time.Time
+}
+
+func NewDeviceRepository(clock *Clock) *DeviceRepository {
+	return &DeviceRepository{
+		AuditLog: []AuditLogEntry{},
+		clock:    clock,
+		devices:  map[uuid.UUID]shared.Device{},
+		ids:      []uuid.UUID{},
+	}
+}
+
+func (r *DeviceRepository) AppendToAuditLog(ctx context.Context, device shared.Device, managedLockCodes []*shared.DeviceManagedLockCode) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, mlc := range managedLockCodes {
+		r.AuditLog = append(r.AuditLog, AuditLogEntry{
+			DeviceID:        device.ID,
+			ManagedLockCode: *mlc,
+			RecordedAt:      r.clock.Now(),
+		})
+	}
+	return nil
+}
+
+func (r *DeviceRepository) Get(ctx context.Context, id uuid.UUID) (shared.Device, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d, ok := r.devices[id]
+	if !ok {
+		return shared.Device{}, false, nil
+	}
+	c, err := copyDevice(d)
+	return c, true, err
+}
+
+func (r *DeviceRepository) List(ctx context.Context) ([]shared.Device, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ds := []shared.Device{}
+	for _, id := range r.ids {
+		d, err := copyDevice(r.devices[id])
+		if err != nil {
+			return nil, err
+		}
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+// ListActive matches the real repository, but uses the simulated time.
+func (r *DeviceRepository) ListActive(ctx context.Context) ([]shared.Device, error) {
+	all, err := r.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	active := []shared.Device{}
+	for _, d := range all {
+		if d.RawDevice.Status != shared.DeviceStatusOnline {
+			continue
+		}
+		if d.LastRefreshedAt.Before(r.clock.Now().Add(-2 * time.Hour)) {
+			continue
+		}
+		active = append(active, d)
+	}
+	return active, nil
+}
+
+func (r *DeviceRepository) Put(ctx context.Context, item shared.Device) (shared.Device, error) {
+	return r.put(item, false)
+}
+
+// PutIfUnchanged returns `shared.ErrDeviceChanged` if the device has been saved since it was read, like the real repository.
+func (r *DeviceRepository) PutIfUnchanged(ctx context.Context, item shared.Device) (shared.Device, error) {
+	return r.put(item, true)
+}
+
+func (r *DeviceRepository) put(item shared.Device, ifUnchanged bool) (shared.Device, error) {
+	if item.ID == uuid.Nil {
+		return shared.Device{}, fmt.Errorf("an ID is required")
+	}
+
+	c, err := copyDevice(item)
+	if err != nil {
+		return shared.Device{}, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.devices[item.ID]
+	if ifUnchanged && ok && existing.Version != item.Version {
+		return shared.Device{}, shared.ErrDeviceChanged
+	}
+	if !ok {
+		r.ids = append(r.ids, item.ID)
+	}
+	c.Version++
+	r.devices[item.ID] = c
+
+	return copyDevice(c)
+}
+
+func copyDevice(d shared.Device) (shared.Device, error) {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return shared.Device{}, fmt.Errorf("error marshalling device: %s", err.Error())
+	}
+	c := shared.Device{}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return shared.Device{}, fmt.Errorf("error unmarshalling device: %s", err.Error())
+	}
+	return c, nil
+}
+
+// ReservationRepository is an in-memory reservation source, reservations can be added, moved and canceled as the simulation runs.
+type ReservationRepository struct {
+	canceled     map[string]shared.Reservation
+	mu           sync.Mutex
+	reservations map[uuid.UUID][]shared.Reservation
+}
+
+func NewReservationRepository() *ReservationRepository {
+	return &ReservationRepository{
+		canceled:     map[string]shared.Reservation{},
+		reservations: map[uuid.UUID][]shared.Reservation{},
+	}
+}
+
+// Cancel removes the reservation, which is what it looks like when a reservation is canceled on the real calendar.
+func (r *ReservationRepository) Cancel(unitID uuid.UUID, reservationID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rs := []shared.Reservation{}
+	for _, res := range r.reservations[unitID] {
+		if res.ID != reservationID {
+			rs = append(rs, res)
+		} else {
+			r.canceled[res.ID] = res
+		}
+	}
+	r.reservations[unitID] = rs
+}
+
+func (r *ReservationRepository) GetForUnits(ctx context.Context, units []shared.Unit) (map[uuid.UUID][]shared.Reservation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	byUnit := map[uuid.UUID][]shared.Reservation{}
+	for _, u := range units {
+		byUnit[u.ID] = append([]shared.Reservation{}, r.reservations[u.ID]...)
+	}
+	return byUnit, nil
+}
+
+// GetChangedUnits doesn't keep track of changes, so every unit might have changed.
+func (r *ReservationRepository) GetChangedUnits(ctx context.Context, units []shared.Unit, since time.Time) (map[uuid.UUID]bool, error) {
+	changed := map[uuid.UUID]bool{}
+	for _, u := range units {
+		changed[u.ID] = true
+	}
+	return changed, nil
+}
+
+func (r *ReservationRepository) GetStatus(ctx context.Context, unit shared.Unit, reservationID string) (shared.ReservationStatus, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if res, ok := r.canceled[reservationID]; ok {
+		return shared.ReservationStatus{Canceled: true, End: res.End}, true, nil
+	}
+	for _, res := range r.reservations[unit.ID] {
+		if res.ID == reservationID {
+			return shared.ReservationStatus{End: res.End}, true, nil
+		}
+	}
+	return shared.ReservationStatus{}, false, nil
+}
+
+// Put adds the reservation, or replaces the one with the same ID (e.g. the dates moved).
+func (r *ReservationRepository) Put(unitID uuid.UUID, reservation shared.Reservation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, res := range r.reservations[unitID] {
+		if res.ID == reservation.ID {
+			r.reservations[unitID][i] = reservation
+			return
+		}
+	}
+	r.reservations[unitID] = append(r.reservations[unitID], reservation)
+}
+
+type UnitRepository struct {
+	mu    sync.Mutex
+	units []shared.Unit
+}
+
+func (r *UnitRepository) List(ctx context.Context) ([]shared.Unit, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]shared.Unit{}, r.units...), nil
+}
+
+func (r *UnitRepository) ListByID(ctx context.Context) (map[uuid.UUID]shared.Unit, error) {
+	units, err := r.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := map[uuid.UUID]shared.Unit{}
+	for _, u := range units {
+		byID[u.ID] = u
+	}
+	return byID, nil
+}
+
+func (r *UnitRepository) Put(u shared.Unit) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.units = append(r.units, u)
+}
+
+type PropertyRepository struct {
+	Properties []shared.Property
+}
+
+func (r *PropertyRepository) List(ctx context.Context) ([]shared.Property, error) {
+	return r.Properties, nil
+}
+
+// EmailService keeps the emails instead of sending them.
+type EmailService struct {
+	Emails []Email
+
+	mu sync.Mutex
+}
+
+type Email struct {
+	Body    string
+	Subject string
+}
+
+func (s *EmailService) SendEmailToDevelopers(ctx context.Context, subject string, body string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Emails = append(s.Emails, Email{Body: body, Subject: subject})
+	return nil
+}
+
+// EventSink keeps the events so that the scenario can look at them.
+type EventSink struct {
+	Events []shared.Event
+
+	mu sync.Mutex
+}
+
+func (s *EventSink) Emit(ctx context.Context, e shared.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Events = append(s.Events, e)
+	return nil
+}
+
+// ForCode returns the types of the events for the code, in order.
+func (s *EventSink) ForCode(code string) []shared.EventType {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	types := []shared.EventType{}
+	for _, e := range s.Events {
+		if e.Code == code {
+			types = append(types, e.Type)
+		}
+	}
+	return types
+}
@@ -0,0 +1,165 @@
+// Package simulation runs the scheduler and the lock engine against simulated devices and reservations, with a clock that only moves when it's told to, so that multi-day scenarios (cancellations, date moves, controller outages, ...) can be replayed in a test.
+package simulation
+
+import (
+	"context"
+	"fmt"
+	"mlock/lambdas/shared"
+	"mlock/lambdas/shared/lockengine"
+	"mlock/lambdas/shared/scheduler"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Simulation struct {
+	Clock        *Clock
+	Controller   *DeviceController
+	Devices      *DeviceRepository
+	Emails       *EmailService
+	Events       *EventSink
+	Properties   *PropertyRepository
+	Reports      []*shared.RunReport
+	Reservations *ReservationRepository
+	Units        *UnitRepository
+}
+
+func NewSimulation(start time.Time) *Simulation {
+	clock := NewClock(start)
+	return &Simulation{
+		Clock:        clock,
+		Controller:   NewDeviceController(clock),
+		Devices:      NewDeviceRepository(clock),
+		Emails:       &EmailService{},
+		Events:       &EventSink{},
+		Properties:   &PropertyRepository{},
+		Reports:      []*shared.RunReport{},
+		Reservations: NewReservationRepository(),
+		Units:        &UnitRepository{},
+	}
+}
+
+func (s *Simulation) AddUnit(name string) shared.Unit {
+	u := shared.Unit{
+		ID:   uuid.New(),
+		Name: name,
+	}
+	s.Units.Put(u)
+	return u
+}
+
+func (s *Simulation) AddDevice(ctx context.Context, name string, controllerID string, unit *shared.Unit) (shared.Device, error) {
+	d := shared.Device{
+		ControllerID:    controllerID,
+		ID:              uuid.New(),
+		LastRefreshedAt: s.Clock.Now(),
+		RawDevice: shared.RawDevice{
+			ID:     uuid.New().String(),
+			Name:   name,
+			Status: shared.DeviceStatusOnline,
+		},
+	}
+	if unit != nil {
+		d.UnitID = &unit.ID
+	}
+	return s.Devices.Put(ctx, d)
+}
+
+// Step does what a single poll does: refresh the devices from the controller, schedule the reservations, and update the locks.
+func (s *Simulation) Step(ctx context.Context) (*shared.RunReport, error) {
+	now := s.Clock.Now()
+
+	if err := s.refreshDevices(ctx, now); err != nil {
+		return nil, fmt.Errorf("error refreshing devices: %s", err.Error())
+	}
+
+	report := shared.NewRunReport(now)
+	s.Reports = append(s.Reports, report)
+
+	if err := scheduler.NewScheduler(
+		s.Devices,
+		s.Events,
+		now,
+		s.Properties,
+		s.Reservations,
+		s.Units,
+	).ReconcileReservationsAndLockCodes(ctx, report); err != nil {
+		return report, fmt.Errorf("error scheduling: %s", err.Error())
+	}
+
+	if err := lockengine.NewLockEngine(
+		s.Controller,
+		s.Devices,
+		s.Emails,
+		s.Events,
+		"",
+		s.Properties,
+		time.UTC,
+		s.Units,
+	).WithClock(s.Clock).UpdateLocks(ctx, report); err != nil {
+		return report, fmt.Errorf("error updating lock codes: %s", err.Error())
+	}
+
+	return report, nil
+}
+
+// RunUntil steps every `interval` until the clock reaches `until`. `before` (if not nil) is called before each step, which is where a scenario can change things as time passes.
+func (s *Simulation) RunUntil(ctx context.Context, until time.Time, interval time.Duration, before func(now time.Time)) error {
+	for s.Clock.Now().Before(until) {
+		if before != nil {
+			before(s.Clock.Now())
+		}
+		if _, err := s.Step(ctx); err != nil {
+			return fmt.Errorf("error at %s: %s", s.Clock.Now().Format(time.RFC3339), err.Error())
+		}
+		s.Clock.Advance(interval)
+	}
+	return nil
+}
+
+// ManagedLockCodes returns the device's managed lock codes as they were last saved.
+func (s *Simulation) ManagedLockCodes(ctx context.Context, deviceID uuid.UUID) ([]*shared.DeviceManagedLockCode, error) {
+	d, ok, err := s.Devices.Get(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("unable to find device %s", deviceID)
+	}
+	return d.ManagedLockCodes, nil
+}
+
+// refreshDevices is the simulated version of updating the devices from the controllers in the poll schedules job.
+func (s *Simulation) refreshDevices(ctx context.Context, now time.Time) error {
+	devices, err := s.Devices.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range devices {
+		refresh := func(d *shared.Device) (bool, error) {
+			if s.Controller.IsOffline(d.ControllerID) {
+				if d.RawDevice.Status != shared.DeviceStatusOffline {
+					d.RawDevice.Status = shared.DeviceStatusOffline
+					d.LastWentOfflineAt = &now
+				}
+			} else {
+				if d.RawDevice.Status == shared.DeviceStatusOffline {
+					d.LastWentOnlineAt = &now
+				}
+				d.RawDevice.Status = shared.DeviceStatusOnline
+				d.RawDevice.LockCodes = s.Controller.LockCodes(d.ID)
+				d.TrackUnmanagedLockCodes(now)
+				d.LastRefreshedAt = now
+			}
+			return true, nil
+		}
+
+		refresh(&d)
+		if _, err := shared.SaveDevice(ctx, s.Devices, d, refresh); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package simulation_test
+
+import (
+	"context"
+	"mlock/lambdas/shared"
+	"mlock/lambdas/shared/simulation"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Week(t *testing.T) {
+	// A week with a normal stay, a cancellation, a stay that moves, and a controller outage.
+
+	ctx := context.Background()
+	monday := time.Date(2026, 10, 5, 0, 0, 0, 0, time.UTC)
+	day := func(n int, hour int) time.Time {
+		return monday.Add(time.Duration(n)*24*time.Hour + time.Duration(hour)*time.Hour)
+	}
+
+	sim := simulation.NewSimulation(monday)
+	sim.Controller.Latency = 10 * time.Minute
+	sim.Controller.AddOutage(simulation.Outage{ControllerID: "c1", StartAt: day(4, 10), EndAt: day(4, 14)})
+
+	unit := sim.AddUnit("Unit 1")
+	device, err := sim.AddDevice(ctx, "Front Door", "c1", &unit)
+	assert.Nil(t, err)
+
+	sim.Reservations.Put(unit.ID, shared.Reservation{ID: "a", DoorCode: "1111", Start: day(0, 16), End: day(2, 10)})
+	sim.Reservations.Put(unit.ID, shared.Reservation{ID: "b", DoorCode: "2222", Start: day(3, 16), End: day(5, 10)})
+	sim.Reservations.Put(unit.ID, shared.Reservation{ID: "c", DoorCode: "3333", Start: day(2, 16), End: day(3, 10)})
+
+	changes := func(now time.Time) {
+		if now.Equal(day(1, 9)) {
+			sim.Reservations.Put(unit.ID, shared.Reservation{ID: "c", DoorCode: "3333", Start: day(4, 16), End: day(6, 10)})
+		}
+		if now.Equal(day(1, 12)) {
+			sim.Reservations.Cancel(unit.ID, "b")
+		}
+	}
+
+	codesOnLock := func() []string {
+		codes := []string{}
+		for _, lc := range sim.Controller.LockCodes(device.ID) {
+			codes = append(codes, lc.Code)
+		}
+		return codes
+	}
+
+	step := 15 * time.Minute
+
+	assert.Nil(t, sim.RunUntil(ctx, day(1, 0), step, changes))
+	assert.Equal(t, []string{"1111"}, codesOnLock())
+
+	assert.Nil(t, sim.RunUntil(ctx, day(3, 0), step, changes))
+	assert.Empty(t, codesOnLock(), "the first stay is over and the second one moved")
+
+	assert.Nil(t, sim.RunUntil(ctx, day(4, 13), step, changes))
+	assert.Empty(t, codesOnLock(), "the controller is down when the moved stay starts")
+
+	assert.Nil(t, sim.RunUntil(ctx, day(4, 15), step, changes))
+	assert.Equal(t, []string{"3333"}, codesOnLock(), "the code is added once the controller is back")
+
+	assert.Nil(t, sim.RunUntil(ctx, day(7, 0), step, changes))
+	assert.Empty(t, codesOnLock())
+
+	for _, r := range sim.Reports {
+		assert.Empty(t, r.Errors)
+	}
+
+	assert.Equal(t, []shared.EventType{
+		shared.EventTypeCodeScheduled,
+		shared.EventTypeCodeAddAttempted,
+		shared.EventTypeCodeEnabled,
+		shared.EventTypeCodeRemoveAttempted,
+		shared.EventTypeCodeRemoved,
+	}, sim.Events.ForCode("1111"))
+	assert.NotContains(t, sim.Events.ForCode("2222"), shared.EventTypeCodeAddAttempted)
+
+	mlcs, err := sim.ManagedLockCodes(ctx, device.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(mlcs))
+	for _, mlc := range mlcs {
+		assert.Equal(t, shared.DeviceManagedLockCodeStatus5Complete, mlc.Status, mlc.Code)
+	}
+}
+
+func Test_FailuresAreRetried(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2026, 10, 5, 0, 0, 0, 0, time.UTC)
+
+	sim := simulation.NewSimulation(start)
+
+	unit := sim.AddUnit("Unit 1")
+	device, err := sim.AddDevice(ctx, "Front Door", "c1", &unit)
+	assert.Nil(t, err)
+
+	sim.Controller.FailNext(device.ID, 2)
+	sim.Reservations.Put(unit.ID, shared.Reservation{ID: "a", DoorCode: "1111", Start: start.Add(6 * time.Hour), End: start.Add(30 * time.Hour)})
+
+	assert.Nil(t, sim.RunUntil(ctx, start.Add(4*time.Hour), 5*time.Minute, nil))
+
+	mlcs, err := sim.ManagedLockCodes(ctx, device.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(mlcs))
+	assert.Equal(t, shared.DeviceManagedLockCodeStatus3Enabled, mlcs[0].Status)
+	assert.Equal(t, 1, len(sim.Controller.LockCodes(device.ID)))
+}
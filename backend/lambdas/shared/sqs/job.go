@@ -0,0 +1,155 @@
+package sqs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	mshared "mlock/shared"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/uuid"
+)
+
+// Job is the body of every message we put on a queue.
+type Job struct {
+	Actor         string     `json:"actor"`         // Who asked for it, e.g. a user's email or "Hostaway webhook".
+	CorrelationID string     `json:"correlationId"` // Usually the API request that asked for it, so the logs can be tied together.
+	DeviceID      *uuid.UUID `json:"deviceId"`
+	Kind          JobKind    `json:"kind"`
+	Reason        string     `json:"reason"`
+	Source        string     `json:"source"` // The change it's for if we know it, e.g. a reservation and when it was updated. Only repeats for the same source are dropped, see `DeduplicationID`.
+	UnitID        *uuid.UUID `json:"unitId"`
+}
+
+type JobKind string
+
+const (
+	JobKindManageClimateControls JobKind = "manageClimateControls"
+	JobKindPollSchedules         JobKind = "pollSchedules" // Every device, unless the job has a unit or device.
+)
+
+func NewPollSchedulesJob(reason string) Job {
+	return Job{Kind: JobKindPollSchedules, Reason: reason}
+}
+
+func NewDeviceJob(deviceID uuid.UUID, reason string) Job {
+	return Job{DeviceID: &deviceID, Kind: JobKindPollSchedules, Reason: reason}
+}
+
+func NewUnitJob(unitID uuid.UUID, reason string) Job {
+	return Job{Kind: JobKindPollSchedules, Reason: reason, UnitID: &unitID}
+}
+
+func NewManageClimateControlsJob(reason string) Job {
+	return Job{Kind: JobKindManageClimateControls, Reason: reason}
+}
+
+// ParseJob reads a message's body. Anything that isn't a job (e.g. the blank messages we used to send) is a full run of `kind`.
+func ParseJob(body string, kind JobKind) Job {
+	var job Job
+	if err := json.Unmarshal([]byte(body), &job); err != nil {
+		return Job{Kind: kind, Reason: "unrecognized message"}
+	}
+	if job.Kind == "" {
+		job.Kind = kind
+	}
+	return job
+}
+
+// Key is what the job does (not who asked for it or why), identical jobs only need to run once.
+func (j Job) Key() string {
+	key := string(j.Kind)
+	if j.UnitID != nil {
+		key += "-unit-" + j.UnitID.String()
+	}
+	if j.DeviceID != nil {
+		key += "-device-" + j.DeviceID.String()
+	}
+	return key
+}
+
+// MessageGroupID is the same for every job of a kind, so that FIFO queues run them one at a time. A full poll and a unit's poll both save the unit's devices, they mustn't run at once.
+func (j Job) MessageGroupID() string {
+	return string(j.Kind)
+}
+
+// DeduplicationID is the same for identical jobs from the same source (e.g. Hostaway retrying a webhook). Jobs without a source are never dropped, a second change might come in after the first job has already read everything.
+func (j Job) DeduplicationID() string {
+	if j.Source == "" {
+		return uuid.New().String()
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%s", j.Key(), j.Source)))
+	return hex.EncodeToString(sum[:])
+}
+
+func (j Job) String() string {
+	return fmt.Sprintf("%s (reason: %s, actor: %s, correlation ID: %s)", j.Key(), j.Reason, j.Actor, j.CorrelationID)
+}
+
+func (j Job) queueURL() (string, error) {
+	var name string
+	switch j.Kind {
+	case JobKindManageClimateControls:
+		name = "MANAGE_CLIMATE_CONTROLS_QUEUE_URL"
+	case JobKindPollSchedules:
+		name = "POLL_SCHEDULES_QUEUE_URL"
+	default:
+		return "", fmt.Errorf("unknown job kind: %s", j.Kind)
+	}
+
+	queueURL, err := mshared.GetConfig(name)
+	if err != nil {
+		return "", fmt.Errorf("empty queue url in config")
+	}
+	return queueURL, nil
+}
+
+// BatchResponse tells Lambda which records to retry, it needs `ReportBatchItemFailures` turned on for the event source mapping. The version of `events` we're on doesn't have it yet.
+type BatchResponse struct {
+	BatchItemFailures []BatchItemFailure `json:"batchItemFailures"`
+}
+
+type BatchItemFailure struct {
+	ItemIdentifier string `json:"itemIdentifier"`
+}
+
+// ProcessJobs runs each record's job one at a time and reports the ones that failed, so that only they're retried. Identical jobs in the same batch only run once. An event without any records (e.g. a scheduled run) is a full run of `kind`.
+func ProcessJobs(
+	ctx context.Context,
+	event events.SQSEvent,
+	kind JobKind,
+	run func(ctx context.Context, job Job) error,
+) (BatchResponse, error) {
+	if len(event.Records) == 0 {
+		job := Job{Kind: kind, Reason: "scheduled"}
+		log.Printf("running job %s\n", job)
+		return BatchResponse{}, run(ctx, job)
+	}
+
+	response := BatchResponse{
+		BatchItemFailures: []BatchItemFailure{},
+	}
+	results := map[string]error{}
+	for _, record := range event.Records {
+		job := ParseJob(record.Body, kind)
+
+		err, ran := results[job.Key()]
+		if ran {
+			log.Printf("skipping duplicate job %s\n", job)
+		} else {
+			log.Printf("running job %s\n", job)
+			err = run(ctx, job)
+			results[job.Key()] = err
+		}
+
+		if err != nil {
+			log.Printf("error running job %s: %s\n", job, err.Error())
+			response.BatchItemFailures = append(response.BatchItemFailures, BatchItemFailure{ItemIdentifier: record.MessageId})
+		}
+	}
+
+	return response, nil
+}
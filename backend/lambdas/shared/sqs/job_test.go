@@ -0,0 +1,100 @@
+package sqs_test
+
+import (
+	"context"
+	"fmt"
+	"mlock/lambdas/shared/sqs"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseJob(t *testing.T) {
+	unitID := uuid.New()
+
+	job := sqs.NewUnitJob(unitID, "reservation changed")
+	job.Actor = "Hostaway webhook"
+	assert.Equal(t, job, sqs.ParseJob(`{"actor":"Hostaway webhook","kind":"pollSchedules","reason":"reservation changed","unitId":"`+unitID.String()+`"}`, sqs.JobKindPollSchedules))
+
+	// Messages from before there were jobs.
+	assert.Equal(t, sqs.NewUnitJob(unitID, ""), sqs.ParseJob(`{"unitId":"`+unitID.String()+`"}`, sqs.JobKindPollSchedules))
+	assert.Equal(t, sqs.JobKindManageClimateControls, sqs.ParseJob("sent from SQSService", sqs.JobKindManageClimateControls).Kind)
+}
+
+func Test_DeduplicationID(t *testing.T) {
+	job := sqs.NewUnitJob(uuid.New(), "reservation 123 changed")
+	job.Source = "Hostaway reservation 123 updated 2024-01-01 10:00:15"
+
+	// Who asked and why doesn't matter, only what the job does and what it's for.
+	other := job
+	other.Actor = "someone@example.com"
+	other.Reason = "reservation changed"
+	assert.Equal(t, job.DeduplicationID(), other.DeduplicationID())
+
+	// The reservation changed again.
+	other.Source = "Hostaway reservation 123 updated 2024-01-01 10:00:40"
+	assert.NotEqual(t, job.DeduplicationID(), other.DeduplicationID())
+
+	other = sqs.NewUnitJob(uuid.New(), "")
+	other.Source = job.Source
+	assert.NotEqual(t, job.DeduplicationID(), other.DeduplicationID())
+
+	// Without a source we can't tell a repeat from a new change.
+	job = sqs.NewDeviceJob(uuid.New(), "lock code created")
+	assert.NotEqual(t, job.DeduplicationID(), job.DeduplicationID())
+}
+
+func Test_MessageGroupID(t *testing.T) {
+	// Everything that touches devices is in one group, so full and targeted polls don't overlap.
+	full := sqs.NewPollSchedulesJob("")
+	assert.Equal(t, full.MessageGroupID(), sqs.NewUnitJob(uuid.New(), "").MessageGroupID())
+	assert.Equal(t, full.MessageGroupID(), sqs.NewDeviceJob(uuid.New(), "").MessageGroupID())
+	assert.NotEqual(t, full.MessageGroupID(), sqs.NewManageClimateControlsJob("").MessageGroupID())
+}
+
+func Test_ProcessJobs(t *testing.T) {
+	ctx := context.Background()
+	unitID := uuid.New()
+	failingUnitID := uuid.New()
+	record := func(messageID string, job sqs.Job) events.SQSMessage {
+		return events.SQSMessage{
+			Body:      fmt.Sprintf(`{"kind":"%s","reason":"%s","unitId":"%s"}`, job.Kind, job.Reason, job.UnitID),
+			MessageId: messageID,
+		}
+	}
+
+	ran := []sqs.Job{}
+	run := func(ctx context.Context, job sqs.Job) error {
+		ran = append(ran, job)
+		if *job.UnitID == failingUnitID {
+			return fmt.Errorf("controller not connected")
+		}
+		return nil
+	}
+
+	response, err := sqs.ProcessJobs(ctx, events.SQSEvent{Records: []events.SQSMessage{
+		record("1", sqs.NewUnitJob(unitID, "first")),
+		record("2", sqs.NewUnitJob(failingUnitID, "first")),
+		record("3", sqs.NewUnitJob(unitID, "second")),
+		record("4", sqs.NewUnitJob(failingUnitID, "second")),
+	}}, sqs.JobKindPollSchedules, run)
+	assert.Nil(t, err)
+
+	// Identical jobs only run once, but every record for a failed job is retried.
+	assert.Equal(t, 2, len(ran))
+	assert.Equal(t, []sqs.BatchItemFailure{{ItemIdentifier: "2"}, {ItemIdentifier: "4"}}, response.BatchItemFailures)
+}
+
+func Test_ProcessJobsScheduled(t *testing.T) {
+	ran := []sqs.Job{}
+	_, err := sqs.ProcessJobs(context.Background(), events.SQSEvent{}, sqs.JobKindPollSchedules, func(ctx context.Context, job sqs.Job) error {
+		ran = append(ran, job)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(ran))
+	assert.Equal(t, sqs.JobKindPollSchedules, ran[0].Kind)
+	assert.Nil(t, ran[0].UnitID)
+}
@@ -2,9 +2,10 @@ package sqs
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"mlock/lambdas/shared"
-	mshared "mlock/shared"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -46,34 +47,36 @@ func getClient(ctx context.Context) (*sqs.Client, error) {
 	return cd.SQS, nil
 }
 
-func (s *SQSService) SendBlankMessageToManageClimateControlsQueue(ctx context.Context) error {
-	queueURL, err := mshared.GetConfig("MANAGE_CLIMATE_CONTROLS_QUEUE_URL")
-	if err != nil {
-		return fmt.Errorf("empty queue url in config")
+// SendJob fills in the actor and correlation ID from the context if they aren't set. FIFO queues drop repeats of the same job from the same source, and run the jobs of each kind in order.
+func (s *SQSService) SendJob(ctx context.Context, job Job) error {
+	if cd, err := shared.GetContextData(ctx); err == nil {
+		if job.Actor == "" && cd.User != nil {
+			job.Actor = cd.User.Email
+		}
+		if job.CorrelationID == "" {
+			job.CorrelationID = cd.RequestID
+		}
 	}
 
-	sMInput := &sqs.SendMessageInput{
-		MessageBody: aws.String("sent from SQSService"),
-		QueueUrl:    aws.String(queueURL),
-	}
-	_, err = s.c.SendMessage(ctx, sMInput)
+	queueURL, err := job.queueURL()
 	if err != nil {
-		return fmt.Errorf("error sending sqs message: %s", err.Error())
+		return err
 	}
 
-	return nil
-}
-
-func (s *SQSService) SendBlankMessageToPollSchedulesQueue(ctx context.Context) error {
-	queueURL, err := mshared.GetConfig("POLL_SCHEDULES_QUEUE_URL")
+	body, err := json.Marshal(job)
 	if err != nil {
-		return fmt.Errorf("empty queue url in config")
+		return fmt.Errorf("error marshalling job: %s", err.Error())
 	}
 
 	sMInput := &sqs.SendMessageInput{
-		MessageBody: aws.String("sent from SQSService"),
+		MessageBody: aws.String(string(body)),
 		QueueUrl:    aws.String(queueURL),
 	}
+	if strings.HasSuffix(queueURL, ".fifo") {
+		sMInput.MessageDeduplicationId = aws.String(job.DeduplicationID())
+		sMInput.MessageGroupId = aws.String(job.MessageGroupID())
+	}
+
 	_, err = s.c.SendMessage(ctx, sMInput)
 	if err != nil {
 		return fmt.Errorf("error sending sqs message: %s", err.Error())
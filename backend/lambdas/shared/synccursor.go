@@ -0,0 +1,14 @@
+package shared
+
+import "time"
+
+// SyncCursor remembers how far we got syncing with something outside of our control, so that the next run can ask for just what changed.
+type SyncCursor struct {
+	FullSyncedAt time.Time `json:"fullSyncedAt"` // The last time we fetched everything, rather than just what changed.
+	ID           string    `json:"id"`
+	SyncedAt     time.Time `json:"syncedAt"` // When the last successful sync started, anything modified after that hasn't been seen yet.
+}
+
+const (
+	SyncCursorIDReservations = "reservations"
+)
@@ -1,6 +1,7 @@
 package shared
 
 import (
+	"fmt"
 	"strconv"
 	"strings"
 	"time"
@@ -9,11 +10,73 @@ import (
 )
 
 type Unit struct {
-	ID                uuid.UUID `json:"id"`
-	Name              string    `json:"name"`
-	PropertyID        uuid.UUID `json:"propertyId"`
-	RemotePropertyURL string    `json:"remotePropertyUrl"`
-	UpdatedBy         string    `json:"updatedBy"`
+	ICalFeed            *UnitICalFeed       `json:"iCalFeed"` // Only used by the iCal provider.
+	ID                  uuid.UUID           `json:"id"`
+	LockCodes           []*UnitLockCode     `json:"lockCodes"` // Codes that apply to every device in the unit.
+	Name                string              `json:"name"`
+	PropertyID          uuid.UUID           `json:"propertyId"`
+	RemotePropertyURL   string              `json:"remotePropertyUrl"`
+	ReservationBuffers  *ReservationBuffers `json:"reservationBuffers"`  // Overrides the property's buffers.
+	ReservationProvider string              `json:"reservationProvider"` // Empty means Hostaway, which is what we started with.
+	UpdatedBy           string              `json:"updatedBy"`
+}
+
+// UnitICalFeed is for units that are listed directly on Airbnb/VRBO, which only give us dates.
+type UnitICalFeed struct {
+	CheckInHour      int    `json:"checkInHour"`  // In the local time zone, e.g. 16.
+	CheckOutHour     int    `json:"checkOutHour"` // In the local time zone, e.g. 11.
+	DoorCodeStrategy string `json:"doorCodeStrategy"`
+	StaticDoorCode   string `json:"staticDoorCode"` // Only used by the static strategy.
+	URL              string `json:"url"`
+}
+
+const (
+	UnitReservationProviderHostaway = "hostaway"
+	UnitReservationProviderICal     = "ical"
+)
+
+const (
+	// The last 4 digits of the guest's phone number (Airbnb puts them in the description), falls back to the UID strategy if they're missing.
+	ICalDoorCodeStrategyPhoneLast4 = "phoneLast4"
+	// Always use `StaticDoorCode`.
+	ICalDoorCodeStrategyStatic = "static"
+	// A code from the code generator, kept for the life of the reservation. It used to be derived from the event's UID, hence the name.
+	ICalDoorCodeStrategyUID = "uid"
+)
+
+func (u *Unit) GetReservationProvider() string {
+	if u.ReservationProvider == "" {
+		return UnitReservationProviderHostaway
+	}
+	return u.ReservationProvider
+}
+
+// GetReservationBuffers combines the unit's buffers with its property's, `p` can be nil if the property is missing.
+func (u *Unit) GetReservationBuffers(p *Property) ReservationBuffers {
+	var propertyBuffers *ReservationBuffers
+	if p != nil {
+		propertyBuffers = p.ReservationBuffers
+	}
+	return EffectiveReservationBuffers(propertyBuffers, u.ReservationBuffers)
+}
+
+func (f *UnitICalFeed) Validate() error {
+	if f.URL == "" {
+		return fmt.Errorf("url is required")
+	}
+	if f.CheckInHour < 0 || f.CheckInHour > 23 || f.CheckOutHour < 0 || f.CheckOutHour > 23 {
+		return fmt.Errorf("check in and check out hours must be between 0 and 23")
+	}
+	switch f.DoorCodeStrategy {
+	case ICalDoorCodeStrategyPhoneLast4, ICalDoorCodeStrategyUID:
+	case ICalDoorCodeStrategyStatic:
+		if f.StaticDoorCode == "" {
+			return fmt.Errorf("static door code is required")
+		}
+	default:
+		return fmt.Errorf("unsupported door code strategy: %s", f.DoorCodeStrategy)
+	}
+	return nil
 }
 
 type UnitOccupancyStatus struct {
@@ -47,7 +110,8 @@ func (u *Unit) GetRemotePropertyID() int {
 	return intID
 }
 
-func (u *Unit) OccupancyStatusForDay(devices []Device, at time.Time) UnitOccupancyStatus {
+// OccupancyStatusForDay uses the managed lock codes for reservations, `buffers` should be the ones the scheduler used so they can be undone to get the real check-in and check-out.
+func (u *Unit) OccupancyStatusForDay(devices []Device, at time.Time, buffers ReservationBuffers) UnitOccupancyStatus {
 	year, month, day := at.Date()
 	date := time.Date(year, month, day, 0, 0, 0, 0, at.Location())
 
@@ -62,8 +126,8 @@ func (u *Unit) OccupancyStatusForDay(devices []Device, at time.Time) UnitOccupan
 		if d.UnitID != nil && *d.UnitID == u.ID {
 			for _, mlc := range d.ManagedLockCodes {
 				if mlc.Reservation.ID != "" {
-					reservationRealEnd := mlc.EndAt.Add(-1 * time.Duration(ReservationEndBufferInMinutes) * time.Minute)
-					reservationRealStart := mlc.StartAt.Add(-1 * time.Duration(ReservationStartBufferInMinutes) * time.Minute)
+					reservationRealEnd := mlc.EndAt.Add(-1 * buffers.End())
+					reservationRealStart := mlc.StartAt.Add(-1 * buffers.Start())
 
 					if (reservationRealStart.Before(at) || reservationRealStart.Equal(at)) && reservationRealEnd.After(at) {
 						unitOccupiedStatus.At.Occupied = true
@@ -0,0 +1,174 @@
+package shared
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UnitLockCode is one logical code for every device in a unit (e.g. the front door and the garage). Each device gets its own managed lock code that points back to it.
+type UnitLockCode struct {
+	Code    string    `json:"code"`
+	EndAt   time.Time `json:"endAt"`
+	ID      uuid.UUID `json:"id"`
+	Note    string    `json:"note"`
+	StartAt time.Time `json:"startAt"`
+}
+
+type UnitLockCodeStatus struct {
+	Devices  []UnitLockCodeDeviceStatus  `json:"devices"`
+	LockCode UnitLockCode                `json:"lockCode"`
+	Status   DeviceManagedLockCodeStatus `json:"status"` // The least far along of the devices, or failed if any of them failed.
+}
+
+type UnitLockCodeDeviceStatus struct {
+	DeviceID   uuid.UUID                   `json:"deviceId"`
+	DeviceName string                      `json:"deviceName"`
+	LastError  string                      `json:"lastError"`
+	Status     DeviceManagedLockCodeStatus `json:"status"` // Empty if the device doesn't have the code yet.
+}
+
+var unitLockCodeStatusOrder = []DeviceManagedLockCodeStatus{
+	DeviceManagedLockCodeStatus1Scheduled,
+	DeviceManagedLockCodeStatus2Adding,
+	DeviceManagedLockCodeStatus3Enabled,
+	DeviceManagedLockCodeStatus4Removing,
+	DeviceManagedLockCodeStatus5Complete,
+}
+
+func (u *Unit) GetLockCode(id uuid.UUID) *UnitLockCode {
+	for _, ulc := range u.LockCodes {
+		if ulc.ID == id {
+			return ulc
+		}
+	}
+	return nil
+}
+
+// End stops the code now, or cancels it if it hasn't started yet.
+func (u *UnitLockCode) End(now time.Time) {
+	if u.StartAt.After(now) {
+		u.StartAt = now
+	}
+	if u.EndAt.After(now) {
+		u.EndAt = now
+	}
+}
+
+// ApplyToDevice creates or updates the device's managed lock code for this unit code, and returns the managed lock codes that changed. Changing the code of one that's no longer scheduled ends it, so the old code is removed from the lock, and schedules a new one.
+func (u *UnitLockCode) ApplyToDevice(d *Device, note string, now time.Time) ([]*DeviceManagedLockCode, error) {
+	mlc := u.findOnDevice(d)
+	if mlc == nil {
+		return []*DeviceManagedLockCode{u.scheduleOnDevice(d, note)}, nil
+	}
+
+	if mlc.Code == u.Code && mlc.StartAt.Equal(u.StartAt) && mlc.EndAt.Equal(u.EndAt) {
+		return []*DeviceManagedLockCode{}, nil
+	}
+
+	if mlc.Code != u.Code && mlc.Status != DeviceManagedLockCodeStatus1Scheduled {
+		changed := []*DeviceManagedLockCode{}
+		if !mlc.IsDone() {
+			if mlc.StartAt.After(now) {
+				mlc.StartAt = now
+			}
+			if mlc.EndAt.After(now) {
+				mlc.EndAt = now
+			}
+			mlc.Note = fmt.Sprintf("%s The code changed; ending this one so it's removed.", note)
+			changed = append(changed, mlc)
+		}
+		return append(changed, u.scheduleOnDevice(d, note)), nil
+	}
+
+	mlc.Code = u.Code
+	mlc.EndAt = u.EndAt
+	mlc.Note = note
+	mlc.StartAt = u.StartAt
+
+	// Editing a failed code gives it another go.
+	if mlc.Status == DeviceManagedLockCodeStatus6Failed {
+		if err := mlc.SetStatusAt(DeviceManagedLockCodeStatus1Scheduled, now); err != nil {
+			return nil, err
+		}
+	}
+
+	return []*DeviceManagedLockCode{mlc}, nil
+}
+
+func (u *UnitLockCode) scheduleOnDevice(d *Device, note string) *DeviceManagedLockCode {
+	id := u.ID
+	mlc := &DeviceManagedLockCode{
+		Code:           u.Code,
+		EndAt:          u.EndAt,
+		ID:             uuid.New(),
+		Note:           note,
+		Status:         DeviceManagedLockCodeStatus1Scheduled,
+		StartAt:        u.StartAt,
+		UnitLockCodeID: &id,
+	}
+	d.ManagedLockCodes = append(d.ManagedLockCodes, mlc)
+	return mlc
+}
+
+// Status aggregates the status of the code across the unit's devices.
+func (u *UnitLockCode) Status(devices []Device) UnitLockCodeStatus {
+	s := UnitLockCodeStatus{
+		Devices:  []UnitLockCodeDeviceStatus{},
+		LockCode: *u,
+	}
+
+	least := len(unitLockCodeStatusOrder)
+	failed := false
+	for _, d := range devices {
+		ds := UnitLockCodeDeviceStatus{
+			DeviceID:   d.ID,
+			DeviceName: d.RawDevice.Name,
+		}
+
+		if mlc := u.findOnDevice(&d); mlc != nil {
+			ds.LastError = mlc.LastError
+			ds.Status = mlc.Status
+		}
+
+		if ds.Status == DeviceManagedLockCodeStatus6Failed {
+			failed = true
+		}
+		for i, status := range unitLockCodeStatusOrder {
+			if ds.Status == status && i < least {
+				least = i
+			}
+		}
+		// A device that doesn't have the code yet is as good as scheduled.
+		if ds.Status == "" {
+			least = 0
+		}
+
+		s.Devices = append(s.Devices, ds)
+	}
+
+	if failed {
+		s.Status = DeviceManagedLockCodeStatus6Failed
+	} else if least < len(unitLockCodeStatusOrder) {
+		s.Status = unitLockCodeStatusOrder[least]
+	} else {
+		s.Status = DeviceManagedLockCodeStatus1Scheduled
+	}
+
+	return s
+}
+
+// findOnDevice returns the device's copy of the code. Once the code has been changed the device has more than one, the current one is the latest to end that isn't done.
+func (u *UnitLockCode) findOnDevice(d *Device) *DeviceManagedLockCode {
+	var found *DeviceManagedLockCode
+	for _, mlc := range d.ManagedLockCodes {
+		if mlc.UnitLockCodeID == nil || *mlc.UnitLockCodeID != u.ID {
+			continue
+		}
+		if found == nil || (found.IsDone() && !mlc.IsDone()) || (found.IsDone() == mlc.IsDone() && mlc.EndAt.After(found.EndAt)) {
+			found = mlc
+		}
+	}
+	return found
+}
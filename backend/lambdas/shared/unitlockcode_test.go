@@ -0,0 +1,115 @@
+package shared
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestUnitLockCode_ApplyToDevice(t *testing.T) {
+	now := time.Now()
+	ulc := UnitLockCode{
+		Code:    "1234",
+		EndAt:   now.Add(2 * time.Hour),
+		ID:      uuid.New(),
+		StartAt: now.Add(1 * time.Hour),
+	}
+	d := Device{}
+
+	changed, err := ulc.ApplyToDevice(&d, "added", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 1 || len(d.ManagedLockCodes) != 1 || *changed[0].UnitLockCodeID != ulc.ID || changed[0].Status != DeviceManagedLockCodeStatus1Scheduled {
+		t.Fatalf("unexpected: %+v", d.ManagedLockCodes)
+	}
+
+	// Nothing changed.
+	if changed, err := ulc.ApplyToDevice(&d, "again", now); err != nil || len(changed) != 0 {
+		t.Fatalf("expected no change but was %+v, %v", changed, err)
+	}
+
+	// Editing a failed code should give it another go.
+	d.ManagedLockCodes[0].Status = DeviceManagedLockCodeStatus6Failed
+	ulc.End(now)
+	changed, err = ulc.ApplyToDevice(&d, "ended", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mlc := changed[0]
+	if len(d.ManagedLockCodes) != 1 || mlc.Status != DeviceManagedLockCodeStatus1Scheduled || !mlc.StartAt.Equal(now) || !mlc.EndAt.Equal(now) || mlc.Note != "ended" {
+		t.Fatalf("unexpected: %+v", mlc)
+	}
+}
+
+func TestUnitLockCode_ApplyToDeviceChangedCode(t *testing.T) {
+	now := time.Now()
+	ulc := UnitLockCode{
+		Code:    "1234",
+		EndAt:   now.Add(2 * time.Hour),
+		ID:      uuid.New(),
+		StartAt: now.Add(-1 * time.Hour),
+	}
+	d := Device{}
+
+	changed, _ := ulc.ApplyToDevice(&d, "added", now)
+	enabled := changed[0]
+	enabled.Status = DeviceManagedLockCodeStatus3Enabled
+
+	// The old code is on the lock, so it has to be removed rather than changed.
+	ulc.Code = "5678"
+	changed, err := ulc.ApplyToDevice(&d, "edited", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 2 || changed[0] != enabled || len(d.ManagedLockCodes) != 2 {
+		t.Fatalf("unexpected: %+v", changed)
+	}
+	if enabled.Code != "1234" || enabled.Status != DeviceManagedLockCodeStatus3Enabled || !enabled.EndAt.Equal(now) {
+		t.Fatalf("unexpected: %+v", enabled)
+	}
+	replacement := changed[1]
+	if replacement.Code != "5678" || replacement.Status != DeviceManagedLockCodeStatus1Scheduled || !replacement.StartAt.Equal(ulc.StartAt) || !replacement.EndAt.Equal(ulc.EndAt) {
+		t.Fatalf("unexpected: %+v", replacement)
+	}
+
+	// From now on the replacement is the unit's code on the device.
+	if changed, err := ulc.ApplyToDevice(&d, "again", now); err != nil || len(changed) != 0 {
+		t.Fatalf("expected no change but was %+v, %v", changed, err)
+	}
+	if ulc.findOnDevice(&d) != replacement {
+		t.Fatalf("expected the replacement")
+	}
+}
+
+func TestUnitLockCode_Status(t *testing.T) {
+	ulc := UnitLockCode{ID: uuid.New()}
+	mlcFor := func(status DeviceManagedLockCodeStatus) *DeviceManagedLockCode {
+		return &DeviceManagedLockCode{Status: status, UnitLockCodeID: &ulc.ID}
+	}
+
+	enabled := Device{ID: uuid.New(), ManagedLockCodes: []*DeviceManagedLockCode{mlcFor(DeviceManagedLockCodeStatus3Enabled)}}
+	adding := Device{ID: uuid.New(), ManagedLockCodes: []*DeviceManagedLockCode{mlcFor(DeviceManagedLockCodeStatus2Adding)}}
+	failed := Device{ID: uuid.New(), ManagedLockCodes: []*DeviceManagedLockCode{mlcFor(DeviceManagedLockCodeStatus6Failed)}}
+	missing := Device{ID: uuid.New()}
+
+	for _, tc := range []struct {
+		devices  []Device
+		expected DeviceManagedLockCodeStatus
+	}{
+		{[]Device{}, DeviceManagedLockCodeStatus1Scheduled},
+		{[]Device{enabled, enabled}, DeviceManagedLockCodeStatus3Enabled},
+		{[]Device{enabled, adding}, DeviceManagedLockCodeStatus2Adding},
+		{[]Device{enabled, missing}, DeviceManagedLockCodeStatus1Scheduled},
+		{[]Device{enabled, failed, adding}, DeviceManagedLockCodeStatus6Failed},
+	} {
+		s := ulc.Status(tc.devices)
+		if s.Status != tc.expected {
+			t.Fatalf("expected %s but was %s", tc.expected, s.Status)
+		}
+		if len(s.Devices) != len(tc.devices) {
+			t.Fatalf("unexpected: %+v", s.Devices)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package shared
+
+import "time"
+
+const DefaultUnmanagedLockCodeGracePeriodInMinutes = 60
+
+// UnmanagedLockCodePolicy controls what happens to codes on a device that we didn't add. It can be set on a property and on a device, see `EffectiveUnmanagedLockCodePolicy`.
+type UnmanagedLockCodePolicy struct {
+	AllowedCodes         []string `json:"allowedCodes"` // e.g. owner or master codes.
+	AutoRemove           bool     `json:"autoRemove"`
+	GracePeriodInMinutes int      `json:"gracePeriodInMinutes"` // How long after we first see a code before we remove it.
+}
+
+// EffectiveUnmanagedLockCodePolicy allows the codes allowed by either policy, the device policy's other settings win if it has one.
+func EffectiveUnmanagedLockCodePolicy(property *UnmanagedLockCodePolicy, device *UnmanagedLockCodePolicy) UnmanagedLockCodePolicy {
+	policy := UnmanagedLockCodePolicy{
+		AllowedCodes: []string{},
+	}
+
+	for _, p := range []*UnmanagedLockCodePolicy{property, device} {
+		if p == nil {
+			continue
+		}
+		policy.AllowedCodes = append(policy.AllowedCodes, p.AllowedCodes...)
+		policy.AutoRemove = p.AutoRemove
+		policy.GracePeriodInMinutes = p.GracePeriodInMinutes
+	}
+
+	if policy.GracePeriodInMinutes <= 0 {
+		policy.GracePeriodInMinutes = DefaultUnmanagedLockCodeGracePeriodInMinutes
+	}
+
+	return policy
+}
+
+func (p *UnmanagedLockCodePolicy) Allows(code string) bool {
+	for _, c := range p.AllowedCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *UnmanagedLockCodePolicy) GracePeriod() time.Duration {
+	return time.Duration(p.GracePeriodInMinutes) * time.Minute
+}
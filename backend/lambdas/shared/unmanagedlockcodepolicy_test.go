@@ -0,0 +1,64 @@
+package shared
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEffectiveUnmanagedLockCodePolicy(t *testing.T) {
+	property := &UnmanagedLockCodePolicy{
+		AllowedCodes:         []string{"1111"},
+		AutoRemove:           true,
+		GracePeriodInMinutes: 10,
+	}
+	device := &UnmanagedLockCodePolicy{
+		AllowedCodes: []string{"2222"},
+		AutoRemove:   false,
+	}
+
+	policy := EffectiveUnmanagedLockCodePolicy(property, device)
+	if !policy.Allows("1111") || !policy.Allows("2222") || policy.Allows("3333") {
+		t.Fatalf("unexpected allowed codes: %+v", policy.AllowedCodes)
+	}
+	if policy.AutoRemove {
+		t.Fatal("expected the device to turn off auto remove")
+	}
+	if policy.GracePeriodInMinutes != DefaultUnmanagedLockCodeGracePeriodInMinutes {
+		t.Fatalf("unexpected grace period: %d", policy.GracePeriodInMinutes)
+	}
+
+	policy = EffectiveUnmanagedLockCodePolicy(property, nil)
+	if !policy.AutoRemove || policy.GracePeriod() != 10*time.Minute {
+		t.Fatalf("unexpected: %+v", policy)
+	}
+}
+
+func TestDevice_TrackUnmanagedLockCodes(t *testing.T) {
+	earlier := time.Now().Add(-1 * time.Hour)
+	now := time.Now()
+	d := Device{
+		ManagedLockCodes: []*DeviceManagedLockCode{
+			{Code: "1111"},
+		},
+		RawDevice: RawDevice{
+			LockCodes: []RawDeviceLockCode{
+				{Code: "1111"},
+				{Code: "2222"},
+				{Code: "3333"},
+			},
+		},
+		UnmanagedLockCodesSeenAt: map[string]time.Time{
+			"2222": earlier,
+			"4444": earlier, // Gone now.
+		},
+	}
+
+	d.TrackUnmanagedLockCodes(now)
+
+	if len(d.UnmanagedLockCodesSeenAt) != 2 {
+		t.Fatalf("unexpected: %+v", d.UnmanagedLockCodesSeenAt)
+	}
+	if !d.UnmanagedLockCodesSeenAt["2222"].Equal(earlier) || !d.UnmanagedLockCodesSeenAt["3333"].Equal(now) {
+		t.Fatalf("unexpected: %+v", d.UnmanagedLockCodesSeenAt)
+	}
+}
@@ -0,0 +1,39 @@
+package shared
+
+import "sync"
+
+// How many controllers we'll talk to at once, it's mostly waiting on the network so this can be a lot higher than the number of CPUs.
+const DefaultMaxControllerWorkers = 8
+
+// RunPerKey calls fn once for each key with at most maxWorkers running at a time, and waits for them all to finish.
+func RunPerKey(keys []string, maxWorkers int, fn func(key string)) {
+	if maxWorkers < 1 {
+		maxWorkers = 1
+	}
+
+	sem := make(chan struct{}, maxWorkers)
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(key string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(key)
+		}(key)
+	}
+	wg.Wait()
+}
+
+// GroupDevicesByController keeps the devices in their original order within each group. The controller IDs are returned in the order we first saw them.
+func GroupDevicesByController(devices []Device) ([]string, map[string][]Device) {
+	controllerIDs := []string{}
+	devicesByController := map[string][]Device{}
+	for _, d := range devices {
+		if _, ok := devicesByController[d.ControllerID]; !ok {
+			controllerIDs = append(controllerIDs, d.ControllerID)
+		}
+		devicesByController[d.ControllerID] = append(devicesByController[d.ControllerID], d)
+	}
+	return controllerIDs, devicesByController
+}
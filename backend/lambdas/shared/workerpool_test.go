@@ -0,0 +1,60 @@
+package shared
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunPerKey(t *testing.T) {
+	keys := []string{"a", "b", "c", "d", "e"}
+
+	var mu sync.Mutex
+	seen := map[string]int{}
+	running := 0
+	maxRunning := 0
+
+	RunPerKey(keys, 2, func(key string) {
+		mu.Lock()
+		seen[key]++
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+
+	if len(seen) != len(keys) {
+		t.Fatalf("unexpected: %+v", seen)
+	}
+	for k, c := range seen {
+		if c != 1 {
+			t.Fatalf("expected %s once but was %d", k, c)
+		}
+	}
+	if maxRunning > 2 {
+		t.Fatalf("expected at most 2 workers but was %d", maxRunning)
+	}
+}
+
+func TestGroupDevicesByController(t *testing.T) {
+	devices := []Device{
+		{ControllerID: "1", RawDevice: RawDevice{Name: "a"}},
+		{ControllerID: "2", RawDevice: RawDevice{Name: "b"}},
+		{ControllerID: "1", RawDevice: RawDevice{Name: "c"}},
+	}
+
+	controllerIDs, devicesByController := GroupDevicesByController(devices)
+	if len(controllerIDs) != 2 || controllerIDs[0] != "1" || controllerIDs[1] != "2" {
+		t.Fatalf("unexpected: %+v", controllerIDs)
+	}
+	if len(devicesByController["1"]) != 2 || devicesByController["1"][0].RawDevice.Name != "a" || devicesByController["1"][1].RawDevice.Name != "c" {
+		t.Fatalf("unexpected: %+v", devicesByController["1"])
+	}
+}
@@ -309,6 +309,8 @@ const sortLockCodes = (
         return 3
       case "Complete":
         return 4
+      case "Failed":
+        return 5
       default:
         console.log(`Couldn't identify status ${status}`)
         return -1
@@ -123,6 +123,8 @@ export const LockCode = (props: Props) => {
             return "danger"
           case "Complete":
             return "secondary"
+          case "Failed":
+            return "danger"
           default:
             return "danger"
         }